@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/apikey"
+)
+
+type APIKeyApi struct {
+	service apikey.Service
+}
+
+func NewAPIKeyApi(service apikey.Service) *APIKeyApi {
+	return &APIKeyApi{service: service}
+}
+
+func (a *APIKeyApi) ConfigureRouter(r chi.Router) {
+	r.Route("/v1", func(r chi.Router) {
+		r.Use(RequirePermission(auth.PermissionAdmin))
+
+		r.Get("/", a.List)
+		r.Post("/", a.Issue)
+
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", a.Get)
+			r.Delete("/", a.Revoke)
+			r.Post("/rotate", a.Rotate)
+		})
+	})
+}
+
+// APIKeyResponse includes the key itself only when it has just been issued
+// or rotated; it can't be retrieved again.
+type APIKeyResponse struct {
+	apikey.Key
+	Secret string `json:"key,omitempty"`
+}
+
+func (rd *APIKeyResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+type APIKeyRequest struct {
+	*apikey.Key
+}
+
+func (k *APIKeyRequest) Bind(_ *http.Request) error {
+	if k.Key == nil {
+		return errors.New("missing required field(s)")
+	}
+	return k.Validate()
+}
+
+func (a *APIKeyApi) Issue(w http.ResponseWriter, r *http.Request) {
+	data := &APIKeyRequest{}
+	if err := render.Bind(r, data); err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	key, secret, err := a.service.IssueKey(r.Context(), *data.Key)
+	if err != nil {
+		renderAPIKeyError(w, r, err, 0)
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	Render(w, r, &APIKeyResponse{Key: key, Secret: secret})
+}
+
+func (a *APIKeyApi) List(w http.ResponseWriter, r *http.Request) {
+	keys, err := a.service.ListKeys(r.Context())
+	if err != nil {
+		renderAPIKeyError(w, r, err, 0)
+		return
+	}
+
+	resp := make([]render.Renderer, 0, len(keys))
+	for _, k := range keys {
+		resp = append(resp, &APIKeyResponse{Key: k})
+	}
+	RenderList(w, r, resp)
+}
+
+func (a *APIKeyApi) Get(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiKeyID(w, r)
+	if !ok {
+		return
+	}
+
+	key, err := a.service.GetKey(r.Context(), id)
+	if err != nil {
+		renderAPIKeyError(w, r, err, id)
+		return
+	}
+	Render(w, r, &APIKeyResponse{Key: key})
+}
+
+// Rotate replaces the key's secret and returns the new key. The old key
+// stops working immediately.
+func (a *APIKeyApi) Rotate(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiKeyID(w, r)
+	if !ok {
+		return
+	}
+
+	key, secret, err := a.service.RotateKey(r.Context(), id)
+	if err != nil {
+		renderAPIKeyError(w, r, err, id)
+		return
+	}
+	Render(w, r, &APIKeyResponse{Key: key, Secret: secret})
+}
+
+func (a *APIKeyApi) Revoke(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiKeyID(w, r)
+	if !ok {
+		return
+	}
+
+	key, err := a.service.RevokeKey(r.Context(), id)
+	if err != nil {
+		renderAPIKeyError(w, r, err, id)
+		return
+	}
+	Render(w, r, &APIKeyResponse{Key: key})
+}
+
+func apiKeyID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(errors.New("id must be a number")))
+		return 0, false
+	}
+	return id, true
+}
+
+func renderAPIKeyError(w http.ResponseWriter, r *http.Request, err error, id int64) {
+	switch {
+	case errors.Is(err, core.ErrNotFound):
+		Render(w, r, ErrNotFound)
+	case errors.Is(err, core.ErrConflict):
+		Render(w, r, ErrConflict(err))
+	case errors.Is(err, apikey.ErrInvalidKey):
+		Render(w, r, ErrInvalidRequest(err))
+	case errors.Is(err, auth.ErrForbidden):
+		Render(w, r, ErrForbidden(err))
+	default:
+		log.Error().Err(err).Int64("id", id).Msg("error handling api key")
+		Render(w, r, ErrInternalServer)
+	}
+}
@@ -0,0 +1,168 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sksmith/smfg-catalog/api"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/apikey"
+	"github.com/sksmith/smfg-catalog/db"
+)
+
+// apiKeyStore keeps keys in memory for a MockAPIKeyRepo.
+type apiKeyStore struct {
+	mu      sync.Mutex
+	keys    map[int64]apikey.Key
+	touched int
+}
+
+func newAPIKeyRepo(s *apiKeyStore) db.MockAPIKeyRepo {
+	repo := db.NewMockAPIKeyRepo()
+	repo.SaveAPIKeyFunc = func(ctx context.Context, key apikey.Key, tx ...core.Transaction) (apikey.Key, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if key.ID == 0 {
+			key.ID = int64(len(s.keys) + 1)
+			key.CreatedAt = time.Now()
+		}
+		s.keys[key.ID] = key
+		return key, nil
+	}
+	repo.GetAPIKeyFunc = func(ctx context.Context, id int64, tx ...core.Transaction) (apikey.Key, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if key, ok := s.keys[id]; ok {
+			return key, nil
+		}
+		return apikey.Key{}, core.ErrNotFound
+	}
+	repo.GetAPIKeyByPrefixFunc = func(ctx context.Context, prefix string, tx ...core.Transaction) (apikey.Key, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, key := range s.keys {
+			if key.Prefix == prefix {
+				return key, nil
+			}
+		}
+		return apikey.Key{}, core.ErrNotFound
+	}
+	repo.TouchAPIKeyFunc = func(ctx context.Context, id int64, at time.Time, tx ...core.Transaction) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		key := s.keys[id]
+		key.LastUsedAt = &at
+		s.keys[id] = key
+		s.touched++
+		return nil
+	}
+	return repo
+}
+
+func TestAPIKeys(t *testing.T) {
+	v, err := auth.NewVerifier(auth.Config{HS256Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &apiKeyStore{keys: make(map[int64]apikey.Key)}
+	keys := apikey.NewService(newAPIKeyRepo(store))
+
+	r := chi.NewRouter()
+	r.Use(api.Authenticate(v, keys))
+	r.Route("/apikey", api.NewAPIKeyApi(keys).ConfigureRouter)
+	r.With(api.RequirePermission(auth.PermissionRead)).Get("/read", func(w http.ResponseWriter, r *http.Request) {})
+	r.With(api.RequirePermission(auth.PermissionWrite)).Get("/write", func(w http.ResponseWriter, r *http.Request) {})
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	token := func(roles ...string) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub": "user", "exp": time.Now().Add(time.Hour).Unix(), "roles": roles,
+		}).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	admin := "Bearer " + token("catalog-admin")
+
+	do := func(method, path, header, value string, body interface{}) (int, api.APIKeyResponse) {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(header, value)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		resp := api.APIKeyResponse{}
+		_ = json.NewDecoder(res.Body).Decode(&resp)
+		return res.StatusCode, resp
+	}
+	expect := func(name string, got, want int) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%s status code got=%d want=%d", name, got, want)
+		}
+	}
+
+	issue := map[string]interface{}{"name": "plc-01", "scopes": []string{"catalog:read"}}
+	code, _ := do(http.MethodPost, "/apikey/v1", "Authorization", "Bearer "+token("product-engineer"), issue)
+	expect("issue as engineer", code, http.StatusForbidden)
+
+	code, issued := do(http.MethodPost, "/apikey/v1", "Authorization", admin, issue)
+	expect("issue", code, http.StatusCreated)
+	if issued.Secret == "" || issued.Prefix == "" {
+		t.Fatalf("issued key got=%+v want key and prefix", issued)
+	}
+	if stored := store.keys[issued.ID]; bytes.Contains(stored.Hash, []byte(issued.Secret)) || len(stored.Hash) == 0 {
+		t.Error("stored hash must not be empty or contain the key")
+	}
+
+	code, _ = do(http.MethodGet, "/read", auth.KeyHeader, issued.Secret, nil)
+	expect("read with key", code, http.StatusOK)
+	code, _ = do(http.MethodGet, "/write", auth.KeyHeader, issued.Secret, nil)
+	expect("write with read key", code, http.StatusForbidden)
+	code, _ = do(http.MethodGet, "/read", auth.KeyHeader, issued.Secret+"0", nil)
+	expect("read with wrong key", code, http.StatusUnauthorized)
+	if store.touched != 1 {
+		t.Errorf("touched got=%d want=1", store.touched)
+	}
+
+	code, got := do(http.MethodGet, "/apikey/v1/1", "Authorization", admin, nil)
+	expect("get", code, http.StatusOK)
+	if got.Secret != "" || got.LastUsedAt == nil {
+		t.Errorf("get got=%+v want no key and a last used time", got)
+	}
+
+	code, rotated := do(http.MethodPost, "/apikey/v1/1/rotate", "Authorization", admin, nil)
+	expect("rotate", code, http.StatusOK)
+	code, _ = do(http.MethodGet, "/read", auth.KeyHeader, issued.Secret, nil)
+	expect("read with rotated out key", code, http.StatusUnauthorized)
+	code, _ = do(http.MethodGet, "/read", auth.KeyHeader, rotated.Secret, nil)
+	expect("read with rotated key", code, http.StatusOK)
+
+	code, _ = do(http.MethodDelete, "/apikey/v1/1", "Authorization", admin, nil)
+	expect("revoke", code, http.StatusOK)
+	code, _ = do(http.MethodGet, "/read", auth.KeyHeader, rotated.Secret, nil)
+	expect("read with revoked key", code, http.StatusUnauthorized)
+	code, _ = do(http.MethodPost, "/apikey/v1/1/rotate", "Authorization", admin, nil)
+	expect("rotate revoked", code, http.StatusConflict)
+
+	expired := time.Now().Add(-time.Hour)
+	issue["expiresAt"] = expired
+	code, _ = do(http.MethodPost, "/apikey/v1", "Authorization", admin, issue)
+	expect("issue expired", code, http.StatusBadRequest)
+}
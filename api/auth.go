@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+)
+
+// Authenticate rejects requests without a valid bearer token or, when keys
+// is not nil, API key with a 401. The caller's auth.User is put into the
+// context, both under CtxKeyUser and where the services look for it when
+// checking permissions.
+func Authenticate(v *auth.Verifier, keys auth.KeyVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var user auth.User
+			if key := r.Header.Get(auth.KeyHeader); key != "" && keys != nil {
+				var err error
+				if user, err = keys.VerifyKey(r.Context(), key); err != nil {
+					if !errors.Is(err, auth.ErrInvalidToken) {
+						log.Error().Err(err).Msg("error verifying api key")
+						Render(w, r, ErrInternalServer)
+						return
+					}
+					log.Debug().Err(err).Str("uri", r.RequestURI).Msg("rejected api key")
+					unauthorized(w, r, errors.New("the api key is invalid, expired or revoked"))
+					return
+				}
+			} else {
+				token, ok := bearerToken(r)
+				if !ok {
+					unauthorized(w, r, errors.New("a bearer token is required"))
+					return
+				}
+
+				var err error
+				if user, err = v.Verify(token); err != nil {
+					log.Debug().Err(err).Str("uri", r.RequestURI).Msg("rejected token")
+					unauthorized(w, r, errors.New("the bearer token is invalid or expired"))
+					return
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), CtxKeyUser, user)
+			ctx = auth.NewContext(ctx, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequirePermission responds 403 unless the request's user has the
+// permission. Requests without a user are only let through when
+// authentication is turned off, otherwise they get a 401.
+func RequirePermission(p auth.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := auth.Require(r.Context(), p); err != nil {
+				if errors.Is(err, auth.ErrUnauthenticated) {
+					unauthorized(w, r, err)
+					return
+				}
+				Render(w, r, ErrForbidden(err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// UserFrom returns the user authenticated for the request, if any.
+func UserFrom(ctx context.Context) (auth.User, bool) {
+	user, ok := ctx.Value(CtxKeyUser).(auth.User)
+	return user, ok
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(h[7:])
+	return token, token != ""
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="smfg-catalog"`)
+	Render(w, r, ErrUnauthorized(err))
+}
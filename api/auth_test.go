@@ -0,0 +1,145 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sksmith/smfg-catalog/api"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+	"github.com/sksmith/smfg-catalog/queue"
+)
+
+func TestAuthenticate(t *testing.T) {
+	v, err := auth.NewVerifier(auth.Config{HS256Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var subject string
+	handler := api.Authenticate(v, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := api.UserFrom(r.Context())
+		subject = user.Subject
+	}))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "engineer", "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"valid", "Bearer " + token, http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"not bearer", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"invalid", "Bearer " + token + "x", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject = ""
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.want {
+				t.Errorf("status code got=%d want=%d", res.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate header")
+			}
+			if tt.want == http.StatusOK && subject != "engineer" {
+				t.Errorf("subject got=%q want=engineer", subject)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	v, err := auth.NewVerifier(auth.Config{HS256Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockRepo := db.NewMockRepo()
+	mockRepo.GetProductFunc = func(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error) {
+		if sku == testProducts[0].Sku {
+			return catalog.Product{}, core.ErrNotFound
+		}
+		return catalog.Product{Sku: sku, Name: "existing"}, nil
+	}
+	service := catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout")
+
+	r := chi.NewRouter()
+	r.Use(api.Authenticate(v, nil))
+	api.NewCatalogApi(service).ConfigureRouter(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	token := func(roles ...string) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub": "user", "exp": time.Now().Add(time.Hour).Unix(), "roles": roles,
+		}).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	product, err := json.Marshal(testProducts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"reader can get", http.MethodGet, "/v1/SKU1", token("catalog-reader"), http.StatusOK},
+		{"reader can't create", http.MethodPut, "/v1", token("catalog-reader"), http.StatusForbidden},
+		{"reader can't import", http.MethodPost, "/v1/import", token("catalog-reader"), http.StatusForbidden},
+		{"engineer can create", http.MethodPut, "/v1", token("product-engineer"), http.StatusCreated},
+		{"no roles can't get", http.MethodGet, "/v1/SKU1", token(), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, ts.URL+tt.path, bytes.NewReader(product))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			req.Header.Set("Content-Type", "application/json")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.want {
+				t.Errorf("status code got=%d want=%d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -2,15 +2,24 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
 	"github.com/sksmith/smfg-catalog/core"
 	"github.com/sksmith/smfg-catalog/core/catalog"
 )
 
+const (
+	// MaxImportSize is the largest file accepted by a synchronous import, in bytes.
+	MaxImportSize = 10 << 20
+	// MaxImportJobSize is the largest file accepted by an import job, in bytes.
+	MaxImportJobSize = 100 << 20
+)
+
 type CatalogApi struct {
 	service catalog.Service
 }
@@ -25,11 +34,35 @@ const (
 )
 
 func (a *CatalogApi) ConfigureRouter(r chi.Router) {
+	read := RequirePermission(auth.PermissionRead)
+	write := RequirePermission(auth.PermissionWrite)
+
 	r.Route("/v1", func(r chi.Router) {
-		r.Put("/", a.Create)
+		r.With(read, Paginate).Get("/", a.List)
+		r.With(write).Put("/", a.Create)
+		r.With(read).Get("/export", a.Export)
+
+		r.With(write).Post("/import", a.Import)
+
+		r.Route("/gs1", func(r chi.Router) {
+			r.With(write).Post("/", a.ImportGS1)
+			r.With(read).Get("/", a.ExportGS1)
+		})
+
+		r.Route("/jobs", func(r chi.Router) {
+			r.With(write).Post("/import", a.SubmitImport)
+			r.With(read).Get("/{id}", a.GetJob)
+			r.With(read).Get("/{id}/errors", a.GetJobErrors)
+		})
+
+		r.With(read).Get("/changes", a.GetChanges)
+		r.With(read).Get("/changes/stream", a.StreamChanges)
+
+		r.With(read).Get("/barcode/{gtin}", a.GetProductByBarcode)
 
 		r.Route("/{sku}", func(r chi.Router) {
-			r.Get("/", a.GetProduct)
+			r.With(read).Get("/", a.GetProduct)
+			r.With(read).Get("/gs1", a.GetProductGS1)
 		})
 	})
 }
@@ -56,8 +89,15 @@ func (a *CatalogApi) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := a.service.CreateProduct(r.Context(), *data.Product); err != nil {
-		log.Err(err).Send()
-		Render(w, r, ErrInternalServer)
+		switch {
+		case errors.Is(err, catalog.ErrInvalidProduct), errors.Is(err, catalog.ErrInvalidBarcode):
+			Render(w, r, ErrInvalidRequest(err))
+		case errors.Is(err, core.ErrConflict):
+			Render(w, r, ErrConflict(err))
+		default:
+			log.Err(err).Send()
+			Render(w, r, ErrInternalServer)
+		}
 		return
 	}
 
@@ -86,16 +126,150 @@ func (a *CatalogApi) GetProduct(w http.ResponseWriter, r *http.Request) {
 	Render(w, r, NewProductResponse(product))
 }
 
+func (a *CatalogApi) List(w http.ResponseWriter, r *http.Request) {
+	limit := r.Context().Value(CtxKeyLimit).(int)
+	offset := r.Context().Value(CtxKeyOffset).(int)
+
+	products, err := a.service.ListProducts(r.Context(), productFilter(r), limit, offset)
+	if err != nil {
+		log.Error().Err(err).Msg("error listing products")
+		Render(w, r, ErrInternalServer)
+		return
+	}
+
+	resp := make([]render.Renderer, 0, len(products))
+	for _, p := range products {
+		resp = append(resp, NewProductResponse(p))
+	}
+	RenderList(w, r, resp)
+}
+
+// Export streams every product matching the list filters as a download in
+// the requested format, csv by default.
+func (a *CatalogApi) Export(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = string(catalog.ExportCSV)
+	}
+	format, err := catalog.ParseExportFormat(name)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	ew := &exportResponse{ResponseWriter: w, contentType: format.ContentType(), filename: "products." + string(format)}
+	err = a.service.ExportProducts(r.Context(), productFilter(r), format, ew)
+	ew.fail(r, err)
+}
+
+// exportResponse sends the download headers with the first byte of an
+// export, so that an export failing before then can still get an error.
+type exportResponse struct {
+	http.ResponseWriter
+	contentType string
+	filename    string
+	started     bool
+}
+
+func (e *exportResponse) Write(b []byte) (int, error) {
+	if !e.started {
+		e.started = true
+		e.Header().Set("Content-Type", e.contentType)
+		e.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.filename))
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+// fail renders err unless the export has already started, when the status
+// can't be changed and the best that can be done is to cut it short.
+func (e *exportResponse) fail(r *http.Request, err error) {
+	if err == nil {
+		return
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		if !e.started {
+			Render(e.ResponseWriter, r, ErrForbidden(err))
+		}
+		return
+	}
+	log.Error().Err(err).Str("file", e.filename).Msg("error exporting products")
+	if !e.started {
+		Render(e.ResponseWriter, r, ErrInternalServer)
+	}
+}
+
+func productFilter(r *http.Request) catalog.ProductFilter {
+	q := r.URL.Query()
+	return catalog.ProductFilter{
+		SkuPrefix: q.Get("sku"),
+		Name:      q.Get("name"),
+		Gtin:      q.Get("gtin"),
+	}
+}
+
+func (a *CatalogApi) GetProductByBarcode(w http.ResponseWriter, r *http.Request) {
+	gtin := chi.URLParam(r, "gtin")
+	if gtin == "" {
+		Render(w, r, ErrInvalidRequest(errors.New("gtin is required")))
+		return
+	}
+
+	product, err := a.service.GetProductByBarcode(r.Context(), gtin)
+
+	if err != nil {
+		if errors.Is(err, core.ErrNotFound) {
+			Render(w, r, ErrNotFound)
+		} else {
+			log.Error().Err(err).Str("gtin", gtin).Msg("error acquiring product by barcode")
+			Render(w, r, ErrInternalServer)
+		}
+		return
+	}
+	Render(w, r, NewProductResponse(product))
+}
+
+type ImportResponse struct {
+	catalog.ImportResult
+}
+
+func (rd *ImportResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+// Import accepts a product CSV as the request body. With dry_run=true every
+// row is validated but nothing is saved.
+func (a *CatalogApi) Import(w http.ResponseWriter, r *http.Request) {
+	dryRun, err := queryBool(r, "dry_run")
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, MaxImportSize)
+	result, err := a.service.ImportProducts(r.Context(), body, catalog.ImportOptions{DryRun: dryRun})
+	if err != nil {
+		if errors.Is(err, catalog.ErrInvalidImport) {
+			Render(w, r, ErrInvalidRequest(err))
+		} else {
+			log.Error().Err(err).Msg("error importing products")
+			Render(w, r, ErrInternalServer)
+		}
+		return
+	}
+
+	Render(w, r, &ImportResponse{ImportResult: result})
+}
+
 type CreateProductRequest struct {
 	*catalog.Product
 }
 
 func (p *CreateProductRequest) Bind(_ *http.Request) error {
-	if p.Upc == "" || p.Name == "" || p.Sku == "" {
+	if p.Product == nil {
 		return errors.New("missing required field(s)")
 	}
 
-	return nil
+	return p.Validate()
 }
 
 func Render(w http.ResponseWriter, r *http.Request, rnd render.Renderer) {
@@ -1,13 +1,17 @@
 package api_test
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/go-chi/chi"
@@ -31,7 +35,7 @@ func TestCreate(t *testing.T) {
 	mockRepo := db.NewMockRepo()
 	mockQueue := queue.NewMockQueue()
 
-	tp := testProducts[0]
+	tp := testProducts[1]
 
 	mockRepo.SaveProductFunc = func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error {
 		if product.Name != tp.Name {
@@ -40,8 +44,13 @@ func TestCreate(t *testing.T) {
 		if product.Sku != tp.Sku {
 			t.Errorf("sku got=%s want=%s", product.Sku, tp.Sku)
 		}
-		if product.Upc != tp.Upc {
-			t.Errorf("upc got=%s want=%s", product.Upc, tp.Upc)
+		if len(product.Barcodes) != len(tp.Barcodes) {
+			t.Errorf("barcodes got=%d want=%d", len(product.Barcodes), len(tp.Barcodes))
+		}
+		for _, b := range product.Barcodes {
+			if len(b.Gtin) != 14 {
+				t.Errorf("gtin got=%s want it padded to GTIN-14", b.Gtin)
+			}
 		}
 		return nil
 	}
@@ -68,20 +77,349 @@ func TestCreate(t *testing.T) {
 	fmt.Printf("%s", body)
 }
 
+func TestCreateBarcodeConflict(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockQueue := queue.NewMockQueue()
+
+	tp := testProducts[0]
+
+	mockRepo.GetProductByBarcodeFunc = func(ctx context.Context, gtin string, tx ...core.Transaction) (catalog.Product, error) {
+		return testProducts[1], nil
+	}
+	mockRepo.SaveProductFunc = func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error {
+		t.Error("product with a conflicting barcode should not be saved")
+		return nil
+	}
+
+	service := catalog.NewService(mockRepo, mockQueue, "product.fanout")
+	ts := configureServer(service)
+	defer ts.Close()
+
+	res := put(t, ts.URL+"/v1", tp)
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("status got=%d want=%d", res.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestGetProductByBarcode(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockQueue := queue.NewMockQueue()
+
+	tp := testProducts[2]
+
+	// Barcodes are stored as GTIN-14.
+	mockRepo.GetProductByBarcodeFunc = func(ctx context.Context, gtin string, tx ...core.Transaction) (catalog.Product, error) {
+		for _, b := range tp.Barcodes {
+			if catalog.NormalizeGtin(b.Gtin) == gtin {
+				return tp, nil
+			}
+		}
+		return catalog.Product{}, core.ErrNotFound
+	}
+
+	service := catalog.NewService(mockRepo, mockQueue, "product.fanout")
+	ts := configureServer(service)
+	defer ts.Close()
+
+	tests := []struct {
+		gtin string
+		want int
+	}{
+		{gtin: tp.Barcodes[0].Gtin, want: http.StatusOK},
+		{gtin: tp.Barcodes[1].Gtin, want: http.StatusOK},
+		{gtin: "00000096385074", want: http.StatusOK},
+		{gtin: "00000000000000", want: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		res, err := http.Get(ts.URL + "/v1/barcode/" + test.gtin)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := catalog.Product{}
+		if test.want == http.StatusOK {
+			if err = json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Sku != tp.Sku {
+				t.Errorf("gtin=%s sku got=%s want=%s", test.gtin, got.Sku, tp.Sku)
+			}
+		}
+		_ = res.Body.Close()
+
+		if res.StatusCode != test.want {
+			t.Errorf("gtin=%s status got=%d want=%d", test.gtin, res.StatusCode, test.want)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	const csv = `sku,name,gtin,packaging_level,quantity,primary
+sku1,name1,00012345678905,each,1,true
+sku2,name2,036000291452,each,1,true
+sku2,name2,10036000291459,case,24,false
+sku3,name3,4006381333931,each,one,true
+sku4,name4,12345,each,1,true
+`
+	tests := []struct {
+		name      string
+		dryRun    string
+		wantSaved int
+		wantValid int
+	}{
+		{name: "apply", dryRun: "false", wantSaved: 2, wantValid: 2},
+		{name: "dry run", dryRun: "true", wantSaved: 0, wantValid: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mockRepo := db.NewMockRepo()
+			saved := 0
+			mockRepo.SaveProductFunc = func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error {
+				saved++
+				return nil
+			}
+
+			service := catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout")
+			ts := configureServer(service)
+			defer ts.Close()
+
+			res, err := http.Post(ts.URL+"/v1/import?dry_run="+test.dryRun, "text/csv", strings.NewReader(csv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status got=%d want=%d", res.StatusCode, http.StatusOK)
+			}
+
+			got := catalog.ImportResult{}
+			if err = json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			if saved != test.wantSaved {
+				t.Errorf("saved got=%d want=%d", saved, test.wantSaved)
+			}
+			if got.Imported != test.wantSaved {
+				t.Errorf("imported got=%d want=%d", got.Imported, test.wantSaved)
+			}
+			if got.Valid != test.wantValid {
+				t.Errorf("valid got=%d want=%d", got.Valid, test.wantValid)
+			}
+			if got.Rows != 5 {
+				t.Errorf("rows got=%d want=%d", got.Rows, 5)
+			}
+			if len(got.Errors) != 2 || got.Errors[0].Row != 4 || got.Errors[1].Row != 5 {
+				t.Errorf("errors got=%+v want rows 4 and 5", got.Errors)
+			}
+		})
+	}
+}
+
+// Every row of a product that isn't imported is reported, and a product that
+// fails to save leaves the rest of its batch alone.
+func TestImportReportsEveryRow(t *testing.T) {
+	const csv = `sku,name,gtin,packaging_level,quantity,primary
+sku1,name1,00012345678905,each,1,true
+sku1,name1,10012345678902,case,x,false
+sku2,name2,036000291452,each,1,true
+sku3,name3,4006381333931,each,1,true
+sku4,name4,12345,each,1,true
+sku4,name4,96385074,case,6,false
+`
+	mockRepo := db.NewMockRepo()
+	saved := make(map[string]bool)
+	mockRepo.SaveProductFunc = func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error {
+		if product.Sku == "sku2" {
+			return errors.New("some database error")
+		}
+		saved[product.Sku] = true
+		return nil
+	}
+
+	service := catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout")
+	result, err := service.ImportProducts(context.Background(), strings.NewReader(csv), catalog.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Imported != 1 || len(saved) != 1 || !saved["sku3"] {
+		t.Errorf("imported got=%d saved=%v want sku3", result.Imported, saved)
+	}
+	var rows []int
+	for _, e := range result.Errors {
+		rows = append(rows, e.Row)
+	}
+	if fmt.Sprint(rows) != "[1 2 3 5 6]" {
+		t.Errorf("error rows got=%v want=[1 2 3 5 6] errors=%+v", rows, result.Errors)
+	}
+}
+
+func TestExport(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockRepo.StreamProductsFunc = func(ctx context.Context, filter catalog.ProductFilter, fn func(catalog.Product) error) error {
+		if filter.SkuPrefix != "sku" {
+			t.Errorf("sku filter got=%s want=%s", filter.SkuPrefix, "sku")
+		}
+		for _, p := range testProducts {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	service := catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout")
+	ts := configureServer(service)
+	defer ts.Close()
+
+	t.Run("csv", func(t *testing.T) {
+		res, err := http.Get(ts.URL + "/v1/export?format=csv&sku=sku")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		// An export should be importable as is.
+		items, rowErrs, rows, err := catalog.ReadImportCSV(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rowErrs) > 0 {
+			t.Errorf("row errors got=%v want none", rowErrs)
+		}
+		if rows != 5 || len(items) != len(testProducts) {
+			t.Errorf("got rows=%d products=%d want rows=5 products=%d", rows, len(items), len(testProducts))
+		}
+	})
+
+	t.Run("xlsx", func(t *testing.T) {
+		res, err := http.Get(ts.URL + "/v1/export?format=xlsx&sku=sku")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			if f.Name != "xl/worksheets/sheet1.xml" {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sheet := struct {
+				Rows []struct{} `xml:"sheetData>row"`
+			}{}
+			err = xml.NewDecoder(rc).Decode(&sheet)
+			_ = rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sheet.Rows) != 6 {
+				t.Errorf("rows got=%d want=%d", len(sheet.Rows), 6)
+			}
+			return
+		}
+		t.Error("workbook has no sheet")
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		res, err := http.Get(ts.URL + "/v1/export?format=pdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("status got=%d want=%d", res.StatusCode, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("query failure", func(t *testing.T) {
+		failing := db.NewMockRepo()
+		failing.StreamProductsFunc = func(ctx context.Context, filter catalog.ProductFilter, fn func(catalog.Product) error) error {
+			return errors.New("database unavailable")
+		}
+		ts := configureServer(catalog.NewService(failing, queue.NewMockQueue(), "product.fanout"))
+		defer ts.Close()
+
+		for _, format := range []string{"csv", "jsonl", "xlsx"} {
+			res, err := http.Get(ts.URL + "/v1/export?format=" + format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = res.Body.Close()
+			if res.StatusCode != http.StatusInternalServerError {
+				t.Errorf("%s status got=%d want=%d", format, res.StatusCode, http.StatusInternalServerError)
+			}
+			if got := res.Header.Get("Content-Disposition"); got != "" {
+				t.Errorf("%s content disposition got=%s want none", format, got)
+			}
+		}
+
+		res, err := http.Get(ts.URL + "/v1/gs1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusInternalServerError || res.Header.Get("Content-Disposition") != "" {
+			t.Errorf("gs1 status got=%d content disposition got=%s", res.StatusCode, res.Header.Get("Content-Disposition"))
+		}
+	})
+}
+
+func put(t *testing.T, url string, v interface{}) *http.Response {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
 var testProducts = []catalog.Product{
 	{
 		Sku:  "sku1",
-		Upc:  "upc1",
 		Name: "name1",
+		Barcodes: []catalog.Barcode{
+			{Gtin: "00012345678905", PackagingLevel: catalog.PackagingEach, Quantity: 1, Primary: true},
+		},
 	},
 	{
 		Sku:  "sku2",
-		Upc:  "upc2",
 		Name: "name2",
+		Barcodes: []catalog.Barcode{
+			{Gtin: "036000291452", PackagingLevel: catalog.PackagingEach, Quantity: 1, Primary: true},
+			{Gtin: "10036000291459", PackagingLevel: catalog.PackagingCase, Quantity: 24},
+		},
 	},
 	{
 		Sku:  "sku3",
-		Upc:  "upc3",
 		Name: "name3",
+		Barcodes: []catalog.Barcode{
+			{Gtin: "4006381333931", PackagingLevel: catalog.PackagingEach, Quantity: 1, Primary: true},
+			{Gtin: "96385074", PackagingLevel: catalog.PackagingInner, Quantity: 6},
+		},
 	},
 }
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+const (
+	// ChangeStreamBuffer is the number of changes held for a slow stream
+	// before it is disconnected and has to resume from Last-Event-ID.
+	ChangeStreamBuffer = 256
+	// ChangeStreamHeartbeat is how often an idle stream sends a comment to
+	// keep proxies from closing the connection.
+	ChangeStreamHeartbeat = 15 * time.Second
+	// ChangeStreamPoll is how often a stream reads the change log for changes
+	// made by other instances.
+	ChangeStreamPoll = 2 * time.Second
+
+	changeReplayPage = 500
+
+	DefaultChangesLimit = 100
+	MaxChangesLimit     = 1000
+)
+
+type ChangesResponse struct {
+	Changes []catalog.Change `json:"changes"`
+	// Next is the sequence to pass as since to read the following changes.
+	Next int64 `json:"next"`
+}
+
+func (rd *ChangesResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+// GetChanges returns the changes after since in sequence order. Polling with
+// the returned next value visits every change exactly once; a consumer that
+// stores it can recover from an outage by polling from where it left off.
+func (a *CatalogApi) GetChanges(w http.ResponseWriter, r *http.Request) {
+	since, err := queryInt(r, "since", 0)
+	if err != nil || since < 0 {
+		Render(w, r, ErrInvalidRequest(errors.New("since must be a change sequence")))
+		return
+	}
+	limit, err := queryInt(r, "limit", DefaultChangesLimit)
+	if err != nil || limit < 1 || limit > MaxChangesLimit {
+		Render(w, r, ErrInvalidRequest(fmt.Errorf("limit must be between 1 and %d", MaxChangesLimit)))
+		return
+	}
+
+	changes, err := a.service.GetChanges(r.Context(), since, int(limit))
+	if err != nil {
+		log.Error().Err(err).Int64("since", since).Msg("error getting changes")
+		Render(w, r, ErrInternalServer)
+		return
+	}
+
+	resp := &ChangesResponse{Changes: changes, Next: since}
+	if len(changes) > 0 {
+		resp.Next = changes[len(changes)-1].Seq
+	}
+	Render(w, r, resp)
+}
+
+func queryInt(r *http.Request, name string, def int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// StreamChanges sends product changes as Server-Sent Events, one event per
+// change with the sequence as its id. A client reconnecting with
+// Last-Event-ID first receives every change it missed, then live changes.
+// Without it the stream starts from the next change. Changes made here are
+// sent as they're committed, and the change log is polled for those made by
+// other instances or the command line.
+func (a *CatalogApi) StreamChanges(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		Render(w, r, ErrInternalServer)
+		return
+	}
+
+	var last int64
+	resume := false
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		var err error
+		if last, err = strconv.ParseInt(id, 10, 64); err != nil || last < 0 {
+			Render(w, r, ErrInvalidRequest(errors.New("Last-Event-ID must be a change sequence")))
+			return
+		}
+		resume = true
+	}
+
+	// Subscribe before reading the change log so nothing committed in between
+	// is missed, anything received twice is skipped by its sequence.
+	sub := a.service.SubscribeChanges(ChangeStreamBuffer)
+	defer sub.Close()
+
+	if !resume {
+		var err error
+		if last, err = a.service.LastChangeSeq(r.Context()); err != nil {
+			log.Error().Err(err).Msg("error starting change stream")
+			Render(w, r, ErrInternalServer)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+	flusher.Flush()
+
+	// catchUp sends the changes after last, up to and including until, or
+	// every one there is when until is zero.
+	catchUp := func(until int64) error {
+		for {
+			limit := changeReplayPage
+			if until > 0 && until-last < int64(limit) {
+				limit = int(until - last)
+			}
+			if limit <= 0 {
+				return nil
+			}
+			changes, err := a.service.GetChanges(r.Context(), last, limit)
+			if err != nil {
+				log.Error().Err(err).Int64("since", last).Msg("error replaying changes")
+				return err
+			}
+			for _, c := range changes {
+				if err = writeChangeEvent(w, c); err != nil {
+					return err
+				}
+				last = c.Seq
+			}
+			flusher.Flush()
+			if len(changes) < limit {
+				return nil
+			}
+		}
+	}
+
+	if resume && catchUp(0) != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(ChangeStreamHeartbeat)
+	defer heartbeat.Stop()
+	poll := time.NewTicker(ChangeStreamPoll)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-poll.C:
+			if catchUp(0) != nil {
+				return
+			}
+		case c, ok := <-sub.C:
+			if !ok {
+				// Dropped for falling behind, the client reconnects and
+				// catches up from the last id it received.
+				return
+			}
+			if c.Seq <= last {
+				continue
+			}
+			// Changes committed concurrently can be published out of order,
+			// and those made elsewhere aren't published here at all, read
+			// any skipped over from the change log.
+			if c.Seq > last+1 && catchUp(c.Seq-1) != nil {
+				return
+			}
+			if c.Seq > last {
+				if err := writeChangeEvent(w, c); err != nil {
+					return
+				}
+				last = c.Seq
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeChangeEvent(w http.ResponseWriter, c catalog.Change) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Type, data)
+	return err
+}
@@ -0,0 +1,190 @@
+package api_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sksmith/smfg-catalog/api"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+	"github.com/sksmith/smfg-catalog/queue"
+)
+
+func TestStreamChanges(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockRepo.GetProductFunc = func(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error) {
+		return catalog.Product{}, core.ErrNotFound
+	}
+	mockRepo.GetChangesFunc = func(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]catalog.Change, error) {
+		if since != 1 {
+			t.Errorf("since got=%d want=1", since)
+		}
+		return []catalog.Change{
+			{Seq: 2, Type: catalog.ChangeUpdated, Sku: "a"},
+			{Seq: 3, Type: catalog.ChangeDeleted, Sku: "b"},
+		}, nil
+	}
+	mockRepo.SaveChangeFunc = func(ctx context.Context, change catalog.Change, tx ...core.Transaction) (catalog.Change, error) {
+		change.Seq = 4
+		return change, nil
+	}
+
+	service := catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout")
+	ts := configureServer(service)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/v1/changes/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type got=%s want=text/event-stream", ct)
+	}
+
+	events := bufio.NewReader(res.Body)
+	readEvent := func() string {
+		var lines []string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				if len(lines) > 0 && !strings.HasPrefix(lines[0], "retry:") {
+					return strings.Join(lines, "\n")
+				}
+				lines = nil
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	for _, want := range []string{"id: 2\nevent: updated", "id: 3\nevent: deleted"} {
+		if got := readEvent(); !strings.HasPrefix(got, want) {
+			t.Errorf("replayed event got=%q want prefix %q", got, want)
+		}
+	}
+
+	if err = service.CreateProduct(context.Background(), testProducts[0]); err != nil {
+		t.Fatal(err)
+	}
+	got := readEvent()
+	if !strings.HasPrefix(got, "id: 4\nevent: created") || !strings.Contains(got, `"sku":"`+testProducts[0].Sku+`"`) {
+		t.Errorf("live event got=%q", got)
+	}
+}
+
+func TestStreamChangesFromOtherInstances(t *testing.T) {
+	var mu sync.Mutex
+	var committed []catalog.Change
+	mockRepo := db.NewMockRepo()
+	mockRepo.LastChangeSeqFunc = func(ctx context.Context, tx ...core.Transaction) (int64, error) {
+		return 5, nil
+	}
+	mockRepo.GetChangesFunc = func(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]catalog.Change, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if since < 5 {
+			t.Errorf("since got=%d, want the stream to start at the latest change", since)
+		}
+		var changes []catalog.Change
+		for _, c := range committed {
+			if c.Seq > since && len(changes) < limit {
+				changes = append(changes, c)
+			}
+		}
+		return changes, nil
+	}
+
+	ts := configureServer(catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout"))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*api.ChangeStreamPoll)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/v1/changes/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	// Committed by another instance, so only in the change log.
+	mu.Lock()
+	committed = append(committed, catalog.Change{Seq: 6, Type: catalog.ChangeDeleted, Sku: "a"})
+	mu.Unlock()
+
+	events := bufio.NewScanner(res.Body)
+	for events.Scan() {
+		if strings.HasPrefix(events.Text(), "id: ") {
+			if got := events.Text(); got != "id: 6" {
+				t.Errorf("event got=%q want id 6", got)
+			}
+			return
+		}
+	}
+	t.Errorf("no event polled from the change log: %v", events.Err())
+}
+
+func TestGetChanges(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockRepo.GetChangesFunc = func(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]catalog.Change, error) {
+		if since != 10 || limit != 2 {
+			t.Errorf("since, limit got=%d, %d want=10, 2", since, limit)
+		}
+		return []catalog.Change{
+			{Seq: 11, Type: catalog.ChangeCreated, Sku: "a"},
+			{Seq: 12, Type: catalog.ChangeDeleted, Sku: "a"},
+		}, nil
+	}
+
+	service := catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout")
+	ts := configureServer(service)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/v1/changes?since=10&limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status code got=%d want=%d", res.StatusCode, http.StatusOK)
+	}
+
+	resp := api.ChangesResponse{}
+	if err = json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Changes) != 2 || resp.Next != 12 {
+		t.Errorf("changes got=%d next=%d want=2 next=12", len(resp.Changes), resp.Next)
+	}
+
+	for _, q := range []string{"since=-1", "since=x", "limit=0", "limit=5000"} {
+		res, err := http.Get(ts.URL + "/v1/changes?" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s status code got=%d want=%d", q, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
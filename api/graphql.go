@@ -0,0 +1,228 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+// MaxGraphQLRequestSize is the largest GraphQL request body accepted, in bytes.
+const MaxGraphQLRequestSize = 1 << 20
+
+type GraphQLApi struct {
+	service catalog.Service
+	schema  graphql.Schema
+	limits  QueryLimits
+}
+
+func NewGraphQLApi(service catalog.Service, limits QueryLimits) (*GraphQLApi, error) {
+	schema, err := graphQLSchema()
+	if err != nil {
+		return nil, err
+	}
+	return &GraphQLApi{service: service, schema: schema, limits: limits}, nil
+}
+
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// ServeHTTP executes a query sent either as a JSON body or, for GET, in the
+// query string. Errors in the query itself are reported in the response
+// body with a 200, following the GraphQL over HTTP convention.
+func (a *GraphQLApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := GraphQLRequest{}
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				Render(w, r, ErrInvalidRequest(err))
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxGraphQLRequestSize)).Decode(&req); err != nil {
+			Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if req.Query == "" {
+		Render(w, r, ErrInvalidRequest(errors.New("query is required")))
+		return
+	}
+
+	render.JSON(w, r, a.execute(r, req))
+}
+
+func (a *GraphQLApi) execute(r *http.Request, req GraphQLRequest) *graphql.Result {
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(req.Query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+
+	validation := graphql.ValidateDocument(&a.schema, doc, nil)
+	if !validation.IsValid {
+		return &graphql.Result{Errors: validation.Errors}
+	}
+
+	if err = a.limits.Check(doc, req.OperationName, req.Variables); err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        a.schema,
+		Root:          map[string]interface{}{},
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       withProductLoader(r.Context(), a.service),
+	})
+	if result.HasErrors() {
+		log.Debug().Interface("errors", result.Errors).Msg("graphql query returned errors")
+	}
+	return result
+}
+
+func graphQLSchema() (graphql.Schema, error) {
+	packagingLevel := graphql.NewEnum(graphql.EnumConfig{
+		Name: "PackagingLevel",
+		Values: graphql.EnumValueConfigMap{
+			"EACH":  &graphql.EnumValueConfig{Value: catalog.PackagingEach},
+			"INNER": &graphql.EnumValueConfig{Value: catalog.PackagingInner},
+			"CASE":  &graphql.EnumValueConfig{Value: catalog.PackagingCase},
+		},
+	})
+
+	barcode := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Barcode",
+		Fields: graphql.Fields{
+			"gtin":           &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"packagingLevel": &graphql.Field{Type: graphql.NewNonNull(packagingLevel)},
+			"quantity":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"primary":        &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+		},
+	})
+
+	dimensions := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Dimensions",
+		Fields: graphql.Fields{
+			"height": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"width":  &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"depth":  &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"unit":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	weight := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Weight",
+		Fields: graphql.Fields{
+			"net":   &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"gross": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			"unit":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	product := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Product",
+		Fields: graphql.Fields{
+			"sku":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"description": &graphql.Field{Type: graphql.String},
+			"dimensions":  &graphql.Field{Type: dimensions},
+			"weight":      &graphql.Field{Type: weight},
+			"barcodes":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(barcode)))},
+			"primaryBarcode": &graphql.Field{
+				Type: barcode,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if b, ok := p.Source.(catalog.Product).PrimaryBarcode(); ok {
+						return b, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"product": &graphql.Field{
+				Type: product,
+				Args: graphql.FieldConfigArgument{
+					"sku": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return productLoaderFrom(p.Context).Load(p.Args["sku"].(string)), nil
+				},
+			},
+			"productsBySku": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(product))),
+				Args: graphql.FieldConfigArgument{
+					"skus": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var skus []string
+					for _, sku := range p.Args["skus"].([]interface{}) {
+						skus = append(skus, sku.(string))
+					}
+					return productLoaderFrom(p.Context).LoadMany(skus), nil
+				},
+			},
+			"productByBarcode": &graphql.Field{
+				Type: product,
+				Args: graphql.FieldConfigArgument{
+					"gtin": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return productLoaderFrom(p.Context).LoadByBarcode(p.Args["gtin"].(string)), nil
+				},
+			},
+			"products": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(product))),
+				Args: graphql.FieldConfigArgument{
+					"sku":    &graphql.ArgumentConfig{Type: graphql.String, Description: "SKU prefix"},
+					"name":   &graphql.ArgumentConfig{Type: graphql.String},
+					"gtin":   &graphql.ArgumentConfig{Type: graphql.String},
+					"first":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: DefaultPageLimit},
+					"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					filter := catalog.ProductFilter{}
+					filter.SkuPrefix, _ = p.Args["sku"].(string)
+					filter.Name, _ = p.Args["name"].(string)
+					filter.Gtin, _ = p.Args["gtin"].(string)
+
+					products, err := productLoaderFrom(p.Context).service.ListProducts(
+						p.Context, filter, p.Args["first"].(int), p.Args["offset"].(int))
+					if err != nil {
+						log.Error().Err(err).Msg("error listing products")
+						return nil, errGraphQLInternal
+					}
+					return products, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+var errGraphQLInternal = errors.New("an internal server error has occurred")
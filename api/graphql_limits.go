@@ -0,0 +1,157 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+const (
+	DefaultMaxQueryDepth      = 8
+	DefaultMaxQueryComplexity = 5000
+)
+
+// QueryLimits bounds the cost of a GraphQL query before it is executed.
+//
+// Depth is the deepest chain of nested selections. Complexity counts one
+// for every field, with the fields below a list multiplied by the number
+// of items it can return: the first argument, or the number of skus asked
+// for. Introspection fields are not counted so that tooling keeps working.
+type QueryLimits struct {
+	MaxDepth      int
+	MaxComplexity int
+}
+
+func DefaultQueryLimits() QueryLimits {
+	return QueryLimits{MaxDepth: DefaultMaxQueryDepth, MaxComplexity: DefaultMaxQueryComplexity}
+}
+
+// Check returns an error if the operation to be executed is over either
+// limit. A limit of zero is not enforced.
+func (l QueryLimits) Check(doc *ast.Document, operationName string, variables map[string]interface{}) error {
+	a := queryAnalysis{fragments: make(map[string]*ast.FragmentDefinition), variables: variables}
+
+	var op *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		switch d := def.(type) {
+		case *ast.FragmentDefinition:
+			a.fragments[d.Name.Value] = d
+		case *ast.OperationDefinition:
+			if op == nil && (operationName == "" || (d.Name != nil && d.Name.Value == operationName)) {
+				op = d
+			}
+		}
+	}
+	if op == nil {
+		return nil
+	}
+
+	depth, complexity := a.selections(op.SelectionSet, nil)
+	if l.MaxDepth > 0 && depth > l.MaxDepth {
+		return fmt.Errorf("query depth %d exceeds the maximum of %d", depth, l.MaxDepth)
+	}
+	if l.MaxComplexity > 0 && complexity > l.MaxComplexity {
+		return fmt.Errorf("query complexity %d exceeds the maximum of %d", complexity, l.MaxComplexity)
+	}
+	return nil
+}
+
+type queryAnalysis struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+}
+
+// selections returns the depth and complexity of a selection set. visiting
+// holds the fragments being expanded, so a cycle can't recurse forever;
+// validation rejects cycles anyway.
+func (a queryAnalysis) selections(set *ast.SelectionSet, visiting []string) (int, int) {
+	if set == nil {
+		return 0, 0
+	}
+
+	depth, complexity := 0, 0
+	for _, sel := range set.Selections {
+		var d, c int
+		switch s := sel.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(s.Name.Value, "__") {
+				continue
+			}
+			d, c = a.selections(s.SelectionSet, visiting)
+			d, c = d+1, 1+c*a.multiplier(s)
+		case *ast.InlineFragment:
+			d, c = a.selections(s.SelectionSet, visiting)
+		case *ast.FragmentSpread:
+			name := s.Name.Value
+			f, ok := a.fragments[name]
+			if !ok || contains(visiting, name) {
+				continue
+			}
+			d, c = a.selections(f.SelectionSet, append(visiting, name))
+		}
+		if d > depth {
+			depth = d
+		}
+		complexity += c
+	}
+	return depth, complexity
+}
+
+// multiplier is the number of items a field can return.
+func (a queryAnalysis) multiplier(f *ast.Field) int {
+	for _, arg := range f.Arguments {
+		switch arg.Name.Value {
+		case "first":
+			if n, ok := a.intValue(arg.Value); ok && n > 0 {
+				return n
+			}
+		case "skus":
+			if n := a.listLen(arg.Value); n > 0 {
+				return n
+			}
+		}
+	}
+	if f.Name.Value == "products" {
+		return DefaultPageLimit
+	}
+	return 1
+}
+
+func (a queryAnalysis) intValue(v ast.Value) (int, bool) {
+	switch val := v.(type) {
+	case *ast.IntValue:
+		n, err := strconv.Atoi(val.Value)
+		return n, err == nil
+	case *ast.Variable:
+		switch n := a.variables[val.Name.Value].(type) {
+		case float64:
+			return int(n), true
+		case int:
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func (a queryAnalysis) listLen(v ast.Value) int {
+	switch val := v.(type) {
+	case *ast.ListValue:
+		return len(val.Values)
+	case *ast.Variable:
+		if l, ok := a.variables[val.Name.Value].([]interface{}); ok {
+			return len(l)
+		}
+	}
+	return 0
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
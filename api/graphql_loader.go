@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+const ctxKeyProductLoader CtxKey = "productLoader"
+
+// productLoader batches the product lookups made while resolving a single
+// GraphQL request. Resolvers register the SKUs they need and hand back a
+// thunk; the executor resolves every field at a level before calling any
+// thunk, so the first thunk called fetches all registered SKUs in one
+// GetProducts call instead of one query per field.
+type productLoader struct {
+	ctx     context.Context
+	service catalog.Service
+
+	mu       sync.Mutex
+	pending  []string
+	products map[string]*catalog.Product
+	err      error
+}
+
+func withProductLoader(ctx context.Context, service catalog.Service) context.Context {
+	l := &productLoader{ctx: ctx, service: service, products: make(map[string]*catalog.Product)}
+	return context.WithValue(ctx, ctxKeyProductLoader, l)
+}
+
+func productLoaderFrom(ctx context.Context) *productLoader {
+	return ctx.Value(ctxKeyProductLoader).(*productLoader)
+}
+
+// Load returns a thunk resolving to the product, or to nil if there is no
+// product with the SKU.
+func (l *productLoader) Load(sku string) func() (interface{}, error) {
+	l.enqueue(sku)
+	return func() (interface{}, error) {
+		if err := l.flush(); err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if p := l.products[sku]; p != nil {
+			return *p, nil
+		}
+		return nil, nil
+	}
+}
+
+// LoadMany returns a thunk resolving to the products found, in the order
+// requested.
+func (l *productLoader) LoadMany(skus []string) func() (interface{}, error) {
+	l.enqueue(skus...)
+	return func() (interface{}, error) {
+		if err := l.flush(); err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		products := make([]catalog.Product, 0, len(skus))
+		for _, sku := range skus {
+			if p := l.products[sku]; p != nil {
+				products = append(products, *p)
+			}
+		}
+		return products, nil
+	}
+}
+
+// LoadByBarcode looks the product up directly, since barcodes can't be
+// batched through GetProducts, but primes the SKU cache with the result.
+func (l *productLoader) LoadByBarcode(gtin string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		product, err := l.service.GetProductByBarcode(l.ctx, gtin)
+		if err != nil {
+			if errors.Is(err, core.ErrNotFound) {
+				return nil, nil
+			}
+			log.Error().Err(err).Str("gtin", gtin).Msg("error acquiring product by barcode")
+			return nil, errGraphQLInternal
+		}
+
+		l.mu.Lock()
+		l.products[product.Sku] = &product
+		l.mu.Unlock()
+		return product, nil
+	}
+}
+
+func (l *productLoader) enqueue(skus ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, sku := range skus {
+		if _, ok := l.products[sku]; !ok {
+			l.products[sku] = nil
+			l.pending = append(l.pending, sku)
+		}
+	}
+}
+
+func (l *productLoader) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) == 0 {
+		return l.err
+	}
+
+	skus := l.pending
+	l.pending = nil
+
+	products, err := l.service.GetProducts(l.ctx, skus)
+	if err != nil {
+		log.Error().Err(err).Strs("skus", skus).Msg("error acquiring products")
+		l.err = errGraphQLInternal
+		return l.err
+	}
+	for i := range products {
+		l.products[products[i].Sku] = &products[i]
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sksmith/smfg-catalog/api"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+	"github.com/sksmith/smfg-catalog/queue"
+)
+
+type graphQLResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func postGraphQL(t *testing.T, repo db.MockRepo, limits api.QueryLimits, query string) graphQLResponse {
+	service := catalog.NewService(repo, queue.NewMockQueue(), "product.fanout")
+	gql, err := api.NewGraphQLApi(service, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(gql)
+	defer ts.Close()
+
+	body, _ := json.Marshal(api.GraphQLRequest{Query: query})
+	res, err := http.Post(ts.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status code got=%d want=%d", res.StatusCode, http.StatusOK)
+	}
+
+	resp := graphQLResponse{}
+	if err = json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestGraphQLBatchesProducts(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	calls := 0
+	mockRepo.GetProductsFunc = func(ctx context.Context, skus []string, tx ...core.Transaction) ([]catalog.Product, error) {
+		calls++
+		if len(skus) != 3 {
+			t.Errorf("skus got=%v want 3", skus)
+		}
+		return testProducts, nil
+	}
+	mockRepo.GetProductFunc = func(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error) {
+		t.Errorf("unexpected single product lookup for %s", sku)
+		return catalog.Product{}, core.ErrNotFound
+	}
+
+	resp := postGraphQL(t, mockRepo, api.DefaultQueryLimits(), `{
+		a: product(sku: "`+testProducts[0].Sku+`") { name barcodes { gtin packagingLevel } }
+		b: product(sku: "missing") { name }
+		c: productsBySku(skus: ["`+testProducts[0].Sku+`", "`+testProducts[1].Sku+`"]) { sku primaryBarcode { gtin } }
+	}`)
+
+	if len(resp.Errors) > 0 {
+		t.Fatalf("unexpected errors %v", resp.Errors)
+	}
+	if calls != 1 {
+		t.Errorf("GetProducts calls got=%d want=1", calls)
+	}
+	if string(resp.Data["b"]) != "null" {
+		t.Errorf("missing product got=%s want=null", resp.Data["b"])
+	}
+	if !strings.Contains(string(resp.Data["a"]), `"packagingLevel":"EACH"`) {
+		t.Errorf("unexpected product %s", resp.Data["a"])
+	}
+
+	c := []catalog.Product{}
+	if err := json.Unmarshal(resp.Data["c"], &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 2 {
+		t.Errorf("products got=%d want=2", len(c))
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"depth", `{ products { barcodes { gtin } } }`, "depth 3 exceeds"},
+		{"complexity", `{ products(first: 1000) { sku name } }`, "complexity 2001 exceeds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := postGraphQL(t, db.NewMockRepo(), api.QueryLimits{MaxDepth: 2, MaxComplexity: 1000}, tt.query)
+			if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, tt.want) {
+				t.Errorf("errors got=%v want %q", resp.Errors, tt.want)
+			}
+		})
+	}
+}
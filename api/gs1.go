@@ -0,0 +1,73 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/gs1"
+)
+
+// ImportGS1 imports the products described by a GS1 trade item document.
+// Row numbers in the result refer to trade items in document order.
+func (a *CatalogApi) ImportGS1(w http.ResponseWriter, r *http.Request) {
+	dryRun, err := queryBool(r, "dry_run")
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	items, err := gs1.Decode(http.MaxBytesReader(w, r.Body, MaxImportSize))
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	result, err := a.service.ImportItems(r.Context(), items, catalog.ImportOptions{DryRun: dryRun})
+	if err != nil {
+		log.Error().Err(err).Msg("error importing gs1 document")
+		Render(w, r, ErrInternalServer)
+		return
+	}
+
+	Render(w, r, &ImportResponse{ImportResult: result})
+}
+
+// ExportGS1 streams every product matching the list filters as a single
+// trade item document. Products have no category, so a selection is made
+// with the filters, or GetProductGS1 for a single product.
+func (a *CatalogApi) ExportGS1(w http.ResponseWriter, r *http.Request) {
+	ew := &exportResponse{ResponseWriter: w, contentType: gs1.ContentType, filename: "products.xml"}
+	err := a.service.WriteProducts(r.Context(), productFilter(r), gs1.NewEncoder(ew))
+	ew.fail(r, err)
+}
+
+func (a *CatalogApi) GetProductGS1(w http.ResponseWriter, r *http.Request) {
+	sku := chi.URLParam(r, "sku")
+
+	product, err := a.service.GetProduct(r.Context(), sku)
+	if err != nil {
+		if errors.Is(err, core.ErrNotFound) {
+			Render(w, r, ErrNotFound)
+		} else {
+			log.Error().Err(err).Str("sku", sku).Msg("error acquiring product")
+			Render(w, r, ErrInternalServer)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", gs1.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sku+".xml"))
+
+	enc := gs1.NewEncoder(w)
+	if err = enc.Write(product); err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		log.Error().Err(err).Str("sku", sku).Msg("error writing gs1 document")
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+type JobResponse struct {
+	catalog.Job
+}
+
+func NewJobResponse(job catalog.Job) *JobResponse {
+	return &JobResponse{Job: job}
+}
+
+func (rd *JobResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+// SubmitImport queues a product CSV to be imported in the background. The
+// job can then be polled at the returned location.
+func (a *CatalogApi) SubmitImport(w http.ResponseWriter, r *http.Request) {
+	dryRun, err := queryBool(r, "dry_run")
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, MaxImportJobSize)
+	job, err := a.service.SubmitImport(r.Context(), body, catalog.ImportOptions{DryRun: dryRun})
+	if err != nil {
+		if errors.Is(err, catalog.ErrInvalidImport) {
+			Render(w, r, ErrInvalidRequest(err))
+		} else {
+			log.Error().Err(err).Msg("error submitting import job")
+			Render(w, r, ErrInternalServer)
+		}
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", path.Dir(r.URL.Path), job.ID))
+	render.Status(r, http.StatusAccepted)
+	Render(w, r, NewJobResponse(job))
+}
+
+func (a *CatalogApi) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.job(w, r)
+	if !ok {
+		return
+	}
+	Render(w, r, NewJobResponse(job))
+}
+
+// GetJobErrors downloads the row errors of a finished job as a CSV report.
+func (a *CatalogApi) GetJobErrors(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.job(w, r)
+	if !ok {
+		return
+	}
+	if !job.Status.Finished() {
+		Render(w, r, ErrConflict(errors.New("job has not finished")))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="job-%d-errors.csv"`, job.ID))
+
+	cw := csv.NewWriter(w)
+	records := [][]string{{"row", "sku", "error"}}
+	for _, e := range job.Errors {
+		records = append(records, []string{strconv.Itoa(e.Row), e.Sku, e.Error})
+	}
+	if err := cw.WriteAll(records); err != nil {
+		log.Warn().Err(err).Int64("job", job.ID).Msg("failed to write job error report")
+	}
+}
+
+func (a *CatalogApi) job(w http.ResponseWriter, r *http.Request) (catalog.Job, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(errors.New("job id must be a number")))
+		return catalog.Job{}, false
+	}
+
+	job, err := a.service.GetJob(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, core.ErrNotFound) {
+			Render(w, r, ErrNotFound)
+		} else {
+			log.Error().Err(err).Int64("job", id).Msg("error acquiring job")
+			Render(w, r, ErrInternalServer)
+		}
+		return job, false
+	}
+	return job, true
+}
+
+func queryBool(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+	return b, nil
+}
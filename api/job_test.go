@@ -0,0 +1,221 @@
+package api_test
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+	"github.com/sksmith/smfg-catalog/queue"
+)
+
+func TestImportJob(t *testing.T) {
+	const input = `sku,name,gtin,packaging_level,quantity,primary
+sku1,name1,00012345678905,each,1,true
+sku2,name2,12345,each,1,true
+`
+	mockRepo := db.NewMockRepo()
+
+	var mu sync.Mutex
+	var stored catalog.Job
+	var storedInput []byte
+	mockRepo.CreateJobFunc = func(ctx context.Context, job catalog.Job, input []byte, tx ...core.Transaction) (catalog.Job, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		job.ID = 1
+		stored, storedInput = job, input
+		return job, nil
+	}
+	mockRepo.ClaimJobFunc = func(ctx context.Context, token string, lease time.Duration) (catalog.Job, []byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if stored.Status != catalog.JobQueued {
+			return catalog.Job{}, nil, core.ErrNotFound
+		}
+		stored.Status = catalog.JobRunning
+		return stored, storedInput, nil
+	}
+	mockRepo.UpdateJobFunc = func(ctx context.Context, job catalog.Job, tx ...core.Transaction) error {
+		mu.Lock()
+		defer mu.Unlock()
+		stored = job
+		return nil
+	}
+	mockRepo.GetJobFunc = func(ctx context.Context, id int64, tx ...core.Transaction) (catalog.Job, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if id != stored.ID {
+			return catalog.Job{}, core.ErrNotFound
+		}
+		return stored, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	service := catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout")
+	service.StartJobWorkers(ctx, 1)
+	ts := configureServer(service)
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/v1/jobs/import", "text/csv", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("status got=%d want=%d", res.StatusCode, http.StatusAccepted)
+	}
+	if got := res.Header.Get("Location"); got != "/v1/jobs/1" {
+		t.Errorf("location got=%s want=%s", got, "/v1/jobs/1")
+	}
+
+	job := catalog.Job{}
+	deadline := time.Now().Add(5 * time.Second)
+	for !job.Status.Finished() {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish, last status=%s", job.Status)
+		}
+		res, err = http.Get(ts.URL + "/v1/jobs/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(res.Body).Decode(&job)
+		_ = res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if job.Status != catalog.JobCompleted {
+		t.Fatalf("status got=%s want=%s message=%s", job.Status, catalog.JobCompleted, job.Message)
+	}
+	if job.Total != 2 || job.Processed != 2 || job.Succeeded != 1 || job.Failed != 1 {
+		t.Errorf("counters got total=%d processed=%d succeeded=%d failed=%d want 2, 2, 1, 1",
+			job.Total, job.Processed, job.Succeeded, job.Failed)
+	}
+
+	res, err = http.Get(ts.URL + "/v1/jobs/1/errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(res.Body).ReadAll()
+	_ = res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1][0] != "2" || records[1][1] != "sku2" {
+		t.Errorf("error report got=%v want one error for row 2, sku2", records)
+	}
+}
+
+// claimedJob runs a job already claimed once, and records the products its
+// worker saves.
+type claimedJob struct {
+	mu    sync.Mutex
+	job   catalog.Job
+	owner string
+	saved []string
+}
+
+func (c *claimedJob) repo(input string) db.MockRepo {
+	mockRepo := db.NewMockRepo()
+	claimed := false
+	mockRepo.ClaimJobFunc = func(ctx context.Context, token string, lease time.Duration) (catalog.Job, []byte, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if claimed {
+			return catalog.Job{}, nil, core.ErrNotFound
+		}
+		claimed = true
+		if c.owner == "" {
+			c.owner = token
+		}
+		c.job.ClaimToken = token
+		return c.job, []byte(input), nil
+	}
+	mockRepo.UpdateJobFunc = func(ctx context.Context, job catalog.Job, tx ...core.Transaction) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if job.ClaimToken != c.owner {
+			return core.ErrNotFound
+		}
+		c.job = job
+		return nil
+	}
+	mockRepo.SaveProductFunc = func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.saved = append(c.saved, product.Sku)
+		return nil
+	}
+	return mockRepo
+}
+
+func (c *claimedJob) state() (catalog.Job, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.job, append([]string{}, c.saved...)
+}
+
+const resumableImport = `sku,name,gtin,packaging_level,quantity,primary
+sku1,name1,00012345678905,each,1,true
+sku2,name2,12345,each,1,true
+sku3,name3,036000291452,each,1,true
+sku4,name4,4006381333931,each,1,true
+`
+
+func TestImportJobResume(t *testing.T) {
+	// The first attempt reported sku2 invalid and saved sku1 before its
+	// worker died.
+	c := &claimedJob{job: catalog.Job{
+		ID: 1, Type: catalog.JobTypeImport, Status: catalog.JobRunning, BatchSize: 1, Attempts: 2,
+		Total: 3, Processed: 2, Succeeded: 1, Failed: 1,
+		Errors: []catalog.RowError{{Row: 2, Sku: "sku2", Error: "invalid"}},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	catalog.NewService(c.repo(resumableImport), queue.NewMockQueue(), "product.fanout").StartJobWorkers(ctx, 1)
+
+	var job catalog.Job
+	var saved []string
+	for !job.Status.Finished() {
+		if ctx.Err() != nil {
+			t.Fatalf("job did not finish, last status=%s", job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+		job, saved = c.state()
+	}
+
+	if job.Status != catalog.JobCompleted || job.Processed != 4 || job.Succeeded != 3 || job.Failed != 1 {
+		t.Errorf("job got=%+v", job)
+	}
+	if strings.Join(saved, ",") != "sku3,sku4" {
+		t.Errorf("saved got=%v want sku3, sku4 only", saved)
+	}
+}
+
+func TestImportJobReclaimed(t *testing.T) {
+	// Another worker has taken the job over, so this one's updates are
+	// refused.
+	c := &claimedJob{owner: "other", job: catalog.Job{ID: 1, Type: catalog.JobTypeImport, Status: catalog.JobQueued, BatchSize: 1}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	catalog.NewService(c.repo(resumableImport), queue.NewMockQueue(), "product.fanout").StartJobWorkers(ctx, 1)
+
+	<-ctx.Done()
+	job, saved := c.state()
+	if job.Status != catalog.JobQueued || len(saved) != 0 {
+		t.Errorf("job got status=%s saved=%v, want it left to its owner", job.Status, saved)
+	}
+}
@@ -96,8 +96,17 @@ func ConfigureMetrics() {
 		[]string{"method", "url"},
 	)
 
+	rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limited_count",
+			Help: "Number of requests rejected for being over a rate limit",
+		},
+		[]string{"route", "client"},
+	)
+
 	prometheus.MustRegister(urlHitCount)
 	prometheus.MustRegister(urlLatency)
+	prometheus.MustRegister(rateLimited)
 }
 
 func Metrics(next http.Handler) http.Handler {
@@ -0,0 +1,460 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+//--
+// OpenAPI 3 document generated from the routes in ConfigureRouter
+//
+// docgen only knows a route's handler and the comment above it, which it
+// reads from the source tree at runtime, so the routes are walked with chi
+// and the bodies and parameters come from operations.
+//--
+
+const openAPIVersion = "3.0.3"
+
+type OpenAPIDoc struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       OpenAPIInfo                      `json:"info"`
+	Servers    []OpenAPIServer                  `json:"servers,omitempty"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components OpenAPIComponents                `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIServer struct {
+	URL string `json:"url"`
+}
+
+type OpenAPIComponents struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId,omitempty"`
+	Summary     string               `json:"summary,omitempty"`
+	Parameters  []Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+}
+
+// apiOperation describes a route for the OpenAPI document. Bodies are Go
+// values whose types are turned into schemas, or a content type mapped to
+// a schema for anything that isn't JSON.
+type apiOperation struct {
+	id        string
+	summary   string
+	params    []Parameter
+	request   interface{}
+	responses map[int]interface{}
+}
+
+// rawContent documents a non JSON body.
+type rawContent map[string]*Schema
+
+var (
+	stringSchema = &Schema{Type: "string"}
+	binarySchema = &Schema{Type: "string", Format: "binary"}
+
+	filterParams = []Parameter{
+		{Name: "sku", In: "query", Description: "SKU prefix", Schema: stringSchema},
+		{Name: "name", In: "query", Description: "case insensitive part of the name", Schema: stringSchema},
+		{Name: "gtin", In: "query", Description: "any of the product's barcodes", Schema: stringSchema},
+	}
+	dryRunParam = Parameter{Name: "dry_run", In: "query", Description: "validate without saving",
+		Schema: &Schema{Type: "boolean"}}
+	errResponse = &ErrResponse{}
+)
+
+func params(ps ...[]Parameter) []Parameter {
+	var all []Parameter
+	for _, p := range ps {
+		all = append(all, p...)
+	}
+	return all
+}
+
+// operations must document every route in ConfigureRouter, keyed by method
+// and OpenAPI path. Generating the document fails if the two drift apart.
+var operations = map[string]apiOperation{
+	"GET /v1": {
+		id: "listProducts", summary: "List products",
+		params: params([]Parameter{
+			{Name: "limit", In: "query", Schema: &Schema{Type: "integer"}},
+			{Name: "offset", In: "query", Schema: &Schema{Type: "integer"}},
+		}, filterParams),
+		responses: map[int]interface{}{http.StatusOK: []catalog.Product{}, http.StatusInternalServerError: errResponse},
+	},
+	"PUT /v1": {
+		id: "createProduct", summary: "Create a product",
+		request: &CreateProductRequest{},
+		responses: map[int]interface{}{
+			http.StatusCreated:             catalog.Product{},
+			http.StatusBadRequest:          errResponse,
+			http.StatusConflict:            errResponse,
+			http.StatusInternalServerError: errResponse,
+		},
+	},
+	"GET /v1/export": {
+		id: "exportProducts", summary: "Download products as csv, jsonl or xlsx",
+		params: params([]Parameter{{Name: "format", In: "query",
+			Schema: &Schema{Type: "string", Enum: []string{"csv", "jsonl", "xlsx"}}}}, filterParams),
+		responses: map[int]interface{}{
+			http.StatusOK: rawContent{
+				catalog.ExportCSV.ContentType():   stringSchema,
+				catalog.ExportJSONL.ContentType(): stringSchema,
+				catalog.ExportXLSX.ContentType():  binarySchema,
+			},
+			http.StatusBadRequest: errResponse,
+		},
+	},
+	"POST /v1/import": {
+		id: "importProducts", summary: "Import products from a csv",
+		params:  []Parameter{dryRunParam},
+		request: rawContent{"text/csv": stringSchema},
+		responses: map[int]interface{}{
+			http.StatusOK:                  catalog.ImportResult{},
+			http.StatusBadRequest:          errResponse,
+			http.StatusInternalServerError: errResponse,
+		},
+	},
+	"GET /v1/gs1": {
+		id: "exportGS1", summary: "Download products as a GS1 trade item document",
+		params:    filterParams,
+		responses: map[int]interface{}{http.StatusOK: rawContent{"application/xml": stringSchema}},
+	},
+	"POST /v1/gs1": {
+		id: "importGS1", summary: "Import a GS1 trade item document",
+		params:  []Parameter{dryRunParam},
+		request: rawContent{"application/xml": stringSchema},
+		responses: map[int]interface{}{
+			http.StatusOK:                  catalog.ImportResult{},
+			http.StatusBadRequest:          errResponse,
+			http.StatusInternalServerError: errResponse,
+		},
+	},
+	"POST /v1/jobs/import": {
+		id: "submitImport", summary: "Queue a csv import to run in the background",
+		params:  []Parameter{dryRunParam},
+		request: rawContent{"text/csv": stringSchema},
+		responses: map[int]interface{}{
+			http.StatusAccepted:            catalog.Job{},
+			http.StatusBadRequest:          errResponse,
+			http.StatusInternalServerError: errResponse,
+		},
+	},
+	"GET /v1/jobs/{id}": {
+		id: "getJob", summary: "Get a job's status and progress",
+		params:    []Parameter{{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "integer"}}},
+		responses: map[int]interface{}{http.StatusOK: catalog.Job{}, http.StatusNotFound: errResponse},
+	},
+	"GET /v1/jobs/{id}/errors": {
+		id: "getJobErrors", summary: "Download the error report of a finished job",
+		params: []Parameter{{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "integer"}}},
+		responses: map[int]interface{}{
+			http.StatusOK:       rawContent{"text/csv": stringSchema},
+			http.StatusNotFound: errResponse,
+			http.StatusConflict: errResponse,
+		},
+	},
+	"GET /v1/changes": {
+		id: "getChanges", summary: "Get product changes in sequence order",
+		params: []Parameter{
+			{Name: "since", In: "query", Description: "return changes after this sequence", Schema: &Schema{Type: "integer"}},
+			{Name: "limit", In: "query", Schema: &Schema{Type: "integer"}},
+		},
+		responses: map[int]interface{}{
+			http.StatusOK:                  ChangesResponse{},
+			http.StatusBadRequest:          errResponse,
+			http.StatusInternalServerError: errResponse,
+		},
+	},
+	"GET /v1/changes/stream": {
+		id: "streamChanges", summary: "Stream product changes as Server-Sent Events",
+		params: []Parameter{{Name: "Last-Event-ID", In: "header",
+			Description: "resume after this change sequence", Schema: &Schema{Type: "integer"}}},
+		responses: map[int]interface{}{
+			http.StatusOK:         rawContent{"text/event-stream": stringSchema},
+			http.StatusBadRequest: errResponse,
+		},
+	},
+	"GET /v1/barcode/{gtin}": {
+		id: "getProductByBarcode", summary: "Get the product with a barcode",
+		responses: map[int]interface{}{http.StatusOK: catalog.Product{}, http.StatusNotFound: errResponse},
+	},
+	"GET /v1/{sku}": {
+		id: "getProduct", summary: "Get a product",
+		responses: map[int]interface{}{http.StatusOK: catalog.Product{}, http.StatusNotFound: errResponse},
+	},
+	"GET /v1/{sku}/gs1": {
+		id: "getProductGS1", summary: "Download a product as a GS1 trade item document",
+		responses: map[int]interface{}{
+			http.StatusOK:       rawContent{"application/xml": stringSchema},
+			http.StatusNotFound: errResponse,
+		},
+	},
+}
+
+var pathParamPattern = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+// openAPIPath converts a chi route pattern to an OpenAPI path. chi serves
+// sub-router roots with and without the trailing slash, the document uses
+// the form without.
+func openAPIPath(route string) string {
+	path := pathParamPattern.ReplaceAllString(route, "{$1}")
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+// OpenAPI builds the document for the routes registered by ConfigureRouter.
+// It returns an error when a route isn't documented in operations, or an
+// operation no longer has a route.
+func (a *CatalogApi) OpenAPI(serverURL string) (*OpenAPIDoc, error) {
+	r := chi.NewRouter()
+	a.ConfigureRouter(r)
+
+	doc := &OpenAPIDoc{
+		OpenAPI:    openAPIVersion,
+		Info:       OpenAPIInfo{Title: "smfg-catalog", Version: "1"},
+		Paths:      map[string]map[string]*Operation{},
+		Components: OpenAPIComponents{Schemas: map[string]*Schema{}},
+	}
+	if serverURL != "" {
+		doc.Servers = []OpenAPIServer{{URL: serverURL}}
+	}
+
+	routed := map[string]bool{}
+	err := chi.Walk(r, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		path := openAPIPath(route)
+		key := method + " " + path
+		op, ok := operations[key]
+		if !ok {
+			return fmt.Errorf("api: route %s is missing from the openapi operations", key)
+		}
+		routed[key] = true
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*Operation{}
+		}
+		doc.Paths[path][strings.ToLower(method)] = doc.operation(path, op)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for key := range operations {
+		if !routed[key] {
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		return nil, fmt.Errorf("api: openapi operations have no route: %s", strings.Join(stale, ", "))
+	}
+
+	return doc, nil
+}
+
+func (d *OpenAPIDoc) operation(path string, op apiOperation) *Operation {
+	o := &Operation{
+		OperationID: op.id,
+		Summary:     op.summary,
+		Responses:   map[string]*Response{},
+	}
+
+	declared := map[string]bool{}
+	for _, p := range op.params {
+		if p.In == "path" {
+			declared[p.Name] = true
+		}
+	}
+	for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		if !declared[m[1]] {
+			o.Parameters = append(o.Parameters, Parameter{Name: m[1], In: "path", Required: true, Schema: stringSchema})
+		}
+	}
+	o.Parameters = append(o.Parameters, op.params...)
+
+	if op.request != nil {
+		o.RequestBody = &RequestBody{Required: true, Content: d.content(op.request)}
+	}
+	for status, body := range op.responses {
+		resp := &Response{Description: http.StatusText(status)}
+		if body != nil {
+			resp.Content = d.content(body)
+		}
+		o.Responses[fmt.Sprintf("%d", status)] = resp
+	}
+	return o
+}
+
+func (d *OpenAPIDoc) content(body interface{}) map[string]*MediaType {
+	if raw, ok := body.(rawContent); ok {
+		content := map[string]*MediaType{}
+		for contentType, schema := range raw {
+			content[contentType] = &MediaType{Schema: schema}
+		}
+		return content
+	}
+	return map[string]*MediaType{"application/json": {Schema: d.schema(reflect.TypeOf(body))}}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+
+	// enums lists the values of string types that only take a known set.
+	enums = map[reflect.Type][]string{
+		reflect.TypeOf(catalog.PackagingLevel("")): {
+			string(catalog.PackagingEach), string(catalog.PackagingInner), string(catalog.PackagingCase),
+		},
+		reflect.TypeOf(catalog.ChangeType("")): {
+			string(catalog.ChangeCreated), string(catalog.ChangeUpdated), string(catalog.ChangeDeleted),
+		},
+		reflect.TypeOf(catalog.JobStatus("")): {
+			string(catalog.JobQueued), string(catalog.JobRunning), string(catalog.JobCompleted), string(catalog.JobFailed),
+		},
+	}
+)
+
+// schema describes t the way encoding/json would encode it. Named structs
+// are added to the components and referenced.
+func (d *OpenAPIDoc) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := d.Components.Schemas[t.Name()]; !ok {
+			// Registered before the fields are walked so recursive types terminate.
+			s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+			d.Components.Schemas[t.Name()] = s
+			d.addFields(s, t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Struct:
+		s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		d.addFields(s, t)
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string", Enum: enums[t]}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: d.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schema(t.Elem())}
+	}
+	return &Schema{}
+}
+
+// addFields adds the JSON fields of t to s. Embedded structs are flattened
+// into s as encoding/json does.
+func (d *OpenAPIDoc) addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, opts = tag[:idx], tag[idx:]
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			d.addFields(s, ft)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		s.Properties[name] = d.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+func OpenAPIHandler(doc *OpenAPIDoc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, doc)
+	}
+}
@@ -0,0 +1,85 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sksmith/smfg-catalog/api"
+)
+
+// TestOpenAPI fails when a route is added to or removed from ConfigureRouter
+// without its operation being documented.
+func TestOpenAPI(t *testing.T) {
+	doc, err := api.NewCatalogApi(nil).OpenAPI("/api/product")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			if len(op.Responses) == 0 {
+				t.Errorf("%s %s has no responses", method, path)
+			}
+			for _, p := range op.Parameters {
+				if p.In == "path" && !strings.Contains(path, "{"+p.Name+"}") {
+					t.Errorf("%s %s documents path parameter %s it doesn't have", method, path, p.Name)
+				}
+			}
+		}
+	}
+
+	schemas := []struct {
+		name       string
+		properties []string
+	}{
+		{name: "Product", properties: []string{"sku", "name", "barcodes", "dimensions", "weight"}},
+		{name: "CreateProductRequest", properties: []string{"sku", "name", "barcodes"}},
+		{name: "ErrResponse", properties: []string{"status", "code", "error"}},
+		{name: "Barcode", properties: []string{"gtin", "packagingLevel", "quantity", "primary"}},
+	}
+	for _, s := range schemas {
+		schema, ok := doc.Components.Schemas[s.name]
+		if !ok {
+			t.Errorf("schema %s is missing", s.name)
+			continue
+		}
+		for _, p := range s.properties {
+			if _, ok := schema.Properties[p]; !ok {
+				t.Errorf("schema %s is missing property %s", s.name, p)
+			}
+		}
+	}
+
+	// Every reference must resolve.
+	body, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range strings.Split(string(body), `"$ref":"#/components/schemas/`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("reference to unknown schema %s", name)
+		}
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	doc, err := api.NewCatalogApi(nil).OpenAPI("/api/product")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	api.OpenAPIHandler(doc)(w, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+
+	got := map[string]interface{}{}
+	if err = json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got["openapi"] != "3.0.3" {
+		t.Errorf("openapi got=%v want=%s", got["openapi"], "3.0.3")
+	}
+}
@@ -0,0 +1,306 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultRate  = 20
+	DefaultBurst = 40
+
+	// bucketSweepInterval is how often buckets that have refilled, and so
+	// are no different to new ones, are dropped.
+	bucketSweepInterval = time.Minute
+)
+
+var rateLimited *prometheus.CounterVec
+
+// RateLimit allows Rate requests a second on average, and bursts of up to
+// Burst requests.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit reads a limit written as rate:burst, such as 10:20. The
+// burst defaults to the rate, rounded up.
+func ParseRateLimit(s string) (RateLimit, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q must start with a positive rate", s)
+	}
+	l := RateLimit{Rate: rate, Burst: int(math.Ceil(rate))}
+	if len(parts) == 2 {
+		if l.Burst, err = strconv.Atoi(parts[1]); err != nil || l.Burst < 1 {
+			return RateLimit{}, fmt.Errorf("rate limit %q must have a positive burst", s)
+		}
+	}
+	return l, nil
+}
+
+// ParseRateLimits reads limits written as name=rate:burst entries separated
+// by semicolons, for example "/api/product/v1/{sku}=5:10;/api/graphql=5".
+func ParseRateLimits(s string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("rate limit %q is not name=rate:burst", entry)
+		}
+		l, err := ParseRateLimit(entry[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(entry[:i])] = l
+	}
+	return limits, nil
+}
+
+// ParseTrustedProxies reads a comma separated list of proxy addresses or
+// CIDR ranges.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an ip or cidr", entry)
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an ip or cidr", entry)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+// RateLimits configures a RateLimiter. Every client gets its own bucket,
+// sized by Clients or else Default. Routes, keyed by chi route pattern such
+// as /api/product/v1/{sku}, add a separate bucket per client for requests
+// to that route. Requests from TrustedProxies are limited by the address
+// they were forwarded for.
+type RateLimits struct {
+	Default        RateLimit
+	Routes         map[string]RateLimit
+	Clients        map[string]RateLimit
+	TrustedProxies []*net.IPNet
+}
+
+// RateLimiter throttles each client with token buckets. Clients are the
+// authenticated user's subject, or the remote IP for anonymous requests,
+// so it belongs after Authenticate.
+type RateLimiter struct {
+	limits RateLimits
+	now    func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{limits: limits, now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// Handler responds 429, with a Retry-After in seconds, to requests over
+// either the client's limit or its limit for the route. A request only
+// takes a token when both allow it, so one turned away by the client
+// limit leaves the route's tokens alone.
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, kind := l.client(r)
+
+		limit, ok := l.limits.Clients[client]
+		if !ok {
+			limit = l.limits.Default
+		}
+		limits := []routeLimit{{key: client, route: "*", limit: limit}}
+		if route := routePattern(r); route != "" {
+			if limit, ok := l.limits.Routes[route]; ok {
+				limits = append(limits, routeLimit{key: client + " " + route, route: route, limit: limit})
+			}
+		}
+
+		if route, wait, allowed := l.take(limits); !allowed {
+			l.reject(w, r, client, kind, route, wait)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *RateLimiter) reject(w http.ResponseWriter, r *http.Request, client, kind, route string, wait time.Duration) {
+	log.Debug().
+		Str("client", client).
+		Str("route", route).
+		Str("uri", r.RequestURI).
+		Dur("wait", wait).
+		Msg("rate limited")
+	if rateLimited != nil {
+		rateLimited.WithLabelValues(route, kind).Inc()
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	Render(w, r, ErrTooManyRequests)
+}
+
+// routePattern returns the pattern of the route r will be served by, or ""
+// if there is none. The limiter runs before routing has finished, so the
+// route is looked up from the root router.
+func routePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.Routes == nil {
+		return ""
+	}
+	path := r.URL.RawPath
+	if path == "" {
+		path = r.URL.Path
+	}
+	match := chi.NewRouteContext()
+	if !rctx.Routes.Match(match, r.Method, path) {
+		return ""
+	}
+	return match.RoutePattern()
+}
+
+type routeLimit struct {
+	key   string
+	route string
+	limit RateLimit
+}
+
+// take removes a token from each limit's bucket if they all have one, or
+// returns the route of the limit with the longest wait until it will.
+func (l *RateLimiter) take(limits []routeLimit) (string, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= bucketSweepInterval {
+		l.sweep(now)
+	}
+
+	buckets := make([]*bucket, len(limits))
+	var route string
+	var wait time.Duration
+	for i, rl := range limits {
+		b, ok := l.buckets[rl.key]
+		if !ok {
+			b = &bucket{tokens: float64(rl.limit.Burst), updated: now, limit: rl.limit}
+			l.buckets[rl.key] = b
+		}
+		buckets[i] = b
+		if w := b.wait(now); w > wait {
+			route, wait = rl.route, w
+		}
+	}
+	if route != "" {
+		return route, wait, false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return "", 0, true
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate)
+	b.updated = now
+}
+
+// wait returns how long until the bucket has a token, zero if it has one.
+func (b *bucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+func (b *bucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= float64(b.limit.Burst)
+}
+
+// client identifies the caller and whether that is by user or ip. For
+// requests from a trusted proxy the ip is the last one in X-Forwarded-For
+// that isn't another trusted proxy, since anything before it could have
+// been sent by the client.
+func (l *RateLimiter) client(r *http.Request) (string, string) {
+	if user, ok := UserFrom(r.Context()); ok {
+		return user.Subject, "user"
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !l.trusted(host) {
+		return host, "ip"
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		host = addr
+		if !l.trusted(addr) {
+			break
+		}
+	}
+	return host, "ip"
+}
+
+func (l *RateLimiter) trusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range l.limits.TrustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package api_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/smfg-catalog/api"
+)
+
+type limitedRequest struct {
+	path string
+	// forwardedFor is sent as X-Forwarded-For.
+	forwardedFor string
+	// after is how long to wait before sending the request.
+	after time.Duration
+	want  int
+}
+
+func TestRateLimiter(t *testing.T) {
+	localhost, err := api.ParseTrustedProxies("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		limits   api.RateLimits
+		requests []limitedRequest
+	}{
+		{
+			name:   "default",
+			limits: api.RateLimits{Default: api.RateLimit{Rate: 1, Burst: 2}},
+			requests: []limitedRequest{
+				{path: "/fast", want: http.StatusOK},
+				{path: "/fast", want: http.StatusOK},
+				{path: "/fast", want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "route",
+			limits: api.RateLimits{
+				Default: api.RateLimit{Rate: 1, Burst: 5},
+				Routes:  map[string]api.RateLimit{"/slow": {Rate: 1, Burst: 1}},
+			},
+			requests: []limitedRequest{
+				{path: "/slow", want: http.StatusOK},
+				{path: "/slow", want: http.StatusTooManyRequests},
+				{path: "/fast", want: http.StatusOK},
+			},
+		},
+		{
+			name: "route pattern",
+			limits: api.RateLimits{
+				Default: api.RateLimit{Rate: 1, Burst: 5},
+				Routes:  map[string]api.RateLimit{"/v1/{sku}": {Rate: 1, Burst: 1}},
+			},
+			requests: []limitedRequest{
+				{path: "/v1/sku1", want: http.StatusOK},
+				{path: "/v1/sku2", want: http.StatusTooManyRequests},
+				{path: "/v1/sku1/gs1", want: http.StatusOK},
+			},
+		},
+		{
+			name: "client",
+			limits: api.RateLimits{
+				Default: api.RateLimit{Rate: 1, Burst: 1},
+				Clients: map[string]api.RateLimit{"127.0.0.1": {Rate: 1, Burst: 3}},
+			},
+			requests: []limitedRequest{
+				{path: "/fast", want: http.StatusOK},
+				{path: "/fast", want: http.StatusOK},
+				{path: "/fast", want: http.StatusOK},
+				{path: "/fast", want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			// The second request is turned away by the client limit, so
+			// the route still has a token for the third.
+			name: "client limit spares the route",
+			limits: api.RateLimits{
+				Default: api.RateLimit{Rate: 10, Burst: 1},
+				Routes:  map[string]api.RateLimit{"/slow": {Rate: 0.001, Burst: 2}},
+			},
+			requests: []limitedRequest{
+				{path: "/slow", want: http.StatusOK},
+				{path: "/slow", want: http.StatusTooManyRequests},
+				{path: "/slow", after: 150 * time.Millisecond, want: http.StatusOK},
+				{path: "/slow", after: 150 * time.Millisecond, want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "trusted proxy",
+			limits: api.RateLimits{
+				Default:        api.RateLimit{Rate: 1, Burst: 1},
+				TrustedProxies: localhost,
+			},
+			requests: []limitedRequest{
+				{path: "/fast", forwardedFor: "10.0.0.1", want: http.StatusOK},
+				{path: "/fast", forwardedFor: "10.0.0.2", want: http.StatusOK},
+				{path: "/fast", forwardedFor: "10.0.0.9, 10.0.0.1", want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name:   "untrusted proxy",
+			limits: api.RateLimits{Default: api.RateLimit{Rate: 1, Burst: 1}},
+			requests: []limitedRequest{
+				{path: "/fast", forwardedFor: "10.0.0.1", want: http.StatusOK},
+				{path: "/fast", forwardedFor: "10.0.0.2", want: http.StatusTooManyRequests},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Use(api.NewRateLimiter(tt.limits).Handler)
+			ok := func(w http.ResponseWriter, r *http.Request) {}
+			r.Get("/slow", ok)
+			r.Get("/v1/{sku}", ok)
+			r.Get("/v1/{sku}/gs1", ok)
+			r.Get("/*", ok)
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			for i, req := range tt.requests {
+				time.Sleep(req.after)
+				httpReq, err := http.NewRequest(http.MethodGet, ts.URL+req.path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if req.forwardedFor != "" {
+					httpReq.Header.Set("X-Forwarded-For", req.forwardedFor)
+				}
+				res, err := http.DefaultClient.Do(httpReq)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+
+				if res.StatusCode != req.want {
+					t.Errorf("request %d status code got=%d want=%d", i, res.StatusCode, req.want)
+				}
+				if req.want == http.StatusTooManyRequests && res.Header.Get("Retry-After") == "" {
+					t.Errorf("request %d has no Retry-After", i)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := api.ParseRateLimits("/api/product/v1/import=0.5:2; apikey:3=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := limits["/api/product/v1/import"]; got != (api.RateLimit{Rate: 0.5, Burst: 2}) {
+		t.Errorf("import got=%+v", got)
+	}
+	if got := limits["apikey:3"]; got != (api.RateLimit{Rate: 10, Burst: 10}) {
+		t.Errorf("apikey:3 got=%+v", got)
+	}
+
+	for _, s := range []string{"/api", "=5", "/api=0", "/api=5:0", "/api=fast"} {
+		if _, err := api.ParseRateLimits(s); err == nil {
+			t.Errorf("%q got=nil want error", s)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := api.ParseTrustedProxies("10.0.0.1, 192.168.0.0/16,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 3 {
+		t.Fatalf("proxies got=%v want 3", proxies)
+	}
+	for i, ip := range []string{"10.0.0.1", "192.168.4.5", "::1"} {
+		if !proxies[i].Contains(net.ParseIP(ip)) {
+			t.Errorf("%s does not contain %s", proxies[i], ip)
+		}
+	}
+	if proxies[0].Contains(net.ParseIP("10.0.0.2")) {
+		t.Errorf("%s contains 10.0.0.2", proxies[0])
+	}
+
+	if _, err = api.ParseTrustedProxies("10.0.0.300"); err == nil {
+		t.Error("invalid address got=nil want error")
+	}
+}
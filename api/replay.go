@@ -0,0 +1,107 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+const (
+	// DefaultReplayLimit and MaxReplayLimit bound how many products a single
+	// request replays, so that a request finishes in reasonable time. Larger
+	// replays are made by repeating the request with after set to the last
+	// SKU.
+	DefaultReplayLimit = 1000
+	MaxReplayLimit     = 10000
+)
+
+type ReplayApi struct {
+	service catalog.Service
+}
+
+func NewReplayApi(service catalog.Service) *ReplayApi {
+	return &ReplayApi{service: service}
+}
+
+func (a *ReplayApi) ConfigureRouter(r chi.Router) {
+	r.Route("/v1", func(r chi.Router) {
+		r.Use(RequirePermission(auth.PermissionAdmin))
+
+		r.Post("/", a.Replay)
+	})
+}
+
+type ReplayRequest struct {
+	catalog.ReplayTarget
+	Rate      int    `json:"rate,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	After     string `json:"after,omitempty"`
+	SkuPrefix string `json:"skuPrefix,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Gtin      string `json:"gtin,omitempty"`
+}
+
+func (rr *ReplayRequest) Bind(_ *http.Request) error {
+	if rr.Rate < 0 || rr.Limit < 0 {
+		return errors.New("rate and limit can't be negative")
+	}
+	if rr.Limit > MaxReplayLimit {
+		return errors.New("limit is too large")
+	}
+	return nil
+}
+
+// ReplayResponse carries the progress made even when the replay failed, so
+// that it can be resumed.
+type ReplayResponse struct {
+	catalog.ReplayResult
+	Error string `json:"error,omitempty"`
+}
+
+func (rr *ReplayResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func (a *ReplayApi) Replay(w http.ResponseWriter, r *http.Request) {
+	data := &ReplayRequest{}
+	if err := render.Bind(r, data); err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if data.Limit == 0 {
+		data.Limit = DefaultReplayLimit
+	}
+
+	result, err := a.service.ReplayProducts(r.Context(), catalog.ReplayOptions{
+		Filter: catalog.ProductFilter{
+			SkuPrefix: data.SkuPrefix,
+			Name:      data.Name,
+			Gtin:      data.Gtin,
+			AfterSku:  data.After,
+		},
+		Target: data.ReplayTarget,
+		Rate:   data.Rate,
+		Limit:  data.Limit,
+	})
+	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			Render(w, r, ErrForbidden(err))
+			return
+		}
+		if errors.Is(err, catalog.ErrUnknownDestination) {
+			Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+		log.Error().Err(err).Str("lastSku", result.LastSku).Msg("replay failed")
+		render.Status(r, http.StatusBadGateway)
+		Render(w, r, &ReplayResponse{ReplayResult: result, Error: err.Error()})
+		return
+	}
+
+	Render(w, r, &ReplayResponse{ReplayResult: result})
+}
@@ -0,0 +1,146 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/smfg-catalog/api"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+	"github.com/sksmith/smfg-catalog/queue"
+)
+
+func TestReplay(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockRepo.ListProductsFunc = func(ctx context.Context, filter catalog.ProductFilter, limit, offset int, tx ...core.Transaction) ([]catalog.Product, error) {
+		if offset != 0 || len(tx) > 0 {
+			t.Errorf("page got offset=%d tx=%v, want a keyset page outside a transaction", offset, tx)
+		}
+		var products []catalog.Product
+		for i := 1; i <= 5 && len(products) < limit; i++ {
+			sku := fmt.Sprintf("SKU-%d", i)
+			if sku > filter.AfterSku {
+				products = append(products, catalog.Product{Sku: sku, Name: sku})
+			}
+		}
+		return products, nil
+	}
+
+	var published []string
+	failOn := ""
+	mockQueue := queue.NewMockQueue()
+	mockQueue.PublishSnapshotFunc = func(ctx context.Context, product catalog.Product, target catalog.ReplayTarget) error {
+		if target.Exchange != "rebuild" || target.RoutingKey != "warehouse" {
+			t.Errorf("target got=%+v", target)
+		}
+		if product.Sku == failOn {
+			failOn = ""
+			return errors.New("broker unavailable")
+		}
+		published = append(published, product.Sku)
+		return nil
+	}
+
+	r := chi.NewRouter()
+	api.NewReplayApi(catalog.NewService(mockRepo, mockQueue, "product.fanout")).ConfigureRouter(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	replay := func(body string, wantStatus int) catalog.ReplayResult {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/v1", "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != wantStatus {
+			t.Fatalf("status got=%d want=%d", res.StatusCode, wantStatus)
+		}
+		result := catalog.ReplayResult{}
+		if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	got := replay(`{"exchange":"rebuild","routingKey":"warehouse","rate":1000,"limit":2}`, http.StatusOK)
+	if got.Published != 2 || got.LastSku != "SKU-2" || got.Done {
+		t.Errorf("first page got=%+v", got)
+	}
+
+	failOn = "SKU-4"
+	got = replay(`{"exchange":"rebuild","routingKey":"warehouse","rate":1000,"after":"SKU-2"}`, http.StatusBadGateway)
+	if got.Published != 1 || got.LastSku != "SKU-3" || got.Done {
+		t.Errorf("failed page got=%+v", got)
+	}
+
+	got = replay(`{"exchange":"rebuild","routingKey":"warehouse","rate":1000,"after":"SKU-3"}`, http.StatusOK)
+	if got.Published != 2 || got.LastSku != "SKU-5" || !got.Done {
+		t.Errorf("last page got=%+v", got)
+	}
+
+	want := []string{"SKU-1", "SKU-2", "SKU-3", "SKU-4", "SKU-5"}
+	if fmt.Sprint(published) != fmt.Sprint(want) {
+		t.Errorf("published got=%v want=%v", published, want)
+	}
+
+	replay(`{"limit":-1}`, http.StatusBadRequest)
+}
+
+func TestReplayDestination(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockRepo.ListProductsFunc = func(ctx context.Context, filter catalog.ProductFilter, limit, offset int, tx ...core.Transaction) ([]catalog.Product, error) {
+		if filter.AfterSku != "" {
+			return nil, nil
+		}
+		return []catalog.Product{{Sku: "SKU-1", Name: "SKU-1"}}, nil
+	}
+
+	published := map[string]int{}
+	destination := func(name string) catalog.Destination {
+		q := queue.NewMockQueue()
+		q.PublishSnapshotFunc = func(ctx context.Context, product catalog.Product, target catalog.ReplayTarget) error {
+			published[name]++
+			return nil
+		}
+		return catalog.Destination{Name: name, Queue: q}
+	}
+	q := queue.NewFanout(destination("rabbitmq"), destination("kafka"))
+
+	r := chi.NewRouter()
+	api.NewReplayApi(catalog.NewService(mockRepo, q, "product.fanout")).ConfigureRouter(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		body   string
+		status int
+		want   map[string]int
+	}{
+		{`{"destination":"kafka","topic":"rebuild"}`, http.StatusOK, map[string]int{"kafka": 1}},
+		{`{"destination":"nats"}`, http.StatusBadRequest, map[string]int{}},
+		{`{"exchange":"rebuild"}`, http.StatusBadRequest, map[string]int{}},
+	}
+	for _, tt := range tests {
+		published = map[string]int{}
+		res, err := http.Post(ts.URL+"/v1", "application/json", bytes.NewBufferString(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.status {
+			t.Errorf("%s status got=%d want=%d", tt.body, res.StatusCode, tt.status)
+		}
+		if fmt.Sprint(published) != fmt.Sprint(tt.want) {
+			t.Errorf("%s published got=%v want=%v", tt.body, published, tt.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/webhook"
+)
+
+type WebhookApi struct {
+	service webhook.Service
+}
+
+func NewWebhookApi(service webhook.Service) *WebhookApi {
+	return &WebhookApi{service: service}
+}
+
+func (a *WebhookApi) ConfigureRouter(r chi.Router) {
+	r.Route("/v1", func(r chi.Router) {
+		r.Use(RequirePermission(auth.PermissionAdmin))
+
+		r.Get("/", a.List)
+		r.Post("/", a.Create)
+
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", a.Get)
+			r.Put("/", a.Update)
+			r.Delete("/", a.Delete)
+			r.With(Paginate).Get("/deliveries", a.ListDeliveries)
+		})
+	})
+}
+
+// SubscriptionResponse leaves out the secret, which is only returned when
+// the subscription is created.
+type SubscriptionResponse struct {
+	webhook.Subscription
+}
+
+func NewSubscriptionResponse(sub webhook.Subscription, withSecret bool) *SubscriptionResponse {
+	if !withSecret {
+		sub.Secret = ""
+	}
+	return &SubscriptionResponse{Subscription: sub}
+}
+
+func (rd *SubscriptionResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+type SubscriptionRequest struct {
+	*webhook.Subscription
+}
+
+func (s *SubscriptionRequest) Bind(_ *http.Request) error {
+	if s.Subscription == nil {
+		return errors.New("missing required field(s)")
+	}
+	return s.Validate()
+}
+
+type DeliveryResponse struct {
+	webhook.Delivery
+}
+
+func (rd *DeliveryResponse) Render(_ http.ResponseWriter, _ *http.Request) error {
+	return nil
+}
+
+func (a *WebhookApi) Create(w http.ResponseWriter, r *http.Request) {
+	data := &SubscriptionRequest{}
+	if err := render.Bind(r, data); err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	sub, err := a.service.CreateSubscription(r.Context(), *data.Subscription)
+	if err != nil {
+		if errors.Is(err, webhook.ErrInvalidSubscription) {
+			Render(w, r, ErrInvalidRequest(err))
+		} else {
+			log.Error().Err(err).Msg("error creating webhook subscription")
+			Render(w, r, ErrInternalServer)
+		}
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	Render(w, r, NewSubscriptionResponse(sub, true))
+}
+
+func (a *WebhookApi) List(w http.ResponseWriter, r *http.Request) {
+	subs, err := a.service.ListSubscriptions(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("error listing webhook subscriptions")
+		Render(w, r, ErrInternalServer)
+		return
+	}
+
+	resp := make([]render.Renderer, 0, len(subs))
+	for _, s := range subs {
+		resp = append(resp, NewSubscriptionResponse(s, false))
+	}
+	RenderList(w, r, resp)
+}
+
+func (a *WebhookApi) Get(w http.ResponseWriter, r *http.Request) {
+	id, ok := subscriptionID(w, r)
+	if !ok {
+		return
+	}
+
+	sub, err := a.service.GetSubscription(r.Context(), id)
+	if err != nil {
+		renderSubscriptionError(w, r, err, id)
+		return
+	}
+	Render(w, r, NewSubscriptionResponse(sub, false))
+}
+
+// Update replaces the subscription's url, event types and active flag. The
+// secret is kept unless a new one is given; setting active re-enables a
+// subscription that was disabled for failing.
+func (a *WebhookApi) Update(w http.ResponseWriter, r *http.Request) {
+	id, ok := subscriptionID(w, r)
+	if !ok {
+		return
+	}
+
+	data := &SubscriptionRequest{}
+	if err := render.Bind(r, data); err != nil {
+		Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	data.ID = id
+
+	sub, err := a.service.UpdateSubscription(r.Context(), *data.Subscription)
+	if err != nil {
+		renderSubscriptionError(w, r, err, id)
+		return
+	}
+	Render(w, r, NewSubscriptionResponse(sub, false))
+}
+
+func (a *WebhookApi) Delete(w http.ResponseWriter, r *http.Request) {
+	id, ok := subscriptionID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.service.DeleteSubscription(r.Context(), id); err != nil {
+		renderSubscriptionError(w, r, err, id)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListDeliveries returns the subscription's delivery log, newest first.
+func (a *WebhookApi) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := subscriptionID(w, r)
+	if !ok {
+		return
+	}
+	limit := r.Context().Value(CtxKeyLimit).(int)
+	offset := r.Context().Value(CtxKeyOffset).(int)
+
+	deliveries, err := a.service.ListDeliveries(r.Context(), id, limit, offset)
+	if err != nil {
+		renderSubscriptionError(w, r, err, id)
+		return
+	}
+
+	resp := make([]render.Renderer, 0, len(deliveries))
+	for _, d := range deliveries {
+		resp = append(resp, &DeliveryResponse{Delivery: d})
+	}
+	RenderList(w, r, resp)
+}
+
+func subscriptionID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		Render(w, r, ErrInvalidRequest(errors.New("id must be a number")))
+		return 0, false
+	}
+	return id, true
+}
+
+func renderSubscriptionError(w http.ResponseWriter, r *http.Request, err error, id int64) {
+	switch {
+	case errors.Is(err, core.ErrNotFound):
+		Render(w, r, ErrNotFound)
+	case errors.Is(err, webhook.ErrInvalidSubscription):
+		Render(w, r, ErrInvalidRequest(err))
+	default:
+		log.Error().Err(err).Int64("id", id).Msg("error handling webhook subscription")
+		Render(w, r, ErrInternalServer)
+	}
+}
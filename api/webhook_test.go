@@ -0,0 +1,207 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/sksmith/smfg-catalog/api"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/core/webhook"
+	"github.com/sksmith/smfg-catalog/db"
+	"github.com/sksmith/smfg-catalog/queue"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	const secret = "s3cret"
+
+	// The receiver fails the first attempt and accepts the retry.
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, r)
+		bodies = append(bodies, body)
+		n := len(received)
+		mu.Unlock()
+		if n == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	catalogRepo := db.NewMockRepo()
+	catalogRepo.GetChangesFunc = func(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]catalog.Change, error) {
+		if since > 0 {
+			return []catalog.Change{}, nil
+		}
+		p := testProducts[0]
+		return []catalog.Change{
+			{Seq: 1, Type: catalog.ChangeDeleted, Sku: "other"},
+			{Seq: 2, Type: catalog.ChangeCreated, Sku: p.Sku, Product: &p, Time: time.Now()},
+		}, nil
+	}
+	catalogService := catalog.NewService(catalogRepo, queue.NewMockQueue(), "product.fanout")
+
+	repo := db.NewMockWebhookRepo()
+	var sub webhook.Subscription
+	var deliveries []webhook.Delivery
+	var updates []webhook.Delivery
+	var attempts []bool
+	var cursor int64
+	repo.SaveSubscriptionFunc = func(ctx context.Context, s webhook.Subscription, tx ...core.Transaction) (webhook.Subscription, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		s.ID = 7
+		sub = s
+		return s, nil
+	}
+	repo.ListSubscriptionsFunc = func(ctx context.Context, tx ...core.Transaction) ([]webhook.Subscription, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if sub.ID == 0 {
+			return []webhook.Subscription{}, nil
+		}
+		return []webhook.Subscription{sub}, nil
+	}
+	repo.LockDispatchCursorFunc = func(ctx context.Context, tx core.Transaction) (int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return cursor, nil
+	}
+	repo.SaveDispatchCursorFunc = func(ctx context.Context, seq int64, tx core.Transaction) error {
+		mu.Lock()
+		defer mu.Unlock()
+		cursor = seq
+		return nil
+	}
+	repo.CreateDeliveryFunc = func(ctx context.Context, d webhook.Delivery, tx ...core.Transaction) (webhook.Delivery, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		d.ID = int64(len(deliveries) + 1)
+		deliveries = append(deliveries, d)
+		return d, nil
+	}
+	repo.ClaimDeliveryFunc = func(ctx context.Context, lease time.Duration) (webhook.Delivery, webhook.Subscription, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, d := range deliveries {
+			if d.Status == webhook.DeliveryPending {
+				// Due immediately, rather than after the backoff, to keep the test fast.
+				deliveries[i].Attempts++
+				return deliveries[i], sub, nil
+			}
+		}
+		return webhook.Delivery{}, webhook.Subscription{}, core.ErrNotFound
+	}
+	repo.UpdateDeliveryFunc = func(ctx context.Context, d webhook.Delivery, tx ...core.Transaction) error {
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries[d.ID-1] = d
+		updates = append(updates, d)
+		return nil
+	}
+	repo.RecordAttemptFunc = func(ctx context.Context, id int64, succeeded bool, disableAfter int, tx ...core.Transaction) (webhook.Subscription, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, succeeded)
+		return sub, nil
+	}
+
+	service := webhook.NewService(repo, catalogService, receiver.Client())
+	r := chi.NewRouter()
+	api.NewWebhookApi(service).ConfigureRouter(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	data, _ := json.Marshal(webhook.Subscription{
+		URL: receiver.URL, EventTypes: []webhook.EventType{webhook.EventProductCreated}, Secret: secret,
+	})
+	res, err := http.Post(ts.URL+"/v1", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status code got=%d want=%d", res.StatusCode, http.StatusCreated)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	service.StartWorkers(ctx, 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := len(attempts) == 2
+		mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for delivery")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(deliveries) != 1 || deliveries[0].Seq != 2 {
+		t.Fatalf("deliveries got=%+v want only the created event", deliveries)
+	}
+	if cursor != 2 {
+		t.Errorf("cursor got=%d want=2", cursor)
+	}
+
+	for i, req := range received {
+		if got, want := req.Header.Get(webhook.SignatureHeader), webhook.Sign(secret, bodies[i]); got != want {
+			t.Errorf("signature got=%s want=%s", got, want)
+		}
+		if got := req.Header.Get(webhook.EventHeader); got != string(webhook.EventProductCreated) {
+			t.Errorf("event got=%s want=%s", got, webhook.EventProductCreated)
+		}
+	}
+	if !bytes.Equal(bodies[0], bodies[1]) {
+		t.Error("retry body differs from the first attempt")
+	}
+
+	first, last := updates[0], updates[1]
+	if first.Status != webhook.DeliveryPending || first.ResponseStatus != http.StatusInternalServerError ||
+		first.NextAttemptAt == nil || time.Until(*first.NextAttemptAt) < webhook.BaseBackoff-time.Second {
+		t.Errorf("failed attempt got=%+v want pending with a backoff", first)
+	}
+	if last.Status != webhook.DeliverySucceeded || last.Attempts != 2 || last.DeliveredAt == nil {
+		t.Errorf("retry got=%+v want succeeded on attempt 2", last)
+	}
+	if len(attempts) != 2 || attempts[0] || !attempts[1] {
+		t.Errorf("recorded attempts got=%v want=[false true]", attempts)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, webhook.BaseBackoff},
+		{2, 2 * webhook.BaseBackoff},
+		{4, 8 * webhook.BaseBackoff},
+		{20, webhook.MaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := webhook.Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) got=%s want=%s", tt.attempts, got, tt.want)
+		}
+	}
+}
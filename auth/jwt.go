@@ -0,0 +1,172 @@
+// Package auth verifies the bearer tokens presented to the catalog's APIs.
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidToken  = errors.New("auth: invalid token")
+	ErrNoKeys        = errors.New("auth: no token signing keys configured")
+	ErrInvalidJWKSet = errors.New("auth: invalid jwk set")
+)
+
+// User is the authenticated caller: the token's subject and all of its
+// claims, and the permissions its roles grant.
+type User struct {
+	Subject     string                 `json:"sub"`
+	Claims      map[string]interface{} `json:"claims"`
+	Permissions []Permission           `json:"permissions"`
+}
+
+type Config struct {
+	// HS256Secret verifies HS256 tokens, which are not accepted without it.
+	HS256Secret string
+	// JWKSFile is a JSON Web Key Set whose RSA keys verify RS256 tokens,
+	// which are not accepted without it.
+	JWKSFile string
+	// Issuer and Audience, when set, must match the token's iss and aud.
+	Issuer   string
+	Audience string
+	// RolesClaim names the claim listing the token's roles, DefaultRolesClaim
+	// when empty, and Roles maps them to permissions, DefaultRoles when nil.
+	RolesClaim string
+	Roles      map[string][]Permission
+}
+
+// Verifier checks a token's signature and expiry and returns its user.
+type Verifier struct {
+	config  Config
+	rsaKeys map[string]*rsa.PublicKey
+	methods []string
+}
+
+func NewVerifier(config Config) (*Verifier, error) {
+	if config.RolesClaim == "" {
+		config.RolesClaim = DefaultRolesClaim
+	}
+	if config.Roles == nil {
+		config.Roles = DefaultRoles
+	}
+	v := &Verifier{config: config}
+	if config.HS256Secret != "" {
+		v.methods = append(v.methods, jwt.SigningMethodHS256.Alg())
+	}
+	if config.JWKSFile != "" {
+		data, err := ioutil.ReadFile(config.JWKSFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if v.rsaKeys, err = ParseJWKS(data); err != nil {
+			return nil, err
+		}
+		v.methods = append(v.methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(v.methods) == 0 {
+		return nil, ErrNoKeys
+	}
+	return v, nil
+}
+
+// Verify returns the user of a signed, unexpired token. Tokens must carry a
+// subject and an expiry.
+func (v *Verifier) Verify(token string) (User, error) {
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: v.methods}
+	if _, err := parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return User{}, errors.Wrap(ErrInvalidToken, err.Error())
+	}
+
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return User{}, errors.Wrap(ErrInvalidToken, "token has no expiry")
+	}
+	if v.config.Issuer != "" && !claims.VerifyIssuer(v.config.Issuer, true) {
+		return User{}, errors.Wrap(ErrInvalidToken, "unexpected issuer")
+	}
+	if v.config.Audience != "" && !claims.VerifyAudience(v.config.Audience, true) {
+		return User{}, errors.Wrap(ErrInvalidToken, "unexpected audience")
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return User{}, errors.Wrap(ErrInvalidToken, "token has no subject")
+	}
+	return User{
+		Subject:     sub,
+		Claims:      claims,
+		Permissions: permissions(claims, v.config.RolesClaim, v.config.Roles),
+	}, nil
+}
+
+func (v *Verifier) key(t *jwt.Token) (interface{}, error) {
+	switch t.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		return []byte(v.config.HS256Secret), nil
+	case jwt.SigningMethodRS256.Alg():
+		kid, _ := t.Header["kid"].(string)
+		if key, ok := v.rsaKeys[kid]; ok {
+			return key, nil
+		}
+		// A token without a kid can only mean the one key there is.
+		if kid == "" && len(v.rsaKeys) == 1 {
+			for _, key := range v.rsaKeys {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ParseJWKS returns the RSA signing keys of a JSON Web Key Set by key id.
+// Keys of other types, or for encryption, are skipped.
+func ParseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrap(ErrInvalidJWKSet, err.Error())
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != "RS256") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidJWKSet, "key %q modulus: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.Wrapf(ErrInvalidJWKSet, "key %q exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.Wrap(ErrInvalidJWKSet, "no RS256 signing keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,134 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sksmith/smfg-catalog/auth"
+)
+
+func writeJWKS(t *testing.T, kid string, key *rsa.PublicKey) string {
+	set := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err = ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := auth.NewVerifier(auth.Config{
+		HS256Secret: "secret",
+		JWKSFile:    writeJWKS(t, "k1", &rsaKey.PublicKey),
+		Issuer:      "https://idp.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":   "engineer",
+			"iss":   "https://idp.example.com",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"roles": []string{"catalog-editor"},
+		}
+	}
+	with := func(k string, val interface{}) jwt.MapClaims {
+		c := valid()
+		if val == nil {
+			delete(c, k)
+		} else {
+			c[k] = val
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"hs256", sign(t, jwt.SigningMethodHS256, []byte("secret"), "", valid()), true},
+		{"rs256", sign(t, jwt.SigningMethodRS256, rsaKey, "k1", valid()), true},
+		{"rs256 without kid", sign(t, jwt.SigningMethodRS256, rsaKey, "", valid()), true},
+		{"wrong secret", sign(t, jwt.SigningMethodHS256, []byte("guess"), "", valid()), false},
+		{"unknown key", sign(t, jwt.SigningMethodRS256, otherKey, "k1", valid()), false},
+		{"unknown kid", sign(t, jwt.SigningMethodRS256, rsaKey, "k2", valid()), false},
+		{"hs384", sign(t, jwt.SigningMethodHS384, []byte("secret"), "", valid()), false},
+		{"none", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", valid()), false},
+		{"expired", sign(t, jwt.SigningMethodHS256, []byte("secret"), "",
+			with("exp", time.Now().Add(-time.Minute).Unix())), false},
+		{"no expiry", sign(t, jwt.SigningMethodHS256, []byte("secret"), "", with("exp", nil)), false},
+		{"no subject", sign(t, jwt.SigningMethodHS256, []byte("secret"), "", with("sub", nil)), false},
+		{"wrong issuer", sign(t, jwt.SigningMethodHS256, []byte("secret"), "", with("iss", "https://evil")), false},
+		{"garbage", "not.a.token", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := v.Verify(tt.token)
+			if !tt.valid {
+				if !errors.Is(err, auth.ErrInvalidToken) {
+					t.Errorf("err got=%v want=%v", err, auth.ErrInvalidToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Subject != "engineer" {
+				t.Errorf("subject got=%s want=engineer", user.Subject)
+			}
+			if _, ok := user.Claims["roles"]; !ok {
+				t.Error("claims are missing roles")
+			}
+		})
+	}
+}
+
+func TestNewVerifierNoKeys(t *testing.T) {
+	if _, err := auth.NewVerifier(auth.Config{}); !errors.Is(err, auth.ErrNoKeys) {
+		t.Errorf("err got=%v want=%v", err, auth.ErrNoKeys)
+	}
+}
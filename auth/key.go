@@ -0,0 +1,12 @@
+package auth
+
+import "context"
+
+// KeyHeader carries an API key, for clients that can't obtain tokens.
+const KeyHeader = "X-API-Key"
+
+// KeyVerifier checks an API key and returns the user it acts as. Invalid,
+// expired and revoked keys are ErrInvalidToken.
+type KeyVerifier interface {
+	VerifyKey(ctx context.Context, key string) (User, error)
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrUnauthenticated = errors.New("auth: authentication required")
+	ErrForbidden       = errors.New("auth: permission denied")
+)
+
+// Permission grants a kind of access to the catalog. Each implies the ones
+// before it: admin can write, and write can read.
+type Permission string
+
+const (
+	PermissionRead  Permission = "catalog:read"
+	PermissionWrite Permission = "catalog:write"
+	PermissionAdmin Permission = "catalog:admin"
+)
+
+var permissionLevels = map[Permission]int{PermissionRead: 1, PermissionWrite: 2, PermissionAdmin: 3}
+
+// Valid reports whether p is one of the catalog's permissions.
+func (p Permission) Valid() bool {
+	_, ok := permissionLevels[p]
+	return ok
+}
+
+// DefaultRolesClaim is the claim holding the token's roles.
+const DefaultRolesClaim = "roles"
+
+// DefaultRoles maps token roles to permissions. A role named after a
+// permission, such as catalog:write, always grants it.
+var DefaultRoles = map[string][]Permission{
+	"catalog-reader":   {PermissionRead},
+	"product-engineer": {PermissionWrite},
+	"catalog-admin":    {PermissionAdmin},
+}
+
+// Can reports whether the user has the permission, directly or through a
+// higher one.
+func (u User) Can(p Permission) bool {
+	for _, has := range u.Permissions {
+		if permissionLevels[has] >= permissionLevels[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// permissions collects what the token's roles and scope grant.
+func permissions(claims map[string]interface{}, rolesClaim string, roles map[string][]Permission) []Permission {
+	var names []string
+	switch v := claims[rolesClaim].(type) {
+	case []interface{}:
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				names = append(names, s)
+			}
+		}
+	case string:
+		names = append(names, strings.Fields(v)...)
+	}
+	if scope, ok := claims["scope"].(string); ok {
+		names = append(names, strings.Fields(scope)...)
+	}
+
+	seen := make(map[Permission]bool)
+	var perms []Permission
+	add := func(p Permission) {
+		if !seen[p] {
+			seen[p] = true
+			perms = append(perms, p)
+		}
+	}
+	for _, name := range names {
+		if _, ok := permissionLevels[Permission(name)]; ok {
+			add(Permission(name))
+		}
+		for _, p := range roles[name] {
+			add(p)
+		}
+	}
+	return perms
+}
+
+type ctxKey struct{}
+
+// NewContext returns a context carrying the authenticated user, for
+// services to check permissions against.
+func NewContext(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, ctxKey{}, u)
+}
+
+func FromContext(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(ctxKey{}).(User)
+	return u, ok
+}
+
+// System is the user background workers act as. It isn't given to any
+// caller of an API, workers opt in to it explicitly with NewContext.
+var System = User{Subject: "system", Permissions: []Permission{PermissionAdmin}}
+
+var enabled int32
+
+// SetEnabled turns authentication on or off for the process. It is off by
+// default, for deployments that don't authenticate their callers at all.
+func SetEnabled(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&enabled, v)
+}
+
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+// Require returns ErrForbidden if the context's user lacks the permission.
+// A context without a user is only allowed while authentication is turned
+// off, otherwise it gets ErrUnauthenticated. Callers that aren't
+// authenticated by an API, such as background workers, act as System.
+func Require(ctx context.Context, p Permission) error {
+	u, ok := FromContext(ctx)
+	if !ok {
+		if Enabled() {
+			return errors.Wrapf(ErrUnauthenticated, "%s requires a user", p)
+		}
+		return nil
+	}
+	if u.Can(p) {
+		return nil
+	}
+	return errors.Wrapf(ErrForbidden, "%s requires %s", u.Subject, p)
+}
+
+// ParseRoles reads a role mapping written as role=permission,permission
+// entries separated by semicolons, for example
+// "viewer=catalog:read;engineer=catalog:write".
+func ParseRoles(s string) (map[string][]Permission, error) {
+	roles := make(map[string][]Permission)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		role := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || role == "" {
+			return nil, errors.Errorf("auth: role mapping %q is not role=permission", entry)
+		}
+		for _, p := range strings.Split(parts[1], ",") {
+			perm := Permission(strings.TrimSpace(p))
+			if _, ok := permissionLevels[perm]; !ok {
+				return nil, errors.Errorf("auth: unknown permission %q for role %s", perm, role)
+			}
+			roles[role] = append(roles[role], perm)
+		}
+	}
+	return roles, nil
+}
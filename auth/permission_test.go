@@ -0,0 +1,105 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sksmith/smfg-catalog/auth"
+)
+
+func TestPermissions(t *testing.T) {
+	v, err := auth.NewVerifier(auth.Config{HS256Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		roles interface{}
+		scope string
+		read  bool
+		write bool
+		admin bool
+	}{
+		{"no roles", nil, "", false, false, false},
+		{"reader", []string{"catalog-reader"}, "", true, false, false},
+		{"engineer", []string{"catalog-reader", "product-engineer"}, "", true, true, false},
+		{"admin", []string{"catalog-admin"}, "", true, true, true},
+		{"roles as string", "product-engineer", "", true, true, false},
+		{"permission as role", []string{"catalog:write"}, "", true, true, false},
+		{"scope", nil, "openid catalog:read", true, false, false},
+		{"unknown role", []string{"catalog-editor"}, "", false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"sub": "user", "exp": time.Now().Add(time.Hour).Unix()}
+			if tt.roles != nil {
+				claims["roles"] = tt.roles
+			}
+			if tt.scope != "" {
+				claims["scope"] = tt.scope
+			}
+			user, err := v.Verify(sign(t, jwt.SigningMethodHS256, []byte("secret"), "", claims))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for p, want := range map[auth.Permission]bool{
+				auth.PermissionRead:  tt.read,
+				auth.PermissionWrite: tt.write,
+				auth.PermissionAdmin: tt.admin,
+			} {
+				if got := user.Can(p); got != want {
+					t.Errorf("can %s got=%v want=%v", p, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequire(t *testing.T) {
+	if err := auth.Require(context.Background(), auth.PermissionAdmin); err != nil {
+		t.Errorf("no user got=%v want=nil", err)
+	}
+
+	ctx := auth.NewContext(context.Background(), auth.User{
+		Subject:     "reader",
+		Permissions: []auth.Permission{auth.PermissionRead},
+	})
+	if err := auth.Require(ctx, auth.PermissionRead); err != nil {
+		t.Errorf("read got=%v want=nil", err)
+	}
+	if err := auth.Require(ctx, auth.PermissionWrite); !errors.Is(err, auth.ErrForbidden) {
+		t.Errorf("write got=%v want=%v", err, auth.ErrForbidden)
+	}
+
+	auth.SetEnabled(true)
+	defer auth.SetEnabled(false)
+	if err := auth.Require(context.Background(), auth.PermissionRead); !errors.Is(err, auth.ErrUnauthenticated) {
+		t.Errorf("enabled, no user got=%v want=%v", err, auth.ErrUnauthenticated)
+	}
+	system := auth.NewContext(context.Background(), auth.System)
+	if err := auth.Require(system, auth.PermissionAdmin); err != nil {
+		t.Errorf("enabled, system got=%v want=nil", err)
+	}
+}
+
+func TestParseRoles(t *testing.T) {
+	roles, err := auth.ParseRoles("viewer=catalog:read; engineer=catalog:read,catalog:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles["viewer"]) != 1 || len(roles["engineer"]) != 2 {
+		t.Errorf("roles got=%v", roles)
+	}
+
+	for _, s := range []string{"viewer", "=catalog:read", "viewer=catalog:delete"} {
+		if _, err := auth.ParseRoles(s); err == nil {
+			t.Errorf("%q got=nil want error", s)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// Package cache keeps recently read products in memory in front of the
+// catalog's repository.
+package cache
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+const (
+	DefaultSize        = 10000
+	DefaultTTL         = 5 * time.Minute
+	DefaultNegativeTTL = 30 * time.Second
+	DefaultFallbackTTL = 15 * time.Second
+)
+
+var (
+	cacheHits   *prometheus.CounterVec
+	cacheMisses *prometheus.CounterVec
+)
+
+func ConfigureMetrics() {
+	cacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "product_cache_hit_count",
+			Help: "Number of product lookups answered from the cache",
+		},
+		[]string{"func"},
+	)
+	cacheMisses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "product_cache_miss_count",
+			Help: "Number of product lookups that went to the database",
+		},
+		[]string{"func"},
+	)
+
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(cacheMisses)
+}
+
+type Config struct {
+	// Size is the most SKUs kept, found or not.
+	Size int
+	// TTL is how long a product is kept, and NegativeTTL how long a SKU
+	// without a product is remembered as not found.
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	// FallbackTTL replaces both while the cache is told it may be missing
+	// invalidations, see SetFallback.
+	FallbackTTL time.Duration
+}
+
+// ProductRepo is a catalog.Repository that answers GetProduct and
+// GetProducts from an LRU cache, and passes everything else through.
+// Saving or deleting a product evicts it, and evicts it again when the
+// transaction it was written in ends, so that a read racing the write
+// can't leave the old product cached. Reads in a transaction bypass the
+// cache, since they may need to see the transaction's own writes.
+type ProductRepo struct {
+	catalog.Repository
+	config Config
+	cache  *lru.Cache
+	// version changes on every eviction. A product read from the database is
+	// only cached if no eviction happened while it was being read.
+	version  uint64
+	fallback int32
+	now      func() time.Time
+}
+
+type entry struct {
+	product catalog.Product
+	found   bool
+	added   time.Time
+}
+
+func NewProductRepo(repo catalog.Repository, config Config) (*ProductRepo, error) {
+	if config.Size <= 0 {
+		config.Size = DefaultSize
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultTTL
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = DefaultNegativeTTL
+	}
+	if config.FallbackTTL <= 0 {
+		config.FallbackTTL = DefaultFallbackTTL
+	}
+
+	c, err := lru.New(config.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &ProductRepo{Repository: repo, config: config, cache: c, now: time.Now}, nil
+}
+
+func (r *ProductRepo) GetProduct(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error) {
+	if len(tx) > 0 {
+		return r.Repository.GetProduct(ctx, sku, tx...)
+	}
+
+	if e, ok := r.get(sku); ok {
+		hit("GetProduct")
+		if !e.found {
+			return catalog.Product{}, core.ErrNotFound
+		}
+		return e.product, nil
+	}
+	miss("GetProduct")
+
+	version := atomic.LoadUint64(&r.version)
+	product, err := r.Repository.GetProduct(ctx, sku)
+	switch {
+	case err == nil:
+		r.put(version, sku, product, true)
+	case errors.Is(err, core.ErrNotFound):
+		r.put(version, sku, catalog.Product{}, false)
+	}
+	return product, err
+}
+
+// GetProducts returns the cached products and fetches the rest in one call,
+// keeping the repository's SKU order.
+func (r *ProductRepo) GetProducts(ctx context.Context, skus []string, tx ...core.Transaction) ([]catalog.Product, error) {
+	if len(tx) > 0 {
+		return r.Repository.GetProducts(ctx, skus, tx...)
+	}
+
+	found := make(map[string]catalog.Product, len(skus))
+	var missing []string
+	for _, sku := range skus {
+		if e, ok := r.get(sku); ok {
+			if e.found {
+				found[sku] = e.product
+			}
+			continue
+		}
+		missing = append(missing, sku)
+	}
+
+	hits := len(skus) - len(missing)
+	if cacheHits != nil {
+		cacheHits.WithLabelValues("GetProducts").Add(float64(hits))
+		cacheMisses.WithLabelValues("GetProducts").Add(float64(len(missing)))
+	}
+
+	if len(missing) > 0 {
+		version := atomic.LoadUint64(&r.version)
+		products, err := r.Repository.GetProducts(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+
+		fetched := make(map[string]bool, len(products))
+		for _, p := range products {
+			found[p.Sku] = p
+			fetched[p.Sku] = true
+			r.put(version, p.Sku, p, true)
+		}
+		for _, sku := range missing {
+			if !fetched[sku] {
+				r.put(version, sku, catalog.Product{}, false)
+			}
+		}
+	}
+
+	products := make([]catalog.Product, 0, len(found))
+	for _, p := range found {
+		products = append(products, p)
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].Sku < products[j].Sku })
+	return products, nil
+}
+
+func (r *ProductRepo) SaveProduct(ctx context.Context, product catalog.Product, tx ...core.Transaction) error {
+	r.Invalidate(product.Sku)
+	err := r.Repository.SaveProduct(ctx, product, tx...)
+	r.invalidateOnEnd(product.Sku, tx)
+	return err
+}
+
+func (r *ProductRepo) DeleteProduct(ctx context.Context, sku string, tx ...core.Transaction) error {
+	r.Invalidate(sku)
+	err := r.Repository.DeleteProduct(ctx, sku, tx...)
+	r.invalidateOnEnd(sku, tx)
+	return err
+}
+
+// BeginTransaction wraps the transaction so that writes made in it can be
+// evicted again once it ends.
+func (r *ProductRepo) BeginTransaction(ctx context.Context) (core.Transaction, error) {
+	tx, err := r.Repository.BeginTransaction(ctx)
+	if err != nil {
+		return tx, err
+	}
+	return &transaction{Transaction: tx, repo: r}, nil
+}
+
+// Invalidate evicts the SKUs, found or not.
+func (r *ProductRepo) Invalidate(skus ...string) {
+	atomic.AddUint64(&r.version, 1)
+	for _, sku := range skus {
+		r.cache.Remove(sku)
+	}
+}
+
+// Purge evicts everything.
+func (r *ProductRepo) Purge() {
+	atomic.AddUint64(&r.version, 1)
+	r.cache.Purge()
+}
+
+// SetFallback turns the fallback TTL on, for when writes made by other
+// instances may not be invalidated, or back off. It applies to products
+// already cached as well as new ones.
+func (r *ProductRepo) SetFallback(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&r.fallback, v)
+}
+
+func (r *ProductRepo) ttl(found bool) time.Duration {
+	ttl := r.config.TTL
+	if !found {
+		ttl = r.config.NegativeTTL
+	}
+	if atomic.LoadInt32(&r.fallback) == 1 && r.config.FallbackTTL < ttl {
+		ttl = r.config.FallbackTTL
+	}
+	return ttl
+}
+
+func (r *ProductRepo) get(sku string) (entry, bool) {
+	v, ok := r.cache.Get(sku)
+	if !ok {
+		return entry{}, false
+	}
+	e := v.(entry)
+	if r.now().Sub(e.added) > r.ttl(e.found) {
+		r.cache.Remove(sku)
+		return entry{}, false
+	}
+	e.product = clone(e.product)
+	return e, true
+}
+
+func (r *ProductRepo) put(version uint64, sku string, product catalog.Product, found bool) {
+	if atomic.LoadUint64(&r.version) != version {
+		return
+	}
+	r.cache.Add(sku, entry{product: clone(product), found: found, added: r.now()})
+}
+
+// clone copies what product refers to, so that a caller changing the
+// product it was given can't change the cached one.
+func clone(product catalog.Product) catalog.Product {
+	if product.Dimensions != nil {
+		d := *product.Dimensions
+		product.Dimensions = &d
+	}
+	if product.Weight != nil {
+		w := *product.Weight
+		product.Weight = &w
+	}
+	if product.Barcodes != nil {
+		barcodes := make([]catalog.Barcode, len(product.Barcodes))
+		copy(barcodes, product.Barcodes)
+		product.Barcodes = barcodes
+	}
+	return product
+}
+
+func (r *ProductRepo) invalidateOnEnd(sku string, tx []core.Transaction) {
+	if len(tx) == 0 {
+		return
+	}
+	if t, ok := tx[0].(*transaction); ok {
+		t.written(sku)
+	}
+}
+
+// transaction evicts the SKUs written in it once more when it ends.
+type transaction struct {
+	core.Transaction
+	repo *ProductRepo
+
+	mu   sync.Mutex
+	skus []string
+}
+
+func (t *transaction) written(sku string) {
+	t.mu.Lock()
+	t.skus = append(t.skus, sku)
+	t.mu.Unlock()
+}
+
+func (t *transaction) Commit(ctx context.Context) error {
+	defer t.end()
+	return t.Transaction.Commit(ctx)
+}
+
+func (t *transaction) Rollback(ctx context.Context) error {
+	defer t.end()
+	return t.Transaction.Rollback(ctx)
+}
+
+func (t *transaction) end() {
+	t.mu.Lock()
+	skus := t.skus
+	t.skus = nil
+	t.mu.Unlock()
+	if len(skus) > 0 {
+		t.repo.Invalidate(skus...)
+	}
+}
+
+func hit(funcName string) {
+	if cacheHits != nil {
+		cacheHits.WithLabelValues(funcName).Inc()
+	}
+}
+
+func miss(funcName string) {
+	if cacheMisses != nil {
+		cacheMisses.WithLabelValues(funcName).Inc()
+	}
+}
@@ -0,0 +1,200 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sksmith/smfg-catalog/cache"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+)
+
+func newRepo(t *testing.T, config cache.Config) (*cache.ProductRepo, map[string]int) {
+	calls := make(map[string]int)
+	products := map[string]catalog.Product{
+		"sku1": {Sku: "sku1", Name: "name1"},
+		"sku2": {Sku: "sku2", Name: "name2"},
+		"measured": {Sku: "measured", Name: "measured", Dimensions: &catalog.Dimensions{Height: 1, Unit: "CMT"},
+			Barcodes: []catalog.Barcode{{Gtin: "00012345600012", PackagingLevel: catalog.PackagingEach, Quantity: 1, Primary: true}}},
+	}
+
+	mockRepo := db.NewMockRepo()
+	mockRepo.GetProductFunc = func(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error) {
+		calls[sku]++
+		if p, ok := products[sku]; ok {
+			return p, nil
+		}
+		return catalog.Product{}, core.ErrNotFound
+	}
+	mockRepo.GetProductsFunc = func(ctx context.Context, skus []string, tx ...core.Transaction) ([]catalog.Product, error) {
+		var found []catalog.Product
+		for _, sku := range skus {
+			calls[sku]++
+			if p, ok := products[sku]; ok {
+				found = append(found, p)
+			}
+		}
+		return found, nil
+	}
+	mockRepo.SaveProductFunc = func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error {
+		products[product.Sku] = product
+		return nil
+	}
+
+	repo, err := cache.NewProductRepo(mockRepo, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, calls
+}
+
+func TestGetProduct(t *testing.T) {
+	ctx := context.Background()
+	repo, calls := newRepo(t, cache.Config{})
+
+	for i := 0; i < 3; i++ {
+		p, err := repo.GetProduct(ctx, "sku1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name != "name1" {
+			t.Errorf("name got=%s want=name1", p.Name)
+		}
+		if _, err = repo.GetProduct(ctx, "missing"); !errors.Is(err, core.ErrNotFound) {
+			t.Errorf("missing err got=%v want=%v", err, core.ErrNotFound)
+		}
+	}
+	if calls["sku1"] != 1 || calls["missing"] != 1 {
+		t.Errorf("database calls got=%v want one per sku", calls)
+	}
+
+	if _, err := repo.GetProduct(ctx, "sku1", db.MockTransaction{}); err != nil {
+		t.Fatal(err)
+	}
+	if calls["sku1"] != 2 {
+		t.Errorf("read in transaction calls got=%d want=2", calls["sku1"])
+	}
+}
+
+// Callers get their own copy of a cached product, so changing it leaves the
+// cache alone.
+func TestGetProductCopies(t *testing.T) {
+	ctx := context.Background()
+	repo, _ := newRepo(t, cache.Config{})
+
+	for i := 0; i < 3; i++ {
+		p, err := repo.GetProduct(ctx, "measured")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Barcodes[0].Gtin != "00012345600012" || p.Dimensions.Height != 1 {
+			t.Fatalf("read %d got=%+v, changed by an earlier caller", i, p)
+		}
+		p.Barcodes[0].Gtin = "changed"
+		p.Dimensions.Height = 2
+
+		products, err := repo.GetProducts(ctx, []string{"measured"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		products[0].Barcodes[0].Gtin = "changed"
+	}
+}
+
+func TestInvalidateOnWrite(t *testing.T) {
+	ctx := context.Background()
+	repo, _ := newRepo(t, cache.Config{})
+
+	if _, err := repo.GetProduct(ctx, "sku1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetProduct(ctx, "sku3"); !errors.Is(err, core.ErrNotFound) {
+		t.Fatalf("err got=%v want=%v", err, core.ErrNotFound)
+	}
+
+	tx, err := repo.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []catalog.Product{{Sku: "sku1", Name: "renamed"}, {Sku: "sku3", Name: "created"}} {
+		if err = repo.SaveProduct(ctx, p, tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := repo.GetProduct(ctx, "sku1")
+	if err != nil || p.Name != "renamed" {
+		t.Errorf("sku1 got=%+v, %v want renamed", p, err)
+	}
+	p, err = repo.GetProduct(ctx, "sku3")
+	if err != nil || p.Name != "created" {
+		t.Errorf("sku3 got=%+v, %v want created", p, err)
+	}
+}
+
+func TestGetProducts(t *testing.T) {
+	ctx := context.Background()
+	repo, calls := newRepo(t, cache.Config{})
+
+	if _, err := repo.GetProduct(ctx, "sku2"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		products, err := repo.GetProducts(ctx, []string{"sku2", "missing", "sku1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(products) != 2 || products[0].Sku != "sku1" || products[1].Sku != "sku2" {
+			t.Errorf("products got=%+v want sku1 and sku2", products)
+		}
+	}
+	if calls["sku1"] != 1 || calls["sku2"] != 1 || calls["missing"] != 1 {
+		t.Errorf("database calls got=%v want one per sku", calls)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	repo, calls := newRepo(t, cache.Config{TTL: time.Hour, NegativeTTL: 10 * time.Millisecond})
+
+	for i := 0; i < 2; i++ {
+		_, _ = repo.GetProduct(ctx, "sku1")
+		_, _ = repo.GetProduct(ctx, "missing")
+		time.Sleep(20 * time.Millisecond)
+	}
+	if calls["sku1"] != 1 || calls["missing"] != 2 {
+		t.Errorf("database calls got=%v want sku1=1 missing=2", calls)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	repo, calls := newRepo(t, cache.Config{TTL: time.Hour, FallbackTTL: 10 * time.Millisecond})
+
+	_, _ = repo.GetProduct(ctx, "sku1")
+	time.Sleep(20 * time.Millisecond)
+	_, _ = repo.GetProduct(ctx, "sku1")
+	if calls["sku1"] != 1 {
+		t.Errorf("database calls got=%d want=1", calls["sku1"])
+	}
+
+	repo.SetFallback(true)
+	_, _ = repo.GetProduct(ctx, "sku1")
+	if calls["sku1"] != 2 {
+		t.Errorf("database calls with fallback got=%d want=2", calls["sku1"])
+	}
+
+	repo.SetFallback(false)
+	time.Sleep(20 * time.Millisecond)
+	_, _ = repo.GetProduct(ctx, "sku1")
+	if calls["sku1"] != 2 {
+		t.Errorf("database calls after fallback got=%d want=2", calls["sku1"])
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+)
+
+// tokenEnv holds the bearer token commands run as when authentication is
+// enabled, so that they get the same permission checks as the api.
+const tokenEnv = "CATALOG_TOKEN"
+
+type command func(ctx context.Context, config *Config, args []string) error
+
+var commands = map[string]command{
+	"export": exportCommand,
+	"import": importCommand,
+	"replay": replayCommand,
+}
+
+func runCommand(ctx context.Context, config *Config, name string, args []string) {
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if config.AuthEnabled {
+		token := os.Getenv(tokenEnv)
+		if token == "" {
+			log.Fatal().Str("command", name).Msgf("authentication is enabled, set %s to a bearer token", tokenEnv)
+		}
+		user, err := configVerifier(config).Verify(token)
+		if err != nil {
+			log.Fatal().Err(err).Str("command", name).Msg("invalid token")
+		}
+		ctx = auth.NewContext(ctx, user)
+	}
+
+	if err := cmd(ctx, config, args); err != nil {
+		log.Fatal().Err(err).Str("command", name).Msg("command failed")
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags]\n\n", ApplicationName)
+	fmt.Fprintf(os.Stderr, "with no command the api server is started, otherwise one of:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", name)
+	}
+	fmt.Fprintf(os.Stderr, "\nwhen authentication is enabled commands run as the token in %s\n", tokenEnv)
+}
@@ -2,14 +2,23 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
 	sc "github.com/sksmith/go-spring-config"
+	"github.com/sksmith/smfg-catalog/api"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/cache"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/core/webhook"
+	"github.com/sksmith/smfg-catalog/queue"
 )
 
 type Config struct {
 	Port             string
+	GrpcPort         string
 	LogLevel         string
 	LogText          bool
 	DbHost           string
@@ -20,6 +29,7 @@ type Config struct {
 	DbMigrate        bool
 	DbClean          bool
 	QMock            bool
+	QBroker          string
 	QHost            string
 	QPort            string
 	QUser            string
@@ -27,6 +37,46 @@ type Config struct {
 	Revision         string
 	ApplicationName  string
 	QProductExchange string
+	QChangesExchange string
+	QEncoding        string
+	QPublishTo       string
+	QKafkaBrokers    string
+	QKafkaTopic      string
+	QPublishAttempts int
+	QPublishBackoff  time.Duration
+	QConfirmTimeout  time.Duration
+	QPLMEnabled      bool
+	QPLMQueue        string
+	QPLMExchange     string
+	QPLMRoutingKey   string
+	QPLMDeadLetter   string
+	QPLMMaxAttempts  int
+	QPLMConsumer     string
+	QNATSURL         string
+	QNATSAckPolicy   string
+	QNATSAckWait     time.Duration
+	QNATSMaxDeliver  int
+	JobWorkers       int
+	WebhookWorkers   int
+	AuthEnabled      bool
+	AuthHS256Secret  string
+	AuthJWKSFile     string
+	AuthIssuer       string
+	AuthAudience     string
+	AuthRolesClaim   string
+	AuthRoles        string
+	GraphQLMaxDepth  int
+	GraphQLMaxCost   int
+	RateLimitEnabled bool
+	RateLimit        string
+	RateLimitRoutes  string
+	RateLimitClients string
+	RateLimitProxies string
+	CacheEnabled     bool
+	CacheSize        int
+	CacheTTL         time.Duration
+	CacheNegativeTTL time.Duration
+	CacheFallbackTTL time.Duration
 }
 
 const maxRetries = 5
@@ -36,6 +86,7 @@ func LoadLocalConfigs() (*Config, error) {
 
 	// API Configs
 	appConfig.Port = "8081"
+	appConfig.GrpcPort = "9081"
 
 	// Log Configs
 	appConfig.LogLevel = "trace"
@@ -52,11 +103,50 @@ func LoadLocalConfigs() (*Config, error) {
 
 	// Queue Configs
 	appConfig.QMock = false
+	appConfig.QBroker = brokerRabbitMQ
 	appConfig.QHost = "localhost"
 	appConfig.QPort = "5672"
 	appConfig.QUser = "guest"
 	appConfig.QPass = "guest"
 	appConfig.QProductExchange = "product.exchange"
+	appConfig.QChangesExchange = "product.changes"
+	appConfig.QEncoding = queue.EncodingJSON
+	appConfig.QPublishTo = brokerRabbitMQ
+	appConfig.QKafkaBrokers = "localhost:9092"
+	appConfig.QKafkaTopic = queue.DefaultKafkaTopic
+	appConfig.QPublishAttempts = queue.DefaultPublishAttempts
+	appConfig.QPublishBackoff = queue.DefaultPublishBackoff
+	appConfig.QConfirmTimeout = queue.DefaultConfirmTimeout
+	appConfig.QPLMEnabled = false
+	appConfig.QPLMQueue = "catalog.plm.products"
+	appConfig.QPLMDeadLetter = "catalog.plm.dead-letter"
+	appConfig.QPLMMaxAttempts = queue.DefaultPLMMaxAttempts
+	appConfig.QNATSURL = nats.DefaultURL
+	appConfig.QNATSAckPolicy = "explicit"
+	appConfig.QNATSAckWait = queue.DefaultJetStreamAckWait
+
+	// Job Configs
+	appConfig.JobWorkers = catalog.DefaultJobWorkers
+	appConfig.WebhookWorkers = webhook.DefaultWorkers
+
+	// Auth Configs
+	appConfig.AuthEnabled = false
+	appConfig.AuthRolesClaim = auth.DefaultRolesClaim
+
+	// GraphQL Configs
+	appConfig.GraphQLMaxDepth = api.DefaultMaxQueryDepth
+	appConfig.GraphQLMaxCost = api.DefaultMaxQueryComplexity
+
+	// Rate Limit Configs
+	appConfig.RateLimitEnabled = false
+	appConfig.RateLimit = fmt.Sprintf("%d:%d", api.DefaultRate, api.DefaultBurst)
+
+	// Cache Configs
+	appConfig.CacheEnabled = true
+	appConfig.CacheSize = cache.DefaultSize
+	appConfig.CacheTTL = cache.DefaultTTL
+	appConfig.CacheNegativeTTL = cache.DefaultNegativeTTL
+	appConfig.CacheFallbackTTL = cache.DefaultFallbackTTL
 
 	return appConfig, nil
 }
@@ -87,6 +177,7 @@ func LoadRemoteConfigs(url, branch, user, pass, profile string) (*Config, error)
 
 	// API Configs
 	appConfig.Port = getString(config, "app.port")
+	appConfig.GrpcPort = getStringOr(config, "app.grpc.port", "9081")
 
 	// Log Configs
 	appConfig.LogLevel = getString(config, "app.log.level")
@@ -103,11 +194,62 @@ func LoadRemoteConfigs(url, branch, user, pass, profile string) (*Config, error)
 
 	// Queue Configs
 	appConfig.QMock = getBool(config, "queue.mock")
-	appConfig.QHost = getString(config, "queue.host")
-	appConfig.QPort = getString(config, "queue.port")
-	appConfig.QUser = getString(config, "queue.user")
-	appConfig.QPass = getString(config, "queue.pass")
+	appConfig.QBroker = getStringOr(config, "queue.broker", brokerRabbitMQ)
+	appConfig.QHost = getStringOr(config, "queue.host", "")
+	appConfig.QPort = getStringOr(config, "queue.port", "")
+	appConfig.QUser = getStringOr(config, "queue.user", "")
+	appConfig.QPass = getStringOr(config, "queue.pass", "")
 	appConfig.QProductExchange = getString(config, "queue.product.exchange")
+	appConfig.QChangesExchange = getStringOr(config, "queue.product.changes-exchange", "product.changes")
+	appConfig.QEncoding = getStringOr(config, "queue.product.encoding", queue.EncodingJSON)
+	appConfig.QPublishTo = getStringOr(config, "queue.product.publish-to", appConfig.QBroker)
+	appConfig.QKafkaBrokers = getStringOr(config, "queue.kafka.brokers", "")
+	appConfig.QKafkaTopic = getStringOr(config, "queue.kafka.topic", queue.DefaultKafkaTopic)
+	appConfig.QPublishAttempts = getInt(config, "queue.publish.attempts", queue.DefaultPublishAttempts)
+	appConfig.QPublishBackoff = getDurationOr(config, "queue.publish.backoff", queue.DefaultPublishBackoff)
+	appConfig.QConfirmTimeout = getDurationOr(config, "queue.publish.confirm-timeout", queue.DefaultConfirmTimeout)
+	appConfig.QPLMEnabled = getBoolOr(config, "queue.plm.enabled", false)
+	appConfig.QPLMQueue = getStringOr(config, "queue.plm.queue", "catalog.plm.products")
+	appConfig.QPLMExchange = getStringOr(config, "queue.plm.exchange", "")
+	appConfig.QPLMRoutingKey = getStringOr(config, "queue.plm.routing-key", "")
+	appConfig.QPLMDeadLetter = getStringOr(config, "queue.plm.dead-letter-exchange", "catalog.plm.dead-letter")
+	appConfig.QPLMMaxAttempts = getInt(config, "queue.plm.max-attempts", queue.DefaultPLMMaxAttempts)
+	appConfig.QPLMConsumer = getStringOr(config, "queue.plm.consumer", "")
+	appConfig.QNATSURL = getStringOr(config, "queue.nats.url", nats.DefaultURL)
+	appConfig.QNATSAckPolicy = getStringOr(config, "queue.nats.ack-policy", "explicit")
+	appConfig.QNATSAckWait = getDurationOr(config, "queue.nats.ack-wait", queue.DefaultJetStreamAckWait)
+	appConfig.QNATSMaxDeliver = getInt(config, "queue.nats.max-deliver", 0)
+
+	// Job Configs
+	appConfig.JobWorkers = getInt(config, "app.jobs.workers", catalog.DefaultJobWorkers)
+	appConfig.WebhookWorkers = getInt(config, "app.webhooks.workers", webhook.DefaultWorkers)
+
+	// Auth Configs
+	appConfig.AuthEnabled = getBoolOr(config, "app.auth.enabled", false)
+	appConfig.AuthHS256Secret = getStringOr(config, "app.auth.hs256-secret", "")
+	appConfig.AuthJWKSFile = getStringOr(config, "app.auth.jwks-file", "")
+	appConfig.AuthIssuer = getStringOr(config, "app.auth.issuer", "")
+	appConfig.AuthAudience = getStringOr(config, "app.auth.audience", "")
+	appConfig.AuthRolesClaim = getStringOr(config, "app.auth.roles-claim", auth.DefaultRolesClaim)
+	appConfig.AuthRoles = getStringOr(config, "app.auth.roles", "")
+
+	// GraphQL Configs
+	appConfig.GraphQLMaxDepth = getInt(config, "app.graphql.max-depth", api.DefaultMaxQueryDepth)
+	appConfig.GraphQLMaxCost = getInt(config, "app.graphql.max-complexity", api.DefaultMaxQueryComplexity)
+
+	// Rate Limit Configs
+	appConfig.RateLimitEnabled = getBoolOr(config, "app.ratelimit.enabled", false)
+	appConfig.RateLimit = getStringOr(config, "app.ratelimit.default", fmt.Sprintf("%d:%d", api.DefaultRate, api.DefaultBurst))
+	appConfig.RateLimitRoutes = getStringOr(config, "app.ratelimit.routes", "")
+	appConfig.RateLimitClients = getStringOr(config, "app.ratelimit.clients", "")
+	appConfig.RateLimitProxies = getStringOr(config, "app.ratelimit.trusted-proxies", "")
+
+	// Cache Configs
+	appConfig.CacheEnabled = getBoolOr(config, "app.cache.enabled", false)
+	appConfig.CacheSize = getInt(config, "app.cache.size", cache.DefaultSize)
+	appConfig.CacheTTL = getDurationOr(config, "app.cache.ttl", cache.DefaultTTL)
+	appConfig.CacheNegativeTTL = getDurationOr(config, "app.cache.negative-ttl", cache.DefaultNegativeTTL)
+	appConfig.CacheFallbackTTL = getDurationOr(config, "app.cache.fallback-ttl", cache.DefaultFallbackTTL)
 
 	return appConfig, nil
 }
@@ -116,6 +258,57 @@ func getBool(c *sc.Config, property string) bool {
 	return c.Get(property).(bool)
 }
 
+// getBoolOr returns def when the property is not set.
+func getBoolOr(c *sc.Config, property string, def bool) bool {
+	if c.Get(property) == nil {
+		return def
+	}
+	return getBool(c, property)
+}
+
+// getInt returns def when the property is not set, so that newer settings
+// don't have to be added to every environment's configuration at once.
+func getInt(c *sc.Config, property string, def int) int {
+	switch v := c.Get(property).(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	case string:
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			log.Warn().Str("property", property).Str("value", v).Msg("not a number, using default")
+			return def
+		}
+		return i
+	default:
+		return def
+	}
+}
+
+// getStringOr returns def when the property is not set.
+// getDurationOr reads a duration such as 90s or 5m, returning def when the
+// property is not set or can't be read.
+func getDurationOr(c *sc.Config, property string, def time.Duration) time.Duration {
+	if c.Get(property) == nil {
+		return def
+	}
+	v := getString(c, property)
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Warn().Str("property", property).Str("value", v).Msg("not a duration, using default")
+		return def
+	}
+	return d
+}
+
+func getStringOr(c *sc.Config, property string, def string) string {
+	if c.Get(property) == nil {
+		return def
+	}
+	return getString(c, property)
+}
+
 func getString(c *sc.Config, property string) string {
 	i := c.Get(property)
 	switch v := i.(type) {
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+// exportCommand writes the catalog, or the part of it matching the filter
+// flags, to a file or stdout.
+func exportCommand(ctx context.Context, config *Config, args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", string(catalog.ExportCSV), "output format, one of csv, jsonl or xlsx")
+	out := fs.String("o", "-", "file to write to, - for stdout")
+	filter := catalog.ProductFilter{}
+	fs.StringVar(&filter.SkuPrefix, "sku", "", "only export SKUs starting with this prefix")
+	fs.StringVar(&filter.Name, "name", "", "only export products whose name contains this")
+	fs.StringVar(&filter.Gtin, "gtin", "", "only export the product with this barcode")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s export [flags]\n", ApplicationName)
+		fs.PrintDefaults()
+	}
+	if err = fs.Parse(args); err != nil {
+		return err
+	}
+
+	f, err := catalog.ParseExportFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		w = file
+	}
+
+	service := configCatalogService(ctx, config)
+	return service.ExportProducts(ctx, filter, f, w)
+}
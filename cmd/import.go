@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+// importCommand loads products from a CSV file, or stdin when the file is
+// "-", and prints the import result as JSON.
+func importCommand(ctx context.Context, config *Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "validate the file without saving any products")
+	batchSize := fs.Int("batch-size", catalog.DefaultImportBatchSize, "number of products saved per transaction")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s import [flags] <file.csv|->\n", ApplicationName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one file, got %d", fs.NArg())
+	}
+
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	service := configCatalogService(ctx, config)
+
+	result, err := service.ImportProducts(ctx, in, catalog.ImportOptions{DryRun: *dryRun, BatchSize: *batchSize})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(result); err != nil {
+		return err
+	}
+
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("%d row error(s)", len(result.Errors))
+	}
+	return nil
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -18,9 +20,16 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/sksmith/bunnyq"
 	"github.com/sksmith/smfg-catalog/api"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/cache"
+	"github.com/sksmith/smfg-catalog/core/apikey"
 	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/core/webhook"
 	"github.com/sksmith/smfg-catalog/db"
+	catgrpc "github.com/sksmith/smfg-catalog/grpc"
 	"github.com/sksmith/smfg-catalog/queue"
+	"github.com/streadway/amqp"
+	"google.golang.org/grpc"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -57,33 +66,218 @@ func main() {
 	config := loadConfigs()
 
 	configLogging(config)
+	auth.SetEnabled(config.AuthEnabled)
+
+	if len(os.Args) > 1 {
+		runCommand(ctx, config, os.Args[1], os.Args[2:])
+		return
+	}
+
+	serve(ctx, config)
+}
+
+func serve(ctx context.Context, config *Config) {
 	printLogHeader(config)
 	dbPool := configDatabase(ctx, config)
-	bq := rabbit(config)
-	q := configInventoryQueue(bq, config)
+	broker := configBroker(ctx, config)
 
-	log.Info().Msg("creating catalog service...")
-	ir := db.NewPostgresRepo(dbPool)
-	catalogService := catalog.NewService(ir, q, config.QProductExchange)
+	var repo catalog.Repository = db.NewPostgresRepo(dbPool)
+	var productCache *cache.ProductRepo
+	if config.CacheEnabled {
+		productCache = configProductCache(repo, config)
+		repo = productCache
+	}
+
+	// Background workers aren't called through an api, they act as the system.
+	workerCtx := auth.NewContext(ctx, auth.System)
+
+	catalogService := newCatalogService(repo, broker, config)
+	catalogService.StartJobWorkers(workerCtx, config.JobWorkers)
+	catalogService.StartPublisher(workerCtx)
+
+	if productCache != nil {
+		configCacheInvalidator(broker, productCache, config).Start(workerCtx, catalogService)
+	}
+	if config.QPLMEnabled {
+		configPLMConsumer(broker, catalogService, config).Start(workerCtx)
+	}
+
+	webhookService := webhook.NewService(db.NewPostgresRepo(dbPool), catalogService, nil)
+	webhookService.StartWorkers(workerCtx, config.WebhookWorkers)
 
 	log.Info().Msg("configuring metrics...")
 	api.ConfigureMetrics()
+	catgrpc.ConfigureMetrics()
+	cache.ConfigureMetrics()
+	queue.ConfigureMetrics()
+
+	apiKeyService := apikey.NewService(db.NewPostgresRepo(dbPool))
+
+	go serveGrpc(catalogService, apiKeyService, config)
 
 	log.Info().Msg("configuring router...")
-	r := configureRouter(catalogService)
+	r := configureRouter(catalogService, webhookService, apiKeyService, config)
 
 	log.Info().Str("port", config.Port).Msg("listening")
 	log.Fatal().Err(http.ListenAndServe(":"+config.Port, r))
 }
 
-func configInventoryQueue(bq *bunnyq.BunnyQ, config *Config) (q catalog.Queue) {
-	if config.QMock {
-		log.Info().Msg("creating mock queue...")
-		return queue.NewMockQueue()
-	} else {
-		log.Info().Msg("connecting to rabbitmq...")
-		return queue.New(bq, config.QProductExchange)
+func serveGrpc(service catalog.Service, keys apikey.Service, config *Config) {
+	lis, err := net.Listen("tcp", ":"+config.GrpcPort)
+	if err != nil {
+		log.Fatal().Err(err).Str("port", config.GrpcPort).Msg("failed to listen for grpc")
+	}
+
+	var opts []grpc.ServerOption
+	if config.AuthEnabled {
+		v := configVerifier(config)
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(catgrpc.UnaryAuth(v, keys)),
+			grpc.ChainStreamInterceptor(catgrpc.StreamAuth(v, keys)))
+	}
+
+	log.Info().Str("port", config.GrpcPort).Msg("grpc listening")
+	log.Fatal().Err(catgrpc.NewServer(service, opts...).Serve(lis))
+}
+
+func configCatalogService(ctx context.Context, config *Config) catalog.Service {
+	return newCatalogService(db.NewPostgresRepo(configDatabase(ctx, config)), configBroker(ctx, config), config)
+}
+
+func newCatalogService(repo catalog.Repository, broker queue.Broker, config *Config) catalog.Service {
+	q := configInventoryQueue(broker, config)
+
+	log.Info().Msg("creating catalog service...")
+	return catalog.NewService(repo, q, config.QProductExchange)
+}
+
+func configProductCache(repo catalog.Repository, config *Config) *cache.ProductRepo {
+	log.Info().
+		Int("size", config.CacheSize).
+		Dur("ttl", config.CacheTTL).
+		Dur("negative-ttl", config.CacheNegativeTTL).
+		Msg("caching products...")
+
+	c, err := cache.NewProductRepo(repo, cache.Config{
+		Size:        config.CacheSize,
+		TTL:         config.CacheTTL,
+		NegativeTTL: config.CacheNegativeTTL,
+		FallbackTTL: config.CacheFallbackTTL,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create product cache")
+	}
+	return c
+}
+
+func configCacheInvalidator(broker queue.Broker, c *cache.ProductRepo, config *Config) *queue.CacheInvalidator {
+	return queue.NewCacheInvalidator(broker, config.QChangesExchange, instanceID(), c)
+}
+
+func configPLMConsumer(broker queue.Broker, service catalog.Service, config *Config) *queue.PLMConsumer {
+	return queue.NewPLMConsumer(broker, queue.PLMConfig{
+		Queue:              config.QPLMQueue,
+		Exchange:           config.QPLMExchange,
+		RoutingKey:         config.QPLMRoutingKey,
+		DeadLetterExchange: config.QPLMDeadLetter,
+		MaxAttempts:        config.QPLMMaxAttempts,
+		Consumer:           config.QPLMConsumer,
+	}, service)
+}
+
+// instanceID tells this process's messages apart from other instances'.
+func instanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = ApplicationName
+	}
+	b := make([]byte, 4)
+	if _, err = rand.Read(b); err != nil {
+		log.Fatal().Err(err).Msg("failed to generate instance id")
+	}
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// Messages go through RabbitMQ or NATS, as QBroker says. Product events
+// can also, or instead, be published to Kafka, as listed in QPublishTo.
+const (
+	brokerRabbitMQ = "rabbitmq"
+	brokerNATS     = "nats"
+	publishKafka   = "kafka"
+)
+
+func configInventoryQueue(broker queue.Broker, config *Config) (q catalog.Queue) {
+	serializer, err := queue.NewSerializer(config.QEncoding)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to configure product event encoding")
+	}
+
+	var destinations []catalog.Destination
+	for _, to := range strings.Split(config.QPublishTo, ",") {
+		switch to = strings.TrimSpace(to); to {
+		case config.QBroker:
+			log.Info().Str("encoding", serializer.Encoding()).Msg("creating product queue...")
+			destinations = append(destinations, catalog.Destination{
+				Name:  to,
+				Queue: queue.New(broker, config.QProductExchange, serializer),
+			})
+		case publishKafka:
+			log.Info().Str("encoding", serializer.Encoding()).Str("topic", config.QKafkaTopic).Msg("connecting to kafka...")
+			writer := queue.NewKafkaWriter(queue.KafkaConfig{Brokers: strings.Split(config.QKafkaBrokers, ",")})
+			destinations = append(destinations, catalog.Destination{
+				Name:  to,
+				Queue: queue.NewKafkaQueue(writer, config.QKafkaTopic, serializer),
+			})
+		default:
+			log.Fatal().Str("publish-to", to).Msg("unknown product event destination")
+		}
 	}
+	return queue.NewFanout(destinations...)
+}
+
+// configBroker connects to RabbitMQ or NATS, or when the queue is mocked
+// keeps messages in memory. Nothing else consumes from the in-memory broker,
+// so product events are logged and the PLM exchange is declared for anything
+// publishing to it in-process.
+func configBroker(ctx context.Context, config *Config) queue.Broker {
+	if !config.QMock {
+		switch config.QBroker {
+		case brokerRabbitMQ:
+			log.Info().Msg("connecting to rabbitmq...")
+			return queue.NewRabbitBroker(rabbitAddress(config), configPublisher(config), logger{})
+		case brokerNATS:
+			return configJetStream(config)
+		default:
+			log.Fatal().Str("broker", config.QBroker).Msg("unknown broker")
+		}
+	}
+
+	log.Info().Msg("creating in-memory broker...")
+	broker := queue.NewMemoryBroker()
+	if config.QPLMExchange != "" {
+		if err := broker.DeclareExchange(config.QPLMExchange, amqp.ExchangeTopic); err != nil {
+			log.Fatal().Err(err).Msg("failed to declare plm exchange")
+		}
+	}
+
+	ready := make(chan struct{})
+	sub := queue.Subscription{
+		Queue:    config.QProductExchange + ".log",
+		Exchange: config.QProductExchange,
+		Kind:     amqp.ExchangeFanout,
+		AutoAck:  true,
+		Started:  func() { close(ready) },
+	}
+	go func() {
+		err := broker.Subscribe(ctx, sub, func(d amqp.Delivery) {
+			log.Debug().Str("type", d.Type).Str("id", d.MessageId).Bytes("body", d.Body).Msg("product event")
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to consume product events")
+		}
+	}()
+	<-ready
+	return broker
 }
 
 func loadConfigs() (config *Config) {
@@ -104,27 +298,54 @@ func loadConfigs() (config *Config) {
 	return config
 }
 
-func rabbit(config *Config) *bunnyq.BunnyQ {
-	osChannel := make(chan os.Signal, 1)
-	signal.Notify(osChannel, syscall.SIGTERM)
-	var bq *bunnyq.BunnyQ
-
-	for {
-		bq = bunnyq.New(context.Background(),
-			bunnyq.Address{
-				User: config.QUser,
-				Pass: config.QPass,
-				Host: config.QHost,
-				Port: config.QPort,
-			},
-			osChannel,
-			bunnyq.LogHandler(logger{}),
-		)
+// configJetStream connects to NATS and makes sure there's a stream for
+// product events, which RabbitMQ deployments declare outside the service.
+// NATS may not be up yet, so the stream is declared in the background.
+func configJetStream(config *Config) *queue.JetStreamBroker {
+	ackPolicy, err := queue.ParseAckPolicy(config.QNATSAckPolicy)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to configure nats")
+	}
 
-		break
+	log.Info().Str("url", config.QNATSURL).Str("ack-policy", config.QNATSAckPolicy).Msg("connecting to nats...")
+	broker, err := queue.NewJetStreamBroker(queue.JetStreamConfig{
+		URL:        config.QNATSURL,
+		Name:       ApplicationName,
+		AckPolicy:  ackPolicy,
+		AckWait:    config.QNATSAckWait,
+		MaxDeliver: config.QNATSMaxDeliver,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to nats")
 	}
+	go func() {
+		for {
+			err := broker.DeclareStream(config.QProductExchange)
+			if err == nil {
+				return
+			}
+			log.Warn().Err(err).Str("exchange", config.QProductExchange).Msg("unable to declare product stream")
+			time.Sleep(5 * time.Second)
+		}
+	}()
+	return broker
+}
+
+func configPublisher(config *Config) *queue.Publisher {
+	return queue.NewPublisher(rabbitAddress(config), queue.PublisherConfig{
+		Attempts:       config.QPublishAttempts,
+		Backoff:        config.QPublishBackoff,
+		ConfirmTimeout: config.QConfirmTimeout,
+	})
+}
 
-	return bq
+func rabbitAddress(config *Config) bunnyq.Address {
+	return bunnyq.Address{
+		User: config.QUser,
+		Pass: config.QPass,
+		Host: config.QHost,
+		Port: config.QPort,
+	}
 }
 
 type logger struct {
@@ -214,7 +435,7 @@ func configDatabase(ctx context.Context, config *Config) (dbPool *pgxpool.Pool)
 	return dbPool
 }
 
-func configureRouter(service catalog.Service) chi.Router {
+func configureRouter(service catalog.Service, webhookService webhook.Service, apiKeyService apikey.Service, config *Config) chi.Router {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
@@ -223,17 +444,94 @@ func configureRouter(service catalog.Service) chi.Router {
 	r.Use(render.SetContentType(render.ContentTypeJSON))
 	r.Use(api.Logging)
 
+	catApi := api.NewCatalogApi(service)
+	doc, err := catApi.OpenAPI("/api/product")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to generate openapi document")
+	}
+
+	gqlApi, err := api.NewGraphQLApi(service, api.QueryLimits{
+		MaxDepth:      config.GraphQLMaxDepth,
+		MaxComplexity: config.GraphQLMaxCost,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to build graphql schema")
+	}
+
 	r.Handle("/metrics", promhttp.Handler())
 	r.Route("/api", func(r chi.Router) {
-		r.Route("/product", catalogApi(service))
+		r.Get("/openapi.json", api.OpenAPIHandler(doc))
+
+		r.Group(func(r chi.Router) {
+			if config.AuthEnabled {
+				r.Use(api.Authenticate(configVerifier(config), apiKeyService))
+			} else {
+				log.Warn().Msg("authentication is disabled")
+			}
+			if config.RateLimitEnabled {
+				r.Use(configRateLimiter(config).Handler)
+			}
+
+			r.With(api.RequirePermission(auth.PermissionRead)).Handle("/graphql", gqlApi)
+			r.Route("/product", catApi.ConfigureRouter)
+			r.Route("/webhook", api.NewWebhookApi(webhookService).ConfigureRouter)
+			r.Route("/apikey", api.NewAPIKeyApi(apiKeyService).ConfigureRouter)
+			r.Route("/replay", api.NewReplayApi(service).ConfigureRouter)
+		})
 	})
 
 	return r
 }
 
-func catalogApi(s catalog.Service) func(r chi.Router) {
-	catApi := api.NewCatalogApi(s)
-	return catApi.ConfigureRouter
+func configVerifier(config *Config) *auth.Verifier {
+	roles, err := auth.ParseRoles(config.AuthRoles)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read role mapping")
+	}
+	if len(roles) == 0 {
+		roles = auth.DefaultRoles
+	}
+
+	v, err := auth.NewVerifier(auth.Config{
+		HS256Secret: config.AuthHS256Secret,
+		JWKSFile:    config.AuthJWKSFile,
+		Issuer:      config.AuthIssuer,
+		Audience:    config.AuthAudience,
+		RolesClaim:  config.AuthRolesClaim,
+		Roles:       roles,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to configure token verification")
+	}
+	return v
+}
+
+func configRateLimiter(config *Config) *api.RateLimiter {
+	limit, err := api.ParseRateLimit(config.RateLimit)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read default rate limit")
+	}
+	routes, err := api.ParseRateLimits(config.RateLimitRoutes)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read route rate limits")
+	}
+	clients, err := api.ParseRateLimits(config.RateLimitClients)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read client rate limits")
+	}
+	proxies, err := api.ParseTrustedProxies(config.RateLimitProxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read trusted proxies")
+	}
+
+	log.Info().
+		Float64("rate", limit.Rate).
+		Int("burst", limit.Burst).
+		Int("routes", len(routes)).
+		Int("clients", len(clients)).
+		Int("proxies", len(proxies)).
+		Msg("rate limiting requests")
+	return api.NewRateLimiter(api.RateLimits{Default: limit, Routes: routes, Clients: clients, TrustedProxies: proxies})
 }
 
 func configLogging(config *Config) {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+// replayCommand republishes the catalog, or the part of it matching the
+// filter flags, as snapshot events. If it stops part way it prints the flag
+// to carry on from where it got to.
+func replayCommand(ctx context.Context, config *Config, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	opts := catalog.ReplayOptions{}
+	fs.StringVar(&opts.Target.Destination, "destination", "", "destination to publish to, required when publishing to several")
+	fs.StringVar(&opts.Target.Exchange, "exchange", "", "exchange to publish to, the product exchange when empty")
+	fs.StringVar(&opts.Target.RoutingKey, "routing-key", "", "routing key to publish with")
+	fs.StringVar(&opts.Target.Topic, "topic", "", "kafka topic to publish to, the product topic when empty")
+	fs.IntVar(&opts.Rate, "rate", catalog.DefaultReplayRate, "most products to publish a second")
+	fs.IntVar(&opts.Limit, "limit", 0, "most products to publish, 0 for all of them")
+	fs.StringVar(&opts.Filter.AfterSku, "after", "", "resume after this SKU")
+	fs.StringVar(&opts.Filter.SkuPrefix, "sku", "", "only replay SKUs starting with this prefix")
+	fs.StringVar(&opts.Filter.Name, "name", "", "only replay products whose name contains this")
+	fs.StringVar(&opts.Filter.Gtin, "gtin", "", "only replay the product with this barcode")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s replay [flags]\n", ApplicationName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts.Progress = func(r catalog.ReplayResult) {
+		fmt.Fprintf(os.Stderr, "published %d, last %s\n", r.Published, r.LastSku)
+	}
+
+	service := configCatalogService(ctx, config)
+	result, err := service.ReplayProducts(ctx, opts)
+	fmt.Fprintf(os.Stderr, "published %d products\n", result.Published)
+	if !result.Done && result.LastSku != "" {
+		fmt.Fprintf(os.Stderr, "to resume, run again with -after %s\n", result.LastSku)
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package apikey
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/auth"
+)
+
+var ErrInvalidKey = errors.New("apikey: invalid key")
+
+// Key lets a machine client call the APIs with the permissions in Scopes,
+// until it expires or is revoked. Only a hash of the secret is kept; the
+// key itself is returned once, when it is issued or rotated. Prefix is the
+// public part of the key used to look it up.
+type Key struct {
+	ID         int64             `json:"id"`
+	Name       string            `json:"name"`
+	Prefix     string            `json:"prefix"`
+	Hash       []byte            `json:"-"`
+	Scopes     []auth.Permission `json:"scopes"`
+	ExpiresAt  *time.Time        `json:"expiresAt,omitempty"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	LastUsedAt *time.Time        `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time        `json:"revokedAt,omitempty"`
+}
+
+func (k Key) Validate() error {
+	if k.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidKey)
+	}
+	if len(k.Scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", ErrInvalidKey)
+	}
+	for _, s := range k.Scopes {
+		if !s.Valid() {
+			return fmt.Errorf("%w: unknown scope %q", ErrInvalidKey, s)
+		}
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("%w: expiry must be in the future", ErrInvalidKey)
+	}
+	return nil
+}
+
+// Usable reports whether the key can authenticate at the given time.
+func (k Key) Usable(at time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || at.Before(*k.ExpiresAt))
+}
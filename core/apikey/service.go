@@ -0,0 +1,259 @@
+// Package apikey issues and verifies the API keys used by machine clients
+// that can't obtain tokens.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// keyPrefix starts every key so that they are easy to recognise, in
+	// logs or secret scanners.
+	keyPrefix = "smfg"
+
+	prefixBytes = 6
+	secretBytes = 24
+
+	// touchInterval limits how often a key's last used time is written.
+	touchInterval = time.Minute
+)
+
+func NewService(repo Repository) *service {
+	return &service{repo: repo}
+}
+
+type Service interface {
+	IssueKey(ctx context.Context, key Key) (Key, string, error)
+	RotateKey(ctx context.Context, id int64) (Key, string, error)
+	RevokeKey(ctx context.Context, id int64) (Key, error)
+	GetKey(ctx context.Context, id int64) (Key, error)
+	ListKeys(ctx context.Context) ([]Key, error)
+	VerifyKey(ctx context.Context, key string) (auth.User, error)
+}
+
+type service struct {
+	repo Repository
+}
+
+// IssueKey saves a new key with the given name, scopes and expiry, and
+// returns it along with the key to hand to the client.
+func (s *service) IssueKey(ctx context.Context, key Key) (Key, string, error) {
+	const funcName = "IssueKey"
+
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return key, "", err
+	}
+
+	if err := key.Validate(); err != nil {
+		return key, "", errors.WithStack(err)
+	}
+
+	raw, err := s.generate(&key)
+	if err != nil {
+		return key, "", err
+	}
+	key.ID = 0
+	key.LastUsedAt = nil
+	key.RevokedAt = nil
+
+	log.Info().
+		Str("func", funcName).
+		Str("name", key.Name).
+		Str("prefix", key.Prefix).
+		Msg("issuing api key")
+
+	saved, err := s.repo.SaveAPIKey(ctx, key)
+	if err != nil {
+		return saved, "", errors.WithStack(err)
+	}
+	return saved, raw, nil
+}
+
+// RotateKey replaces the key's secret, keeping its name, scopes and expiry.
+// The old key stops working straight away.
+func (s *service) RotateKey(ctx context.Context, id int64) (Key, string, error) {
+	const funcName = "RotateKey"
+
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return Key{}, "", err
+	}
+
+	key, err := s.repo.GetAPIKey(ctx, id)
+	if err != nil {
+		return key, "", errors.WithStack(err)
+	}
+	if key.RevokedAt != nil {
+		return key, "", errors.Wrap(core.ErrConflict, "a revoked key can't be rotated")
+	}
+
+	raw, err := s.generate(&key)
+	if err != nil {
+		return key, "", err
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int64("id", id).
+		Str("prefix", key.Prefix).
+		Msg("rotating api key")
+
+	saved, err := s.repo.SaveAPIKey(ctx, key)
+	if err != nil {
+		return saved, "", errors.WithStack(err)
+	}
+	return saved, raw, nil
+}
+
+// RevokeKey stops a key from working. The key is kept, so that it still
+// shows when it was last used.
+func (s *service) RevokeKey(ctx context.Context, id int64) (Key, error) {
+	const funcName = "RevokeKey"
+
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return Key{}, err
+	}
+
+	key, err := s.repo.GetAPIKey(ctx, id)
+	if err != nil {
+		return key, errors.WithStack(err)
+	}
+	if key.RevokedAt != nil {
+		return key, nil
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int64("id", id).
+		Msg("revoking api key")
+
+	now := time.Now()
+	key.RevokedAt = &now
+	saved, err := s.repo.SaveAPIKey(ctx, key)
+	if err != nil {
+		return saved, errors.WithStack(err)
+	}
+	return saved, nil
+}
+
+func (s *service) GetKey(ctx context.Context, id int64) (Key, error) {
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return Key{}, err
+	}
+
+	key, err := s.repo.GetAPIKey(ctx, id)
+	if err != nil {
+		return key, errors.WithStack(err)
+	}
+	return key, nil
+}
+
+func (s *service) ListKeys(ctx context.Context) ([]Key, error) {
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return nil, err
+	}
+
+	keys, err := s.repo.ListAPIKeys(ctx)
+	if err != nil {
+		return keys, errors.WithStack(err)
+	}
+	return keys, nil
+}
+
+// VerifyKey returns the user a key acts as, which has the key's scopes as
+// its permissions, and records that the key was used.
+func (s *service) VerifyKey(ctx context.Context, raw string) (auth.User, error) {
+	prefix, secret, ok := parseKey(raw)
+	if !ok {
+		return auth.User{}, errors.Wrap(auth.ErrInvalidToken, "malformed api key")
+	}
+
+	key, err := s.repo.GetAPIKeyByPrefix(ctx, prefix)
+	if err != nil {
+		if errors.Is(err, core.ErrNotFound) {
+			return auth.User{}, errors.Wrap(auth.ErrInvalidToken, "unknown api key")
+		}
+		return auth.User{}, errors.WithStack(err)
+	}
+
+	now := time.Now()
+	if !key.Usable(now) {
+		return auth.User{}, errors.Wrap(auth.ErrInvalidToken, "api key is expired or revoked")
+	}
+	if subtle.ConstantTimeCompare(key.Hash, hashSecret(secret)) != 1 {
+		return auth.User{}, errors.Wrap(auth.ErrInvalidToken, "api key does not match")
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= touchInterval {
+		if err = s.repo.TouchAPIKey(ctx, key.ID, now); err != nil {
+			log.Warn().Err(err).Int64("id", key.ID).Msg("failed to record api key use")
+		}
+	}
+
+	return auth.User{
+		Subject:     "apikey:" + strconv.FormatInt(key.ID, 10),
+		Claims:      map[string]interface{}{"name": key.Name, "prefix": key.Prefix},
+		Permissions: key.Scopes,
+	}, nil
+}
+
+// generate gives the key a new prefix and secret, and returns the key
+// string made of the two.
+func (s *service) generate(key *Key) (string, error) {
+	prefix, err := randomHex(prefixBytes)
+	if err != nil {
+		return "", err
+	}
+	secret, err := randomHex(secretBytes)
+	if err != nil {
+		return "", err
+	}
+	key.Prefix = prefix
+	key.Hash = hashSecret(secret)
+	return keyPrefix + "_" + prefix + "_" + secret, nil
+}
+
+// hashSecret hashes a key's secret for storage with BLAKE2b. The secret is
+// random and long enough that it can't be guessed, so unlike a password it
+// doesn't need a slow hash, which would let anyone sending keys use up the
+// server's CPU.
+func hashSecret(secret string) []byte {
+	sum := blake2b.Sum256([]byte(secret))
+	return sum[:]
+}
+
+func parseKey(raw string) (string, string, bool) {
+	parts := strings.Split(raw, "_")
+	if len(parts) != 3 || parts[0] != keyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type Repository interface {
+	// SaveAPIKey inserts a key without an ID, otherwise updates it.
+	SaveAPIKey(ctx context.Context, key Key, tx ...core.Transaction) (Key, error)
+	GetAPIKey(ctx context.Context, id int64, tx ...core.Transaction) (Key, error)
+	GetAPIKeyByPrefix(ctx context.Context, prefix string, tx ...core.Transaction) (Key, error)
+	ListAPIKeys(ctx context.Context, tx ...core.Transaction) ([]Key, error)
+	TouchAPIKey(ctx context.Context, id int64, at time.Time, tx ...core.Transaction) error
+}
@@ -0,0 +1,165 @@
+package catalog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+)
+
+type ChangeType string
+
+const (
+	ChangeCreated ChangeType = "created"
+	ChangeUpdated ChangeType = "updated"
+	ChangeDeleted ChangeType = "deleted"
+)
+
+// Change records a single product mutation. Seq is assigned when the change
+// is saved and increases with every change, so a consumer can resume from
+// the last one it saw. Product is the state after the change and is absent
+// for deletes.
+type Change struct {
+	Seq     int64      `json:"seq"`
+	Type    ChangeType `json:"type"`
+	Sku     string     `json:"sku"`
+	Product *Product   `json:"product,omitempty"`
+	Time    time.Time  `json:"time"`
+}
+
+// ChangeSubscription receives changes as they are committed. If the
+// subscriber falls behind and its buffer fills, C is closed and Dropped
+// reports true; the subscriber can catch up from GetChanges.
+type ChangeSubscription struct {
+	C <-chan Change
+
+	c       chan Change
+	feed    *changeFeed
+	dropped bool
+}
+
+func (s *ChangeSubscription) Dropped() bool {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	return s.dropped
+}
+
+// Close stops delivery to the subscription.
+func (s *ChangeSubscription) Close() {
+	s.feed.remove(s, false)
+}
+
+// changeFeed fans committed changes out to in-process subscribers without
+// ever blocking the writer.
+type changeFeed struct {
+	mu   sync.Mutex
+	subs map[*ChangeSubscription]struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subs: make(map[*ChangeSubscription]struct{})}
+}
+
+func (f *changeFeed) subscribe(buffer int) *ChangeSubscription {
+	c := make(chan Change, buffer)
+	s := &ChangeSubscription{C: c, c: c, feed: f}
+
+	f.mu.Lock()
+	f.subs[s] = struct{}{}
+	f.mu.Unlock()
+	return s
+}
+
+func (f *changeFeed) remove(s *ChangeSubscription, dropped bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removeLocked(s, dropped)
+}
+
+func (f *changeFeed) removeLocked(s *ChangeSubscription, dropped bool) {
+	if _, ok := f.subs[s]; !ok {
+		return
+	}
+	delete(f.subs, s)
+	s.dropped = dropped
+	close(s.c)
+}
+
+func (f *changeFeed) publish(changes ...Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for s := range f.subs {
+		for _, c := range changes {
+			select {
+			case s.c <- c:
+			default:
+				log.Warn().Int64("seq", c.Seq).Msg("change subscriber fell behind, dropping it")
+				f.removeLocked(s, true)
+			}
+			if _, ok := f.subs[s]; !ok {
+				break
+			}
+		}
+	}
+}
+
+func (s *service) SubscribeChanges(buffer int) *ChangeSubscription {
+	return s.changes.subscribe(buffer)
+}
+
+// GetChanges returns up to limit changes with a sequence after since, in
+// sequence order.
+func (s *service) GetChanges(ctx context.Context, since int64, limit int) ([]Change, error) {
+	if err := auth.Require(ctx, auth.PermissionRead); err != nil {
+		return nil, err
+	}
+
+	changes, err := s.repo.GetChanges(ctx, since, limit)
+	if err != nil {
+		return changes, errors.WithStack(err)
+	}
+	return changes, nil
+}
+
+// LastChangeSeq returns the sequence of the latest change, or zero when
+// there are none.
+func (s *service) LastChangeSeq(ctx context.Context) (int64, error) {
+	if err := auth.Require(ctx, auth.PermissionRead); err != nil {
+		return 0, err
+	}
+
+	seq, err := s.repo.LastChangeSeq(ctx)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return seq, nil
+}
+
+// beginChange begins a transaction that will write products and record
+// their changes. The change log is locked before anything else, so that
+// the lock is never waited for while holding a product row.
+func (s *service) beginChange(ctx context.Context) (core.Transaction, error) {
+	tx, err := s.repo.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.repo.LockChangeLog(ctx, tx); err != nil {
+		rollback(ctx, tx, err)
+		return nil, err
+	}
+	return tx, nil
+}
+
+// saveChange records a change in the transaction making it, so that the
+// change log never disagrees with the products table.
+func (s *service) saveChange(ctx context.Context, tx core.Transaction, changeType ChangeType, sku string, product *Product) (Change, error) {
+	change, err := s.repo.SaveChange(ctx, Change{Type: changeType, Sku: sku, Product: product}, tx)
+	if err != nil {
+		return change, errors.WithStack(err)
+	}
+	return change, nil
+}
@@ -0,0 +1,208 @@
+package catalog
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+)
+
+var ErrUnknownFormat = errors.New("catalog: unknown export format")
+
+type ExportFormat string
+
+const (
+	ExportCSV   ExportFormat = "csv"
+	ExportJSONL ExportFormat = "jsonl"
+	ExportXLSX  ExportFormat = "xlsx"
+)
+
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch f := ExportFormat(s); f {
+	case ExportCSV, ExportJSONL, ExportXLSX:
+		return f, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownFormat, s)
+}
+
+func (f ExportFormat) ContentType() string {
+	switch f {
+	case ExportCSV:
+		return "text/csv"
+	case ExportJSONL:
+		return "application/x-ndjson"
+	case ExportXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "application/octet-stream"
+}
+
+// ExportProducts writes every product matching the filter to w in the given
+// format. Spreadsheet formats use the same columns as an import, one row per
+// barcode, so an export can be edited and imported again. Nothing is written
+// to w until the first product has been read, so an export that fails to
+// start leaves w untouched.
+func (s *service) ExportProducts(ctx context.Context, filter ProductFilter, format ExportFormat, w io.Writer) error {
+	const funcName = "ExportProducts"
+
+	if _, err := ParseExportFormat(string(format)); err != nil {
+		return err
+	}
+	pw := &lazyExportWriter{format: format, w: w}
+
+	log.Info().
+		Str("func", funcName).
+		Str("format", string(format)).
+		Interface("filter", filter).
+		Msg("exporting products")
+
+	return s.WriteProducts(ctx, filter, pw)
+}
+
+// ProductWriter encodes a stream of products. Close is called once every
+// product has been written.
+type ProductWriter interface {
+	Write(p Product) error
+	Close() error
+}
+
+// WriteProducts streams every product matching the filter to pw, for
+// encodings that live outside of this package.
+func (s *service) WriteProducts(ctx context.Context, filter ProductFilter, pw ProductWriter) error {
+	const funcName = "WriteProducts"
+
+	if err := auth.Require(ctx, auth.PermissionRead); err != nil {
+		return err
+	}
+
+	count := 0
+	err := s.repo.StreamProducts(ctx, filter, func(p Product) error {
+		count++
+		return pw.Write(p)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = pw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Info().Str("func", funcName).Int("products", count).Msg("export complete")
+	return nil
+}
+
+// lazyExportWriter holds off creating its writer, and with it writing the
+// format's header, until there is something to write.
+type lazyExportWriter struct {
+	format ExportFormat
+	w      io.Writer
+	pw     ProductWriter
+}
+
+func (l *lazyExportWriter) Write(p Product) error {
+	if err := l.start(); err != nil {
+		return err
+	}
+	return l.pw.Write(p)
+}
+
+func (l *lazyExportWriter) Close() error {
+	if err := l.start(); err != nil {
+		return err
+	}
+	return l.pw.Close()
+}
+
+func (l *lazyExportWriter) start() error {
+	if l.pw != nil {
+		return nil
+	}
+	pw, err := newExportWriter(l.format, l.w)
+	if err != nil {
+		return err
+	}
+	l.pw = pw
+	return nil
+}
+
+func newExportWriter(format ExportFormat, w io.Writer) (ProductWriter, error) {
+	switch format {
+	case ExportCSV:
+		return newCSVExportWriter(w)
+	case ExportJSONL:
+		return &jsonlExportWriter{enc: json.NewEncoder(w)}, nil
+	case ExportXLSX:
+		return newXLSXExportWriter(w)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+}
+
+// ExportColumns are the columns written by spreadsheet exports.
+var ExportColumns = append(append([]string{}, ImportColumns...), ImportOptionalColumns...)
+
+// exportRows flattens a product into one row per barcode, in ExportColumns
+// order. A product without barcodes still gets a row.
+func exportRows(p Product) [][]string {
+	details := []string{p.Description, "", "", "", "", "", "", ""}
+	if d := p.Dimensions; d != nil {
+		details[1], details[2], details[3], details[4] = formatFloat(d.Height), formatFloat(d.Width), formatFloat(d.Depth), d.Unit
+	}
+	if w := p.Weight; w != nil {
+		details[5], details[6], details[7] = formatFloat(w.Net), formatFloat(w.Gross), w.Unit
+	}
+
+	if len(p.Barcodes) == 0 {
+		return [][]string{append([]string{p.Sku, p.Name, "", "", "", ""}, details...)}
+	}
+	rows := make([][]string, 0, len(p.Barcodes))
+	for _, b := range p.Barcodes {
+		rows = append(rows, append([]string{
+			p.Sku, p.Name, b.Gtin, string(b.PackagingLevel), strconv.Itoa(b.Quantity), strconv.FormatBool(b.Primary),
+		}, details...))
+	}
+	return rows
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer) (*csvExportWriter, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(ExportColumns); err != nil {
+		return nil, err
+	}
+	return &csvExportWriter{w: cw}, nil
+}
+
+func (c *csvExportWriter) Write(p Product) error {
+	return c.w.WriteAll(exportRows(p))
+}
+
+func (c *csvExportWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlExportWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonlExportWriter) Write(p Product) error {
+	return j.enc.Encode(p)
+}
+
+func (j *jsonlExportWriter) Close() error {
+	return nil
+}
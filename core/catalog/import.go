@@ -0,0 +1,551 @@
+package catalog
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+)
+
+const DefaultImportBatchSize = 100
+
+var ErrInvalidImport = errors.New("catalog: invalid import file")
+
+// ImportColumns are the columns expected in a product import CSV. Each row
+// describes one barcode, rows sharing a SKU are combined into one product.
+var ImportColumns = []string{"sku", "name", "gtin", "packaging_level", "quantity", "primary"}
+
+// ImportOptionalColumns describe the product rather than a barcode, so only
+// need to be filled in on one of a product's rows.
+var ImportOptionalColumns = []string{
+	"description", "height", "width", "depth", "dimension_unit", "net_weight", "gross_weight", "weight_unit",
+}
+
+// ImportItem is a product read from an import file along with the data rows
+// it was built from, so that errors can be reported against them. Rows[i] is
+// the row Product.Barcodes[i] was read from.
+type ImportItem struct {
+	Rows    []int
+	Product Product
+}
+
+type ImportOptions struct {
+	DryRun    bool
+	BatchSize int
+	// Progress, when set, is called once products have been validated and
+	// again after every batch is saved.
+	Progress func(ImportResult)
+	// Resume, when set, is the last progress reported by an earlier attempt
+	// at the same import. The products it processed aren't saved again, and
+	// the errors it reported for them are kept.
+	Resume *ImportResult
+}
+
+type RowError struct {
+	Row   int    `json:"row"`
+	Sku   string `json:"sku,omitempty"`
+	Error string `json:"error"`
+}
+
+type ImportResult struct {
+	DryRun    bool       `json:"dryRun"`
+	Rows      int        `json:"rows"`
+	Products  int        `json:"products"`
+	Processed int        `json:"processed"`
+	Valid     int        `json:"valid"`
+	Imported  int        `json:"imported"`
+	Errors    []RowError `json:"errors"`
+}
+
+// ReadImportCSV parses a product import file. Rows that cannot be parsed are
+// returned as row errors and the product they belong to is left out of the
+// returned items, with an error for each of its other rows as well. Rows are
+// numbered from 1, not counting the header.
+func ReadImportCSV(r io.Reader) ([]ImportItem, []RowError, int, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil, 0, errors.Wrap(ErrInvalidImport, "file is empty")
+		}
+		return nil, nil, 0, errors.Wrap(ErrInvalidImport, err.Error())
+	}
+	cols, err := importColumnIndexes(header)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var (
+		items   []ImportItem
+		rowErrs []RowError
+		bySku   = make(map[string]int)
+		invalid = make(map[string]bool)
+		row     = 0
+	)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		row++
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+				rowErrs = append(rowErrs, RowError{Row: row, Error: err.Error()})
+				continue
+			}
+			return nil, nil, row, errors.Wrap(ErrInvalidImport, err.Error())
+		}
+
+		field := func(name string) string {
+			i, ok := cols[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		sku := field("sku")
+		if sku == "" {
+			rowErrs = append(rowErrs, RowError{Row: row, Error: "sku is required"})
+			continue
+		}
+
+		barcode, err := parseImportBarcode(field("gtin"), field("packaging_level"), field("quantity"), field("primary"))
+		if err != nil {
+			rowErrs = append(rowErrs, RowError{Row: row, Sku: sku, Error: err.Error()})
+			invalid[sku] = true
+			continue
+		}
+
+		details, err := parseImportDetails(field)
+		if err != nil {
+			rowErrs = append(rowErrs, RowError{Row: row, Sku: sku, Error: err.Error()})
+			invalid[sku] = true
+			continue
+		}
+
+		i, ok := bySku[sku]
+		if !ok {
+			bySku[sku] = len(items)
+			items = append(items, ImportItem{Product: Product{Sku: sku, Name: field("name")}})
+			i = len(items) - 1
+		}
+		item := &items[i]
+
+		if name := field("name"); name != "" && item.Product.Name != "" && name != item.Product.Name {
+			rowErrs = append(rowErrs, RowError{Row: row, Sku: sku,
+				Error: fmt.Sprintf("name %q does not match %q given on an earlier row", name, item.Product.Name)})
+			invalid[sku] = true
+			continue
+		} else if item.Product.Name == "" {
+			item.Product.Name = name
+		}
+		item.Rows = append(item.Rows, row)
+		item.Product.Barcodes = append(item.Product.Barcodes, barcode)
+		item.Product.addDetails(details)
+	}
+
+	valid := items[:0]
+	for _, item := range items {
+		if invalid[item.Product.Sku] {
+			rowErrs = append(rowErrs, notImported(item, nil)...)
+			continue
+		}
+		valid = append(valid, item)
+	}
+
+	return valid, rowErrs, row, nil
+}
+
+func importColumnIndexes(header []string) (map[string]int, error) {
+	cols := make(map[string]int, len(header))
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, c := range ImportColumns {
+		if _, ok := cols[c]; !ok {
+			return nil, errors.Wrapf(ErrInvalidImport, "missing column %q", c)
+		}
+	}
+	return cols, nil
+}
+
+// parseImportDetails reads the optional product columns of a row. Each group
+// of measurements is left nil when all of its columns are empty.
+func parseImportDetails(field func(string) string) (Product, error) {
+	p := Product{Description: field("description")}
+
+	number := func(name string) (float64, error) {
+		v := field(name)
+		if v == "" {
+			return 0, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s %q is not a number", name, v)
+		}
+		return f, nil
+	}
+
+	if field("height") != "" || field("width") != "" || field("depth") != "" || field("dimension_unit") != "" {
+		d := &Dimensions{Unit: strings.ToUpper(field("dimension_unit"))}
+		var err error
+		if d.Height, err = number("height"); err != nil {
+			return p, err
+		}
+		if d.Width, err = number("width"); err != nil {
+			return p, err
+		}
+		if d.Depth, err = number("depth"); err != nil {
+			return p, err
+		}
+		p.Dimensions = d
+	}
+
+	if field("net_weight") != "" || field("gross_weight") != "" || field("weight_unit") != "" {
+		w := &Weight{Unit: strings.ToUpper(field("weight_unit"))}
+		var err error
+		if w.Net, err = number("net_weight"); err != nil {
+			return p, err
+		}
+		if w.Gross, err = number("gross_weight"); err != nil {
+			return p, err
+		}
+		p.Weight = w
+	}
+
+	return p, nil
+}
+
+// addDetails fills in whichever of the optional fields the product doesn't
+// have yet, the first row to give a value wins.
+func (p *Product) addDetails(d Product) {
+	if p.Description == "" {
+		p.Description = d.Description
+	}
+	if p.Dimensions == nil {
+		p.Dimensions = d.Dimensions
+	}
+	if p.Weight == nil {
+		p.Weight = d.Weight
+	}
+}
+
+func parseImportBarcode(gtin, level, quantity, primary string) (Barcode, error) {
+	b := Barcode{Gtin: gtin, PackagingLevel: PackagingLevel(strings.ToLower(level))}
+
+	q, err := strconv.Atoi(quantity)
+	if err != nil {
+		return b, fmt.Errorf("quantity %q is not a number", quantity)
+	}
+	b.Quantity = q
+
+	if primary != "" {
+		p, err := strconv.ParseBool(primary)
+		if err != nil {
+			return b, fmt.Errorf("primary %q is not true or false", primary)
+		}
+		b.Primary = p
+	}
+	return b, nil
+}
+
+// ImportProducts reads a product import CSV, validates every product in it
+// and, unless this is a dry run, saves the valid ones in transactions of
+// opts.BatchSize products. Each product is saved in a savepoint of its own,
+// so one that fails is reported against its rows and the rest of its batch
+// is still saved. A batch that fails to commit is reported against every
+// row of it.
+func (s *service) ImportProducts(ctx context.Context, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	if err := auth.Require(ctx, auth.PermissionWrite); err != nil {
+		return ImportResult{}, err
+	}
+
+	items, rowErrs, rows, err := ReadImportCSV(r)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	result := ImportResult{DryRun: opts.DryRun, Rows: rows, Products: len(items), Errors: rowErrs}
+	if result.Errors == nil {
+		result.Errors = []RowError{}
+	}
+
+	result, err = s.importItems(ctx, items, result, opts)
+	if err != nil {
+		return result, err
+	}
+
+	sort.SliceStable(result.Errors, func(i, j int) bool {
+		return result.Errors[i].Row < result.Errors[j].Row
+	})
+	return result, nil
+}
+
+// ImportItems validates and saves products decoded from some other kind of
+// document, the same way ImportProducts does for a CSV. Errors are reported
+// against each item's Rows.
+func (s *service) ImportItems(ctx context.Context, items []ImportItem, opts ImportOptions) (ImportResult, error) {
+	if err := auth.Require(ctx, auth.PermissionWrite); err != nil {
+		return ImportResult{}, err
+	}
+
+	result := ImportResult{DryRun: opts.DryRun, Products: len(items), Errors: []RowError{}}
+	for _, item := range items {
+		result.Rows += len(item.Rows)
+	}
+	return s.importItems(ctx, items, result, opts)
+}
+
+func (s *service) importItems(ctx context.Context, items []ImportItem, result ImportResult, opts ImportOptions) (ImportResult, error) {
+	const funcName = "ImportProducts"
+
+	if opts.BatchSize < 1 {
+		opts.BatchSize = DefaultImportBatchSize
+	}
+	progress := func() {
+		if opts.Progress != nil {
+			opts.Progress(result)
+		}
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int("products", len(items)).
+		Bool("dryRun", opts.DryRun).
+		Msg("importing products")
+
+	gtins := make(map[string]string)
+	valid := make([]ImportItem, 0, len(items))
+	for _, item := range items {
+		errs, err := s.validateImportItem(ctx, item, gtins)
+		if err != nil {
+			return result, err
+		}
+		if len(errs) > 0 {
+			result.Errors = append(result.Errors, notImported(item, errs)...)
+			continue
+		}
+		valid = append(valid, item)
+	}
+	result.Valid = len(valid)
+	result.Processed = len(items) - len(valid)
+
+	if opts.DryRun {
+		result.Processed = len(items)
+		progress()
+		return result, nil
+	}
+
+	// Invalid products are processed first, then the valid ones in order, so
+	// the earlier attempt got through this many of the valid ones.
+	done := 0
+	if r := opts.Resume; r != nil && r.Processed > result.Processed {
+		done = r.Processed - result.Processed
+		if done > len(valid) {
+			done = len(valid)
+		}
+		result.Imported = r.Imported
+		result.Errors = append(result.Errors, resumedErrors(valid[:done], r.Errors)...)
+		result.Processed += done
+		log.Info().Str("func", funcName).Int("skipped", done).Msg("resuming import")
+	}
+	progress()
+
+	for start := done; start < len(valid); start += opts.BatchSize {
+		if err := ctx.Err(); err != nil {
+			return result, errors.WithStack(err)
+		}
+
+		end := start + opts.BatchSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+		batch := valid[start:end]
+
+		failed, err := s.saveImportBatch(ctx, batch)
+		if err != nil {
+			log.Warn().Err(err).Str("func", funcName).Int("size", len(batch)).Msg("import batch failed")
+		}
+		for n, item := range batch {
+			itemErr := failed[n]
+			if itemErr == nil {
+				itemErr = err
+			}
+			if itemErr != nil {
+				result.Errors = append(result.Errors, itemErrors(item, itemErr)...)
+				continue
+			}
+			result.Imported++
+		}
+		result.Processed += len(batch)
+		progress()
+	}
+
+	return result, nil
+}
+
+// validateImportItem returns every problem found with the item, each
+// reported against the row it comes from when it can be. The error is only
+// for failing to check.
+func (s *service) validateImportItem(ctx context.Context, item ImportItem, gtins map[string]string) ([]RowError, error) {
+	p := &item.Product
+	var errs []RowError
+	report := func(i int, err error) {
+		rows := item.Rows
+		if i >= 0 && len(item.Rows) == len(p.Barcodes) {
+			rows = item.Rows[i : i+1]
+		}
+		for _, row := range rows {
+			errs = append(errs, RowError{Row: row, Sku: p.Sku, Error: err.Error()})
+		}
+	}
+
+	barcodeErrs := false
+	for i, b := range p.Barcodes {
+		if err := b.Validate(); err != nil {
+			report(i, err)
+			barcodeErrs = true
+			continue
+		}
+		gtin := NormalizeGtin(b.Gtin)
+		if sku, ok := gtins[gtin]; ok && sku != p.Sku {
+			report(i, errors.Wrapf(core.ErrConflict, "gtin %s is also given for sku %s", gtin, sku))
+			continue
+		}
+		if err := s.checkBarcodeAvailable(ctx, p.Sku, gtin); err != nil {
+			if !isImportError(err) {
+				return nil, err
+			}
+			report(i, err)
+		}
+	}
+	// Validate stops at the first bad barcode, which is already reported.
+	if err := p.Validate(); err != nil && !(barcodeErrs && errors.Is(err, ErrInvalidBarcode)) {
+		report(-1, err)
+	}
+	if len(errs) > 0 {
+		return errs, nil
+	}
+
+	for _, b := range p.Barcodes {
+		gtins[b.Gtin] = p.Sku
+	}
+	return nil, nil
+}
+
+// saveImportBatch saves the batch in one transaction, each product in a
+// savepoint of its own. It returns the error each product that wasn't saved
+// failed with by its index in the batch, and an error when the batch as a
+// whole wasn't.
+func (s *service) saveImportBatch(ctx context.Context, batch []ImportItem) (map[int]error, error) {
+	skus := make([]string, 0, len(batch))
+	for _, item := range batch {
+		skus = append(skus, item.Product.Sku)
+	}
+	existing, err := s.repo.GetProducts(ctx, skus)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, p := range existing {
+		exists[p.Sku] = true
+	}
+
+	tx, err := s.beginChange(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	failed := make(map[int]error)
+	changes := make([]Change, 0, len(batch))
+	for i := range batch {
+		product := &batch[i].Product
+		var change Change
+		err = s.repo.Savepoint(ctx, tx, func() error {
+			if err := s.repo.SaveProduct(ctx, *product, tx); err != nil {
+				return errors.WithStack(err)
+			}
+
+			changeType := ChangeCreated
+			if exists[product.Sku] {
+				changeType = ChangeUpdated
+			}
+			saved, err := s.saveChange(ctx, tx, changeType, product.Sku, product)
+			change = saved
+			return err
+		})
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		changes = append(changes, change)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		rollback(ctx, tx, err)
+		return failed, errors.WithStack(err)
+	}
+
+	s.changes.publish(changes...)
+	return failed, nil
+}
+
+// resumedErrors picks the errors an earlier attempt reported for the items
+// it saved, or failed to.
+func resumedErrors(items []ImportItem, errs []RowError) []RowError {
+	rows := make(map[int]bool)
+	for _, item := range items {
+		for _, row := range item.Rows {
+			rows[row] = true
+		}
+	}
+	var resumed []RowError
+	for _, e := range errs {
+		if rows[e.Row] {
+			resumed = append(resumed, e)
+		}
+	}
+	return resumed
+}
+
+func isImportError(err error) bool {
+	return errors.Is(err, ErrInvalidProduct) || errors.Is(err, ErrInvalidBarcode) || errors.Is(err, core.ErrConflict)
+}
+
+// notImported adds an error to errs for each row of the item that has none of
+// its own, since the whole product is left out because of them.
+func notImported(item ImportItem, errs []RowError) []RowError {
+	reported := make(map[int]bool, len(errs))
+	for _, e := range errs {
+		reported[e.Row] = true
+	}
+	for _, row := range item.Rows {
+		if !reported[row] {
+			errs = append(errs, RowError{Row: row, Sku: item.Product.Sku,
+				Error: "not imported because of errors on other rows of this sku"})
+		}
+	}
+	return errs
+}
+
+func itemErrors(item ImportItem, err error) []RowError {
+	errs := make([]RowError, 0, len(item.Rows))
+	for _, row := range item.Rows {
+		errs = append(errs, RowError{Row: row, Sku: item.Product.Sku, Error: err.Error()})
+	}
+	return errs
+}
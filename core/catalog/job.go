@@ -0,0 +1,293 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+)
+
+const (
+	DefaultJobWorkers = 2
+	jobPollInterval   = 10 * time.Second
+
+	// jobLease is how long a running job can go without a heartbeat before
+	// it is assumed abandoned, by an instance that died, and claimed again.
+	jobLease       = time.Minute
+	jobMaxAttempts = 3
+)
+
+type JobType string
+
+const JobTypeImport JobType = "import"
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+)
+
+func (s JobStatus) Finished() bool {
+	return s == JobCompleted || s == JobFailed
+}
+
+// Job is a unit of background work, such as a large import, whose progress
+// can be polled while it runs. Succeeded counts products imported, or found
+// valid on a dry run, and Failed counts rows reported in Errors.
+type Job struct {
+	ID         int64      `json:"id"`
+	Type       JobType    `json:"type"`
+	Status     JobStatus  `json:"status"`
+	DryRun     bool       `json:"dryRun"`
+	BatchSize  int        `json:"batchSize"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	Succeeded  int        `json:"succeeded"`
+	Failed     int        `json:"failed"`
+	Message    string     `json:"message,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Attempts   int        `json:"attempts"`
+	Errors     []RowError `json:"-"`
+	// ClaimToken identifies the worker running the job, only its updates are
+	// saved.
+	ClaimToken string `json:"-"`
+}
+
+// SubmitImport queues an import to be run by the job workers and returns
+// the job straight away. The header is checked up front so that a file
+// which could never be imported is rejected before it is queued.
+func (s *service) SubmitImport(ctx context.Context, r io.Reader, opts ImportOptions) (Job, error) {
+	const funcName = "SubmitImport"
+
+	if err := auth.Require(ctx, auth.PermissionWrite); err != nil {
+		return Job{}, err
+	}
+
+	input, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Job{}, errors.Wrap(ErrInvalidImport, err.Error())
+	}
+
+	header, err := csv.NewReader(bytes.NewReader(input)).Read()
+	if err != nil {
+		return Job{}, errors.Wrap(ErrInvalidImport, "unable to read header")
+	}
+	if _, err = importColumnIndexes(header); err != nil {
+		return Job{}, err
+	}
+
+	job, err := s.repo.CreateJob(ctx, Job{
+		Type:      JobTypeImport,
+		Status:    JobQueued,
+		DryRun:    opts.DryRun,
+		BatchSize: opts.BatchSize,
+	}, input)
+	if err != nil {
+		return job, errors.WithStack(err)
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int64("job", job.ID).
+		Int("bytes", len(input)).
+		Msg("queued import job")
+
+	s.wakeJobWorkers()
+	return job, nil
+}
+
+func (s *service) GetJob(ctx context.Context, id int64) (Job, error) {
+	if err := auth.Require(ctx, auth.PermissionRead); err != nil {
+		return Job{}, err
+	}
+
+	job, err := s.repo.GetJob(ctx, id)
+	if err != nil {
+		return job, errors.WithStack(err)
+	}
+	return job, nil
+}
+
+// StartJobWorkers runs workers in the background until ctx is done. Queued
+// jobs are claimed from the repository, so jobs submitted to any instance,
+// or left queued by a restart, are picked up. Jobs left running by an
+// instance that died are claimed again once their lease runs out.
+func (s *service) StartJobWorkers(ctx context.Context, workers int) {
+	log.Info().Int("workers", workers).Msg("starting job workers")
+	for i := 0; i < workers; i++ {
+		go s.jobWorker(ctx)
+	}
+}
+
+func (s *service) wakeJobWorkers() {
+	select {
+	case s.jobSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *service) jobWorker(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.runQueuedJobs(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.jobSignal:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *service) runQueuedJobs(ctx context.Context) {
+	for ctx.Err() == nil {
+		token, err := newToken()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to claim job")
+			return
+		}
+		job, input, err := s.repo.ClaimJob(ctx, token, jobLease)
+		if err != nil {
+			if !errors.Is(err, core.ErrNotFound) {
+				log.Error().Err(err).Msg("failed to claim job")
+			}
+			return
+		}
+
+		// There may be more queued, let an idle worker look while this one is busy.
+		s.wakeJobWorkers()
+		s.runJob(ctx, job, input)
+	}
+}
+
+func (s *service) runJob(ctx context.Context, job Job, input []byte) {
+	const funcName = "runJob"
+
+	log.Info().
+		Str("func", funcName).
+		Int64("job", job.ID).
+		Str("type", string(job.Type)).
+		Int("attempt", job.Attempts).
+		Msg("running job")
+
+	// A job that keeps being abandoned is likely what is killing its worker.
+	if job.Attempts > jobMaxAttempts {
+		s.finishJob(ctx, job, errors.Errorf("job abandoned after %d attempts", jobMaxAttempts))
+		return
+	}
+
+	// Once the job is reclaimed by another worker this one stops, and leaves
+	// the job to it.
+	jobCtx, lost := context.WithCancel(ctx)
+	defer lost()
+	go s.heartbeatJob(jobCtx, job, lost)
+
+	opts := ImportOptions{
+		DryRun:    job.DryRun,
+		BatchSize: job.BatchSize,
+		Progress: func(p ImportResult) {
+			job.setProgress(p)
+			s.updateJob(jobCtx, job, lost)
+		},
+	}
+	// An earlier attempt's products aren't saved again, which would record
+	// their changes twice.
+	if job.Processed > 0 {
+		opts.Resume = &ImportResult{Processed: job.Processed, Imported: job.Succeeded, Errors: job.Errors}
+	}
+
+	result, err := s.ImportProducts(jobCtx, bytes.NewReader(input), opts)
+	if jobCtx.Err() != nil && ctx.Err() == nil {
+		log.Warn().Int64("job", job.ID).Msg("job was reclaimed by another worker")
+		return
+	}
+	if err == nil {
+		job.setProgress(result)
+	}
+	s.finishJob(ctx, job, err)
+}
+
+// updateJob saves a job's progress, and calls lost if its claim has been
+// taken over.
+func (s *service) updateJob(ctx context.Context, job Job, lost func()) {
+	err := s.repo.UpdateJob(ctx, job)
+	if errors.Is(err, core.ErrNotFound) {
+		lost()
+	} else if err != nil && ctx.Err() == nil {
+		log.Warn().Err(err).Int64("job", job.ID).Msg("failed to record job progress")
+	}
+}
+
+// finishJob records the outcome of a job, which also lets the repository
+// drop its input.
+func (s *service) finishJob(ctx context.Context, job Job, err error) {
+	const funcName = "finishJob"
+
+	now := time.Now()
+	job.FinishedAt = &now
+	if err != nil {
+		log.Error().Err(err).Str("func", funcName).Int64("job", job.ID).Msg("job failed")
+		job.Status = JobFailed
+		job.Message = err.Error()
+	} else {
+		job.Status = JobCompleted
+	}
+
+	err = s.repo.UpdateJob(ctx, job)
+	if errors.Is(err, core.ErrNotFound) {
+		log.Warn().Str("func", funcName).Int64("job", job.ID).Msg("job was reclaimed by another worker")
+	} else if err != nil {
+		log.Error().Err(err).Str("func", funcName).Int64("job", job.ID).Msg("failed to record job result")
+	}
+}
+
+// heartbeatJob keeps a running job's lease until ctx is done, or calls lost
+// when the job has been claimed by another worker. Progress updates renew
+// it too, but a single slow batch can take longer than that.
+func (s *service) heartbeatJob(ctx context.Context, job Job, lost func()) {
+	ticker := time.NewTicker(jobLease / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.repo.HeartbeatJob(ctx, job.ID, job.ClaimToken)
+			if errors.Is(err, core.ErrNotFound) {
+				lost()
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Warn().Err(err).Int64("job", job.ID).Msg("failed to record job heartbeat")
+			}
+		}
+	}
+}
+
+func (j *Job) setProgress(r ImportResult) {
+	j.Total = r.Products
+	j.Processed = r.Processed
+	j.Failed = len(r.Errors)
+	j.Errors = r.Errors
+	if r.DryRun {
+		j.Succeeded = r.Valid
+	} else {
+		j.Succeeded = r.Imported
+	}
+}
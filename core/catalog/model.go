@@ -1,8 +1,236 @@
 package catalog
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidProduct = errors.New("catalog: invalid product")
+	ErrInvalidBarcode = errors.New("catalog: invalid barcode")
+)
+
+// PackagingLevel describes the unit of packaging a barcode identifies.
+type PackagingLevel string
+
+const (
+	PackagingEach  PackagingLevel = "each"
+	PackagingInner PackagingLevel = "inner"
+	PackagingCase  PackagingLevel = "case"
+)
+
+func (l PackagingLevel) Valid() bool {
+	switch l {
+	case PackagingEach, PackagingInner, PackagingCase:
+		return true
+	}
+	return false
+}
+
 // Product is a value object. A SKU able to be produced by the factory.
+// Dimensions and Weight describe a single each.
 type Product struct {
-	Sku  string `json:"sku"`
-	Upc  string `json:"upc"`
-	Name string `json:"name"`
+	Sku         string      `json:"sku"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Dimensions  *Dimensions `json:"dimensions,omitempty"`
+	Weight      *Weight     `json:"weight,omitempty"`
+	Barcodes    []Barcode   `json:"barcodes"`
+}
+
+// Dimensions of a product. Unit is a UN/CEFACT code, one of MMT, CMT, MTR,
+// INH or FOT.
+type Dimensions struct {
+	Height float64 `json:"height"`
+	Width  float64 `json:"width"`
+	Depth  float64 `json:"depth"`
+	Unit   string  `json:"unit"`
+}
+
+// Weight of a product. Unit is a UN/CEFACT code, one of GRM, KGM, LBR or ONZ.
+type Weight struct {
+	Net   float64 `json:"net"`
+	Gross float64 `json:"gross"`
+	Unit  string  `json:"unit"`
+}
+
+var (
+	dimensionUnits = map[string]bool{"MMT": true, "CMT": true, "MTR": true, "INH": true, "FOT": true}
+	weightUnits    = map[string]bool{"GRM": true, "KGM": true, "LBR": true, "ONZ": true}
+)
+
+func (d Dimensions) Validate() error {
+	if d.Height < 0 || d.Width < 0 || d.Depth < 0 {
+		return fmt.Errorf("%w: dimensions can't be negative", ErrInvalidProduct)
+	}
+	if !dimensionUnits[d.Unit] {
+		return fmt.Errorf("%w: unknown dimension unit %q", ErrInvalidProduct, d.Unit)
+	}
+	return nil
+}
+
+func (w Weight) Validate() error {
+	if w.Net < 0 || w.Gross < 0 {
+		return fmt.Errorf("%w: weights can't be negative", ErrInvalidProduct)
+	}
+	if w.Gross > 0 && w.Net > w.Gross {
+		return fmt.Errorf("%w: net weight is more than gross weight", ErrInvalidProduct)
+	}
+	if !weightUnits[w.Unit] {
+		return fmt.Errorf("%w: unknown weight unit %q", ErrInvalidProduct, w.Unit)
+	}
+	return nil
+}
+
+// ProductFilter narrows a product list or export. Empty fields match
+// everything. AfterSku skips SKUs up to and including it, so that a walk
+// through the catalog in SKU order can be picked up where it stopped.
+type ProductFilter struct {
+	SkuPrefix string
+	Name      string
+	Gtin      string
+	AfterSku  string
+}
+
+// Barcode is a GTIN identifying a product at a given packaging level. GTINs
+// are globally unique, no two products may share one.
+type Barcode struct {
+	Gtin           string         `json:"gtin"`
+	PackagingLevel PackagingLevel `json:"packagingLevel"`
+	Quantity       int            `json:"quantity"`
+	Primary        bool           `json:"primary"`
+}
+
+// PrimaryBarcode returns the barcode flagged as primary, if there is one.
+func (p Product) PrimaryBarcode() (Barcode, bool) {
+	for _, b := range p.Barcodes {
+		if b.Primary {
+			return b, true
+		}
+	}
+	return Barcode{}, false
+}
+
+// Equal reports whether two products hold the same data, regardless of the
+// order of their barcodes.
+func (p Product) Equal(o Product) bool {
+	if p.Sku != o.Sku || p.Name != o.Name || p.Description != o.Description {
+		return false
+	}
+	if (p.Dimensions == nil) != (o.Dimensions == nil) || (p.Dimensions != nil && *p.Dimensions != *o.Dimensions) {
+		return false
+	}
+	if (p.Weight == nil) != (o.Weight == nil) || (p.Weight != nil && *p.Weight != *o.Weight) {
+		return false
+	}
+	if len(p.Barcodes) != len(o.Barcodes) {
+		return false
+	}
+	barcodes := make(map[string]Barcode, len(p.Barcodes))
+	for _, b := range p.Barcodes {
+		barcodes[b.Gtin] = b
+	}
+	for _, b := range o.Barcodes {
+		if barcodes[b.Gtin] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that the product has its required fields and that its
+// barcodes are well formed, unique within the product and that exactly one
+// of them is primary. Valid GTINs are zero padded to GTIN-14, so that an
+// item is stored and compared the same way however its barcode was given.
+func (p *Product) Validate() error {
+	if p.Sku == "" || p.Name == "" {
+		return fmt.Errorf("%w: missing required field(s)", ErrInvalidProduct)
+	}
+	if len(p.Barcodes) == 0 {
+		return fmt.Errorf("%w: at least one barcode is required", ErrInvalidProduct)
+	}
+	if p.Dimensions != nil {
+		if err := p.Dimensions.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.Weight != nil {
+		if err := p.Weight.Validate(); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool, len(p.Barcodes))
+	primaries := 0
+	for i, b := range p.Barcodes {
+		if err := b.Validate(); err != nil {
+			return err
+		}
+		b.Gtin = NormalizeGtin(b.Gtin)
+		p.Barcodes[i] = b
+		if seen[b.Gtin] {
+			return fmt.Errorf("%w: duplicate gtin %s", ErrInvalidBarcode, b.Gtin)
+		}
+		seen[b.Gtin] = true
+		if b.Primary {
+			primaries++
+		}
+	}
+	if primaries != 1 {
+		return fmt.Errorf("%w: exactly one primary barcode is required", ErrInvalidBarcode)
+	}
+	return nil
+}
+
+func (b Barcode) Validate() error {
+	if !ValidGtin(b.Gtin) {
+		return fmt.Errorf("%w: gtin %q is not a valid GTIN-8, 12, 13 or 14", ErrInvalidBarcode, b.Gtin)
+	}
+	if !b.PackagingLevel.Valid() {
+		return fmt.Errorf("%w: unknown packaging level %q", ErrInvalidBarcode, b.PackagingLevel)
+	}
+	if b.Quantity < 1 {
+		return fmt.Errorf("%w: quantity for gtin %s must be positive", ErrInvalidBarcode, b.Gtin)
+	}
+	return nil
+}
+
+// NormalizeGtin zero pads a valid GTIN-8, 12 or 13 to the GTIN-14 naming the
+// same item, 036000291452 and 00036000291452 are one barcode. Anything else
+// is returned as given.
+func NormalizeGtin(gtin string) string {
+	if len(gtin) >= 14 || !ValidGtin(gtin) {
+		return gtin
+	}
+	return strings.Repeat("0", 14-len(gtin)) + gtin
+}
+
+// ValidGtin reports whether gtin is a GTIN-8, 12, 13 or 14 with a correct
+// check digit.
+func ValidGtin(gtin string) bool {
+	switch len(gtin) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+
+	sum := 0
+	for i := len(gtin) - 2; i >= 0; i-- {
+		c := gtin[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if (len(gtin)-2-i)%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+
+	check := gtin[len(gtin)-1]
+	if check < '0' || check > '9' {
+		return false
+	}
+	return (10-sum%10)%10 == int(check-'0')
 }
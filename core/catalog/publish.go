@@ -0,0 +1,141 @@
+package catalog
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/core"
+)
+
+const (
+	publishPollInterval = 5 * time.Second
+	publishBatchSize    = 100
+	publishWakeBuffer   = 16
+
+	// publishLease is how long a publisher holds the cursor. A batch stops
+	// taking on changes after half of it, so that a publish still retrying
+	// then finishes before another publisher can take over.
+	publishLease = time.Minute
+)
+
+// StartPublisher publishes recorded changes to the queue in the background
+// until ctx is done. The change log acts as an outbox: the last change
+// published is kept in the repository and leased while publishing, so
+// changes go out once, in order, however many instances run publishers, and
+// changes made while the queue is unreachable go out once it's back. The
+// lease isn't a transaction, so none is held open while waiting on the
+// queue. A queue with several Destinations gets a publisher, and a cursor,
+// for each.
+func (s *service) StartPublisher(ctx context.Context) {
+	for _, d := range s.destinations() {
+		log.Info().Str("destination", d.Name).Msg("starting change publisher")
+		go s.publisher(ctx, d)
+	}
+}
+
+func (s *service) destinations() []Destination {
+	if d, ok := s.queue.(Destinations); ok {
+		return d.Destinations()
+	}
+	return []Destination{{Queue: s.queue}}
+}
+
+func (s *service) publisher(ctx context.Context, dest Destination) {
+	ticker := time.NewTicker(publishPollInterval)
+	defer ticker.Stop()
+
+	token, err := newToken()
+	if err != nil {
+		log.Error().Err(err).Str("destination", dest.Name).Msg("unable to start change publisher")
+		return
+	}
+
+	// Changes committed here are published straight away rather than on the
+	// next tick.
+	sub := s.changes.subscribe(publishWakeBuffer)
+	defer func() { sub.Close() }()
+
+	for {
+		if err := s.publishChanges(ctx, dest, token); err != nil {
+			log.Error().Err(err).Str("destination", dest.Name).Msg("failed to publish changes")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case _, ok := <-sub.C:
+			if !ok {
+				sub = s.changes.subscribe(publishWakeBuffer)
+			}
+		}
+	}
+}
+
+func (s *service) publishChanges(ctx context.Context, dest Destination, token string) error {
+	for ctx.Err() == nil {
+		n, err := s.publishBatch(ctx, dest, token)
+		if err != nil || n < publishBatchSize {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishBatch publishes the changes after the destination's cursor, and
+// advances it past those that were published even when a later one fails.
+func (s *service) publishBatch(ctx context.Context, dest Destination, token string) (int, error) {
+	last, err := s.repo.ClaimPublishCursor(ctx, dest.Name, token, publishLease)
+	if err != nil {
+		if errors.Is(err, core.ErrNotFound) {
+			// Another instance is publishing.
+			return 0, nil
+		}
+		return 0, errors.WithStack(err)
+	}
+
+	changes, err := s.repo.GetChanges(ctx, last, publishBatchSize)
+	if err != nil || len(changes) == 0 {
+		s.savePublishCursor(ctx, dest, token, last)
+		return 0, errors.WithStack(err)
+	}
+
+	deadline := time.Now().Add(publishLease / 2)
+	published := 0
+	var publishErr error
+	for _, c := range changes {
+		if time.Now().After(deadline) {
+			break
+		}
+		if publishErr = dest.Queue.PublishChange(ctx, c); publishErr != nil {
+			publishErr = errors.WithMessagef(publishErr, "failed to publish change %d", c.Seq)
+			break
+		}
+		last = c.Seq
+		published++
+	}
+
+	if err = s.savePublishCursor(ctx, dest, token, last); err != nil {
+		return 0, err
+	}
+
+	log.Debug().Str("destination", dest.Name).Int("published", published).Int64("seq", last).Msg("published changes")
+	if publishErr != nil {
+		return published, publishErr
+	}
+	return len(changes), nil
+}
+
+func (s *service) savePublishCursor(ctx context.Context, dest Destination, token string, seq int64) error {
+	err := s.repo.SavePublishCursor(ctx, dest.Name, token, seq)
+	if errors.Is(err, core.ErrNotFound) {
+		// The changes are published again by whoever took over, and consumers
+		// discard those they've seen by ID.
+		log.Warn().Str("destination", dest.Name).Int64("seq", seq).Msg("publish cursor lease ran out")
+	} else if err != nil {
+		log.Error().Err(err).Str("destination", dest.Name).Int64("seq", seq).Msg("failed to save publish cursor")
+	}
+	return errors.WithStack(err)
+}
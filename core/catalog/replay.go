@@ -0,0 +1,161 @@
+package catalog
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+)
+
+const (
+	DefaultReplayRate  = 100
+	MaxReplayRate      = 10000
+	replayProgressStep = 100
+
+	// replayPageSize is how many products are read at a time. Each page is
+	// read on its own, so no transaction is held open while throttling.
+	replayPageSize = 500
+)
+
+var ErrUnknownDestination = errors.New("catalog: unknown replay destination")
+
+// ReplayTarget is where replayed products are sent: the named Destination,
+// which can be left empty when changes are only published to one. Exchange
+// and RoutingKey apply to a RabbitMQ or NATS destination and Topic to a
+// Kafka one, and when empty the exchange or topic changes are published to
+// is used.
+type ReplayTarget struct {
+	Destination string `json:"destination,omitempty"`
+	Exchange    string `json:"exchange,omitempty"`
+	RoutingKey  string `json:"routingKey,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+}
+
+// ReplayDestination returns the one of destinations target names.
+func ReplayDestination(destinations []Destination, target ReplayTarget) (Destination, error) {
+	if target.Destination == "" {
+		if len(destinations) == 1 {
+			return destinations[0], nil
+		}
+		return Destination{}, errors.WithMessage(ErrUnknownDestination, "a destination has to be named when changes are published to several")
+	}
+	for _, d := range destinations {
+		if d.Name == target.Destination {
+			return d, nil
+		}
+	}
+	return Destination{}, errors.WithMessagef(ErrUnknownDestination, "%q", target.Destination)
+}
+
+// ReplayOptions selects the products to replay with Filter, in SKU order,
+// and sends at most Rate a second. A replay stopped by an error or by Limit
+// is resumed by setting Filter.AfterSku to the result's LastSku.
+type ReplayOptions struct {
+	Filter   ProductFilter
+	Target   ReplayTarget
+	Rate     int
+	Limit    int
+	Progress func(ReplayResult)
+}
+
+// ReplayResult counts the products sent. Done is set once every product
+// matching the filter has been.
+type ReplayResult struct {
+	Published int    `json:"published"`
+	LastSku   string `json:"lastSku,omitempty"`
+	Done      bool   `json:"done"`
+}
+
+// ReplayProducts publishes a snapshot of every product matching the filter,
+// so that a consumer which has lost its copy of the catalog can rebuild it.
+func (s *service) ReplayProducts(ctx context.Context, opts ReplayOptions) (ReplayResult, error) {
+	const funcName = "ReplayProducts"
+
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return ReplayResult{}, err
+	}
+
+	dest, err := ReplayDestination(s.destinations(), opts.Target)
+	if err != nil {
+		return ReplayResult{LastSku: opts.Filter.AfterSku}, err
+	}
+
+	if opts.Rate <= 0 {
+		opts.Rate = DefaultReplayRate
+	} else if opts.Rate > MaxReplayRate {
+		opts.Rate = MaxReplayRate
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("destination", dest.Name).
+		Str("exchange", opts.Target.Exchange).
+		Str("routingKey", opts.Target.RoutingKey).
+		Str("topic", opts.Target.Topic).
+		Str("after", opts.Filter.AfterSku).
+		Int("rate", opts.Rate).
+		Int("limit", opts.Limit).
+		Msg("replaying products")
+
+	ticker := time.NewTicker(time.Second / time.Duration(opts.Rate))
+	defer ticker.Stop()
+
+	result := ReplayResult{LastSku: opts.Filter.AfterSku}
+	err = s.replay(ctx, dest.Queue, opts, ticker, &result)
+
+	log.Info().
+		Str("func", funcName).
+		Int("published", result.Published).
+		Str("lastSku", result.LastSku).
+		Bool("done", result.Done).
+		Msg("replayed products")
+
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// replay pages through the products by SKU, after the last one sent, until
+// they run out or the limit is reached. Only the one destination is
+// published to, so a replay resumed after it fails repeats nothing
+// elsewhere.
+func (s *service) replay(ctx context.Context, q Queue, opts ReplayOptions, ticker *time.Ticker, result *ReplayResult) error {
+	filter := opts.Filter
+	for {
+		filter.AfterSku = result.LastSku
+		products, err := s.repo.ListProducts(ctx, filter, replayPageSize, 0)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range products {
+			if opts.Limit > 0 && result.Published >= opts.Limit {
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+
+			if err = q.PublishSnapshot(ctx, p, opts.Target); err != nil {
+				return errors.WithMessagef(err, "failed to publish %s", p.Sku)
+			}
+			result.Published++
+			result.LastSku = p.Sku
+
+			if opts.Progress != nil && result.Published%replayProgressStep == 0 {
+				opts.Progress(*result)
+			}
+		}
+
+		if len(products) < replayPageSize {
+			result.Done = true
+			return nil
+		}
+	}
+}
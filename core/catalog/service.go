@@ -2,30 +2,69 @@ package catalog
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
 	"github.com/sksmith/smfg-catalog/core"
 )
 
 func NewService(repo Repository, q Queue, productExchange string) *service {
-	return &service{repo: repo, queue: q, productExchange: productExchange}
+	return &service{
+		repo:            repo,
+		queue:           q,
+		productExchange: productExchange,
+		jobSignal:       make(chan struct{}, 1),
+		changes:         newChangeFeed(),
+	}
 }
 
 type Service interface {
 	GetProduct(ctx context.Context, sku string) (Product, error)
+	GetProductByBarcode(ctx context.Context, gtin string) (Product, error)
+	GetProducts(ctx context.Context, skus []string) ([]Product, error)
+	ListProducts(ctx context.Context, filter ProductFilter, limit, offset int) ([]Product, error)
+	ExportProducts(ctx context.Context, filter ProductFilter, format ExportFormat, w io.Writer) error
+	WriteProducts(ctx context.Context, filter ProductFilter, pw ProductWriter) error
 	CreateProduct(ctx context.Context, product Product) error
+	UpdateProduct(ctx context.Context, product Product) error
+	UpsertProduct(ctx context.Context, product Product) (bool, error)
+	DeleteProduct(ctx context.Context, sku string) error
+	ImportProducts(ctx context.Context, r io.Reader, opts ImportOptions) (ImportResult, error)
+	ImportItems(ctx context.Context, items []ImportItem, opts ImportOptions) (ImportResult, error)
+	SubmitImport(ctx context.Context, r io.Reader, opts ImportOptions) (Job, error)
+	GetJob(ctx context.Context, id int64) (Job, error)
+	StartJobWorkers(ctx context.Context, workers int)
+	StartPublisher(ctx context.Context)
+	ReplayProducts(ctx context.Context, opts ReplayOptions) (ReplayResult, error)
+	GetChanges(ctx context.Context, since int64, limit int) ([]Change, error)
+	LastChangeSeq(ctx context.Context) (int64, error)
+	SubscribeChanges(buffer int) *ChangeSubscription
 }
 
 type service struct {
 	repo            Repository
 	queue           Queue
 	productExchange string
+	jobSignal       chan struct{}
+	changes         *changeFeed
 }
 
 func (s *service) CreateProduct(ctx context.Context, product Product) error {
 	const funcName = "CreateProduct"
 
+	if err := auth.Require(ctx, auth.PermissionWrite); err != nil {
+		return err
+	}
+
+	if err := product.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+
 	dbProduct, err := s.repo.GetProduct(ctx, product.Sku)
 	if err != nil && !errors.Is(err, core.ErrNotFound) {
 		return errors.WithStack(err)
@@ -39,7 +78,11 @@ func (s *service) CreateProduct(ctx context.Context, product Product) error {
 		return nil
 	}
 
-	tx, err := s.repo.BeginTransaction(ctx)
+	if err = s.checkBarcodesAvailable(ctx, product); err != nil {
+		return err
+	}
+
+	tx, err := s.beginChange(ctx)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -47,7 +90,7 @@ func (s *service) CreateProduct(ctx context.Context, product Product) error {
 	log.Info().
 		Str("func", funcName).
 		Str("sku", product.Sku).
-		Str("upc", product.Upc).
+		Int("barcodes", len(product.Barcodes)).
 		Msg("creating product")
 
 	if err = s.repo.SaveProduct(ctx, product, tx); err != nil {
@@ -55,17 +98,180 @@ func (s *service) CreateProduct(ctx context.Context, product Product) error {
 		return errors.WithStack(err)
 	}
 
+	change, err := s.saveChange(ctx, tx, ChangeCreated, product.Sku, &product)
+	if err != nil {
+		rollback(ctx, tx, err)
+		return err
+	}
+
 	if err = tx.Commit(ctx); err != nil {
 		rollback(ctx, tx, err)
 		return errors.WithStack(err)
 	}
 
+	s.changes.publish(change)
+	return nil
+}
+
+// UpdateProduct replaces an existing product, including its barcodes.
+func (s *service) UpdateProduct(ctx context.Context, product Product) error {
+	const funcName = "UpdateProduct"
+
+	if err := auth.Require(ctx, auth.PermissionWrite); err != nil {
+		return err
+	}
+
+	if err := product.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := s.repo.GetProduct(ctx, product.Sku); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := s.checkBarcodesAvailable(ctx, product); err != nil {
+		return err
+	}
+
+	tx, err := s.beginChange(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("sku", product.Sku).
+		Int("barcodes", len(product.Barcodes)).
+		Msg("updating product")
+
+	if err = s.repo.SaveProduct(ctx, product, tx); err != nil {
+		rollback(ctx, tx, err)
+		return errors.WithStack(err)
+	}
+
+	change, err := s.saveChange(ctx, tx, ChangeUpdated, product.Sku, &product)
+	if err != nil {
+		rollback(ctx, tx, err)
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		rollback(ctx, tx, err)
+		return errors.WithStack(err)
+	}
+
+	s.changes.publish(change)
+	return nil
+}
+
+// UpsertProduct creates the product or replaces the existing one, and
+// reports whether anything changed. Saving a product identical to the one
+// stored is a no-op, so repeating an upsert records no further changes.
+func (s *service) UpsertProduct(ctx context.Context, product Product) (bool, error) {
+	const funcName = "UpsertProduct"
+
+	if err := auth.Require(ctx, auth.PermissionWrite); err != nil {
+		return false, err
+	}
+
+	if err := product.Validate(); err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	changeType := ChangeUpdated
+	existing, err := s.repo.GetProduct(ctx, product.Sku)
+	if errors.Is(err, core.ErrNotFound) {
+		changeType = ChangeCreated
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	} else if existing.Equal(product) {
+		log.Debug().
+			Str("func", funcName).
+			Str("sku", product.Sku).
+			Msg("product is unchanged")
+		return false, nil
+	}
+
+	if err = s.checkBarcodesAvailable(ctx, product); err != nil {
+		return false, err
+	}
+
+	tx, err := s.beginChange(ctx)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("sku", product.Sku).
+		Str("change", string(changeType)).
+		Int("barcodes", len(product.Barcodes)).
+		Msg("upserting product")
+
+	if err = s.repo.SaveProduct(ctx, product, tx); err != nil {
+		rollback(ctx, tx, err)
+		return false, errors.WithStack(err)
+	}
+
+	change, err := s.saveChange(ctx, tx, changeType, product.Sku, &product)
+	if err != nil {
+		rollback(ctx, tx, err)
+		return false, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		rollback(ctx, tx, err)
+		return false, errors.WithStack(err)
+	}
+
+	s.changes.publish(change)
+	return true, nil
+}
+
+func (s *service) DeleteProduct(ctx context.Context, sku string) error {
+	const funcName = "DeleteProduct"
+
+	if err := auth.Require(ctx, auth.PermissionWrite); err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Str("sku", sku).
+		Msg("deleting product")
+
+	tx, err := s.beginChange(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = s.repo.DeleteProduct(ctx, sku, tx); err != nil {
+		rollback(ctx, tx, err)
+		return errors.WithStack(err)
+	}
+
+	change, err := s.saveChange(ctx, tx, ChangeDeleted, sku, nil)
+	if err != nil {
+		rollback(ctx, tx, err)
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		rollback(ctx, tx, err)
+		return errors.WithStack(err)
+	}
+
+	s.changes.publish(change)
 	return nil
 }
 
 func (s *service) GetProduct(ctx context.Context, sku string) (Product, error) {
 	const funcName = "GetProduct"
 
+	if err := auth.Require(ctx, auth.PermissionRead); err != nil {
+		return Product{}, err
+	}
+
 	log.Info().
 		Str("func", funcName).
 		Str("sku", sku).
@@ -78,6 +284,93 @@ func (s *service) GetProduct(ctx context.Context, sku string) (Product, error) {
 	return product, nil
 }
 
+func (s *service) GetProductByBarcode(ctx context.Context, gtin string) (Product, error) {
+	const funcName = "GetProductByBarcode"
+
+	if err := auth.Require(ctx, auth.PermissionRead); err != nil {
+		return Product{}, err
+	}
+
+	gtin = NormalizeGtin(gtin)
+	log.Info().
+		Str("func", funcName).
+		Str("gtin", gtin).
+		Msg("getting product by barcode")
+
+	product, err := s.repo.GetProductByBarcode(ctx, gtin)
+	if err != nil {
+		return product, errors.WithStack(err)
+	}
+	return product, nil
+}
+
+// GetProducts returns the products that exist for the given SKUs, in SKU
+// order. SKUs without a product are left out rather than being an error.
+func (s *service) GetProducts(ctx context.Context, skus []string) ([]Product, error) {
+	const funcName = "GetProducts"
+
+	if err := auth.Require(ctx, auth.PermissionRead); err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int("skus", len(skus)).
+		Msg("getting products")
+
+	products, err := s.repo.GetProducts(ctx, skus)
+	if err != nil {
+		return products, errors.WithStack(err)
+	}
+	return products, nil
+}
+
+func (s *service) ListProducts(ctx context.Context, filter ProductFilter, limit, offset int) ([]Product, error) {
+	const funcName = "ListProducts"
+
+	if err := auth.Require(ctx, auth.PermissionRead); err != nil {
+		return nil, err
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Interface("filter", filter).
+		Int("limit", limit).
+		Int("offset", offset).
+		Msg("listing products")
+
+	products, err := s.repo.ListProducts(ctx, filter, limit, offset)
+	if err != nil {
+		return products, errors.WithStack(err)
+	}
+	return products, nil
+}
+
+// checkBarcodesAvailable returns core.ErrConflict if any of the product's
+// barcodes are already assigned to a different SKU.
+func (s *service) checkBarcodesAvailable(ctx context.Context, product Product) error {
+	for _, b := range product.Barcodes {
+		if err := s.checkBarcodeAvailable(ctx, product.Sku, b.Gtin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *service) checkBarcodeAvailable(ctx context.Context, sku, gtin string) error {
+	owner, err := s.repo.GetProductByBarcode(ctx, gtin)
+	if err != nil {
+		if errors.Is(err, core.ErrNotFound) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	if owner.Sku != sku {
+		return errors.Wrapf(core.ErrConflict, "gtin %s is already assigned to sku %s", gtin, owner.Sku)
+	}
+	return nil
+}
+
 func rollback(ctx context.Context, tx core.Transaction, err error) {
 	e := tx.Rollback(ctx)
 	if e != nil {
@@ -88,9 +381,76 @@ func rollback(ctx context.Context, tx core.Transaction, err error) {
 type Repository interface {
 	SaveProduct(ctx context.Context, product Product, tx ...core.Transaction) error
 	GetProduct(ctx context.Context, sku string, tx ...core.Transaction) (Product, error)
+	GetProductByBarcode(ctx context.Context, gtin string, tx ...core.Transaction) (Product, error)
+	GetProducts(ctx context.Context, skus []string, tx ...core.Transaction) ([]Product, error)
+	DeleteProduct(ctx context.Context, sku string, tx ...core.Transaction) error
+	ListProducts(ctx context.Context, filter ProductFilter, limit, offset int, tx ...core.Transaction) ([]Product, error)
+	StreamProducts(ctx context.Context, filter ProductFilter, fn func(Product) error) error
 	BeginTransaction(ctx context.Context) (core.Transaction, error)
+	// Savepoint runs fn inside a savepoint of tx, rolling back only what fn
+	// wrote when it fails.
+	Savepoint(ctx context.Context, tx core.Transaction, fn func() error) error
+
+	CreateJob(ctx context.Context, job Job, input []byte, tx ...core.Transaction) (Job, error)
+	// UpdateJob saves a claimed job's progress, or returns core.ErrNotFound
+	// once its claim has been taken over.
+	UpdateJob(ctx context.Context, job Job, tx ...core.Transaction) error
+	GetJob(ctx context.Context, id int64, tx ...core.Transaction) (Job, error)
+	// ClaimJob marks the oldest queued job as running under token and returns
+	// it with its input, or core.ErrNotFound when nothing is queued. Running
+	// jobs without a heartbeat for longer than lease are claimed again.
+	ClaimJob(ctx context.Context, token string, lease time.Duration) (Job, []byte, error)
+	// HeartbeatJob records that a running job is still being worked on, or
+	// returns core.ErrNotFound once token's claim has been taken over.
+	HeartbeatJob(ctx context.Context, id int64, token string) error
+
+	// LockChangeLog orders the changes recorded by tx with those of other
+	// transactions. It has to come first in tx, before any product is
+	// written, and SaveChange only in a transaction that has taken it.
+	LockChangeLog(ctx context.Context, tx core.Transaction) error
+	SaveChange(ctx context.Context, change Change, tx ...core.Transaction) (Change, error)
+	GetChanges(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]Change, error)
+	// LastChangeSeq returns the sequence of the latest change, or zero when
+	// there are none.
+	LastChangeSeq(ctx context.Context, tx ...core.Transaction) (int64, error)
+	// ClaimPublishCursor leases destination's cursor to token for lease and
+	// returns the sequence of the last change published there, or
+	// core.ErrNotFound while another publisher holds it. A destination's
+	// cursor starts where the furthest one is.
+	ClaimPublishCursor(ctx context.Context, destination, token string, lease time.Duration) (int64, error)
+	// SavePublishCursor moves destination's cursor to seq and ends token's
+	// lease, or returns core.ErrNotFound if the lease ran out and was taken
+	// over.
+	SavePublishCursor(ctx context.Context, destination, token string, seq int64) error
 }
 
+// Queue publishes changes as events for other systems.
 type Queue interface {
-	PublishProduct(ctx context.Context, product Product) error
+	PublishChange(ctx context.Context, change Change) error
+	// PublishSnapshot sends a product's current state to target, for a
+	// consumer rebuilding what it knows.
+	PublishSnapshot(ctx context.Context, product Product, target ReplayTarget) error
+}
+
+// Destination is a named Queue that changes are published to.
+type Destination struct {
+	Name  string
+	Queue Queue
+}
+
+// Destinations is implemented by a Queue that publishes to several
+// destinations. Changes are published to each from its own cursor, so that
+// one being down neither holds back nor repeats changes to the others.
+type Destinations interface {
+	Destinations() []Destination
+}
+
+// newToken tells a claim on a job or lease on a publish cursor apart from
+// those of other workers and instances.
+func newToken() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(b), nil
 }
@@ -0,0 +1,113 @@
+package catalog
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"io"
+	"strconv"
+)
+
+// xlsxNumberColumns are the indexes of the numeric columns in ExportColumns.
+var xlsxNumberColumns = map[int]bool{4: true, 7: true, 8: true, 9: true, 11: true, 12: true}
+
+// xlsxExportWriter writes a single sheet workbook. The sheet is streamed
+// into the zip as rows arrive, only the fixed package parts are buffered.
+type xlsxExportWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+}
+
+var xlsxParts = []struct{ name, body string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Products" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+func newXLSXExportWriter(w io.Writer) (*xlsxExportWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(f, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x := &xlsxExportWriter{zw: zw, sheet: bufio.NewWriter(f)}
+	if _, err = x.sheet.WriteString(xml.Header +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`); err != nil {
+		return nil, err
+	}
+	if err = x.writeRow(ExportColumns); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *xlsxExportWriter) Write(p Product) error {
+	for _, row := range exportRows(p) {
+		if err := x.writeRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRow writes quantities and measurements as numbers and everything else
+// as inline strings, so GTINs keep their leading zeros.
+func (x *xlsxExportWriter) writeRow(cells []string) error {
+	if _, err := x.sheet.WriteString("<row>"); err != nil {
+		return err
+	}
+	for i, cell := range cells {
+		if xlsxNumberColumns[i] && cell != "" {
+			if _, err := strconv.ParseFloat(cell, 64); err == nil {
+				if _, err = x.sheet.WriteString(`<c><v>` + cell + `</v></c>`); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if _, err := x.sheet.WriteString(`<c t="inlineStr"><is><t>`); err != nil {
+			return err
+		}
+		if err := xml.EscapeText(x.sheet, []byte(cell)); err != nil {
+			return err
+		}
+		if _, err := x.sheet.WriteString(`</t></is></c>`); err != nil {
+			return err
+		}
+	}
+	_, err := x.sheet.WriteString("</row>")
+	return err
+}
+
+func (x *xlsxExportWriter) Close() error {
+	if _, err := x.sheet.WriteString(`</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
@@ -7,7 +7,10 @@ import (
 	"github.com/jackc/pgx/v4"
 )
 
-var ErrNotFound = errors.New("core: record not found")
+var (
+	ErrNotFound = errors.New("core: record not found")
+	ErrConflict = errors.New("core: record conflicts with an existing record")
+)
 
 type Transaction interface {
 	Commit(ctx context.Context) error
@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+var ErrInvalidSubscription = errors.New("webhook: invalid subscription")
+
+// EventType names the change a delivery reports, such as product.created.
+type EventType string
+
+const (
+	EventProductCreated EventType = "product.created"
+	EventProductUpdated EventType = "product.updated"
+	EventProductDeleted EventType = "product.deleted"
+)
+
+var eventTypes = map[catalog.ChangeType]EventType{
+	catalog.ChangeCreated: EventProductCreated,
+	catalog.ChangeUpdated: EventProductUpdated,
+	catalog.ChangeDeleted: EventProductDeleted,
+}
+
+func (t EventType) Valid() bool {
+	for _, e := range eventTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription asks for events of the given types to be POSTed to URL,
+// signed with Secret. It is deactivated after too many consecutive failed
+// attempts; Failures counts them.
+type Subscription struct {
+	ID         int64       `json:"id"`
+	URL        string      `json:"url"`
+	EventTypes []EventType `json:"eventTypes"`
+	Secret     string      `json:"secret,omitempty"`
+	Active     bool        `json:"active"`
+	Failures   int         `json:"failures"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	DisabledAt *time.Time  `json:"disabledAt,omitempty"`
+}
+
+func (s Subscription) Validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidSubscription)
+	}
+	if len(s.EventTypes) == 0 {
+		return fmt.Errorf("%w: at least one event type is required", ErrInvalidSubscription)
+	}
+	for _, t := range s.EventTypes {
+		if !t.Valid() {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalidSubscription, t)
+		}
+	}
+	return nil
+}
+
+func (s Subscription) Wants(t EventType) bool {
+	for _, e := range s.EventTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Delivery is one event sent to one subscription, with the outcome of its
+// latest attempt. Payload is the exact body sent on every attempt.
+type Delivery struct {
+	ID             int64          `json:"id"`
+	SubscriptionID int64          `json:"subscriptionId"`
+	Seq            int64          `json:"seq"`
+	EventType      EventType      `json:"eventType"`
+	Status         DeliveryStatus `json:"status"`
+	Attempts       int            `json:"attempts"`
+	ResponseStatus int            `json:"responseStatus,omitempty"`
+	LastError      string         `json:"lastError,omitempty"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	NextAttemptAt  *time.Time     `json:"nextAttemptAt,omitempty"`
+	DeliveredAt    *time.Time     `json:"deliveredAt,omitempty"`
+	Payload        []byte         `json:"-"`
+}
+
+// Event is the body POSTed to a subscriber.
+type Event struct {
+	ID      int64            `json:"id"`
+	Type    EventType        `json:"type"`
+	Sku     string           `json:"sku"`
+	Time    time.Time        `json:"time"`
+	Product *catalog.Product `json:"product,omitempty"`
+}
@@ -0,0 +1,479 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+const (
+	DefaultWorkers = 1
+	// MaxAttempts is the number of times a delivery is tried before it is
+	// marked failed.
+	MaxAttempts = 8
+	// DisableAfter is the number of consecutive failed attempts, across all
+	// of a subscription's deliveries, after which it is deactivated.
+	DisableAfter = 20
+	BaseBackoff  = 30 * time.Second
+	MaxBackoff   = time.Hour
+
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+
+	pollInterval      = 5 * time.Second
+	deliveryLease     = time.Minute
+	deliveryTimeout   = 10 * time.Second
+	dispatchBatchSize = 100
+)
+
+func NewService(repo Repository, changes ChangeSource, client *http.Client) *service {
+	if client == nil {
+		client = &http.Client{Timeout: deliveryTimeout}
+	}
+	return &service{repo: repo, changes: changes, client: client}
+}
+
+type Service interface {
+	CreateSubscription(ctx context.Context, sub Subscription) (Subscription, error)
+	UpdateSubscription(ctx context.Context, sub Subscription) (Subscription, error)
+	GetSubscription(ctx context.Context, id int64) (Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]Subscription, error)
+	DeleteSubscription(ctx context.Context, id int64) error
+	ListDeliveries(ctx context.Context, subscriptionID int64, limit, offset int) ([]Delivery, error)
+	StartWorkers(ctx context.Context, workers int)
+}
+
+type service struct {
+	repo    Repository
+	changes ChangeSource
+	client  *http.Client
+}
+
+// CreateSubscription saves a new, active subscription. A secret is
+// generated when none is given; it is only ever returned here.
+func (s *service) CreateSubscription(ctx context.Context, sub Subscription) (Subscription, error) {
+	const funcName = "CreateSubscription"
+
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return sub, err
+	}
+
+	if err := sub.Validate(); err != nil {
+		return sub, errors.WithStack(err)
+	}
+	if sub.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			return sub, err
+		}
+		sub.Secret = secret
+	}
+	sub.ID = 0
+	sub.Active = true
+	sub.Failures = 0
+	sub.DisabledAt = nil
+
+	log.Info().
+		Str("func", funcName).
+		Str("url", sub.URL).
+		Msg("creating webhook subscription")
+
+	saved, err := s.repo.SaveSubscription(ctx, sub)
+	if err != nil {
+		return saved, errors.WithStack(err)
+	}
+	return saved, nil
+}
+
+// UpdateSubscription replaces a subscription's url, event types and active
+// flag, and its secret when one is given. Reactivating a subscription
+// clears its failures.
+func (s *service) UpdateSubscription(ctx context.Context, sub Subscription) (Subscription, error) {
+	const funcName = "UpdateSubscription"
+
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return sub, err
+	}
+
+	if err := sub.Validate(); err != nil {
+		return sub, errors.WithStack(err)
+	}
+
+	existing, err := s.repo.GetSubscription(ctx, sub.ID)
+	if err != nil {
+		return sub, errors.WithStack(err)
+	}
+	existing.URL = sub.URL
+	existing.EventTypes = sub.EventTypes
+	if sub.Secret != "" {
+		existing.Secret = sub.Secret
+	}
+	if sub.Active && !existing.Active {
+		existing.Failures = 0
+		existing.DisabledAt = nil
+	} else if !sub.Active && existing.Active {
+		now := time.Now()
+		existing.DisabledAt = &now
+	}
+	existing.Active = sub.Active
+
+	log.Info().
+		Str("func", funcName).
+		Int64("id", sub.ID).
+		Bool("active", sub.Active).
+		Msg("updating webhook subscription")
+
+	saved, err := s.repo.SaveSubscription(ctx, existing)
+	if err != nil {
+		return saved, errors.WithStack(err)
+	}
+	return saved, nil
+}
+
+func (s *service) GetSubscription(ctx context.Context, id int64) (Subscription, error) {
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return Subscription{}, err
+	}
+
+	sub, err := s.repo.GetSubscription(ctx, id)
+	if err != nil {
+		return sub, errors.WithStack(err)
+	}
+	return sub, nil
+}
+
+func (s *service) ListSubscriptions(ctx context.Context) ([]Subscription, error) {
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return nil, err
+	}
+
+	subs, err := s.repo.ListSubscriptions(ctx)
+	if err != nil {
+		return subs, errors.WithStack(err)
+	}
+	return subs, nil
+}
+
+func (s *service) DeleteSubscription(ctx context.Context, id int64) error {
+	const funcName = "DeleteSubscription"
+
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return err
+	}
+
+	log.Info().
+		Str("func", funcName).
+		Int64("id", id).
+		Msg("deleting webhook subscription")
+
+	if err := s.repo.DeleteSubscription(ctx, id); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// ListDeliveries returns a subscription's deliveries, newest first.
+func (s *service) ListDeliveries(ctx context.Context, subscriptionID int64, limit, offset int) ([]Delivery, error) {
+	if err := auth.Require(ctx, auth.PermissionAdmin); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.repo.GetSubscription(ctx, subscriptionID); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	deliveries, err := s.repo.ListDeliveries(ctx, subscriptionID, limit, offset)
+	if err != nil {
+		return deliveries, errors.WithStack(err)
+	}
+	return deliveries, nil
+}
+
+// StartWorkers runs delivery workers in the background until ctx is done.
+// Each pass turns new catalog changes into deliveries, then sends every
+// delivery that is due. Both are claimed through the repository, so any
+// number of instances can run workers.
+func (s *service) StartWorkers(ctx context.Context, workers int) {
+	log.Info().Int("workers", workers).Msg("starting webhook workers")
+	for i := 0; i < workers; i++ {
+		go s.worker(ctx)
+	}
+}
+
+func (s *service) worker(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.dispatch(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to dispatch webhook events")
+		}
+		s.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch creates a delivery for every active subscription wanting each
+// change recorded since the last dispatch. The cursor is locked for the
+// duration, so changes are dispatched once however many workers run.
+func (s *service) dispatch(ctx context.Context) error {
+	for ctx.Err() == nil {
+		n, err := s.dispatchBatch(ctx)
+		if err != nil || n < dispatchBatchSize {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *service) dispatchBatch(ctx context.Context) (int, error) {
+	tx, err := s.repo.BeginTransaction(ctx)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	last, err := s.repo.LockDispatchCursor(ctx, tx)
+	if err != nil {
+		rollback(ctx, tx, err)
+		if errors.Is(err, core.ErrNotFound) {
+			// Another worker is dispatching.
+			return 0, nil
+		}
+		return 0, errors.WithStack(err)
+	}
+
+	changes, err := s.changes.GetChanges(ctx, last, dispatchBatchSize)
+	if err != nil || len(changes) == 0 {
+		rollback(ctx, tx, err)
+		return 0, errors.WithStack(err)
+	}
+
+	subs, err := s.repo.ListSubscriptions(ctx, tx)
+	if err != nil {
+		rollback(ctx, tx, err)
+		return 0, errors.WithStack(err)
+	}
+
+	for _, c := range changes {
+		event := Event{ID: c.Seq, Type: eventTypes[c.Type], Sku: c.Sku, Time: c.Time, Product: c.Product}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			rollback(ctx, tx, err)
+			return 0, errors.WithStack(err)
+		}
+
+		for _, sub := range subs {
+			if !sub.Active || !sub.Wants(event.Type) {
+				continue
+			}
+			_, err = s.repo.CreateDelivery(ctx, Delivery{
+				SubscriptionID: sub.ID,
+				Seq:            c.Seq,
+				EventType:      event.Type,
+				Status:         DeliveryPending,
+				Payload:        payload,
+			}, tx)
+			if err != nil {
+				rollback(ctx, tx, err)
+				return 0, errors.WithStack(err)
+			}
+		}
+		last = c.Seq
+	}
+
+	if err = s.repo.SaveDispatchCursor(ctx, last, tx); err != nil {
+		rollback(ctx, tx, err)
+		return 0, errors.WithStack(err)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		rollback(ctx, tx, err)
+		return 0, errors.WithStack(err)
+	}
+	return len(changes), nil
+}
+
+func (s *service) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		d, sub, err := s.repo.ClaimDelivery(ctx, deliveryLease)
+		if err != nil {
+			if !errors.Is(err, core.ErrNotFound) {
+				log.Error().Err(err).Msg("failed to claim webhook delivery")
+			}
+			return
+		}
+		s.deliver(ctx, d, sub)
+	}
+}
+
+// deliver makes one attempt at a claimed delivery and records the outcome
+// against both the delivery and its subscription.
+func (s *service) deliver(ctx context.Context, d Delivery, sub Subscription) {
+	const funcName = "deliver"
+
+	status, err := s.post(ctx, d, sub)
+
+	now := time.Now()
+	d.ResponseStatus = status
+	d.NextAttemptAt = nil
+	if err == nil {
+		d.Status = DeliverySucceeded
+		d.DeliveredAt = &now
+		d.LastError = ""
+	} else {
+		d.LastError = err.Error()
+		if d.Attempts >= MaxAttempts {
+			d.Status = DeliveryFailed
+		} else {
+			next := now.Add(Backoff(d.Attempts))
+			d.NextAttemptAt = &next
+		}
+		log.Warn().Err(err).
+			Str("func", funcName).
+			Int64("delivery", d.ID).
+			Int64("subscription", sub.ID).
+			Int("attempts", d.Attempts).
+			Msg("webhook delivery failed")
+	}
+
+	tx, err := s.repo.BeginTransaction(ctx)
+	if err != nil {
+		log.Error().Err(err).Str("func", funcName).Int64("delivery", d.ID).Msg("failed to record webhook delivery")
+		return
+	}
+	if err = s.repo.UpdateDelivery(ctx, d, tx); err != nil {
+		rollback(ctx, tx, err)
+		log.Error().Err(err).Str("func", funcName).Int64("delivery", d.ID).Msg("failed to record webhook delivery")
+		return
+	}
+	updated, err := s.repo.RecordAttempt(ctx, sub.ID, d.Status == DeliverySucceeded, DisableAfter, tx)
+	if err != nil {
+		rollback(ctx, tx, err)
+		log.Error().Err(err).Str("func", funcName).Int64("delivery", d.ID).Msg("failed to record webhook delivery")
+		return
+	}
+	if err = tx.Commit(ctx); err != nil {
+		rollback(ctx, tx, err)
+		log.Error().Err(err).Str("func", funcName).Int64("delivery", d.ID).Msg("failed to record webhook delivery")
+		return
+	}
+
+	if sub.Active && !updated.Active {
+		log.Warn().
+			Str("func", funcName).
+			Int64("subscription", sub.ID).
+			Int("failures", updated.Failures).
+			Msg("disabled webhook subscription after repeated failures")
+	}
+}
+
+func (s *service) post(ctx context.Context, d Delivery, sub Subscription) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(d.EventType))
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, d.Payload))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Sign returns the signature header value for a body: the hex HMAC-SHA256
+// of the body keyed with the subscription secret, prefixed with sha256=.
+// Receivers should compute the same and compare in constant time.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff is the wait before retrying after the given number of attempts,
+// doubling from BaseBackoff up to MaxBackoff.
+func Backoff(attempts int) time.Duration {
+	d := BaseBackoff
+	for i := 1; i < attempts && d < MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > MaxBackoff {
+		d = MaxBackoff
+	}
+	return d
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func rollback(ctx context.Context, tx core.Transaction, err error) {
+	e := tx.Rollback(ctx)
+	if e != nil {
+		log.Warn().Err(err).Msg("failed to rollback")
+	}
+}
+
+// ChangeSource supplies the catalog changes to deliver, catalog.Service
+// satisfies it.
+type ChangeSource interface {
+	GetChanges(ctx context.Context, since int64, limit int) ([]catalog.Change, error)
+}
+
+type Repository interface {
+	BeginTransaction(ctx context.Context) (core.Transaction, error)
+
+	SaveSubscription(ctx context.Context, sub Subscription, tx ...core.Transaction) (Subscription, error)
+	GetSubscription(ctx context.Context, id int64, tx ...core.Transaction) (Subscription, error)
+	ListSubscriptions(ctx context.Context, tx ...core.Transaction) ([]Subscription, error)
+	DeleteSubscription(ctx context.Context, id int64, tx ...core.Transaction) error
+
+	// LockDispatchCursor returns the sequence of the last change dispatched,
+	// locked until tx ends, or core.ErrNotFound if it is already locked.
+	LockDispatchCursor(ctx context.Context, tx core.Transaction) (int64, error)
+	SaveDispatchCursor(ctx context.Context, seq int64, tx core.Transaction) error
+
+	CreateDelivery(ctx context.Context, d Delivery, tx ...core.Transaction) (Delivery, error)
+	UpdateDelivery(ctx context.Context, d Delivery, tx ...core.Transaction) error
+	ListDeliveries(ctx context.Context, subscriptionID int64, limit, offset int, tx ...core.Transaction) ([]Delivery, error)
+	// ClaimDelivery returns the next due delivery of an active subscription
+	// with its attempts incremented, hidden from other workers for lease,
+	// or core.ErrNotFound when none are due.
+	ClaimDelivery(ctx context.Context, lease time.Duration) (Delivery, Subscription, error)
+	// RecordAttempt resets or increments the subscription's failures and
+	// deactivates it once they reach disableAfter.
+	RecordAttempt(ctx context.Context, id int64, succeeded bool, disableAfter int, tx ...core.Transaction) (Subscription, error)
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/apikey"
+)
+
+const apiKeyColumns = `k.id, k.name, k.prefix, k.hash, k.scopes, k.expires_at, k.created_at, k.last_used_at, k.revoked_at`
+
+func (d *dbRepo) SaveAPIKey(ctx context.Context, key apikey.Key, txs ...core.Transaction) (apikey.Key, error) {
+	m := StartMetric("SaveAPIKey")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	scopes := make([]string, 0, len(key.Scopes))
+	for _, s := range key.Scopes {
+		scopes = append(scopes, string(s))
+	}
+
+	var row pgx.Row
+	if key.ID == 0 {
+		row = tx.QueryRow(ctx, `
+		INSERT INTO api_keys AS k (name, prefix, hash, scopes, expires_at)
+                           VALUES ($1, $2, $3, $4, $5)
+                        RETURNING `+apiKeyColumns+`;`,
+			key.Name, key.Prefix, key.Hash, scopes, key.ExpiresAt)
+	} else {
+		row = tx.QueryRow(ctx, `
+		UPDATE api_keys k
+           SET name = $2, prefix = $3, hash = $4, scopes = $5, expires_at = $6, revoked_at = $7
+         WHERE id = $1
+     RETURNING `+apiKeyColumns+`;`,
+			key.ID, key.Name, key.Prefix, key.Hash, scopes, key.ExpiresAt, key.RevokedAt)
+	}
+
+	saved, err := scanAPIKey(row)
+	if err != nil {
+		m.Complete(err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return key, errors.WithStack(core.ErrNotFound)
+		}
+		return key, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return saved, nil
+}
+
+func (d *dbRepo) GetAPIKey(ctx context.Context, id int64, txs ...core.Transaction) (apikey.Key, error) {
+	m := StartMetric("GetAPIKey")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	key, err := scanAPIKey(tx.QueryRow(ctx, `SELECT `+apiKeyColumns+` FROM api_keys k WHERE k.id = $1`, id))
+	if err != nil {
+		m.Complete(err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return key, errors.WithStack(core.ErrNotFound)
+		}
+		return key, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return key, nil
+}
+
+func (d *dbRepo) GetAPIKeyByPrefix(ctx context.Context, prefix string, txs ...core.Transaction) (apikey.Key, error) {
+	m := StartMetric("GetAPIKeyByPrefix")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	key, err := scanAPIKey(tx.QueryRow(ctx, `SELECT `+apiKeyColumns+` FROM api_keys k WHERE k.prefix = $1`, prefix))
+	if err != nil {
+		m.Complete(err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return key, errors.WithStack(core.ErrNotFound)
+		}
+		return key, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return key, nil
+}
+
+func (d *dbRepo) ListAPIKeys(ctx context.Context, txs ...core.Transaction) ([]apikey.Key, error) {
+	m := StartMetric("ListAPIKeys")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	rows, err := tx.Query(ctx, `SELECT `+apiKeyColumns+` FROM api_keys k ORDER BY k.id`)
+	if err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	keys := make([]apikey.Key, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			m.Complete(err)
+			return nil, errors.WithStack(err)
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return keys, nil
+}
+
+func (d *dbRepo) TouchAPIKey(ctx context.Context, id int64, at time.Time, txs ...core.Transaction) error {
+	m := StartMetric("TouchAPIKey")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	_, err := tx.Exec(ctx, `
+		UPDATE api_keys
+           SET last_used_at = $2
+         WHERE id = $1
+           AND (last_used_at IS NULL OR last_used_at < $2);`,
+		id, at)
+	if err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return nil
+}
+
+func scanAPIKey(row pgx.Row) (apikey.Key, error) {
+	key := apikey.Key{}
+	var scopes []string
+
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.Hash, &scopes, &key.ExpiresAt,
+		&key.CreatedAt, &key.LastUsedAt, &key.RevokedAt)
+	if err != nil {
+		return key, err
+	}
+
+	for _, s := range scopes {
+		key.Scopes = append(key.Scopes, auth.Permission(s))
+	}
+	return key, nil
+}
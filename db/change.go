@@ -0,0 +1,192 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+// changeSequenceLock is the advisory lock key held by transactions that
+// record changes.
+const changeSequenceLock = 0x736d6667
+
+// LockChangeLog takes the lock that orders the change log, and holds it
+// until tx ends. Sequences are handed out in the order nextval is called,
+// not the order transactions commit, so a reader could see seq 11 before
+// seq 10 and skip it for good; holding the lock until commit makes the two
+// orders agree, at the cost of serialising writers. It has to be taken
+// before the transaction writes any product: a writer that held a product
+// row while waiting for the lock would deadlock with the lock's holder
+// waiting for that row.
+func (d *dbRepo) LockChangeLog(ctx context.Context, tx core.Transaction) error {
+	m := StartMetric("LockChangeLog")
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1);`, changeSequenceLock); err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+	m.Complete(nil)
+	return nil
+}
+
+// SaveChange must be called with a transaction that has taken
+// LockChangeLog. The change's sequence is visible to readers in the same
+// order it was assigned.
+func (d *dbRepo) SaveChange(ctx context.Context, change catalog.Change, txs ...core.Transaction) (catalog.Change, error) {
+	m := StartMetric("SaveChange")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	var product []byte
+	if change.Product != nil {
+		var err error
+		if product, err = json.Marshal(change.Product); err != nil {
+			m.Complete(err)
+			return change, errors.WithStack(err)
+		}
+	}
+
+	err := tx.QueryRow(ctx, `
+		INSERT INTO product_changes (type, sku, product)
+                             VALUES ($1, $2, $3)
+                          RETURNING seq, created_at;`,
+		string(change.Type), change.Sku, product).
+		Scan(&change.Seq, &change.Time)
+	if err != nil {
+		m.Complete(err)
+		return change, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return change, nil
+}
+
+func (d *dbRepo) GetChanges(ctx context.Context, since int64, limit int, txs ...core.Transaction) ([]catalog.Change, error) {
+	m := StartMetric("GetChanges")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT seq, type, sku, product, created_at
+		  FROM product_changes
+		 WHERE seq > $1
+	  ORDER BY seq
+	     LIMIT $2;`,
+		since, limit)
+	if err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	changes := make([]catalog.Change, 0)
+	for rows.Next() {
+		change := catalog.Change{}
+		var changeType string
+		var product []byte
+		if err = rows.Scan(&change.Seq, &changeType, &change.Sku, &product, &change.Time); err != nil {
+			m.Complete(err)
+			return nil, errors.WithStack(err)
+		}
+		change.Type = catalog.ChangeType(changeType)
+		if product != nil {
+			change.Product = &catalog.Product{}
+			if err = json.Unmarshal(product, change.Product); err != nil {
+				m.Complete(err)
+				return nil, errors.WithStack(err)
+			}
+		}
+		changes = append(changes, change)
+	}
+	if err = rows.Err(); err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return changes, nil
+}
+
+func (d *dbRepo) LastChangeSeq(ctx context.Context, txs ...core.Transaction) (int64, error) {
+	m := StartMetric("LastChangeSeq")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	var seq int64
+	err := tx.QueryRow(ctx, `SELECT COALESCE(MAX(seq), 0) FROM product_changes;`).Scan(&seq)
+	if err != nil {
+		m.Complete(err)
+		return 0, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return seq, nil
+}
+
+func (d *dbRepo) ClaimPublishCursor(ctx context.Context, destination, token string, lease time.Duration) (int64, error) {
+	m := StartMetric("ClaimPublishCursor")
+
+	// A new destination starts where the furthest one is, so that history
+	// isn't sent to it.
+	_, err := d.conn.Exec(ctx, `
+		INSERT INTO event_publish (destination, last_seq)
+		SELECT $1, MAX(last_seq)
+		  FROM event_publish
+   ON CONFLICT (destination) DO NOTHING;`,
+		destination)
+	if err != nil {
+		m.Complete(err)
+		return 0, errors.WithStack(err)
+	}
+
+	var seq int64
+	err = d.conn.QueryRow(ctx, `
+		UPDATE event_publish
+           SET lease_token = $2, leased_until = NOW() + $3 * INTERVAL '1 second'
+         WHERE destination = $1
+           AND (leased_until IS NULL OR leased_until < NOW() OR lease_token = $2)
+     RETURNING last_seq;`,
+		destination, token, lease.Seconds()).Scan(&seq)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			m.Complete(nil)
+			return 0, errors.WithStack(core.ErrNotFound)
+		}
+		m.Complete(err)
+		return 0, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return seq, nil
+}
+
+func (d *dbRepo) SavePublishCursor(ctx context.Context, destination, token string, seq int64) error {
+	m := StartMetric("SavePublishCursor")
+
+	tag, err := d.conn.Exec(ctx, `
+		UPDATE event_publish
+           SET last_seq = $3, lease_token = NULL, leased_until = NULL
+         WHERE destination = $1 AND lease_token = $2;`,
+		destination, token, seq)
+	if err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+	if tag.RowsAffected() == 0 {
+		m.Complete(nil)
+		return errors.WithStack(core.ErrNotFound)
+	}
+
+	m.Complete(nil)
+	return nil
+}
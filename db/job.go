@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+const jobColumns = `id, type, status, dry_run, batch_size, total, processed, succeeded, failed,
+                    errors, COALESCE(message, ''), created_at, started_at, finished_at, attempts`
+
+func (d *dbRepo) CreateJob(ctx context.Context, job catalog.Job, input []byte, txs ...core.Transaction) (catalog.Job, error) {
+	m := StartMetric("CreateJob")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	err := tx.QueryRow(ctx, `
+		INSERT INTO jobs (type, status, dry_run, batch_size, input)
+                  VALUES ($1, $2, $3, $4, $5)
+               RETURNING id, created_at;`,
+		string(job.Type), string(job.Status), job.DryRun, job.BatchSize, input).
+		Scan(&job.ID, &job.CreatedAt)
+	if err != nil {
+		m.Complete(err)
+		return job, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return job, nil
+}
+
+func (d *dbRepo) UpdateJob(ctx context.Context, job catalog.Job, txs ...core.Transaction) error {
+	m := StartMetric("UpdateJob")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	var jobErrors []byte
+	if job.Errors != nil {
+		var err error
+		if jobErrors, err = json.Marshal(job.Errors); err != nil {
+			m.Complete(err)
+			return errors.WithStack(err)
+		}
+	}
+
+	ct, err := tx.Exec(ctx, `
+		UPDATE jobs
+           SET status = $2, total = $3, processed = $4, succeeded = $5, failed = $6,
+               errors = $7, message = NULLIF($8, ''), started_at = $9, finished_at = $10,
+               heartbeat_at = NOW(),
+               input = CASE WHEN $2 IN ($11, $12) THEN NULL ELSE input END
+         WHERE id = $1 AND claim_token = $13;`,
+		job.ID, string(job.Status), job.Total, job.Processed, job.Succeeded, job.Failed,
+		jobErrors, job.Message, job.StartedAt, job.FinishedAt,
+		string(catalog.JobCompleted), string(catalog.JobFailed), job.ClaimToken)
+	if err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+	if ct.RowsAffected() == 0 {
+		m.Complete(nil)
+		return errors.WithStack(core.ErrNotFound)
+	}
+
+	m.Complete(nil)
+	return nil
+}
+
+func (d *dbRepo) GetJob(ctx context.Context, id int64, txs ...core.Transaction) (catalog.Job, error) {
+	m := StartMetric("GetJob")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	job, err := scanJob(tx.QueryRow(ctx, `SELECT `+jobColumns+` FROM jobs WHERE id = $1`, id))
+	if err != nil {
+		m.Complete(err)
+		if err == pgx.ErrNoRows {
+			return job, errors.WithStack(core.ErrNotFound)
+		}
+		return job, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return job, nil
+}
+
+func (d *dbRepo) ClaimJob(ctx context.Context, token string, lease time.Duration) (catalog.Job, []byte, error) {
+	m := StartMetric("ClaimJob")
+
+	var input []byte
+	row := d.conn.QueryRow(ctx, `
+		UPDATE jobs
+           SET status = $1, started_at = COALESCE(started_at, NOW()), heartbeat_at = NOW(),
+               claim_token = $4, attempts = attempts + 1
+         WHERE id = (SELECT id
+                       FROM jobs
+                      WHERE status = $2
+                         OR (status = $1 AND heartbeat_at < NOW() - $3 * INTERVAL '1 second')
+                   ORDER BY id
+                      LIMIT 1
+                        FOR UPDATE SKIP LOCKED)
+     RETURNING `+jobColumns+`, input;`,
+		string(catalog.JobRunning), string(catalog.JobQueued), lease.Seconds(), token)
+
+	job, err := scanJob(row, &input)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			m.Complete(nil)
+			return job, nil, errors.WithStack(core.ErrNotFound)
+		}
+		m.Complete(err)
+		return job, nil, errors.WithStack(err)
+	}
+
+	job.ClaimToken = token
+	m.Complete(nil)
+	return job, input, nil
+}
+
+func (d *dbRepo) HeartbeatJob(ctx context.Context, id int64, token string) error {
+	m := StartMetric("HeartbeatJob")
+
+	ct, err := d.conn.Exec(ctx, `
+		UPDATE jobs
+           SET heartbeat_at = NOW()
+         WHERE id = $1 AND status = $2 AND claim_token = $3;`,
+		id, string(catalog.JobRunning), token)
+	if err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+	if ct.RowsAffected() == 0 {
+		m.Complete(nil)
+		return errors.WithStack(core.ErrNotFound)
+	}
+
+	m.Complete(nil)
+	return nil
+}
+
+func scanJob(row pgx.Row, extra ...interface{}) (catalog.Job, error) {
+	job := catalog.Job{}
+	var jobType, status string
+	var jobErrors []byte
+
+	dest := append([]interface{}{
+		&job.ID, &jobType, &status, &job.DryRun, &job.BatchSize, &job.Total, &job.Processed,
+		&job.Succeeded, &job.Failed, &jobErrors, &job.Message, &job.CreatedAt, &job.StartedAt, &job.FinishedAt,
+		&job.Attempts,
+	}, extra...)
+
+	if err := row.Scan(dest...); err != nil {
+		return job, err
+	}
+
+	job.Type = catalog.JobType(jobType)
+	job.Status = catalog.JobStatus(status)
+	if len(jobErrors) > 0 {
+		if err := json.Unmarshal(jobErrors, &job.Errors); err != nil {
+			return job, err
+		}
+	}
+	return job, nil
+}
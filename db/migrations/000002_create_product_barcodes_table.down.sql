@@ -0,0 +1,11 @@
+ALTER TABLE products ADD COLUMN upc VARCHAR(50) UNIQUE;
+
+UPDATE products p
+   SET upc = b.gtin
+  FROM product_barcodes b
+ WHERE b.sku = p.sku
+   AND b.is_primary;
+
+DROP TABLE IF EXISTS product_barcodes;
+
+COMMIT;
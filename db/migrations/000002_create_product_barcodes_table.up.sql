@@ -0,0 +1,19 @@
+CREATE TABLE product_barcodes
+(
+    gtin            VARCHAR(50) PRIMARY KEY,
+    sku             VARCHAR(50) NOT NULL REFERENCES products (sku) ON DELETE CASCADE,
+    packaging_level VARCHAR(20) NOT NULL,
+    quantity        INTEGER     NOT NULL CHECK (quantity > 0),
+    is_primary      BOOLEAN     NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX product_barcodes_sku_idx ON product_barcodes (sku);
+CREATE UNIQUE INDEX product_barcodes_primary_idx ON product_barcodes (sku) WHERE is_primary;
+
+INSERT INTO product_barcodes (gtin, sku, packaging_level, quantity, is_primary)
+SELECT upc, sku, 'each', 1, TRUE
+  FROM products;
+
+ALTER TABLE products DROP COLUMN upc;
+
+COMMIT;
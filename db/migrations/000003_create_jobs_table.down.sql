@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS jobs;
+
+COMMIT;
@@ -0,0 +1,31 @@
+CREATE TABLE jobs
+(
+    id          BIGSERIAL PRIMARY KEY,
+    type        VARCHAR(30) NOT NULL,
+    status      VARCHAR(20) NOT NULL,
+    dry_run     BOOLEAN     NOT NULL DEFAULT FALSE,
+    batch_size  INTEGER     NOT NULL DEFAULT 0,
+    -- Inputs are only kept until a job finishes.
+    input       BYTEA,
+    total       INTEGER     NOT NULL DEFAULT 0,
+    processed   INTEGER     NOT NULL DEFAULT 0,
+    succeeded   INTEGER     NOT NULL DEFAULT 0,
+    failed      INTEGER     NOT NULL DEFAULT 0,
+    errors      JSONB,
+    message     TEXT,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at  TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    -- Running jobs record a heartbeat, so that a job left running by an
+    -- instance that died can be reclaimed once it stops. The claim token
+    -- tells the worker holding the job apart from one it was reclaimed from,
+    -- and attempts counts the claims, so that a job which keeps killing its
+    -- worker is eventually given up on.
+    heartbeat_at TIMESTAMPTZ,
+    claim_token  TEXT,
+    attempts     INTEGER     NOT NULL DEFAULT 0
+);
+
+CREATE INDEX jobs_status_idx ON jobs (status, id);
+
+COMMIT;
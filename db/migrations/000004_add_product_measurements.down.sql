@@ -0,0 +1,11 @@
+ALTER TABLE products
+    DROP COLUMN IF EXISTS description,
+    DROP COLUMN IF EXISTS height,
+    DROP COLUMN IF EXISTS width,
+    DROP COLUMN IF EXISTS depth,
+    DROP COLUMN IF EXISTS dimension_unit,
+    DROP COLUMN IF EXISTS net_weight,
+    DROP COLUMN IF EXISTS gross_weight,
+    DROP COLUMN IF EXISTS weight_unit;
+
+COMMIT;
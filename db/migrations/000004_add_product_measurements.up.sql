@@ -0,0 +1,11 @@
+ALTER TABLE products
+    ADD COLUMN description    TEXT,
+    ADD COLUMN height         DOUBLE PRECISION,
+    ADD COLUMN width          DOUBLE PRECISION,
+    ADD COLUMN depth          DOUBLE PRECISION,
+    ADD COLUMN dimension_unit VARCHAR(3),
+    ADD COLUMN net_weight     DOUBLE PRECISION,
+    ADD COLUMN gross_weight   DOUBLE PRECISION,
+    ADD COLUMN weight_unit    VARCHAR(3);
+
+COMMIT;
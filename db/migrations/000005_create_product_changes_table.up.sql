@@ -0,0 +1,10 @@
+CREATE TABLE product_changes
+(
+    seq        BIGSERIAL PRIMARY KEY,
+    type       VARCHAR(20)  NOT NULL,
+    sku        VARCHAR(50)  NOT NULL,
+    product    JSONB,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+COMMIT;
@@ -0,0 +1,43 @@
+CREATE TABLE webhook_subscriptions
+(
+    id          BIGSERIAL PRIMARY KEY,
+    url         TEXT        NOT NULL,
+    event_types TEXT[]      NOT NULL,
+    secret      TEXT        NOT NULL,
+    active      BOOLEAN     NOT NULL DEFAULT TRUE,
+    failures    INTEGER     NOT NULL DEFAULT 0,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    disabled_at TIMESTAMPTZ
+);
+
+CREATE TABLE webhook_deliveries
+(
+    id              BIGSERIAL PRIMARY KEY,
+    subscription_id BIGINT      NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    seq             BIGINT      NOT NULL,
+    event_type      VARCHAR(50) NOT NULL,
+    status          VARCHAR(20) NOT NULL,
+    attempts        INTEGER     NOT NULL DEFAULT 0,
+    response_status INTEGER,
+    last_error      TEXT,
+    payload         BYTEA       NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    next_attempt_at TIMESTAMPTZ          DEFAULT NOW(),
+    delivered_at    TIMESTAMPTZ
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, id DESC);
+
+-- A single row holding the last change turned into deliveries. It starts at
+-- the current end of the change log so existing history isn't sent.
+CREATE TABLE webhook_dispatch
+(
+    id       INTEGER PRIMARY KEY CHECK (id = 1),
+    last_seq BIGINT NOT NULL
+);
+
+INSERT INTO webhook_dispatch (id, last_seq)
+SELECT 1, COALESCE(MAX(seq), 0) FROM product_changes;
+
+COMMIT;
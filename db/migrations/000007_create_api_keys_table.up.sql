@@ -0,0 +1,15 @@
+CREATE TABLE api_keys
+(
+    id           BIGSERIAL PRIMARY KEY,
+    name         TEXT        NOT NULL,
+    prefix       VARCHAR(32) NOT NULL UNIQUE,
+    -- The BLAKE2b-256 hash of the key's secret.
+    hash         BYTEA       NOT NULL,
+    scopes       TEXT[]      NOT NULL,
+    expires_at   TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ,
+    revoked_at   TIMESTAMPTZ
+);
+
+COMMIT;
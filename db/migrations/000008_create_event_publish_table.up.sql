@@ -0,0 +1,19 @@
+-- The last change published to each destination, so that one being down
+-- neither holds back nor repeats changes to the others. A destination's row
+-- is added when it's first published to, starting where the furthest one
+-- is. The unnamed row starts them at the current end of the change log, so
+-- existing history isn't sent. Rows are leased rather than locked while
+-- publishing, so that no transaction is held open while changes are sent to
+-- the message queue.
+CREATE TABLE event_publish
+(
+    destination  TEXT PRIMARY KEY,
+    last_seq     BIGINT NOT NULL,
+    lease_token  TEXT,
+    leased_until TIMESTAMPTZ
+);
+
+INSERT INTO event_publish (destination, last_seq)
+SELECT '', COALESCE(MAX(seq), 0) FROM product_changes;
+
+COMMIT;
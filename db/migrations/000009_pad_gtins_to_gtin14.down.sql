@@ -0,0 +1,5 @@
+-- Padded GTINs are left as they are, the shorter forms can't be told apart
+-- from GTIN-14s that really do start with zeros.
+SELECT 1;
+
+COMMIT;
@@ -0,0 +1,42 @@
+-- GTINs are stored as GTIN-14, so that a barcode given with or without its
+-- leading zeros names the same item. As with catalog.NormalizeGtin only
+-- GTIN-8, 12 and 13 with a correct check digit are padded, anything else is
+-- looked up as it's stored. Leading zeros don't change the check digit.
+CREATE TEMPORARY TABLE gtin_padding AS
+SELECT b.gtin, lpad(b.gtin, 14, '0') AS padded
+  FROM product_barcodes b
+ WHERE length(b.gtin) IN (8, 12, 13)
+   AND b.gtin ~ '^[0-9]+$'
+   AND right(b.gtin, 1)::INTEGER = (10 - (
+           SELECT SUM(substr(b.gtin, length(b.gtin) - i, 1)::INTEGER * CASE WHEN i % 2 = 1 THEN 3 ELSE 1 END)
+             FROM generate_series(1, length(b.gtin) - 1) AS i
+       ) % 10) % 10;
+
+-- An item stored under more than one form has to be merged by hand first,
+-- all of them are listed rather than failing on the first.
+DO
+$$
+    DECLARE
+        duplicates TEXT;
+    BEGIN
+        SELECT string_agg(padded || ' (' || forms || ')', ', ' ORDER BY padded)
+          INTO duplicates
+          FROM (SELECT p.padded, string_agg(DISTINCT b.gtin, ', ' ORDER BY b.gtin) AS forms
+                  FROM gtin_padding p
+                  JOIN product_barcodes b ON b.gtin = p.gtin OR b.gtin = p.padded
+                 GROUP BY p.padded
+                HAVING COUNT(DISTINCT b.gtin) > 1) d;
+        IF duplicates IS NOT NULL THEN
+            RAISE EXCEPTION 'barcodes stored under more than one GTIN form: %', duplicates;
+        END IF;
+    END
+$$;
+
+UPDATE product_barcodes b
+   SET gtin = p.padded
+  FROM gtin_padding p
+ WHERE b.gtin = p.gtin;
+
+DROP TABLE gtin_padding;
+
+COMMIT;
@@ -2,17 +2,37 @@ package db
 
 import (
 	"context"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/apikey"
 	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/core/webhook"
 )
 
 type MockRepo struct {
-	SaveProductFunc      func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error
-	GetProductFunc       func(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error)
-	BeginTransactionFunc func(ctx context.Context) (core.Transaction, error)
+	SaveProductFunc         func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error
+	GetProductFunc          func(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error)
+	GetProductByBarcodeFunc func(ctx context.Context, gtin string, tx ...core.Transaction) (catalog.Product, error)
+	GetProductsFunc         func(ctx context.Context, skus []string, tx ...core.Transaction) ([]catalog.Product, error)
+	DeleteProductFunc       func(ctx context.Context, sku string, tx ...core.Transaction) error
+	ListProductsFunc        func(ctx context.Context, filter catalog.ProductFilter, limit, offset int, tx ...core.Transaction) ([]catalog.Product, error)
+	StreamProductsFunc      func(ctx context.Context, filter catalog.ProductFilter, fn func(catalog.Product) error) error
+	BeginTransactionFunc    func(ctx context.Context) (core.Transaction, error)
+	SavepointFunc           func(ctx context.Context, tx core.Transaction, fn func() error) error
+	CreateJobFunc           func(ctx context.Context, job catalog.Job, input []byte, tx ...core.Transaction) (catalog.Job, error)
+	UpdateJobFunc           func(ctx context.Context, job catalog.Job, tx ...core.Transaction) error
+	GetJobFunc              func(ctx context.Context, id int64, tx ...core.Transaction) (catalog.Job, error)
+	ClaimJobFunc            func(ctx context.Context, token string, lease time.Duration) (catalog.Job, []byte, error)
+	HeartbeatJobFunc        func(ctx context.Context, id int64, token string) error
+	LockChangeLogFunc       func(ctx context.Context, tx core.Transaction) error
+	SaveChangeFunc          func(ctx context.Context, change catalog.Change, tx ...core.Transaction) (catalog.Change, error)
+	GetChangesFunc          func(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]catalog.Change, error)
+	LastChangeSeqFunc       func(ctx context.Context, tx ...core.Transaction) (int64, error)
+	ClaimPublishCursorFunc  func(ctx context.Context, destination, token string, lease time.Duration) (int64, error)
+	SavePublishCursorFunc   func(ctx context.Context, destination, token string, seq int64) error
 }
 
 func (r MockRepo) SaveProduct(ctx context.Context, product catalog.Product, tx ...core.Transaction) error {
@@ -23,19 +43,270 @@ func (r MockRepo) GetProduct(ctx context.Context, sku string, tx ...core.Transac
 	return r.GetProductFunc(ctx, sku, tx...)
 }
 
+func (r MockRepo) GetProductByBarcode(ctx context.Context, gtin string, tx ...core.Transaction) (catalog.Product, error) {
+	return r.GetProductByBarcodeFunc(ctx, gtin, tx...)
+}
+
+func (r MockRepo) GetProducts(ctx context.Context, skus []string, tx ...core.Transaction) ([]catalog.Product, error) {
+	return r.GetProductsFunc(ctx, skus, tx...)
+}
+
+func (r MockRepo) DeleteProduct(ctx context.Context, sku string, tx ...core.Transaction) error {
+	return r.DeleteProductFunc(ctx, sku, tx...)
+}
+
+func (r MockRepo) ListProducts(ctx context.Context, filter catalog.ProductFilter, limit, offset int, tx ...core.Transaction) ([]catalog.Product, error) {
+	return r.ListProductsFunc(ctx, filter, limit, offset, tx...)
+}
+
+func (r MockRepo) StreamProducts(ctx context.Context, filter catalog.ProductFilter, fn func(catalog.Product) error) error {
+	return r.StreamProductsFunc(ctx, filter, fn)
+}
+
 func (r MockRepo) BeginTransaction(ctx context.Context) (core.Transaction, error) {
 	return r.BeginTransactionFunc(ctx)
 }
 
+func (r MockRepo) Savepoint(ctx context.Context, tx core.Transaction, fn func() error) error {
+	return r.SavepointFunc(ctx, tx, fn)
+}
+
+func (r MockRepo) CreateJob(ctx context.Context, job catalog.Job, input []byte, tx ...core.Transaction) (catalog.Job, error) {
+	return r.CreateJobFunc(ctx, job, input, tx...)
+}
+
+func (r MockRepo) UpdateJob(ctx context.Context, job catalog.Job, tx ...core.Transaction) error {
+	return r.UpdateJobFunc(ctx, job, tx...)
+}
+
+func (r MockRepo) GetJob(ctx context.Context, id int64, tx ...core.Transaction) (catalog.Job, error) {
+	return r.GetJobFunc(ctx, id, tx...)
+}
+
+func (r MockRepo) ClaimJob(ctx context.Context, token string, lease time.Duration) (catalog.Job, []byte, error) {
+	return r.ClaimJobFunc(ctx, token, lease)
+}
+
+func (r MockRepo) HeartbeatJob(ctx context.Context, id int64, token string) error {
+	return r.HeartbeatJobFunc(ctx, id, token)
+}
+
+func (r MockRepo) LockChangeLog(ctx context.Context, tx core.Transaction) error {
+	return r.LockChangeLogFunc(ctx, tx)
+}
+
+func (r MockRepo) SaveChange(ctx context.Context, change catalog.Change, tx ...core.Transaction) (catalog.Change, error) {
+	return r.SaveChangeFunc(ctx, change, tx...)
+}
+
+func (r MockRepo) GetChanges(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]catalog.Change, error) {
+	return r.GetChangesFunc(ctx, since, limit, tx...)
+}
+
+func (r MockRepo) LastChangeSeq(ctx context.Context, tx ...core.Transaction) (int64, error) {
+	return r.LastChangeSeqFunc(ctx, tx...)
+}
+
+func (r MockRepo) ClaimPublishCursor(ctx context.Context, destination, token string, lease time.Duration) (int64, error) {
+	return r.ClaimPublishCursorFunc(ctx, destination, token, lease)
+}
+
+func (r MockRepo) SavePublishCursor(ctx context.Context, destination, token string, seq int64) error {
+	return r.SavePublishCursorFunc(ctx, destination, token, seq)
+}
+
 func NewMockRepo() MockRepo {
 	return MockRepo{
 		SaveProductFunc: func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error { return nil },
 		GetProductFunc: func(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error) {
 			return catalog.Product{}, nil
 		},
+		GetProductByBarcodeFunc: func(ctx context.Context, gtin string, tx ...core.Transaction) (catalog.Product, error) {
+			return catalog.Product{}, core.ErrNotFound
+		},
+		GetProductsFunc: func(ctx context.Context, skus []string, tx ...core.Transaction) ([]catalog.Product, error) {
+			return []catalog.Product{}, nil
+		},
+		DeleteProductFunc: func(ctx context.Context, sku string, tx ...core.Transaction) error { return nil },
+		ListProductsFunc: func(ctx context.Context, filter catalog.ProductFilter, limit, offset int, tx ...core.Transaction) ([]catalog.Product, error) {
+			return []catalog.Product{}, nil
+		},
+		StreamProductsFunc: func(ctx context.Context, filter catalog.ProductFilter, fn func(catalog.Product) error) error {
+			return nil
+		},
 		BeginTransactionFunc: func(ctx context.Context) (core.Transaction, error) {
 			return MockTransaction{}, nil
 		},
+		SavepointFunc: func(ctx context.Context, tx core.Transaction, fn func() error) error {
+			return fn()
+		},
+		CreateJobFunc: func(ctx context.Context, job catalog.Job, input []byte, tx ...core.Transaction) (catalog.Job, error) {
+			return job, nil
+		},
+		UpdateJobFunc: func(ctx context.Context, job catalog.Job, tx ...core.Transaction) error { return nil },
+		GetJobFunc: func(ctx context.Context, id int64, tx ...core.Transaction) (catalog.Job, error) {
+			return catalog.Job{}, core.ErrNotFound
+		},
+		ClaimJobFunc: func(ctx context.Context, token string, lease time.Duration) (catalog.Job, []byte, error) {
+			return catalog.Job{}, nil, core.ErrNotFound
+		},
+		HeartbeatJobFunc:  func(ctx context.Context, id int64, token string) error { return nil },
+		LockChangeLogFunc: func(ctx context.Context, tx core.Transaction) error { return nil },
+		SaveChangeFunc: func(ctx context.Context, change catalog.Change, tx ...core.Transaction) (catalog.Change, error) {
+			return change, nil
+		},
+		GetChangesFunc: func(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]catalog.Change, error) {
+			return []catalog.Change{}, nil
+		},
+		LastChangeSeqFunc: func(ctx context.Context, tx ...core.Transaction) (int64, error) { return 0, nil },
+		ClaimPublishCursorFunc: func(ctx context.Context, destination, token string, lease time.Duration) (int64, error) {
+			return 0, nil
+		},
+		SavePublishCursorFunc: func(ctx context.Context, destination, token string, seq int64) error { return nil },
+	}
+}
+
+type MockWebhookRepo struct {
+	BeginTransactionFunc   func(ctx context.Context) (core.Transaction, error)
+	SaveSubscriptionFunc   func(ctx context.Context, sub webhook.Subscription, tx ...core.Transaction) (webhook.Subscription, error)
+	GetSubscriptionFunc    func(ctx context.Context, id int64, tx ...core.Transaction) (webhook.Subscription, error)
+	ListSubscriptionsFunc  func(ctx context.Context, tx ...core.Transaction) ([]webhook.Subscription, error)
+	DeleteSubscriptionFunc func(ctx context.Context, id int64, tx ...core.Transaction) error
+	LockDispatchCursorFunc func(ctx context.Context, tx core.Transaction) (int64, error)
+	SaveDispatchCursorFunc func(ctx context.Context, seq int64, tx core.Transaction) error
+	CreateDeliveryFunc     func(ctx context.Context, d webhook.Delivery, tx ...core.Transaction) (webhook.Delivery, error)
+	UpdateDeliveryFunc     func(ctx context.Context, d webhook.Delivery, tx ...core.Transaction) error
+	ListDeliveriesFunc     func(ctx context.Context, subscriptionID int64, limit, offset int, tx ...core.Transaction) ([]webhook.Delivery, error)
+	ClaimDeliveryFunc      func(ctx context.Context, lease time.Duration) (webhook.Delivery, webhook.Subscription, error)
+	RecordAttemptFunc      func(ctx context.Context, id int64, succeeded bool, disableAfter int, tx ...core.Transaction) (webhook.Subscription, error)
+}
+
+func (r MockWebhookRepo) BeginTransaction(ctx context.Context) (core.Transaction, error) {
+	return r.BeginTransactionFunc(ctx)
+}
+
+func (r MockWebhookRepo) SaveSubscription(ctx context.Context, sub webhook.Subscription, tx ...core.Transaction) (webhook.Subscription, error) {
+	return r.SaveSubscriptionFunc(ctx, sub, tx...)
+}
+
+func (r MockWebhookRepo) GetSubscription(ctx context.Context, id int64, tx ...core.Transaction) (webhook.Subscription, error) {
+	return r.GetSubscriptionFunc(ctx, id, tx...)
+}
+
+func (r MockWebhookRepo) ListSubscriptions(ctx context.Context, tx ...core.Transaction) ([]webhook.Subscription, error) {
+	return r.ListSubscriptionsFunc(ctx, tx...)
+}
+
+func (r MockWebhookRepo) DeleteSubscription(ctx context.Context, id int64, tx ...core.Transaction) error {
+	return r.DeleteSubscriptionFunc(ctx, id, tx...)
+}
+
+func (r MockWebhookRepo) LockDispatchCursor(ctx context.Context, tx core.Transaction) (int64, error) {
+	return r.LockDispatchCursorFunc(ctx, tx)
+}
+
+func (r MockWebhookRepo) SaveDispatchCursor(ctx context.Context, seq int64, tx core.Transaction) error {
+	return r.SaveDispatchCursorFunc(ctx, seq, tx)
+}
+
+func (r MockWebhookRepo) CreateDelivery(ctx context.Context, d webhook.Delivery, tx ...core.Transaction) (webhook.Delivery, error) {
+	return r.CreateDeliveryFunc(ctx, d, tx...)
+}
+
+func (r MockWebhookRepo) UpdateDelivery(ctx context.Context, d webhook.Delivery, tx ...core.Transaction) error {
+	return r.UpdateDeliveryFunc(ctx, d, tx...)
+}
+
+func (r MockWebhookRepo) ListDeliveries(ctx context.Context, subscriptionID int64, limit, offset int, tx ...core.Transaction) ([]webhook.Delivery, error) {
+	return r.ListDeliveriesFunc(ctx, subscriptionID, limit, offset, tx...)
+}
+
+func (r MockWebhookRepo) ClaimDelivery(ctx context.Context, lease time.Duration) (webhook.Delivery, webhook.Subscription, error) {
+	return r.ClaimDeliveryFunc(ctx, lease)
+}
+
+func (r MockWebhookRepo) RecordAttempt(ctx context.Context, id int64, succeeded bool, disableAfter int, tx ...core.Transaction) (webhook.Subscription, error) {
+	return r.RecordAttemptFunc(ctx, id, succeeded, disableAfter, tx...)
+}
+
+func NewMockWebhookRepo() MockWebhookRepo {
+	return MockWebhookRepo{
+		BeginTransactionFunc: func(ctx context.Context) (core.Transaction, error) {
+			return MockTransaction{}, nil
+		},
+		SaveSubscriptionFunc: func(ctx context.Context, sub webhook.Subscription, tx ...core.Transaction) (webhook.Subscription, error) {
+			return sub, nil
+		},
+		GetSubscriptionFunc: func(ctx context.Context, id int64, tx ...core.Transaction) (webhook.Subscription, error) {
+			return webhook.Subscription{}, core.ErrNotFound
+		},
+		ListSubscriptionsFunc: func(ctx context.Context, tx ...core.Transaction) ([]webhook.Subscription, error) {
+			return []webhook.Subscription{}, nil
+		},
+		DeleteSubscriptionFunc: func(ctx context.Context, id int64, tx ...core.Transaction) error { return nil },
+		LockDispatchCursorFunc: func(ctx context.Context, tx core.Transaction) (int64, error) {
+			return 0, nil
+		},
+		SaveDispatchCursorFunc: func(ctx context.Context, seq int64, tx core.Transaction) error { return nil },
+		CreateDeliveryFunc: func(ctx context.Context, d webhook.Delivery, tx ...core.Transaction) (webhook.Delivery, error) {
+			return d, nil
+		},
+		UpdateDeliveryFunc: func(ctx context.Context, d webhook.Delivery, tx ...core.Transaction) error { return nil },
+		ListDeliveriesFunc: func(ctx context.Context, subscriptionID int64, limit, offset int, tx ...core.Transaction) ([]webhook.Delivery, error) {
+			return []webhook.Delivery{}, nil
+		},
+		ClaimDeliveryFunc: func(ctx context.Context, lease time.Duration) (webhook.Delivery, webhook.Subscription, error) {
+			return webhook.Delivery{}, webhook.Subscription{}, core.ErrNotFound
+		},
+		RecordAttemptFunc: func(ctx context.Context, id int64, succeeded bool, disableAfter int, tx ...core.Transaction) (webhook.Subscription, error) {
+			return webhook.Subscription{ID: id, Active: true}, nil
+		},
+	}
+}
+
+type MockAPIKeyRepo struct {
+	SaveAPIKeyFunc        func(ctx context.Context, key apikey.Key, tx ...core.Transaction) (apikey.Key, error)
+	GetAPIKeyFunc         func(ctx context.Context, id int64, tx ...core.Transaction) (apikey.Key, error)
+	GetAPIKeyByPrefixFunc func(ctx context.Context, prefix string, tx ...core.Transaction) (apikey.Key, error)
+	ListAPIKeysFunc       func(ctx context.Context, tx ...core.Transaction) ([]apikey.Key, error)
+	TouchAPIKeyFunc       func(ctx context.Context, id int64, at time.Time, tx ...core.Transaction) error
+}
+
+func (r MockAPIKeyRepo) SaveAPIKey(ctx context.Context, key apikey.Key, tx ...core.Transaction) (apikey.Key, error) {
+	return r.SaveAPIKeyFunc(ctx, key, tx...)
+}
+
+func (r MockAPIKeyRepo) GetAPIKey(ctx context.Context, id int64, tx ...core.Transaction) (apikey.Key, error) {
+	return r.GetAPIKeyFunc(ctx, id, tx...)
+}
+
+func (r MockAPIKeyRepo) GetAPIKeyByPrefix(ctx context.Context, prefix string, tx ...core.Transaction) (apikey.Key, error) {
+	return r.GetAPIKeyByPrefixFunc(ctx, prefix, tx...)
+}
+
+func (r MockAPIKeyRepo) ListAPIKeys(ctx context.Context, tx ...core.Transaction) ([]apikey.Key, error) {
+	return r.ListAPIKeysFunc(ctx, tx...)
+}
+
+func (r MockAPIKeyRepo) TouchAPIKey(ctx context.Context, id int64, at time.Time, tx ...core.Transaction) error {
+	return r.TouchAPIKeyFunc(ctx, id, at, tx...)
+}
+
+func NewMockAPIKeyRepo() MockAPIKeyRepo {
+	return MockAPIKeyRepo{
+		SaveAPIKeyFunc: func(ctx context.Context, key apikey.Key, tx ...core.Transaction) (apikey.Key, error) {
+			return key, nil
+		},
+		GetAPIKeyFunc: func(ctx context.Context, id int64, tx ...core.Transaction) (apikey.Key, error) {
+			return apikey.Key{}, core.ErrNotFound
+		},
+		GetAPIKeyByPrefixFunc: func(ctx context.Context, prefix string, tx ...core.Transaction) (apikey.Key, error) {
+			return apikey.Key{}, core.ErrNotFound
+		},
+		ListAPIKeysFunc: func(ctx context.Context, tx ...core.Transaction) ([]apikey.Key, error) {
+			return []apikey.Key{}, nil
+		},
+		TouchAPIKeyFunc: func(ctx context.Context, id int64, at time.Time, tx ...core.Transaction) error { return nil },
 	}
 }
 
@@ -2,13 +2,19 @@ package db
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/pkg/errors"
 	"github.com/sksmith/smfg-catalog/core"
 	"github.com/sksmith/smfg-catalog/core/catalog"
 )
 
+const pgUniqueViolation = "23505"
+
 type dbRepo struct {
 	conn core.Conn
 }
@@ -25,29 +31,77 @@ func (d *dbRepo) SaveProduct(ctx context.Context, product catalog.Product, txs .
 	if len(txs) > 0 {
 		tx = txs[0]
 	}
+
+	args := productArgs(product)
 	ct, err := tx.Exec(ctx, `
 		UPDATE products
-           SET upc = $2, name = $3
+           SET name = $2, description = $3, height = $4, width = $5, depth = $6,
+               dimension_unit = $7, net_weight = $8, gross_weight = $9, weight_unit = $10
          WHERE sku = $1;`,
-		product.Sku, product.Upc, product.Name)
+		args...)
 	if err != nil {
-		m.Complete(nil)
+		m.Complete(err)
 		return errors.WithStack(err)
 	}
 	if ct.RowsAffected() == 0 {
 		_, err := tx.Exec(ctx, `
-		INSERT INTO products (sku, upc, name)
-                      VALUES ($1, $2, $3);`,
-			product.Sku, product.Upc, product.Name)
+		INSERT INTO products (sku, name, description, height, width, depth,
+                              dimension_unit, net_weight, gross_weight, weight_unit)
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`,
+			args...)
 		if err != nil {
 			m.Complete(err)
-			return err
+			return errors.WithStack(err)
 		}
 	}
+
+	if err = saveBarcodes(ctx, tx, product); err != nil {
+		m.Complete(err)
+		return err
+	}
+
 	m.Complete(nil)
 	return nil
 }
 
+// productArgs returns the product's columns in the order used by
+// SaveProduct, with missing measurements as NULLs.
+func productArgs(p catalog.Product) []interface{} {
+	var description, dimensionUnit, weightUnit *string
+	var height, width, depth, net, gross *float64
+	if p.Description != "" {
+		description = &p.Description
+	}
+	if d := p.Dimensions; d != nil {
+		height, width, depth, dimensionUnit = &d.Height, &d.Width, &d.Depth, &d.Unit
+	}
+	if w := p.Weight; w != nil {
+		net, gross, weightUnit = &w.Net, &w.Gross, &w.Unit
+	}
+	return []interface{}{p.Sku, p.Name, description, height, width, depth, dimensionUnit, net, gross, weightUnit}
+}
+
+func saveBarcodes(ctx context.Context, tx core.Conn, product catalog.Product) error {
+	_, err := tx.Exec(ctx, `DELETE FROM product_barcodes WHERE sku = $1;`, product.Sku)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, b := range product.Barcodes {
+		_, err = tx.Exec(ctx, `
+		INSERT INTO product_barcodes (gtin, sku, packaging_level, quantity, is_primary)
+                              VALUES ($1, $2, $3, $4, $5);`,
+			catalog.NormalizeGtin(b.Gtin), product.Sku, string(b.PackagingLevel), b.Quantity, b.Primary)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return errors.Wrapf(core.ErrConflict, "gtin %s is already assigned", b.Gtin)
+			}
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
 func (d *dbRepo) GetProduct(ctx context.Context, sku string, txs ...core.Transaction) (catalog.Product, error) {
 	m := StartMetric("GetProduct")
 	tx := d.conn
@@ -55,22 +109,271 @@ func (d *dbRepo) GetProduct(ctx context.Context, sku string, txs ...core.Transac
 		tx = txs[0]
 	}
 
-	product := catalog.Product{}
-	err := tx.QueryRow(ctx, `SELECT sku, upc, name FROM products WHERE sku = $1`, sku).
-		Scan(&product.Sku, &product.Upc, &product.Name)
+	product, err := scanProduct(tx.QueryRow(ctx, productSelect+`
+         WHERE p.sku = $1
+      GROUP BY p.sku`, sku))
 
 	if err != nil {
 		m.Complete(err)
-		if err == pgx.ErrNoRows {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return product, errors.WithStack(core.ErrNotFound)
 		}
-		return product, errors.WithStack(err)
+		return product, err
+	}
+
+	m.Complete(nil)
+	return product, nil
+}
+
+func (d *dbRepo) GetProductByBarcode(ctx context.Context, gtin string, txs ...core.Transaction) (catalog.Product, error) {
+	m := StartMetric("GetProductByBarcode")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	product, err := scanProduct(tx.QueryRow(ctx, productSelect+`
+         WHERE p.sku = (SELECT sku FROM product_barcodes WHERE gtin = $1)
+      GROUP BY p.sku`, gtin))
+
+	if err != nil {
+		m.Complete(err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return product, errors.WithStack(core.ErrNotFound)
+		}
+		return product, err
 	}
 
 	m.Complete(nil)
 	return product, nil
 }
 
+func (d *dbRepo) GetProducts(ctx context.Context, skus []string, txs ...core.Transaction) ([]catalog.Product, error) {
+	m := StartMetric("GetProducts")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	rows, err := tx.Query(ctx, productSelect+`
+         WHERE p.sku = ANY($1)
+      GROUP BY p.sku
+      ORDER BY p.sku`, skus)
+	if err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	products, err := scanProducts(rows)
+	m.Complete(err)
+	return products, err
+}
+
+func (d *dbRepo) DeleteProduct(ctx context.Context, sku string, txs ...core.Transaction) error {
+	m := StartMetric("DeleteProduct")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	ct, err := tx.Exec(ctx, `DELETE FROM products WHERE sku = $1;`, sku)
+	if err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+	if ct.RowsAffected() == 0 {
+		m.Complete(nil)
+		return errors.WithStack(core.ErrNotFound)
+	}
+
+	m.Complete(nil)
+	return nil
+}
+
+// productSelect reads each product with its barcodes aggregated as JSON so
+// that lists and exports need a single query rather than one per product.
+const productSelect = `
+		SELECT p.sku, p.name, COALESCE(p.description, ''), p.height, p.width, p.depth,
+               COALESCE(p.dimension_unit, ''), p.net_weight, p.gross_weight, COALESCE(p.weight_unit, ''),
+               COALESCE(json_agg(json_build_object(
+                   'gtin', b.gtin,
+                   'packagingLevel', b.packaging_level,
+                   'quantity', b.quantity,
+                   'primary', b.is_primary) ORDER BY b.is_primary DESC, b.quantity, b.gtin)
+                   FILTER (WHERE b.gtin IS NOT NULL), '[]')
+          FROM products p
+     LEFT JOIN product_barcodes b ON b.sku = p.sku`
+
+func productQuery(filter catalog.ProductFilter) (string, []interface{}) {
+	var where []string
+	var args []interface{}
+
+	if filter.SkuPrefix != "" {
+		args = append(args, escapeLike(filter.SkuPrefix))
+		where = append(where, fmt.Sprintf("p.sku LIKE $%d || '%%'", len(args)))
+	}
+	if filter.Name != "" {
+		args = append(args, escapeLike(filter.Name))
+		where = append(where, fmt.Sprintf("p.name ILIKE '%%' || $%d || '%%'", len(args)))
+	}
+	if filter.Gtin != "" {
+		args = append(args, catalog.NormalizeGtin(filter.Gtin))
+		where = append(where, fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM product_barcodes f WHERE f.sku = p.sku AND f.gtin = $%d)", len(args)))
+	}
+	if filter.AfterSku != "" {
+		args = append(args, filter.AfterSku)
+		where = append(where, fmt.Sprintf("p.sku > $%d", len(args)))
+	}
+
+	query := productSelect
+	if len(where) > 0 {
+		query += "\n         WHERE " + strings.Join(where, " AND ")
+	}
+	query += "\n      GROUP BY p.sku\n      ORDER BY p.sku"
+	return query, args
+}
+
+// likeEscaper escapes the LIKE wildcards, and the default escape character
+// itself, so that filters match what they were given literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+func scanProduct(row pgx.Row) (catalog.Product, error) {
+	product := catalog.Product{}
+	var height, width, depth, net, gross *float64
+	var dimensionUnit, weightUnit string
+	var barcodes []byte
+
+	err := row.Scan(&product.Sku, &product.Name, &product.Description, &height, &width, &depth,
+		&dimensionUnit, &net, &gross, &weightUnit, &barcodes)
+	if err != nil {
+		return product, errors.WithStack(err)
+	}
+
+	if height != nil || width != nil || depth != nil {
+		product.Dimensions = &catalog.Dimensions{
+			Height: valueOf(height), Width: valueOf(width), Depth: valueOf(depth), Unit: dimensionUnit,
+		}
+	}
+	if net != nil || gross != nil {
+		product.Weight = &catalog.Weight{Net: valueOf(net), Gross: valueOf(gross), Unit: weightUnit}
+	}
+
+	if err = json.Unmarshal(barcodes, &product.Barcodes); err != nil {
+		return product, errors.WithStack(err)
+	}
+	return product, nil
+}
+
+func valueOf(f *float64) float64 {
+	if f == nil {
+		return 0
+	}
+	return *f
+}
+
+func (d *dbRepo) ListProducts(ctx context.Context, filter catalog.ProductFilter, limit, offset int, txs ...core.Transaction) ([]catalog.Product, error) {
+	m := StartMetric("ListProducts")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	query, args := productQuery(filter)
+	args = append(args, limit, offset)
+	query += fmt.Sprintf("\n         LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	products, err := scanProducts(rows)
+	m.Complete(err)
+	return products, err
+}
+
+func scanProducts(rows pgx.Rows) ([]catalog.Product, error) {
+	products := make([]catalog.Product, 0)
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return products, nil
+}
+
+// StreamProducts calls fn for every product matching the filter, in SKU
+// order. Products are read through a server-side cursor a page at a time so
+// the full catalog is never held in memory.
+func (d *dbRepo) StreamProducts(ctx context.Context, filter catalog.ProductFilter, fn func(catalog.Product) error) error {
+	m := StartMetric("StreamProducts")
+
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	query, args := productQuery(filter)
+	if _, err = tx.Exec(ctx, "DECLARE product_stream NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+
+	for {
+		n, err := fetchProducts(ctx, tx, fn)
+		if err != nil {
+			m.Complete(err)
+			return err
+		}
+		if n < streamFetchSize {
+			break
+		}
+	}
+
+	m.Complete(nil)
+	return nil
+}
+
+const streamFetchSize = 500
+
+func fetchProducts(ctx context.Context, tx pgx.Tx, fn func(catalog.Product) error) (int, error) {
+	rows, err := tx.Query(ctx, fmt.Sprintf("FETCH FORWARD %d FROM product_stream", streamFetchSize))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return n, err
+		}
+		if err = fn(product); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, errors.WithStack(rows.Err())
+}
+
 func (d *dbRepo) BeginTransaction(ctx context.Context) (core.Transaction, error) {
 	tx, err := d.conn.Begin(ctx)
 	if err != nil {
@@ -78,3 +381,33 @@ func (d *dbRepo) BeginTransaction(ctx context.Context) (core.Transaction, error)
 	}
 	return tx, nil
 }
+
+// Savepoint runs fn inside a savepoint of tx. When fn fails what it wrote is
+// rolled back, and the rest of tx can still be committed.
+func (d *dbRepo) Savepoint(ctx context.Context, tx core.Transaction, fn func() error) error {
+	m := StartMetric("Savepoint")
+	if _, err := tx.Exec(ctx, `SAVEPOINT catalog_savepoint;`); err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+
+	err := fn()
+	end := `RELEASE SAVEPOINT catalog_savepoint;`
+	if err != nil {
+		end = `ROLLBACK TO SAVEPOINT catalog_savepoint;`
+	}
+	if _, e := tx.Exec(ctx, end); e != nil {
+		m.Complete(e)
+		if err != nil {
+			return errors.Wrapf(e, "failed to roll back savepoint after %v", err)
+		}
+		return errors.WithStack(e)
+	}
+	m.Complete(nil)
+	return err
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
+}
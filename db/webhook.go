@@ -0,0 +1,348 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/webhook"
+)
+
+const subscriptionColumns = `s.id, s.url, s.event_types, s.secret, s.active, s.failures, s.created_at, s.disabled_at`
+
+const deliveryColumns = `d.id, d.subscription_id, d.seq, d.event_type, d.status, d.attempts,
+                         COALESCE(d.response_status, 0), COALESCE(d.last_error, ''), d.created_at,
+                         d.next_attempt_at, d.delivered_at`
+
+func (d *dbRepo) SaveSubscription(ctx context.Context, sub webhook.Subscription, txs ...core.Transaction) (webhook.Subscription, error) {
+	m := StartMetric("SaveSubscription")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	eventTypes := make([]string, 0, len(sub.EventTypes))
+	for _, t := range sub.EventTypes {
+		eventTypes = append(eventTypes, string(t))
+	}
+
+	var row pgx.Row
+	if sub.ID == 0 {
+		row = tx.QueryRow(ctx, `
+		INSERT INTO webhook_subscriptions AS s (url, event_types, secret, active, failures, disabled_at)
+                                     VALUES ($1, $2, $3, $4, $5, $6)
+                                  RETURNING `+subscriptionColumns+`;`,
+			sub.URL, eventTypes, sub.Secret, sub.Active, sub.Failures, sub.DisabledAt)
+	} else {
+		row = tx.QueryRow(ctx, `
+		UPDATE webhook_subscriptions s
+           SET url = $2, event_types = $3, secret = $4, active = $5, failures = $6, disabled_at = $7
+         WHERE id = $1
+     RETURNING `+subscriptionColumns+`;`,
+			sub.ID, sub.URL, eventTypes, sub.Secret, sub.Active, sub.Failures, sub.DisabledAt)
+	}
+
+	saved, err := scanSubscription(row)
+	if err != nil {
+		m.Complete(err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return sub, errors.WithStack(core.ErrNotFound)
+		}
+		return sub, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return saved, nil
+}
+
+func (d *dbRepo) GetSubscription(ctx context.Context, id int64, txs ...core.Transaction) (webhook.Subscription, error) {
+	m := StartMetric("GetSubscription")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	sub, err := scanSubscription(tx.QueryRow(ctx,
+		`SELECT `+subscriptionColumns+` FROM webhook_subscriptions s WHERE s.id = $1`, id))
+	if err != nil {
+		m.Complete(err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return sub, errors.WithStack(core.ErrNotFound)
+		}
+		return sub, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return sub, nil
+}
+
+func (d *dbRepo) ListSubscriptions(ctx context.Context, txs ...core.Transaction) ([]webhook.Subscription, error) {
+	m := StartMetric("ListSubscriptions")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	rows, err := tx.Query(ctx, `SELECT `+subscriptionColumns+` FROM webhook_subscriptions s ORDER BY s.id`)
+	if err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	subs := make([]webhook.Subscription, 0)
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			m.Complete(err)
+			return nil, errors.WithStack(err)
+		}
+		subs = append(subs, sub)
+	}
+	if err = rows.Err(); err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return subs, nil
+}
+
+func (d *dbRepo) DeleteSubscription(ctx context.Context, id int64, txs ...core.Transaction) error {
+	m := StartMetric("DeleteSubscription")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	ct, err := tx.Exec(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1;`, id)
+	if err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+	if ct.RowsAffected() == 0 {
+		m.Complete(nil)
+		return errors.WithStack(core.ErrNotFound)
+	}
+
+	m.Complete(nil)
+	return nil
+}
+
+func (d *dbRepo) RecordAttempt(ctx context.Context, id int64, succeeded bool, disableAfter int, txs ...core.Transaction) (webhook.Subscription, error) {
+	m := StartMetric("RecordAttempt")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	sub, err := scanSubscription(tx.QueryRow(ctx, `
+		UPDATE webhook_subscriptions s
+           SET failures = CASE WHEN $2 THEN 0 ELSE failures + 1 END,
+               active = active AND ($2 OR failures + 1 < $3),
+               disabled_at = CASE WHEN active AND NOT $2 AND failures + 1 >= $3 THEN NOW() ELSE disabled_at END
+         WHERE id = $1
+     RETURNING `+subscriptionColumns+`;`,
+		id, succeeded, disableAfter))
+	if err != nil {
+		m.Complete(err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return sub, errors.WithStack(core.ErrNotFound)
+		}
+		return sub, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return sub, nil
+}
+
+func scanSubscription(row pgx.Row) (webhook.Subscription, error) {
+	sub := webhook.Subscription{}
+	var eventTypes []string
+
+	err := row.Scan(&sub.ID, &sub.URL, &eventTypes, &sub.Secret, &sub.Active, &sub.Failures,
+		&sub.CreatedAt, &sub.DisabledAt)
+	if err != nil {
+		return sub, err
+	}
+
+	for _, t := range eventTypes {
+		sub.EventTypes = append(sub.EventTypes, webhook.EventType(t))
+	}
+	return sub, nil
+}
+
+func (d *dbRepo) LockDispatchCursor(ctx context.Context, tx core.Transaction) (int64, error) {
+	m := StartMetric("LockDispatchCursor")
+
+	var seq int64
+	err := tx.QueryRow(ctx, `SELECT last_seq FROM webhook_dispatch WHERE id = 1 FOR UPDATE SKIP LOCKED`).Scan(&seq)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			m.Complete(nil)
+			return 0, errors.WithStack(core.ErrNotFound)
+		}
+		m.Complete(err)
+		return 0, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return seq, nil
+}
+
+func (d *dbRepo) SaveDispatchCursor(ctx context.Context, seq int64, tx core.Transaction) error {
+	m := StartMetric("SaveDispatchCursor")
+
+	_, err := tx.Exec(ctx, `UPDATE webhook_dispatch SET last_seq = $1 WHERE id = 1;`, seq)
+	m.Complete(err)
+	return errors.WithStack(err)
+}
+
+func (d *dbRepo) CreateDelivery(ctx context.Context, delivery webhook.Delivery, txs ...core.Transaction) (webhook.Delivery, error) {
+	m := StartMetric("CreateDelivery")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	err := tx.QueryRow(ctx, `
+		INSERT INTO webhook_deliveries (subscription_id, seq, event_type, status, payload)
+                                VALUES ($1, $2, $3, $4, $5)
+                             RETURNING id, created_at, next_attempt_at;`,
+		delivery.SubscriptionID, delivery.Seq, string(delivery.EventType), string(delivery.Status), delivery.Payload).
+		Scan(&delivery.ID, &delivery.CreatedAt, &delivery.NextAttemptAt)
+	if err != nil {
+		m.Complete(err)
+		return delivery, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return delivery, nil
+}
+
+func (d *dbRepo) UpdateDelivery(ctx context.Context, delivery webhook.Delivery, txs ...core.Transaction) error {
+	m := StartMetric("UpdateDelivery")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	ct, err := tx.Exec(ctx, `
+		UPDATE webhook_deliveries
+           SET status = $2, attempts = $3, response_status = NULLIF($4, 0), last_error = NULLIF($5, ''),
+               next_attempt_at = $6, delivered_at = $7
+         WHERE id = $1;`,
+		delivery.ID, string(delivery.Status), delivery.Attempts, delivery.ResponseStatus, delivery.LastError,
+		delivery.NextAttemptAt, delivery.DeliveredAt)
+	if err != nil {
+		m.Complete(err)
+		return errors.WithStack(err)
+	}
+	if ct.RowsAffected() == 0 {
+		m.Complete(nil)
+		return errors.WithStack(core.ErrNotFound)
+	}
+
+	m.Complete(nil)
+	return nil
+}
+
+func (d *dbRepo) ListDeliveries(ctx context.Context, subscriptionID int64, limit, offset int, txs ...core.Transaction) ([]webhook.Delivery, error) {
+	m := StartMetric("ListDeliveries")
+	tx := d.conn
+	if len(txs) > 0 {
+		tx = txs[0]
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT `+deliveryColumns+`
+		  FROM webhook_deliveries d
+		 WHERE d.subscription_id = $1
+	  ORDER BY d.id DESC
+	     LIMIT $2 OFFSET $3`,
+		subscriptionID, limit, offset)
+	if err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]webhook.Delivery, 0)
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			m.Complete(err)
+			return nil, errors.WithStack(err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		m.Complete(err)
+		return nil, errors.WithStack(err)
+	}
+
+	m.Complete(nil)
+	return deliveries, nil
+}
+
+func (d *dbRepo) ClaimDelivery(ctx context.Context, lease time.Duration) (webhook.Delivery, webhook.Subscription, error) {
+	m := StartMetric("ClaimDelivery")
+
+	var delivery webhook.Delivery
+	var sub webhook.Subscription
+	var eventTypes []string
+	var deliveryType, status string
+
+	err := d.conn.QueryRow(ctx, `
+		UPDATE webhook_deliveries d
+           SET attempts = d.attempts + 1, next_attempt_at = NOW() + $3 * INTERVAL '1 second'
+          FROM webhook_subscriptions s
+         WHERE s.id = d.subscription_id
+           AND d.id = (SELECT p.id
+                         FROM webhook_deliveries p
+                         JOIN webhook_subscriptions a ON a.id = p.subscription_id
+                        WHERE p.status = $1 AND p.next_attempt_at <= NOW() AND a.active = $2
+                     ORDER BY p.next_attempt_at
+                        LIMIT 1
+                          FOR UPDATE OF p SKIP LOCKED)
+     RETURNING `+deliveryColumns+`, d.payload, `+subscriptionColumns+`;`,
+		string(webhook.DeliveryPending), true, lease.Seconds()).
+		Scan(&delivery.ID, &delivery.SubscriptionID, &delivery.Seq, &deliveryType, &status, &delivery.Attempts,
+			&delivery.ResponseStatus, &delivery.LastError, &delivery.CreatedAt, &delivery.NextAttemptAt,
+			&delivery.DeliveredAt, &delivery.Payload,
+			&sub.ID, &sub.URL, &eventTypes, &sub.Secret, &sub.Active, &sub.Failures, &sub.CreatedAt, &sub.DisabledAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			m.Complete(nil)
+			return delivery, sub, errors.WithStack(core.ErrNotFound)
+		}
+		m.Complete(err)
+		return delivery, sub, errors.WithStack(err)
+	}
+
+	delivery.EventType = webhook.EventType(deliveryType)
+	delivery.Status = webhook.DeliveryStatus(status)
+	for _, t := range eventTypes {
+		sub.EventTypes = append(sub.EventTypes, webhook.EventType(t))
+	}
+
+	m.Complete(nil)
+	return delivery, sub, nil
+}
+
+func scanDelivery(row pgx.Row) (webhook.Delivery, error) {
+	delivery := webhook.Delivery{}
+	var eventType, status string
+
+	err := row.Scan(&delivery.ID, &delivery.SubscriptionID, &delivery.Seq, &eventType, &status, &delivery.Attempts,
+		&delivery.ResponseStatus, &delivery.LastError, &delivery.CreatedAt, &delivery.NextAttemptAt, &delivery.DeliveredAt)
+	if err != nil {
+		return delivery, err
+	}
+
+	delivery.EventType = webhook.EventType(eventType)
+	delivery.Status = webhook.DeliveryStatus(status)
+	return delivery, nil
+}
@@ -4,17 +4,25 @@ go 1.15
 
 require (
 	github.com/go-chi/chi v4.1.2+incompatible
-	github.com/go-chi/docgen v1.0.5
 	github.com/go-chi/render v1.0.1
+	github.com/golang-jwt/jwt/v4 v4.0.0
 	github.com/golang-migrate/migrate/v4 v4.13.0
+	github.com/golang/protobuf v1.4.2
+	github.com/graphql-go/graphql v0.7.9
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/jackc/pgconn v1.7.0
 	github.com/jackc/pgx/v4 v4.9.0
+	github.com/linkedin/goavro/v2 v2.10.0
+	github.com/nats-io/nats-server/v2 v2.8.4
+	github.com/nats-io/nats.go v1.16.0
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.7.1
 	github.com/rs/zerolog v1.20.0
+	github.com/segmentio/kafka-go v0.4.30
 	github.com/sksmith/bunnyq v0.2.2
 	github.com/sksmith/go-spring-config v0.0.1
 	github.com/streadway/amqp v1.0.0
-	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899
+	golang.org/x/crypto v0.0.0-20220315160706-3147a52a75dd
+	google.golang.org/grpc v1.36.0
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,82 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryAuth and StreamAuth reject calls without a valid bearer token in the
+// authorization metadata or, when keys is not nil, API key in x-api-key.
+// The caller's user is put into the context for the service's permission
+// checks.
+func UnaryAuth(v *auth.Verifier, keys auth.KeyVerifier) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, v, keys)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func StreamAuth(v *auth.Verifier, keys auth.KeyVerifier) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), v, keys)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func authenticate(ctx context.Context, v *auth.Verifier, keys auth.KeyVerifier) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if key := md.Get(strings.ToLower(auth.KeyHeader)); len(key) > 0 && keys != nil {
+		user, err := keys.VerifyKey(ctx, key[0])
+		if err != nil {
+			if !errors.Is(err, auth.ErrInvalidToken) {
+				log.Error().Err(err).Msg("error verifying api key")
+				return ctx, status.Error(codes.Internal, "an internal server error has occurred")
+			}
+			log.Debug().Err(err).Msg("rejected api key")
+			return ctx, status.Error(codes.Unauthenticated, "the api key is invalid, expired or revoked")
+		}
+		return auth.NewContext(ctx, user), nil
+	}
+
+	var token string
+	for _, h := range md.Get("authorization") {
+		if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+			token = strings.TrimSpace(h[7:])
+			break
+		}
+	}
+	if token == "" {
+		return ctx, status.Error(codes.Unauthenticated, "a bearer token is required")
+	}
+
+	user, err := v.Verify(token)
+	if err != nil {
+		log.Debug().Err(err).Msg("rejected token")
+		return ctx, status.Error(codes.Unauthenticated, "the bearer token is invalid or expired")
+	}
+	return auth.NewContext(ctx, user), nil
+}
+
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authStream) Context() context.Context {
+	return s.ctx
+}
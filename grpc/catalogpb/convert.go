@@ -0,0 +1,71 @@
+package catalogpb
+
+import (
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+var packagingLevels = map[catalog.PackagingLevel]PackagingLevel{
+	catalog.PackagingEach:  PackagingLevel_PACKAGING_LEVEL_EACH,
+	catalog.PackagingInner: PackagingLevel_PACKAGING_LEVEL_INNER,
+	catalog.PackagingCase:  PackagingLevel_PACKAGING_LEVEL_CASE,
+}
+
+// FromProduct converts a catalog product to its protobuf message.
+func FromProduct(p catalog.Product) *Product {
+	pb := &Product{
+		Sku:         p.Sku,
+		Name:        p.Name,
+		Description: p.Description,
+	}
+	if d := p.Dimensions; d != nil {
+		pb.Dimensions = &Dimensions{Height: d.Height, Width: d.Width, Depth: d.Depth, Unit: d.Unit}
+	}
+	if w := p.Weight; w != nil {
+		pb.Weight = &Weight{Net: w.Net, Gross: w.Gross, Unit: w.Unit}
+	}
+	for _, b := range p.Barcodes {
+		pb.Barcodes = append(pb.Barcodes, &Barcode{
+			Gtin:           b.Gtin,
+			PackagingLevel: packagingLevels[b.PackagingLevel],
+			Quantity:       int32(b.Quantity),
+			Primary:        b.Primary,
+		})
+	}
+	return pb
+}
+
+// ToProduct converts a protobuf message to a catalog product.
+func ToProduct(pb *Product) catalog.Product {
+	p := catalog.Product{
+		Sku:         pb.GetSku(),
+		Name:        pb.GetName(),
+		Description: pb.GetDescription(),
+		Barcodes:    make([]catalog.Barcode, 0, len(pb.GetBarcodes())),
+	}
+	if d := pb.GetDimensions(); d != nil {
+		p.Dimensions = &catalog.Dimensions{Height: d.GetHeight(), Width: d.GetWidth(), Depth: d.GetDepth(), Unit: d.GetUnit()}
+	}
+	if w := pb.GetWeight(); w != nil {
+		p.Weight = &catalog.Weight{Net: w.GetNet(), Gross: w.GetGross(), Unit: w.GetUnit()}
+	}
+	for _, b := range pb.GetBarcodes() {
+		p.Barcodes = append(p.Barcodes, catalog.Barcode{
+			Gtin:           b.GetGtin(),
+			PackagingLevel: packagingLevel(b.GetPackagingLevel()),
+			Quantity:       int(b.GetQuantity()),
+			Primary:        b.GetPrimary(),
+		})
+	}
+	return p
+}
+
+// packagingLevel returns an empty level for an unspecified one, which
+// fails validation.
+func packagingLevel(l PackagingLevel) catalog.PackagingLevel {
+	for level, pb := range packagingLevels {
+		if pb == l {
+			return level
+		}
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package grpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	rpcHitCount *prometheus.CounterVec
+	rpcLatency  *prometheus.SummaryVec
+)
+
+func ConfigureMetrics() {
+	rpcHitCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_hit_count",
+			Help: "Number of times the given gRPC method was called",
+		},
+		[]string{"method", "code"},
+	)
+	rpcLatency = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "grpc_latency",
+			Help:       "The latency quantiles for the given gRPC method",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+		[]string{"method"},
+	)
+
+	prometheus.MustRegister(rpcHitCount)
+	prometheus.MustRegister(rpcLatency)
+}
+
+func UnaryLogging(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logCall(info.FullMethod, start, err)
+	return resp, err
+}
+
+func StreamLogging(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logCall(info.FullMethod, start, err)
+	return err
+}
+
+func logCall(method string, start time.Time, err error) {
+	log.Trace().
+		Str("method", method).
+		Str("code", status.Code(err).String()).
+		Dur("duration", time.Since(start)).Send()
+}
+
+// UnaryMetrics and StreamMetrics record nothing until ConfigureMetrics has
+// been called, so servers in tests don't need a registry.
+func UnaryMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observe(info.FullMethod, start, err)
+	return resp, err
+}
+
+func StreamMetrics(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observe(info.FullMethod, start, err)
+	return err
+}
+
+func observe(method string, start time.Time, err error) {
+	if rpcHitCount == nil {
+		return
+	}
+	rpcLatency.WithLabelValues(method).Observe(float64(time.Since(start).Milliseconds()))
+	rpcHitCount.WithLabelValues(method, status.Code(err).String()).Inc()
+}
@@ -0,0 +1,150 @@
+// Package grpc serves the catalog over gRPC, on top of the same
+// catalog.Service as the REST api.
+package grpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/auth"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/grpc/catalogpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type CatalogServer struct {
+	catalogpb.UnimplementedCatalogServiceServer
+	service catalog.Service
+}
+
+func NewCatalogServer(service catalog.Service) *CatalogServer {
+	return &CatalogServer{service: service}
+}
+
+// NewServer creates a gRPC server with the catalog service registered and
+// the logging and metrics interceptors installed.
+func NewServer(service catalog.Service, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(UnaryLogging, UnaryMetrics),
+		grpc.ChainStreamInterceptor(StreamLogging, StreamMetrics),
+	}, opts...)
+
+	s := grpc.NewServer(opts...)
+	catalogpb.RegisterCatalogServiceServer(s, NewCatalogServer(service))
+	return s
+}
+
+func (c *CatalogServer) GetProduct(ctx context.Context, req *catalogpb.GetProductRequest) (*catalogpb.Product, error) {
+	if req.GetSku() == "" {
+		return nil, status.Error(codes.InvalidArgument, "sku is required")
+	}
+
+	product, err := c.service.GetProduct(ctx, req.GetSku())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return catalogpb.FromProduct(product), nil
+}
+
+func (c *CatalogServer) BatchGetProducts(ctx context.Context, req *catalogpb.BatchGetProductsRequest) (*catalogpb.BatchGetProductsResponse, error) {
+	products, err := c.service.GetProducts(ctx, req.GetSkus())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	found := make(map[string]bool, len(products))
+	resp := &catalogpb.BatchGetProductsResponse{}
+	for _, p := range products {
+		found[p.Sku] = true
+		resp.Products = append(resp.Products, catalogpb.FromProduct(p))
+	}
+	for _, sku := range req.GetSkus() {
+		if !found[sku] {
+			resp.NotFound = append(resp.NotFound, sku)
+		}
+	}
+	return resp, nil
+}
+
+func (c *CatalogServer) ListProducts(req *catalogpb.ListProductsRequest, stream catalogpb.CatalogService_ListProductsServer) error {
+	filter := catalog.ProductFilter{SkuPrefix: req.GetSkuPrefix(), Name: req.GetName(), Gtin: req.GetGtin()}
+	if err := c.service.WriteProducts(stream.Context(), filter, &streamWriter{stream: stream}); err != nil {
+		return toStatus(err)
+	}
+	return nil
+}
+
+// streamWriter sends each product written to it down a ListProducts stream.
+type streamWriter struct {
+	stream catalogpb.CatalogService_ListProductsServer
+}
+
+func (w *streamWriter) Write(p catalog.Product) error {
+	return w.stream.Send(catalogpb.FromProduct(p))
+}
+
+func (w *streamWriter) Close() error {
+	return nil
+}
+
+func (c *CatalogServer) CreateProduct(ctx context.Context, req *catalogpb.CreateProductRequest) (*catalogpb.Product, error) {
+	if req.GetProduct() == nil {
+		return nil, status.Error(codes.InvalidArgument, "product is required")
+	}
+
+	product := catalogpb.ToProduct(req.GetProduct())
+	if err := c.service.CreateProduct(ctx, product); err != nil {
+		return nil, toStatus(err)
+	}
+	return c.GetProduct(ctx, &catalogpb.GetProductRequest{Sku: product.Sku})
+}
+
+func (c *CatalogServer) UpdateProduct(ctx context.Context, req *catalogpb.UpdateProductRequest) (*catalogpb.Product, error) {
+	if req.GetProduct() == nil {
+		return nil, status.Error(codes.InvalidArgument, "product is required")
+	}
+
+	product := catalogpb.ToProduct(req.GetProduct())
+	if err := c.service.UpdateProduct(ctx, product); err != nil {
+		return nil, toStatus(err)
+	}
+	return catalogpb.FromProduct(product), nil
+}
+
+func (c *CatalogServer) DeleteProduct(ctx context.Context, req *catalogpb.DeleteProductRequest) (*catalogpb.DeleteProductResponse, error) {
+	if req.GetSku() == "" {
+		return nil, status.Error(codes.InvalidArgument, "sku is required")
+	}
+
+	if err := c.service.DeleteProduct(ctx, req.GetSku()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &catalogpb.DeleteProductResponse{}, nil
+}
+
+// toStatus maps service errors to gRPC status codes, the way the REST api
+// maps them to HTTP statuses.
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, core.ErrNotFound):
+		return status.Error(codes.NotFound, "product not found")
+	case errors.Is(err, core.ErrConflict):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, catalog.ErrInvalidProduct), errors.Is(err, catalog.ErrInvalidBarcode):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, auth.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	log.Error().Err(err).Msg("grpc request failed")
+	return status.Error(codes.Internal, "an internal server error has occurred")
+}
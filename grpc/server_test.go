@@ -0,0 +1,139 @@
+package grpc_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+	catgrpc "github.com/sksmith/smfg-catalog/grpc"
+	"github.com/sksmith/smfg-catalog/grpc/catalogpb"
+	"github.com/sksmith/smfg-catalog/queue"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var testProduct = catalog.Product{
+	Sku:  "100",
+	Name: "Widget",
+	Barcodes: []catalog.Barcode{
+		{Gtin: "00012345600012", PackagingLevel: catalog.PackagingEach, Quantity: 1, Primary: true},
+		{Gtin: "10012345600019", PackagingLevel: catalog.PackagingCase, Quantity: 12},
+	},
+}
+
+func configureClient(t *testing.T, repo db.MockRepo) catalogpb.CatalogServiceClient {
+	service := catalog.NewService(repo, queue.NewMockQueue(), "product.fanout")
+
+	lis := bufconn.Listen(1 << 20)
+	s := catgrpc.NewServer(service)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return catalogpb.NewCatalogServiceClient(conn)
+}
+
+func TestGetProduct(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockRepo.GetProductFunc = func(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error) {
+		if sku != testProduct.Sku {
+			return catalog.Product{}, core.ErrNotFound
+		}
+		return testProduct, nil
+	}
+	client := configureClient(t, mockRepo)
+
+	p, err := client.GetProduct(context.Background(), &catalogpb.GetProductRequest{Sku: testProduct.Sku})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.GetName() != testProduct.Name {
+		t.Errorf("name got=%s want=%s", p.GetName(), testProduct.Name)
+	}
+	if len(p.GetBarcodes()) != 2 || p.GetBarcodes()[1].GetPackagingLevel() != catalogpb.PackagingLevel_PACKAGING_LEVEL_CASE {
+		t.Errorf("unexpected barcodes %v", p.GetBarcodes())
+	}
+
+	_, err = client.GetProduct(context.Background(), &catalogpb.GetProductRequest{Sku: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("code got=%s want=%s", status.Code(err), codes.NotFound)
+	}
+}
+
+func TestBatchGetProducts(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockRepo.GetProductsFunc = func(ctx context.Context, skus []string, tx ...core.Transaction) ([]catalog.Product, error) {
+		return []catalog.Product{testProduct}, nil
+	}
+	client := configureClient(t, mockRepo)
+
+	resp, err := client.BatchGetProducts(context.Background(),
+		&catalogpb.BatchGetProductsRequest{Skus: []string{testProduct.Sku, "missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetProducts()) != 1 {
+		t.Errorf("products got=%d want=1", len(resp.GetProducts()))
+	}
+	if len(resp.GetNotFound()) != 1 || resp.GetNotFound()[0] != "missing" {
+		t.Errorf("not found got=%v want=[missing]", resp.GetNotFound())
+	}
+}
+
+func TestListProducts(t *testing.T) {
+	mockRepo := db.NewMockRepo()
+	mockRepo.StreamProductsFunc = func(ctx context.Context, filter catalog.ProductFilter, fn func(catalog.Product) error) error {
+		if filter.SkuPrefix != "1" {
+			t.Errorf("sku prefix got=%s want=1", filter.SkuPrefix)
+		}
+		for i := 0; i < 3; i++ {
+			if err := fn(testProduct); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	client := configureClient(t, mockRepo)
+
+	stream, err := client.ListProducts(context.Background(), &catalogpb.ListProductsRequest{SkuPrefix: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Errorf("streamed got=%d want=3", n)
+	}
+}
+
+func TestCreateProductInvalid(t *testing.T) {
+	client := configureClient(t, db.NewMockRepo())
+
+	_, err := client.CreateProduct(context.Background(),
+		&catalogpb.CreateProductRequest{Product: &catalogpb.Product{Sku: "100", Name: "Widget"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("code got=%s want=%s", status.Code(err), codes.InvalidArgument)
+	}
+}
@@ -0,0 +1,345 @@
+// Package gs1 maps catalog products to and from GS1 style trade item XML
+// documents, the format our retail partners exchange item data in.
+//
+// Each barcode of a product becomes a trade item. Items belonging to the
+// same product are tied together by the SKU, carried as a supplier assigned
+// additional identification, and the product's primary barcode is always
+// written as its first trade item.
+package gs1
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+const (
+	Namespace   = "urn:gs1:gdsn:trade_item:xsd:3"
+	ContentType = "application/xml"
+
+	skuTypeCode  = "SUPPLIER_ASSIGNED"
+	languageCode = "en"
+)
+
+var ErrInvalidDocument = errors.New("gs1: invalid trade item document")
+
+var unitDescriptors = map[catalog.PackagingLevel]string{
+	catalog.PackagingEach:  "BASE_UNIT_OR_EACH",
+	catalog.PackagingInner: "PACK_OR_INNER_PACK",
+	catalog.PackagingCase:  "CASE",
+}
+
+type TradeItem struct {
+	XMLName                xml.Name                `xml:"tradeItem"`
+	Gtin                   string                  `xml:"gtin"`
+	UnitDescriptor         string                  `xml:"tradeItemUnitDescriptorCode"`
+	IsBaseUnit             bool                    `xml:"isTradeItemABaseUnit"`
+	AdditionalIDs          []AdditionalID          `xml:"additionalTradeItemIdentification"`
+	NextLowerLevel         *NextLowerLevel         `xml:"nextLowerLevelTradeItemInformation,omitempty"`
+	DescriptionInformation *DescriptionInformation `xml:"tradeItemDescriptionInformation,omitempty"`
+	Measurements           *Measurements           `xml:"tradeItemMeasurements,omitempty"`
+	Weight                 *TradeItemWeight        `xml:"tradeItemWeight,omitempty"`
+}
+
+type AdditionalID struct {
+	TypeCode string `xml:"additionalTradeItemIdentificationTypeCode,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type NextLowerLevel struct {
+	QuantityOfChildren int              `xml:"quantityOfChildren"`
+	TotalQuantity      int              `xml:"totalQuantityOfNextLowerLevelTradeItem"`
+	Children           []ChildTradeItem `xml:"childTradeItem"`
+}
+
+type ChildTradeItem struct {
+	Gtin     string `xml:"gtin"`
+	Quantity int    `xml:"quantityOfNextLowerLevelTradeItem"`
+}
+
+type DescriptionInformation struct {
+	DescriptionShort string    `xml:"descriptionShort,omitempty"`
+	Description      *LangText `xml:"tradeItemDescription,omitempty"`
+}
+
+type LangText struct {
+	LanguageCode string `xml:"languageCode,attr"`
+	Value        string `xml:",chardata"`
+}
+
+type Measurements struct {
+	Height *Measure `xml:"height,omitempty"`
+	Width  *Measure `xml:"width,omitempty"`
+	Depth  *Measure `xml:"depth,omitempty"`
+}
+
+type TradeItemWeight struct {
+	Gross *Measure `xml:"grossWeight,omitempty"`
+	Net   *Measure `xml:"netWeight,omitempty"`
+}
+
+type Measure struct {
+	Unit  string  `xml:"measurementUnitCode,attr"`
+	Value float64 `xml:",chardata"`
+}
+
+// TradeItems maps a product to one trade item per barcode, primary first.
+// Measurements are only given on the base unit, the each the product's
+// dimensions and weight describe.
+func TradeItems(p catalog.Product) []TradeItem {
+	barcodes := make([]catalog.Barcode, 0, len(p.Barcodes))
+	for _, b := range p.Barcodes {
+		if b.Primary {
+			barcodes = append([]catalog.Barcode{b}, barcodes...)
+		} else {
+			barcodes = append(barcodes, b)
+		}
+	}
+
+	base, hasBase := baseUnit(barcodes)
+
+	items := make([]TradeItem, 0, len(barcodes))
+	for _, b := range barcodes {
+		item := TradeItem{
+			Gtin:           b.Gtin,
+			UnitDescriptor: unitDescriptors[b.PackagingLevel],
+			IsBaseUnit:     hasBase && b.Gtin == base.Gtin,
+			AdditionalIDs:  []AdditionalID{{TypeCode: skuTypeCode, Value: p.Sku}},
+			DescriptionInformation: &DescriptionInformation{
+				DescriptionShort: p.Name,
+			},
+		}
+		if p.Description != "" {
+			item.DescriptionInformation.Description = &LangText{LanguageCode: languageCode, Value: p.Description}
+		}
+
+		if item.IsBaseUnit {
+			if d := p.Dimensions; d != nil {
+				item.Measurements = &Measurements{
+					Height: &Measure{Unit: d.Unit, Value: d.Height},
+					Width:  &Measure{Unit: d.Unit, Value: d.Width},
+					Depth:  &Measure{Unit: d.Unit, Value: d.Depth},
+				}
+			}
+			if w := p.Weight; w != nil {
+				item.Weight = &TradeItemWeight{
+					Gross: &Measure{Unit: w.Unit, Value: w.Gross},
+					Net:   &Measure{Unit: w.Unit, Value: w.Net},
+				}
+			}
+		} else {
+			item.NextLowerLevel = &NextLowerLevel{TotalQuantity: b.Quantity}
+			if hasBase {
+				item.NextLowerLevel.QuantityOfChildren = 1
+				item.NextLowerLevel.Children = []ChildTradeItem{{Gtin: base.Gtin, Quantity: b.Quantity}}
+			}
+		}
+
+		items = append(items, item)
+	}
+	return items
+}
+
+func baseUnit(barcodes []catalog.Barcode) (catalog.Barcode, bool) {
+	for _, b := range barcodes {
+		if b.PackagingLevel == catalog.PackagingEach && b.Quantity == 1 {
+			return b, true
+		}
+	}
+	return catalog.Barcode{}, false
+}
+
+// Encoder writes products as a trade item document. It implements
+// catalog.ProductWriter so a document can be streamed straight from the
+// repository.
+type Encoder struct {
+	enc     *xml.Encoder
+	started bool
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return &Encoder{enc: enc}
+}
+
+var documentStart = xml.StartElement{
+	Name: xml.Name{Local: "tradeItemDocument"},
+	Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: Namespace}},
+}
+
+func (e *Encoder) start() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+	if err := e.enc.EncodeToken(xml.ProcInst{Target: "xml", Inst: []byte(`version="1.0" encoding="UTF-8"`)}); err != nil {
+		return err
+	}
+	return e.enc.EncodeToken(documentStart)
+}
+
+func (e *Encoder) Write(p catalog.Product) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	for _, item := range TradeItems(p) {
+		if err := e.enc.Encode(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) Close() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	if err := e.enc.EncodeToken(documentStart.End()); err != nil {
+		return err
+	}
+	return e.enc.Flush()
+}
+
+// Decode reads a trade item document and groups its trade items back into
+// products by SKU. Each item's Rows are the 1-based positions of the trade
+// items it was built from.
+func Decode(r io.Reader) ([]catalog.ImportItem, error) {
+	dec := xml.NewDecoder(r)
+
+	var (
+		items    []catalog.ImportItem
+		bySku    = make(map[string]int)
+		position = 0
+		rootSeen = false
+	)
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidDocument, err.Error())
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if !rootSeen {
+			if start.Name.Local != documentStart.Name.Local {
+				return nil, errors.Wrapf(ErrInvalidDocument, "unexpected root element %q", start.Name.Local)
+			}
+			rootSeen = true
+			continue
+		}
+		if start.Name.Local != "tradeItem" {
+			if err = dec.Skip(); err != nil {
+				return nil, errors.Wrap(ErrInvalidDocument, err.Error())
+			}
+			continue
+		}
+
+		position++
+		item := TradeItem{}
+		if err = dec.DecodeElement(&item, &start); err != nil {
+			return nil, errors.Wrapf(ErrInvalidDocument, "trade item %d: %v", position, err)
+		}
+
+		sku := item.sku()
+		if sku == "" {
+			return nil, errors.Wrapf(ErrInvalidDocument, "trade item %d has no %s identification", position, skuTypeCode)
+		}
+
+		i, ok := bySku[sku]
+		if !ok {
+			bySku[sku] = len(items)
+			items = append(items, catalog.ImportItem{Product: catalog.Product{Sku: sku}})
+			i = len(items) - 1
+		}
+		items[i].Rows = append(items[i].Rows, position)
+		addTradeItem(&items[i].Product, item)
+	}
+
+	if !rootSeen {
+		return nil, errors.Wrap(ErrInvalidDocument, "document is empty")
+	}
+	return items, nil
+}
+
+func (t TradeItem) sku() string {
+	for _, id := range t.AdditionalIDs {
+		if id.TypeCode == skuTypeCode {
+			return id.Value
+		}
+	}
+	return ""
+}
+
+// addTradeItem adds the item's barcode to the product. The first item of a
+// product is its primary barcode, and the product details are taken from
+// whichever items carry them first.
+func addTradeItem(p *catalog.Product, item TradeItem) {
+	b := catalog.Barcode{
+		Gtin:           item.Gtin,
+		PackagingLevel: packagingLevel(item.UnitDescriptor),
+		Quantity:       1,
+		Primary:        len(p.Barcodes) == 0,
+	}
+	if item.NextLowerLevel != nil && item.NextLowerLevel.TotalQuantity > 0 {
+		b.Quantity = item.NextLowerLevel.TotalQuantity
+	}
+	p.Barcodes = append(p.Barcodes, b)
+
+	if info := item.DescriptionInformation; info != nil {
+		if p.Name == "" {
+			p.Name = info.DescriptionShort
+		}
+		if p.Description == "" && info.Description != nil {
+			p.Description = info.Description.Value
+		}
+	}
+
+	if m := item.Measurements; m != nil && p.Dimensions == nil {
+		d := &catalog.Dimensions{}
+		for _, measure := range []struct {
+			m    *Measure
+			dest *float64
+		}{{m.Height, &d.Height}, {m.Width, &d.Width}, {m.Depth, &d.Depth}} {
+			if measure.m != nil {
+				*measure.dest = measure.m.Value
+				d.Unit = measure.m.Unit
+			}
+		}
+		// An empty measurements element says nothing about the product.
+		if d.Unit != "" {
+			p.Dimensions = d
+		}
+	}
+
+	if w := item.Weight; w != nil && p.Weight == nil {
+		weight := &catalog.Weight{}
+		if w.Gross != nil {
+			weight.Gross, weight.Unit = w.Gross.Value, w.Gross.Unit
+		}
+		if w.Net != nil {
+			weight.Net, weight.Unit = w.Net.Value, w.Net.Unit
+		}
+		if weight.Unit != "" {
+			p.Weight = weight
+		}
+	}
+}
+
+func packagingLevel(unitDescriptor string) catalog.PackagingLevel {
+	for level, code := range unitDescriptors {
+		if code == unitDescriptor {
+			return level
+		}
+	}
+	// Left as is so that validation reports the code that wasn't recognised.
+	return catalog.PackagingLevel(unitDescriptor)
+}
@@ -0,0 +1,102 @@
+package gs1_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/gs1"
+)
+
+func TestRoundTrip(t *testing.T) {
+	products := []catalog.Product{
+		{
+			Sku:         "sku1",
+			Name:        "Widget",
+			Description: "A widget & its <parts>",
+			Dimensions:  &catalog.Dimensions{Height: 10, Width: 20.5, Depth: 3, Unit: "MMT"},
+			Weight:      &catalog.Weight{Net: 0.25, Gross: 0.3, Unit: "KGM"},
+			Barcodes: []catalog.Barcode{
+				{Gtin: "036000291452", PackagingLevel: catalog.PackagingEach, Quantity: 1, Primary: true},
+				{Gtin: "10036000291459", PackagingLevel: catalog.PackagingCase, Quantity: 24},
+			},
+		},
+		{
+			Sku:  "sku2",
+			Name: "Gadget",
+			Barcodes: []catalog.Barcode{
+				{Gtin: "96385074", PackagingLevel: catalog.PackagingInner, Quantity: 6},
+				{Gtin: "4006381333931", PackagingLevel: catalog.PackagingEach, Quantity: 1, Primary: true},
+			},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	enc := gs1.NewEncoder(buf)
+	for _, p := range products {
+		if err := enc.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := gs1.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(products) {
+		t.Fatalf("products got=%d want=%d", len(items), len(products))
+	}
+
+	// The primary barcode is always written first.
+	products[1].Barcodes = []catalog.Barcode{products[1].Barcodes[1], products[1].Barcodes[0]}
+
+	for i, item := range items {
+		if !reflect.DeepEqual(item.Product, products[i]) {
+			t.Errorf("product %d got=%+v want=%+v", i, item.Product, products[i])
+		}
+		if err = item.Product.Validate(); err != nil {
+			t.Errorf("product %d is invalid: %v", i, err)
+		}
+	}
+	if !reflect.DeepEqual(items[1].Rows, []int{3, 4}) {
+		t.Errorf("rows got=%v want=%v", items[1].Rows, []int{3, 4})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{name: "empty", doc: ``},
+		{name: "wrong root", doc: `<catalog/>`},
+		{name: "no sku", doc: `<tradeItemDocument><tradeItem><gtin>036000291452</gtin></tradeItem></tradeItemDocument>`},
+		{name: "malformed", doc: `<tradeItemDocument><tradeItem>`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := gs1.Decode(strings.NewReader(test.doc)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestDecodeEmptyMeasures(t *testing.T) {
+	doc := `<tradeItemDocument><tradeItem><gtin>036000291452</gtin>` +
+		`<additionalTradeItemIdentification additionalTradeItemIdentificationTypeCode="SUPPLIER_ASSIGNED">sku1</additionalTradeItemIdentification>` +
+		`<tradeItemMeasurements/><tradeItemWeight/></tradeItem></tradeItemDocument>`
+	items, err := gs1.Decode(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Product.Dimensions != nil || items[0].Product.Weight != nil {
+		t.Errorf("items got=%+v want no dimensions or weight", items)
+	}
+}
@@ -0,0 +1,142 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sksmith/bunnyq"
+	"github.com/streadway/amqp"
+)
+
+// Broker carries messages between exchanges and queues, as RabbitMQ does.
+// Deliveries are settled through the usual amqp.Delivery methods unless the
+// subscription acks automatically.
+type Broker interface {
+	// Publish sends msg to exchange with routing key key. It fails when no
+	// queue takes the message.
+	Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error
+	// Subscribe declares the subscription's queue and bindings, then calls
+	// handler with each delivery until ctx is done.
+	Subscribe(ctx context.Context, sub Subscription, handler func(d amqp.Delivery)) error
+	Close() error
+}
+
+// Subscription describes a queue and what it's bound to. When Exchange is
+// set the queue is bound to it with each of Keys, or an empty key when there
+// are none. The exchange is declared as Kind, or when Kind is empty it's
+// expected to exist already. When DeadLetterExchange is set, rejected
+// messages go to it and from there to a queue named after Queue with a
+// ".dead" suffix.
+type Subscription struct {
+	Queue              string
+	Exchange           string
+	Kind               string
+	Keys               []string
+	Durable            bool
+	AutoDelete         bool
+	DeadLetterExchange string
+	AutoAck            bool
+	// Consumer names the subscriber to the broker, Queue when it's empty.
+	// A durable subscription resumes where the last with the same name
+	// left off.
+	Consumer string
+
+	// Started and Stopped, when set, are called as the broker starts and
+	// stops delivering. A broker that reconnects calls them again each time.
+	Started func()
+	Stopped func()
+}
+
+// DeadLetterQueue is where the messages rejected from queue end up.
+func DeadLetterQueue(queue string) string {
+	return queue + ".dead"
+}
+
+func (s Subscription) consumerName() string {
+	if s.Consumer != "" {
+		return streamName(s.Consumer)
+	}
+	return streamName(s.Queue)
+}
+
+func (s Subscription) bindingKeys() []string {
+	if len(s.Keys) == 0 {
+		return []string{""}
+	}
+	return s.Keys
+}
+
+// RabbitBroker publishes with a Publisher and consumes with bunnyq. Each
+// subscription has connections of its own, redeclaring its queue and
+// reconnecting whenever the connection drops.
+type RabbitBroker struct {
+	addr      bunnyq.Address
+	publisher *Publisher
+	logger    bunnyq.Logger
+}
+
+func NewRabbitBroker(addr bunnyq.Address, publisher *Publisher, logger bunnyq.Logger) *RabbitBroker {
+	return &RabbitBroker{addr: addr, publisher: publisher, logger: logger}
+}
+
+func (b *RabbitBroker) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	return b.publisher.Publish(ctx, exchange, key, msg)
+}
+
+// Subscribe retries until ctx is done when the queue can't be declared or
+// the connection drops, so it only returns once ctx is done.
+func (b *RabbitBroker) Subscribe(ctx context.Context, sub Subscription, handler func(d amqp.Delivery)) error {
+	c := &consumer{
+		addr:    b.addr,
+		logger:  b.logger,
+		queue:   sub.Queue,
+		tag:     sub.Consumer,
+		declare: func(ch *amqp.Channel) error { return declareSubscription(ch, sub) },
+		handle:  handler,
+		started: sub.Started,
+		stopped: sub.Stopped,
+	}
+	if sub.AutoAck {
+		c.options = append(c.options, bunnyq.StreamOpAutoAck)
+	}
+	c.run(ctx)
+	return nil
+}
+
+func (b *RabbitBroker) Close() error {
+	return b.publisher.Close()
+}
+
+func declareSubscription(ch *amqp.Channel, sub Subscription) error {
+	var args amqp.Table
+	if sub.DeadLetterExchange != "" {
+		dead := DeadLetterQueue(sub.Queue)
+		if err := ch.ExchangeDeclare(sub.DeadLetterExchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := ch.QueueDeclare(dead, true, false, false, false, nil); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := ch.QueueBind(dead, "", sub.DeadLetterExchange, false, nil); err != nil {
+			return errors.WithStack(err)
+		}
+		args = amqp.Table{"x-dead-letter-exchange": sub.DeadLetterExchange}
+	}
+
+	if sub.Exchange != "" && sub.Kind != "" {
+		if err := ch.ExchangeDeclare(sub.Exchange, sub.Kind, true, false, false, false, nil); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if _, err := ch.QueueDeclare(sub.Queue, sub.Durable, sub.AutoDelete, false, false, args); err != nil {
+		return errors.WithStack(err)
+	}
+	if sub.Exchange != "" {
+		for _, key := range sub.bindingKeys() {
+			if err := ch.QueueBind(sub.Queue, key, sub.Exchange, false, nil); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
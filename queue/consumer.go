@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/bunnyq"
+	"github.com/streadway/amqp"
+)
+
+const consumerRetryDelay = 5 * time.Second
+
+// consumer streams deliveries from a queue until its context is done. A
+// bunnyq consumer can't be restarted once its connection drops, so each
+// attempt declares the topology and streams with a BunnyQ of its own.
+type consumer struct {
+	addr    bunnyq.Address
+	logger  bunnyq.Logger
+	queue   string
+	tag     string
+	declare func(ch *amqp.Channel) error
+	handle  func(d amqp.Delivery)
+	options []bunnyq.StreamOption
+
+	// started and stopped, when set, are called as each attempt begins and
+	// ends streaming.
+	started func()
+	stopped func()
+}
+
+func (c *consumer) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := declare(c.addr, c.declare); err != nil {
+			log.Warn().Err(err).Str("queue", c.queue).Msg("unable to declare queue")
+			if !sleep(ctx, consumerRetryDelay) {
+				return
+			}
+			continue
+		}
+
+		done := make(chan os.Signal, 1)
+		bq := bunnyq.New(ctx, c.addr, done, bunnyq.LogHandler(c.logger))
+
+		if c.started != nil {
+			c.started()
+		}
+		log.Info().Str("queue", c.queue).Msg("consuming")
+
+		err := c.stream(ctx, bq)
+
+		if c.stopped != nil {
+			c.stopped()
+		}
+		if ctx.Err() == nil {
+			log.Warn().Err(err).Str("queue", c.queue).Msg("stopped consuming")
+		}
+		if err = bq.Close(); err != nil {
+			log.Warn().Err(err).Str("queue", c.queue).Msg("failed to close consumer")
+		}
+		done <- os.Interrupt
+
+		if !sleep(ctx, consumerRetryDelay) {
+			return
+		}
+	}
+}
+
+func (c *consumer) stream(ctx context.Context, bq *bunnyq.BunnyQ) error {
+	tag := c.tag
+	if tag == "" {
+		tag = c.queue
+	}
+	options := append([]bunnyq.StreamOption{bunnyq.StreamOpConsumer(tag)}, c.options...)
+	return bq.Stream(ctx, c.queue, c.handle, options...)
+}
+
+// declare sets up exchanges, queues and bindings over a connection of its
+// own, since bunnyq can only declare plain queues.
+func declare(addr bunnyq.Address, topology func(ch *amqp.Channel) error) error {
+	conn, err := amqp.Dial(amqpURL(addr))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer ch.Close()
+
+	return topology(ch)
+}
+
+func amqpURL(a bunnyq.Address) string {
+	u := url.URL{Scheme: "amqp", User: url.UserPassword(a.User, a.Pass), Host: fmt.Sprintf("%s:%s", a.Host, a.Port)}
+	return u.String()
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,238 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/streadway/amqp"
+)
+
+// Messages are CloudEvents 1.0. Events with JSON data are sent in
+// structured mode, the body being the whole event, and those with data in
+// any other encoding in binary mode, the body being just the data. Either
+// way the attributes are in the message headers, named as the CloudEvents
+// AMQP binding describes, and the content type says which mode was used.
+const (
+	SpecVersion        = "1.0"
+	EventContentType   = "application/cloudevents+json"
+	DataContentType    = "application/json"
+	DefaultEventSource = "/smfg-catalog"
+
+	ProductEventPrefix = "com.smfg.catalog.product."
+	InvalidationType   = "com.smfg.catalog.cache.invalidation"
+
+	// ProductSchema identifies the shape of product event data. It changes
+	// when a change would break existing consumers, adding fields doesn't.
+	ProductSchema = "urn:smfg:catalog:product:v1"
+
+	headerPrefix = "cloudEvents_"
+)
+
+// SnapshotType is a product's current state sent by a replay, rather than
+// a change.
+const SnapshotType = ProductEventPrefix + "snapshot"
+
+var productEventTypes = map[catalog.ChangeType]string{
+	catalog.ChangeCreated: ProductEventPrefix + "created",
+	catalog.ChangeUpdated: ProductEventPrefix + "updated",
+	catalog.ChangeDeleted: ProductEventPrefix + "deleted",
+}
+
+// Event is a CloudEvents envelope. Data holds JSON data and DataBase64 data
+// in any other encoding. Both are absent for deletes, the subject still
+// names the SKU.
+type Event struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            time.Time       `json:"time"`
+	Subject         string          `json:"subject,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	DataSchema      string          `json:"dataschema,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      []byte          `json:"data_base64,omitempty"`
+}
+
+// NewEvent wraps data in an envelope with a random ID, for messages that
+// have nothing better to be identified by.
+func NewEvent(source, eventType, subject string, data interface{}) (Event, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Event{}, errors.WithStack(err)
+	}
+	e := Event{
+		SpecVersion: SpecVersion,
+		ID:          hex.EncodeToString(b),
+		Source:      source,
+		Type:        eventType,
+		Time:        time.Now().UTC(),
+		Subject:     subject,
+	}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return Event{}, errors.WithMessage(err, "failed to serialize event data")
+		}
+		e.SetData(DataContentType, b)
+	}
+	return e, nil
+}
+
+// ProductEvent describes a catalog change, with the product encoded by s.
+// The change's sequence is its ID, so a consumer can discard redeliveries.
+func ProductEvent(source string, change catalog.Change, s Serializer) (Event, error) {
+	eventType, ok := productEventTypes[change.Type]
+	if !ok {
+		return Event{}, errors.Errorf("unknown change type %q", change.Type)
+	}
+	e := Event{
+		SpecVersion: SpecVersion,
+		ID:          strconv.FormatInt(change.Seq, 10),
+		Source:      source,
+		Type:        eventType,
+		Time:        change.Time.UTC(),
+		Subject:     change.Sku,
+		DataSchema:  ProductSchema,
+	}
+	if change.Product != nil {
+		data, err := s.Marshal(*change.Product)
+		if err != nil {
+			return Event{}, errors.WithMessage(err, "failed to serialize product")
+		}
+		e.SetData(s.ContentType(), data)
+	}
+	return e, nil
+}
+
+// SnapshotEvent describes a product as it is now, for a replay.
+func SnapshotEvent(source string, product catalog.Product, s Serializer) (Event, error) {
+	e, err := NewEvent(source, SnapshotType, product.Sku, nil)
+	if err != nil {
+		return Event{}, err
+	}
+	data, err := s.Marshal(product)
+	if err != nil {
+		return Event{}, errors.WithMessage(err, "failed to serialize product")
+	}
+	e.DataSchema = ProductSchema
+	e.SetData(s.ContentType(), data)
+	return e, nil
+}
+
+// SetData sets the event's data and its content type.
+func (e *Event) SetData(contentType string, data []byte) {
+	e.DataContentType = contentType
+	if contentType == DataContentType {
+		e.Data = data
+		e.DataBase64 = nil
+	} else {
+		e.Data = nil
+		e.DataBase64 = data
+	}
+}
+
+// Product decodes the product in the event's data, nil when there isn't
+// one.
+func (e Event) Product() (*catalog.Product, error) {
+	data := []byte(e.Data)
+	if data == nil {
+		data = e.DataBase64
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	s, err := serializerFor(e.DataContentType)
+	if err != nil {
+		return nil, err
+	}
+	product, err := s.Unmarshal(data)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to decode product")
+	}
+	return &product, nil
+}
+
+// Publishing turns the event into a message, in binary mode when it has
+// data that isn't JSON.
+func (e Event) Publishing() (amqp.Publishing, error) {
+	contentType := EventContentType
+	body := e.DataBase64
+	if body != nil {
+		contentType = e.DataContentType
+	} else {
+		var err error
+		if body, err = json.Marshal(e); err != nil {
+			return amqp.Publishing{}, errors.WithMessage(err, "failed to serialize event")
+		}
+	}
+
+	headers := amqp.Table{
+		headerPrefix + "specversion": e.SpecVersion,
+		headerPrefix + "id":          e.ID,
+		headerPrefix + "source":      e.Source,
+		headerPrefix + "type":        e.Type,
+		headerPrefix + "time":        e.Time.Format(time.RFC3339Nano),
+	}
+	if e.Subject != "" {
+		headers[headerPrefix+"subject"] = e.Subject
+	}
+	if e.DataContentType != "" {
+		headers[headerPrefix+"datacontenttype"] = e.DataContentType
+	}
+	if e.DataSchema != "" {
+		headers[headerPrefix+"dataschema"] = e.DataSchema
+	}
+
+	return amqp.Publishing{
+		Headers:      headers,
+		ContentType:  contentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    e.ID,
+		Timestamp:    e.Time,
+		Type:         e.Type,
+		Body:         body,
+	}, nil
+}
+
+// DecodeEvent reads an event from a message in either mode.
+func DecodeEvent(d amqp.Delivery) (Event, error) {
+	e := Event{}
+	if d.ContentType == EventContentType {
+		if err := json.Unmarshal(d.Body, &e); err != nil {
+			return e, errors.WithStack(err)
+		}
+	} else {
+		e = Event{
+			SpecVersion: header(d, "specversion"),
+			ID:          header(d, "id"),
+			Source:      header(d, "source"),
+			Type:        header(d, "type"),
+			Subject:     header(d, "subject"),
+			DataSchema:  header(d, "dataschema"),
+		}
+		if t := header(d, "time"); t != "" {
+			var err error
+			if e.Time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+				return e, errors.WithStack(err)
+			}
+		}
+		if len(d.Body) > 0 {
+			e.SetData(d.ContentType, d.Body)
+		}
+	}
+	if e.SpecVersion == "" || e.Type == "" {
+		return e, errors.New("message is not a cloud event")
+	}
+	return e, nil
+}
+
+func header(d amqp.Delivery, name string) string {
+	v, _ := d.Headers[headerPrefix+name].(string)
+	return v
+}
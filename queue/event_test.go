@@ -0,0 +1,113 @@
+package queue_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/queue"
+	"github.com/streadway/amqp"
+)
+
+func TestEventEnvelope(t *testing.T) {
+	product := testProduct()
+	change := catalog.Change{Seq: 7, Type: catalog.ChangeCreated, Sku: product.Sku, Product: &product, Time: time.Now()}
+
+	for _, encoding := range encodings {
+		t.Run(encoding, func(t *testing.T) {
+			s := serializer(t, encoding)
+			event, err := queue.ProductEvent(queue.DefaultEventSource, change, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := event.Publishing()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The attributes are in the headers in either mode, so that
+			// consumers can route on them without reading the body.
+			wantHeaders := map[string]string{
+				"cloudEvents_specversion":     queue.SpecVersion,
+				"cloudEvents_id":              "7",
+				"cloudEvents_source":          queue.DefaultEventSource,
+				"cloudEvents_type":            queue.ProductEventPrefix + "created",
+				"cloudEvents_subject":         product.Sku,
+				"cloudEvents_dataschema":      queue.ProductSchema,
+				"cloudEvents_datacontenttype": s.ContentType(),
+			}
+			for name, want := range wantHeaders {
+				if got, _ := msg.Headers[name].(string); got != want {
+					t.Errorf("header %s got=%q want=%q", name, got, want)
+				}
+			}
+			sent, _ := msg.Headers["cloudEvents_time"].(string)
+			if at, err := time.Parse(time.RFC3339Nano, sent); err != nil || !at.Equal(change.Time) {
+				t.Errorf("header cloudEvents_time got=%q want=%s", sent, change.Time.Format(time.RFC3339Nano))
+			}
+			if msg.MessageId != "7" || msg.Type != wantHeaders["cloudEvents_type"] {
+				t.Errorf("message id got=%s type got=%s", msg.MessageId, msg.Type)
+			}
+
+			if encoding != queue.EncodingJSON {
+				// Binary mode, the body is just the data.
+				if msg.ContentType != s.ContentType() {
+					t.Errorf("content type got=%s want=%s", msg.ContentType, s.ContentType())
+				}
+				if got, err := s.Unmarshal(msg.Body); err != nil || !got.Equal(product) {
+					t.Errorf("body got=%+v err=%v want the product", got, err)
+				}
+				return
+			}
+
+			// Structured mode, the body is the whole event.
+			if msg.ContentType != queue.EventContentType {
+				t.Errorf("content type got=%s want=%s", msg.ContentType, queue.EventContentType)
+			}
+			body := map[string]interface{}{}
+			if err = json.Unmarshal(msg.Body, &body); err != nil {
+				t.Fatal(err)
+			}
+			for _, attr := range []string{"specversion", "id", "source", "type", "time", "subject", "data"} {
+				if body[attr] == nil || body[attr] == "" {
+					t.Errorf("attribute %s missing from %s", attr, msg.Body)
+				}
+			}
+			if body["data_base64"] != nil {
+				t.Errorf("json data sent as base64: %s", msg.Body)
+			}
+		})
+	}
+}
+
+func TestDecodeEventRejectsOtherMessages(t *testing.T) {
+	deliveries := map[string]amqp.Delivery{
+		"plain json":      {ContentType: "application/json", Body: []byte(`{"sku":"SKU-1"}`)},
+		"missing type":    {ContentType: queue.EventContentType, Body: []byte(`{"specversion":"1.0","id":"1"}`)},
+		"unreadable":      {ContentType: queue.EventContentType, Body: []byte(`not json`)},
+		"binary, no type": {ContentType: queue.AvroContentType, Headers: amqp.Table{"cloudEvents_specversion": "1.0"}},
+	}
+	for name, d := range deliveries {
+		if _, err := queue.DecodeEvent(d); err == nil {
+			t.Errorf("%s: decoded as an event", name)
+		}
+	}
+}
+
+func TestNewEvent(t *testing.T) {
+	a, err := queue.NewEvent(queue.DefaultEventSource, queue.InvalidationType, "", queue.Invalidation{Instance: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := queue.NewEvent(queue.DefaultEventSource, queue.InvalidationType, "", queue.Invalidation{Instance: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID == "" || a.ID == b.ID {
+		t.Errorf("ids got=%s,%s want unique", a.ID, b.ID)
+	}
+	if a.SpecVersion != queue.SpecVersion || a.DataContentType != queue.DataContentType || a.Time.IsZero() {
+		t.Errorf("event got=%+v", a)
+	}
+}
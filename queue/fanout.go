@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+// fanoutQueue publishes every event to each of its destinations, so that
+// product events can go to more than one kind of broker at once.
+type fanoutQueue struct {
+	destinations []catalog.Destination
+}
+
+// NewFanout publishes changes to each of destinations in turn. A publish
+// fails when any of them fails, and retrying it sends the change to all of
+// them again, which is why the change publisher publishes to each
+// Destination on its own instead. Snapshots only go to the destination
+// their target names.
+func NewFanout(destinations ...catalog.Destination) catalog.Queue {
+	return &fanoutQueue{destinations: destinations}
+}
+
+func (f *fanoutQueue) Destinations() []catalog.Destination {
+	return f.destinations
+}
+
+func (f *fanoutQueue) PublishChange(ctx context.Context, change catalog.Change) error {
+	return f.each(func(q catalog.Queue) error {
+		return q.PublishChange(ctx, change)
+	})
+}
+
+func (f *fanoutQueue) PublishSnapshot(ctx context.Context, product catalog.Product, target catalog.ReplayTarget) error {
+	d, err := catalog.ReplayDestination(f.destinations, target)
+	if err != nil {
+		return err
+	}
+	return d.Queue.PublishSnapshot(ctx, product, target)
+}
+
+// each tries every queue even when one fails, so one broker being down
+// doesn't hold back the others.
+func (f *fanoutQueue) each(publish func(q catalog.Queue) error) error {
+	var failed []error
+	for _, d := range f.destinations {
+		if err := publish(d.Queue); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return failed[0]
+	}
+	msgs := make([]string, len(failed))
+	for i, err := range failed {
+		msgs[i] = err.Error()
+	}
+	return errors.WithMessage(failed[0], strings.Join(msgs[1:], "; "))
+}
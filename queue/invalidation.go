@@ -0,0 +1,264 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// InvalidationPoll is how often the change log is read for writes that
+	// weren't made by an instance, such as those of the import command.
+	InvalidationPoll = 2 * time.Second
+
+	invalidationBuffer = 1024
+	invalidationRetry  = time.Second
+)
+
+// Invalidation asks every other instance to evict SKUs from its cache, or
+// everything when Purge is set. Instance identifies the sender, which has
+// already evicted them itself.
+type Invalidation struct {
+	Instance string   `json:"instance"`
+	Skus     []string `json:"skus,omitempty"`
+	Purge    bool     `json:"purge,omitempty"`
+}
+
+// Cache is the local cache kept in step with the other instances;
+// cache.ProductRepo satisfies it.
+type Cache interface {
+	Invalidate(skus ...string)
+	Purge()
+	SetFallback(on bool)
+}
+
+// ChangeSource supplies this instance's committed changes and the change
+// log everyone's are recorded in, catalog.Service satisfies it.
+type ChangeSource interface {
+	SubscribeChanges(buffer int) *catalog.ChangeSubscription
+	GetChanges(ctx context.Context, since int64, limit int) ([]catalog.Change, error)
+	LastChangeSeq(ctx context.Context) (int64, error)
+}
+
+// CacheInvalidator publishes the SKUs this instance writes to a fanout
+// exchange, and evicts the SKUs other instances write from the local cache.
+// Each instance consumes from its own auto-deleted queue bound to the
+// exchange. While that queue isn't being consumed the cache is put on its
+// fallback TTL, since writes elsewhere would go unnoticed. Writes made
+// without an instance, by the commands, are found by reading the change log
+// every InvalidationPoll.
+type CacheInvalidator struct {
+	broker   Broker
+	exchange string
+	instance string
+	cache    Cache
+	ready    chan struct{}
+}
+
+func NewCacheInvalidator(broker Broker, exchange, instance string, cache Cache) *CacheInvalidator {
+	return &CacheInvalidator{
+		broker:   broker,
+		exchange: exchange,
+		instance: instance,
+		cache:    cache,
+		ready:    make(chan struct{}),
+	}
+}
+
+// Start publishes and consumes invalidations in the background until ctx
+// is done.
+func (i *CacheInvalidator) Start(ctx context.Context, changes ChangeSource) {
+	log.Info().Str("exchange", i.exchange).Str("instance", i.instance).Msg("starting cache invalidation")
+	i.cache.SetFallback(true)
+	go i.consume(ctx)
+	go i.publish(ctx, changes)
+	go i.follow(ctx, changes)
+}
+
+func (i *CacheInvalidator) publish(ctx context.Context, changes ChangeSource) {
+	// Publishing to an exchange that hasn't been declared closes the channel.
+	select {
+	case <-ctx.Done():
+		return
+	case <-i.ready:
+	}
+
+	for ctx.Err() == nil {
+		sub := changes.SubscribeChanges(invalidationBuffer)
+		i.publishChanges(ctx, sub)
+		sub.Close()
+
+		if sub.Dropped() {
+			// Changes were missed, so the other instances can't know what to evict.
+			i.send(ctx, Invalidation{Instance: i.instance, Purge: true})
+		}
+	}
+}
+
+func (i *CacheInvalidator) publishChanges(ctx context.Context, sub *catalog.ChangeSubscription) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			skus := []string{c.Sku}
+			// Take whatever else is waiting, so an import sends a few messages
+			// rather than one per product.
+			for more := true; more && len(skus) < invalidationBuffer; {
+				select {
+				case c, ok = <-sub.C:
+					if !ok {
+						more = false
+						break
+					}
+					skus = append(skus, c.Sku)
+				default:
+					more = false
+				}
+			}
+			i.send(ctx, Invalidation{Instance: i.instance, Skus: skus})
+		}
+	}
+}
+
+// send publishes inv. An invalidation that is lost would leave the other
+// instances serving the SKUs it names until they expire, so when it can't
+// be sent they are told to purge instead, retrying until that gets through.
+func (i *CacheInvalidator) send(ctx context.Context, inv Invalidation) {
+	err := i.sendOnce(ctx, inv)
+	for err != nil {
+		log.Error().Err(err).Int("skus", len(inv.Skus)).Bool("purge", inv.Purge).Msg("failed to publish cache invalidation")
+		if !sleep(ctx, invalidationRetry) {
+			return
+		}
+		inv = Invalidation{Instance: i.instance, Purge: true}
+		err = i.sendOnce(ctx, inv)
+	}
+}
+
+func (i *CacheInvalidator) sendOnce(ctx context.Context, inv Invalidation) error {
+	event, err := NewEvent(DefaultEventSource, InvalidationType, "", inv)
+	if err != nil {
+		return errors.WithMessage(err, "failed to create cache invalidation")
+	}
+	msg, err := event.Publishing()
+	if err != nil {
+		return errors.WithMessage(err, "failed to serialize cache invalidation")
+	}
+	// Invalidations are of no use once the instances have restarted.
+	msg.DeliveryMode = amqp.Transient
+	return i.broker.Publish(ctx, i.exchange, "", msg)
+}
+
+// follow evicts the SKUs of every change recorded in the change log, which
+// includes those written by the commands. Writes by the instances are
+// evicted again, which does no harm.
+func (i *CacheInvalidator) follow(ctx context.Context, changes ChangeSource) {
+	ticker := time.NewTicker(InvalidationPoll)
+	defer ticker.Stop()
+
+	seq := int64(-1)
+	for {
+		var err error
+		if seq < 0 {
+			seq, err = changes.LastChangeSeq(ctx)
+			if err != nil {
+				seq = -1
+			}
+		} else {
+			seq, err = i.evictChanges(ctx, changes, seq)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Msg("unable to read the change log for cache invalidation")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// evictChanges evicts the SKUs changed after since, and returns the last
+// change's sequence.
+func (i *CacheInvalidator) evictChanges(ctx context.Context, changes ChangeSource, since int64) (int64, error) {
+	for {
+		page, err := changes.GetChanges(ctx, since, invalidationBuffer)
+		if err != nil {
+			return since, err
+		}
+		if len(page) == 0 {
+			return since, nil
+		}
+		skus := make([]string, len(page))
+		for n, c := range page {
+			skus[n] = c.Sku
+		}
+		i.cache.Invalidate(skus...)
+		since = page[len(page)-1].Seq
+		if len(page) < invalidationBuffer {
+			return since, nil
+		}
+	}
+}
+
+func (i *CacheInvalidator) consume(ctx context.Context) {
+	readied := false
+	sub := Subscription{
+		Queue:      i.exchange + "." + i.instance,
+		Exchange:   i.exchange,
+		Kind:       amqp.ExchangeFanout,
+		AutoDelete: true,
+		AutoAck:    true,
+		Started: func() {
+			if !readied {
+				close(i.ready)
+				readied = true
+			}
+			// Anything cached while no invalidations were arriving may be stale.
+			i.cache.Purge()
+			i.cache.SetFallback(false)
+		},
+		Stopped: func() {
+			i.cache.SetFallback(true)
+		},
+	}
+	if err := i.broker.Subscribe(ctx, sub, i.handle); err != nil {
+		log.Error().Err(err).Str("exchange", i.exchange).Msg("unable to consume cache invalidations")
+	}
+}
+
+func (i *CacheInvalidator) handle(d amqp.Delivery) {
+	inv := Invalidation{}
+	event, err := DecodeEvent(d)
+	if err == nil && event.Type != InvalidationType {
+		err = errors.Errorf("unexpected event type %q", event.Type)
+	}
+	if err == nil {
+		err = json.Unmarshal(event.Data, &inv)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("ignoring unreadable cache invalidation")
+		return
+	}
+	if inv.Instance == i.instance {
+		return
+	}
+
+	if inv.Purge {
+		log.Debug().Str("from", inv.Instance).Msg("purging cache")
+		i.cache.Purge()
+		return
+	}
+	log.Trace().Str("from", inv.Instance).Strs("skus", inv.Skus).Msg("invalidating cached products")
+	i.cache.Invalidate(inv.Skus...)
+}
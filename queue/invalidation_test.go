@@ -0,0 +1,218 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+	"github.com/sksmith/smfg-catalog/queue"
+	"github.com/streadway/amqp"
+)
+
+type invalidatedCache struct {
+	mu       sync.Mutex
+	skus     map[string]bool
+	purges   int
+	fallback bool
+}
+
+func (c *invalidatedCache) Invalidate(skus ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sku := range skus {
+		c.skus[sku] = true
+	}
+}
+
+func (c *invalidatedCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purges++
+}
+
+func (c *invalidatedCache) SetFallback(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fallback = on
+}
+
+func (c *invalidatedCache) check(f func(c *invalidatedCache) bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return f(c)
+}
+
+// changeSource hands out first, then live subscriptions to the service.
+type changeSource struct {
+	catalog.Service
+	first *catalog.ChangeSubscription
+}
+
+func (s *changeSource) SubscribeChanges(buffer int) *catalog.ChangeSubscription {
+	if sub := s.first; sub != nil {
+		s.first = nil
+		return sub
+	}
+	return s.Service.SubscribeChanges(buffer)
+}
+
+func eventually(t *testing.T, ctx context.Context, what string, f func() bool) {
+	t.Helper()
+	for !f() {
+		if ctx.Err() != nil {
+			t.Fatalf("%s never happened", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheInvalidator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const exchange = "catalog.invalidation"
+	b := queue.NewMemoryBroker()
+	newService := func() catalog.Service {
+		return catalog.NewService(db.NewMockRepo(), queue.NewMockQueue(), "product.fanout")
+	}
+
+	local, remote := &invalidatedCache{skus: map[string]bool{}}, &invalidatedCache{skus: map[string]bool{}}
+	localService := newService()
+
+	localCtx, stopLocal := context.WithCancel(ctx)
+	defer stopLocal()
+	queue.NewCacheInvalidator(b, exchange, "local", local).Start(localCtx, localService)
+	queue.NewCacheInvalidator(b, exchange, "remote", remote).Start(ctx, newService())
+
+	// The fallback TTL is only off while invalidations are being consumed,
+	// and anything cached before then is purged.
+	for _, c := range []*invalidatedCache{local, remote} {
+		eventually(t, ctx, "consuming invalidations", func() bool {
+			return c.check(func(c *invalidatedCache) bool { return !c.fallback && c.purges == 1 })
+		})
+	}
+
+	// An instance ignores its own writes, which it has already evicted, and
+	// evicts those of the others. Invalidations arrive in order, so by the
+	// time the foreign one has been handled the local one has too.
+	product := testProduct()
+	if err := localService.CreateProduct(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, ctx, "remote eviction", func() bool {
+		return remote.check(func(c *invalidatedCache) bool { return c.skus[product.Sku] })
+	})
+	event, err := queue.NewEvent(queue.DefaultEventSource, queue.InvalidationType, "",
+		queue.Invalidation{Instance: "other", Skus: []string{"SKU-2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := event.Publishing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Publish(ctx, exchange, "", msg); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, ctx, "local eviction", func() bool {
+		return local.check(func(c *invalidatedCache) bool { return c.skus["SKU-2"] })
+	})
+	if local.check(func(c *invalidatedCache) bool { return c.skus[product.Sku] }) {
+		t.Error("local cache evicted its own write")
+	}
+
+	// An instance that fell behind its changes can't say what to evict, so
+	// everyone else purges.
+	dropping := newService()
+	dropped := dropping.SubscribeChanges(0)
+	if err = dropping.CreateProduct(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	if !dropped.Dropped() {
+		t.Fatal("subscription didn't drop the change")
+	}
+	queue.NewCacheInvalidator(b, exchange, "dropping", &invalidatedCache{skus: map[string]bool{}}).
+		Start(ctx, &changeSource{Service: dropping, first: dropped})
+	for _, c := range []*invalidatedCache{local, remote} {
+		eventually(t, ctx, "purge", func() bool {
+			return c.check(func(c *invalidatedCache) bool { return c.purges == 2 })
+		})
+	}
+
+	// Once invalidations stop arriving, the fallback TTL is back on.
+	stopLocal()
+	eventually(t, ctx, "fallback", func() bool {
+		return local.check(func(c *invalidatedCache) bool { return c.fallback })
+	})
+}
+
+// flakyBroker fails the first publishes made through it.
+type flakyBroker struct {
+	queue.Broker
+	mu       sync.Mutex
+	failures int
+}
+
+func (b *flakyBroker) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	b.mu.Lock()
+	failed := b.failures > 0
+	b.failures--
+	b.mu.Unlock()
+	if failed {
+		return errors.New("broker unavailable")
+	}
+	return b.Broker.Publish(ctx, exchange, key, msg)
+}
+
+// An invalidation that can't be published is replaced by a purge, retried
+// until it gets through.
+func TestCacheInvalidatorPurgesAfterFailedPublish(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const exchange = "catalog.invalidation"
+	b := queue.NewMemoryBroker()
+	localService := catalog.NewService(db.NewMockRepo(), queue.NewMockQueue(), "product.fanout")
+	remote := &invalidatedCache{skus: map[string]bool{}}
+	queue.NewCacheInvalidator(&flakyBroker{Broker: b, failures: 2}, exchange, "local", &invalidatedCache{skus: map[string]bool{}}).
+		Start(ctx, localService)
+	queue.NewCacheInvalidator(b, exchange, "remote", remote).
+		Start(ctx, catalog.NewService(db.NewMockRepo(), queue.NewMockQueue(), "product.fanout"))
+	eventually(t, ctx, "consuming invalidations", func() bool {
+		return remote.check(func(c *invalidatedCache) bool { return !c.fallback && c.purges == 1 })
+	})
+
+	if err := localService.CreateProduct(ctx, testProduct()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, ctx, "purge", func() bool {
+		return remote.check(func(c *invalidatedCache) bool { return c.purges == 2 })
+	})
+}
+
+// Writes that no instance made, such as the import command's, are evicted
+// once they turn up in the change log.
+func TestCacheInvalidatorFollowsChangeLog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*queue.InvalidationPoll)
+	defer cancel()
+
+	mockRepo := db.NewMockRepo()
+	mockRepo.GetChangesFunc = func(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]catalog.Change, error) {
+		if since >= 1 {
+			return nil, nil
+		}
+		return []catalog.Change{{Seq: 1, Type: catalog.ChangeUpdated, Sku: "SKU-CLI"}}, nil
+	}
+	c := &invalidatedCache{skus: map[string]bool{}}
+	queue.NewCacheInvalidator(queue.NewMemoryBroker(), "catalog.invalidation", "local", c).
+		Start(ctx, catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout"))
+
+	eventually(t, ctx, "eviction", func() bool {
+		return c.check(func(c *invalidatedCache) bool { return c.skus["SKU-CLI"] })
+	})
+}
@@ -0,0 +1,493 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
+)
+
+const (
+	DefaultJetStreamAckWait        = 30 * time.Second
+	DefaultJetStreamPublishTimeout = 5 * time.Second
+
+	// jetStreamFetchWait is how long a pull waits for messages before asking
+	// again, which is also how long a subscription takes to notice ctx is done.
+	jetStreamFetchWait = 5 * time.Second
+	jetStreamBuffer    = 256
+	// jetStreamTransientAge is how long streams declared for ephemeral
+	// subscriptions keep messages.
+	jetStreamTransientAge = time.Minute
+
+	natsContentType = "Content-Type"
+	natsType        = "Type"
+)
+
+// ParseAckPolicy reads an ack policy named as in the JetStream consumer
+// configuration: explicit, all or none.
+func ParseAckPolicy(s string) (nats.AckPolicy, error) {
+	var p nats.AckPolicy
+	if err := p.UnmarshalJSON([]byte(strconv.Quote(s))); err != nil {
+		return p, errors.Errorf("unknown ack policy %q", s)
+	}
+	return p, nil
+}
+
+// JetStreamConfig says where NATS is and how durable consumers are set up.
+// MaxDeliver of zero leaves redeliveries unlimited, the consumers here
+// count attempts themselves.
+type JetStreamConfig struct {
+	URL            string
+	Name           string
+	AckPolicy      nats.AckPolicy
+	AckWait        time.Duration
+	MaxDeliver     int
+	PublishTimeout time.Duration
+}
+
+// JetStreamBroker carries messages over NATS JetStream, so that the same
+// publishers and consumers run where there's no RabbitMQ. Exchanges are
+// streams: a stream takes the subject named after the exchange and any
+// subject beneath it, a routing key being appended to the exchange name
+// with a dot. Topic wildcards in binding keys become their NATS
+// equivalents. Publishing directly to a queue, through the default
+// exchange, sends to the subject named after the queue.
+//
+// Durable subscriptions are durable pull consumers, named after the
+// subscription's consumer or its queue, that outlive the process. Other
+// subscriptions are ephemeral and only see messages published while
+// they're running. JetStream has no dead-letter exchanges, so messages
+// rejected without requeueing are published to the dead-letter subject
+// before being terminated.
+type JetStreamBroker struct {
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	config JetStreamConfig
+}
+
+// NewJetStreamBroker connects to config.URL, carrying on in the background
+// when the server can't be reached yet.
+func NewJetStreamBroker(config JetStreamConfig) (*JetStreamBroker, error) {
+	if config.AckWait <= 0 {
+		config.AckWait = DefaultJetStreamAckWait
+	}
+	if config.PublishTimeout <= 0 {
+		config.PublishTimeout = DefaultJetStreamPublishTimeout
+	}
+
+	conn, err := nats.Connect(config.URL,
+		nats.Name(config.Name),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warn().Err(err).Msg("disconnected from nats")
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Info().Str("url", c.ConnectedUrl()).Msg("reconnected to nats")
+		}))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	return &JetStreamBroker{conn: conn, js: js, config: config}, nil
+}
+
+// DeclareStream creates the stream for exchange unless it already exists,
+// for exchanges published to that nothing here subscribes to.
+func (b *JetStreamBroker) DeclareStream(exchange string) error {
+	return b.declareStream(&nats.StreamConfig{
+		Name:     streamName(exchange),
+		Subjects: []string{exchange, exchange + ".>"},
+		Storage:  nats.FileStorage,
+	})
+}
+
+func (b *JetStreamBroker) declareStream(config *nats.StreamConfig) error {
+	_, err := b.js.StreamInfo(config.Name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return errors.WithStack(err)
+	}
+	_, err = b.js.AddStream(config)
+	return errors.WithStack(err)
+}
+
+func (b *JetStreamBroker) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.config.PublishTimeout)
+		defer cancel()
+	}
+
+	m := nats.NewMsg(subject(exchange, key))
+	m.Data = msg.Body
+	for name, v := range msg.Headers {
+		m.Header[name] = []string{fmt.Sprint(v)}
+	}
+	if msg.ContentType != "" {
+		m.Header[natsContentType] = []string{msg.ContentType}
+	}
+	if msg.Type != "" {
+		m.Header[natsType] = []string{msg.Type}
+	}
+	opts := []nats.PubOpt{nats.Context(ctx)}
+	if msg.MessageId != "" {
+		// JetStream discards a message it's already stored with this ID.
+		opts = append(opts, nats.MsgId(msg.MessageId))
+	}
+
+	_, err := b.js.PublishMsg(m, opts...)
+	if errors.Is(err, nats.ErrNoResponders) || errors.Is(err, nats.ErrNoStreamResponse) {
+		err = errors.Wrapf(ErrReturned, "no stream takes %s", m.Subject)
+	} else if err != nil {
+		err = errors.WithStack(err)
+	}
+	countPublish(exchange, err)
+	return err
+}
+
+// Subscribe returns straight away with an error when the subscription
+// can't be expressed in JetStream. Otherwise it retries until ctx is done
+// when the consumer can't be set up or fails, so only returns once ctx is
+// done.
+func (b *JetStreamBroker) Subscribe(ctx context.Context, sub Subscription, handler func(d amqp.Delivery)) error {
+	if len(sub.Keys) > 1 {
+		return errors.Errorf("jetstream consumers take one subject, %s has %d binding keys", sub.Queue, len(sub.Keys))
+	}
+	for _, key := range sub.Keys {
+		if i := strings.Index(key, "#"); i >= 0 && i != len(key)-1 {
+			return errors.Errorf("jetstream can only match any number of words at the end of a subject, not %q", key)
+		}
+	}
+	if sub.Durable && sub.consumerName() == "" {
+		return errors.New("durable subscriptions need a queue or consumer name")
+	}
+
+	for ctx.Err() == nil {
+		err := b.consume(ctx, sub, handler)
+		if ctx.Err() != nil {
+			break
+		}
+		log.Warn().Err(err).Str("queue", sub.Queue).Msg("stopped consuming")
+		if !sleep(ctx, consumerRetryDelay) {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *JetStreamBroker) consume(ctx context.Context, sub Subscription, handler func(d amqp.Delivery)) error {
+	stream, filter, err := b.declare(sub)
+	if err != nil {
+		return err
+	}
+
+	var next func() (*nats.Msg, error)
+	var s *nats.Subscription
+	if sub.Durable {
+		s, err = b.pull(stream, filter, sub)
+		next = func() (*nats.Msg, error) {
+			fetchCtx, cancel := context.WithTimeout(ctx, jetStreamFetchWait)
+			defer cancel()
+			msgs, err := s.Fetch(1, nats.Context(fetchCtx))
+			if err != nil {
+				return nil, err
+			}
+			if len(msgs) == 0 {
+				return nil, nats.ErrTimeout
+			}
+			return msgs[0], nil
+		}
+	} else {
+		ch := make(chan *nats.Msg, jetStreamBuffer)
+		s, err = b.push(stream, filter, sub, ch)
+		next = func() (*nats.Msg, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case m := <-ch:
+				return m, nil
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// Unsubscribing deletes ephemeral consumers, but not the durable ones
+	// bound to.
+	defer s.Unsubscribe()
+
+	if sub.Started != nil {
+		sub.Started()
+	}
+	if sub.Stopped != nil {
+		defer sub.Stopped()
+	}
+	log.Info().Str("queue", sub.Queue).Str("stream", stream).Str("subject", filter).Msg("consuming")
+
+	for {
+		m, err := next()
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout):
+			continue
+		case err != nil:
+			return errors.WithStack(err)
+		}
+
+		d := b.delivery(m, sub)
+		if sub.AutoAck && sub.Durable {
+			if err = m.Ack(); err != nil {
+				log.Warn().Err(err).Str("queue", sub.Queue).Msg("failed to ack message")
+			}
+		}
+		handler(d)
+	}
+}
+
+// declare sets up the subscription's streams and returns the stream and
+// subject to consume.
+func (b *JetStreamBroker) declare(sub Subscription) (string, string, error) {
+	if sub.DeadLetterExchange != "" {
+		if err := b.DeclareStream(sub.DeadLetterExchange); err != nil {
+			return "", "", err
+		}
+	}
+
+	if sub.Exchange == "" {
+		err := b.declareStream(&nats.StreamConfig{
+			Name:     streamName(sub.Queue),
+			Subjects: []string{sub.Queue},
+			Storage:  nats.FileStorage,
+		})
+		if err != nil {
+			return "", "", err
+		}
+		return streamName(sub.Queue), sub.Queue, nil
+	}
+
+	if sub.Kind != "" {
+		config := &nats.StreamConfig{
+			Name:     streamName(sub.Exchange),
+			Subjects: []string{sub.Exchange, sub.Exchange + ".>"},
+			Storage:  nats.FileStorage,
+		}
+		if !sub.Durable {
+			// Ephemeral consumers only see new messages, so there's no use
+			// keeping them.
+			config.Storage = nats.MemoryStorage
+			config.MaxAge = jetStreamTransientAge
+		}
+		if err := b.declareStream(config); err != nil {
+			return "", "", err
+		}
+	}
+	filter := sub.Exchange + ".>"
+	if len(sub.Keys) == 1 && sub.Kind != amqp.ExchangeFanout {
+		filter = subject(sub.Exchange, topicSubject(sub.Keys[0]))
+	}
+	if filter == sub.Exchange+".>" {
+		// The exchange's own subject as well as those beneath it.
+		filter = ""
+	}
+	return streamName(sub.Exchange), filter, nil
+}
+
+// pull binds the subscription's durable consumer, creating it or bringing
+// it in line with the configuration here. JetStream refuses to change some
+// settings of an existing consumer, in which case it has to be deleted by
+// hand before the subscription can start.
+func (b *JetStreamBroker) pull(stream, filter string, sub Subscription) (*nats.Subscription, error) {
+	name := sub.consumerName()
+	want := &nats.ConsumerConfig{
+		Durable:       name,
+		DeliverPolicy: nats.DeliverAllPolicy,
+		AckPolicy:     b.config.AckPolicy,
+		AckWait:       b.config.AckWait,
+		MaxDeliver:    b.config.MaxDeliver,
+		FilterSubject: filter,
+	}
+
+	info, err := b.js.ConsumerInfo(stream, name)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		_, err = b.js.AddConsumer(stream, want)
+	case err == nil:
+		if diff := consumerDiff(info.Config, *want); diff != "" {
+			log.Warn().Str("consumer", name).Str("stream", stream).Str("changed", diff).Msg("updating consumer")
+			if _, err = b.js.UpdateConsumer(stream, want); err != nil {
+				return nil, errors.Wrapf(err, "consumer %s on %s differs in %s and can't be updated", name, stream, diff)
+			}
+		}
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s, err := b.js.PullSubscribe(filter, name, nats.Bind(stream, name))
+	return s, errors.WithStack(err)
+}
+
+// consumerDiff lists the settings made here that an existing consumer
+// doesn't have. The server stores unlimited deliveries as -1.
+func consumerDiff(got, want nats.ConsumerConfig) string {
+	maxDeliver := func(n int) int {
+		if n <= 0 {
+			return -1
+		}
+		return n
+	}
+
+	var diff []string
+	if got.DeliverPolicy != want.DeliverPolicy {
+		diff = append(diff, "deliver policy")
+	}
+	if got.AckPolicy != want.AckPolicy {
+		diff = append(diff, "ack policy")
+	}
+	if got.AckWait != want.AckWait {
+		diff = append(diff, "ack wait")
+	}
+	if maxDeliver(got.MaxDeliver) != maxDeliver(want.MaxDeliver) {
+		diff = append(diff, "max deliver")
+	}
+	if got.FilterSubject != want.FilterSubject {
+		diff = append(diff, "filter subject")
+	}
+	return strings.Join(diff, ", ")
+}
+
+func (b *JetStreamBroker) push(stream, filter string, sub Subscription, ch chan *nats.Msg) (*nats.Subscription, error) {
+	opts := []nats.SubOpt{nats.BindStream(stream), nats.DeliverNew()}
+	if sub.AutoAck {
+		opts = append(opts, nats.AckNone())
+	} else {
+		opts = append(opts, nats.ManualAck(), nats.AckExplicit(), nats.AckWait(b.config.AckWait))
+	}
+	s, err := b.js.ChanSubscribe(filter, ch, opts...)
+	return s, errors.WithStack(err)
+}
+
+// delivery presents a message as RabbitMQ would have delivered it, with
+// JetStream's delivery count in the header quorum queues use.
+func (b *JetStreamBroker) delivery(m *nats.Msg, sub Subscription) amqp.Delivery {
+	headers := amqp.Table{}
+	for name, v := range m.Header {
+		if len(v) > 0 && name != natsContentType && name != natsType && name != nats.MsgIdHdr {
+			headers[name] = v[0]
+		}
+	}
+	d := amqp.Delivery{
+		Headers:     headers,
+		ContentType: m.Header.Get(natsContentType),
+		MessageId:   m.Header.Get(nats.MsgIdHdr),
+		Type:        m.Header.Get(natsType),
+		Exchange:    sub.Exchange,
+		RoutingKey:  m.Subject,
+		Body:        m.Data,
+	}
+	if md, err := m.Metadata(); err == nil {
+		d.DeliveryTag = md.Sequence.Consumer
+		d.Timestamp = md.Timestamp
+		d.Redelivered = md.NumDelivered > 1
+		headers["x-delivery-count"] = int64(md.NumDelivered) - 1
+	}
+
+	acked := sub.AutoAck || (sub.Durable && b.config.AckPolicy == nats.AckNonePolicy)
+	if !acked {
+		d.Acknowledger = &jetStreamAck{broker: b, msg: m, queue: sub.Queue, deadLetter: sub.DeadLetterExchange}
+	}
+	return d
+}
+
+func (b *JetStreamBroker) Close() error {
+	return errors.WithStack(b.conn.Drain())
+}
+
+// jetStreamAck settles a message through JetStream. Acks and nacks apply
+// to the one message, multiple isn't supported.
+type jetStreamAck struct {
+	broker     *JetStreamBroker
+	msg        *nats.Msg
+	queue      string
+	deadLetter string
+}
+
+func (a *jetStreamAck) Ack(_ uint64, _ bool) error {
+	return errors.WithStack(a.msg.Ack())
+}
+
+// Nack redelivers the message, or when requeue isn't set dead-letters it
+// and stops it being redelivered. If it can't be dead-lettered it's
+// redelivered rather than lost.
+func (a *jetStreamAck) Nack(_ uint64, _ bool, requeue bool) error {
+	if requeue {
+		return errors.WithStack(a.msg.Nak())
+	}
+	if a.deadLetter != "" {
+		headers := amqp.Table{"x-first-death-queue": a.queue}
+		for name, v := range a.msg.Header {
+			if len(v) > 0 && name != nats.MsgIdHdr {
+				headers[name] = v[0]
+			}
+		}
+		msg := amqp.Publishing{
+			Headers:     headers,
+			ContentType: a.msg.Header.Get(natsContentType),
+			Type:        a.msg.Header.Get(natsType),
+			Body:        a.msg.Data,
+		}
+		if err := a.broker.Publish(context.Background(), a.deadLetter, "", msg); err != nil {
+			if nakErr := a.msg.Nak(); nakErr != nil {
+				log.Warn().Err(nakErr).Msg("failed to redeliver message")
+			}
+			return errors.WithMessage(err, "failed to dead-letter message")
+		}
+	}
+	return errors.WithStack(a.msg.Term())
+}
+
+func (a *jetStreamAck) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// subject names where a message sent to exchange with key goes.
+func subject(exchange, key string) string {
+	switch {
+	case exchange == "":
+		return key
+	case key == "":
+		return exchange
+	default:
+		return exchange + "." + key
+	}
+}
+
+// topicSubject turns a topic binding key into a NATS subject filter.
+func topicSubject(key string) string {
+	words := strings.Split(key, ".")
+	for i, w := range words {
+		if w == "#" {
+			words[i] = ">"
+		}
+	}
+	return strings.Join(words, ".")
+}
+
+// streamName makes a valid stream or consumer name of an exchange or queue
+// name, which may contain dots.
+func streamName(name string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(name)
+}
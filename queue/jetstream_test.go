@@ -0,0 +1,246 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	natstest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/sksmith/smfg-catalog/queue"
+	"github.com/streadway/amqp"
+)
+
+func TestParseAckPolicy(t *testing.T) {
+	tests := map[string]nats.AckPolicy{
+		"explicit": nats.AckExplicitPolicy,
+		"all":      nats.AckAllPolicy,
+		"none":     nats.AckNonePolicy,
+	}
+	for s, want := range tests {
+		got, err := queue.ParseAckPolicy(s)
+		if err != nil || got != want {
+			t.Errorf("%s got=%v err=%v want=%v", s, got, err, want)
+		}
+	}
+	if _, err := queue.ParseAckPolicy("sometimes"); err == nil {
+		t.Error("unknown policy wasn't rejected")
+	}
+}
+
+func TestJetStreamUnsupportedSubscriptions(t *testing.T) {
+	// Nothing listens here, the subscriptions are refused before connecting.
+	b, err := queue.NewJetStreamBroker(queue.JetStreamConfig{URL: "nats://127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	subs := map[string]queue.Subscription{
+		"several keys": {Queue: "q", Exchange: "e", Kind: amqp.ExchangeTopic, Keys: []string{"a", "b"}},
+		"inner #":      {Queue: "q", Exchange: "e", Kind: amqp.ExchangeTopic, Keys: []string{"#.deleted"}},
+	}
+	for name, sub := range subs {
+		handled := false
+		if err = b.Subscribe(ctx, sub, func(amqp.Delivery) { handled = true }); err == nil {
+			t.Errorf("%s: subscription wasn't refused", name)
+		}
+		if handled || ctx.Err() != nil {
+			t.Errorf("%s: subscribed before refusing", name)
+		}
+	}
+}
+
+// runJetStream starts a NATS server with JetStream in the test's temporary
+// directory.
+func runJetStream(t *testing.T) string {
+	t.Helper()
+	opts := natstest.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	s := natstest.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+	return s.ClientURL()
+}
+
+func jetStreamBroker(t *testing.T, url string, config queue.JetStreamConfig) *queue.JetStreamBroker {
+	t.Helper()
+	config.URL = url
+	b, err := queue.NewJetStreamBroker(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// consumerInfo reads a consumer as the server has it.
+func consumerInfo(t *testing.T, url, stream, name string) *nats.ConsumerInfo {
+	t.Helper()
+	conn, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := js.ConsumerInfo(stream, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestJetStreamBroker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	url := runJetStream(t)
+	b := jetStreamBroker(t, url, queue.JetStreamConfig{AckPolicy: nats.AckExplicitPolicy})
+
+	deliveries := make(chan amqp.Delivery, 8)
+	started := make(chan struct{})
+	sub := queue.Subscription{
+		Queue:              "plm.products",
+		Exchange:           "plm",
+		Kind:               amqp.ExchangeTopic,
+		Keys:               []string{"product.#"},
+		Durable:            true,
+		DeadLetterExchange: "plm-dead",
+		Started:            func() { close(started) },
+	}
+	go b.Subscribe(ctx, sub, func(d amqp.Delivery) { deliveries <- d })
+	select {
+	case <-started:
+	case <-ctx.Done():
+		t.Fatal("subscription didn't start")
+	}
+
+	next := func() amqp.Delivery {
+		t.Helper()
+		select {
+		case d := <-deliveries:
+			return d
+		case <-ctx.Done():
+			t.Fatal("nothing delivered")
+			return amqp.Delivery{}
+		}
+	}
+
+	for _, id := range []string{"kept", "rejected"} {
+		msg := amqp.Publishing{MessageId: id, ContentType: "application/json", Body: []byte(id)}
+		if err := b.Publish(ctx, "plm", "product.created", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Republishing a message JetStream has stored is discarded.
+	if err := b.Publish(ctx, "plm", "product.created", amqp.Publishing{MessageId: "kept", Body: []byte("kept")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(ctx, "elsewhere", "", message("lost")); !errors.Is(err, queue.ErrReturned) {
+		t.Errorf("unroutable err got=%v want=%v", err, queue.ErrReturned)
+	}
+
+	d := next()
+	if d.MessageId != "kept" || d.ContentType != "application/json" || d.RoutingKey != "plm.product.created" || d.Redelivered {
+		t.Errorf("delivery got=%+v", d)
+	}
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requeued messages come back counted, the way quorum queues count them.
+	d = next()
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	d = next()
+	if d.MessageId != "rejected" || !d.Redelivered || d.Headers["x-delivery-count"] != int64(1) {
+		t.Errorf("redelivery got=%+v", d)
+	}
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejected message goes to the dead-letter subject and isn't
+	// delivered again.
+	dead := make(chan amqp.Delivery, 1)
+	deadSub := queue.Subscription{Queue: "plm-dead.products", Exchange: "plm-dead", Durable: true}
+	go b.Subscribe(ctx, deadSub, func(d amqp.Delivery) {
+		_ = d.Ack(false)
+		dead <- d
+	})
+	select {
+	case d = <-dead:
+		if string(d.Body) != "rejected" || d.Headers["x-first-death-queue"] != "plm.products" {
+			t.Errorf("dead letter got=%+v", d)
+		}
+	case <-ctx.Done():
+		t.Fatal("nothing dead-lettered")
+	}
+	select {
+	case d = <-deliveries:
+		t.Errorf("delivered again got=%+v", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	eventually(t, ctx, "settling every message", func() bool {
+		info := consumerInfo(t, url, "plm", "plm_products")
+		return info.NumAckPending == 0 && info.NumPending == 0
+	})
+}
+
+func TestJetStreamConsumerConfig(t *testing.T) {
+	url := runJetStream(t)
+	sub := queue.Subscription{Queue: "plm.products", Exchange: "plm", Kind: amqp.ExchangeTopic, Durable: true}
+
+	// subscribe runs a subscription until it starts or a second passes.
+	subscribe := func(config queue.JetStreamConfig) bool {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		started := make(chan struct{})
+		sub.Started = func() { close(started) }
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			jetStreamBroker(t, url, config).Subscribe(ctx, sub, func(amqp.Delivery) {})
+		}()
+		defer func() { <-done }()
+		select {
+		case <-started:
+			cancel()
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if !subscribe(queue.JetStreamConfig{AckPolicy: nats.AckExplicitPolicy, AckWait: 30 * time.Second}) {
+		t.Fatal("subscription didn't start")
+	}
+
+	// Settings the server can change are brought in line.
+	if !subscribe(queue.JetStreamConfig{AckPolicy: nats.AckExplicitPolicy, AckWait: 10 * time.Second, MaxDeliver: 5}) {
+		t.Fatal("subscription with a new ack wait didn't start")
+	}
+	info := consumerInfo(t, url, "plm", "plm_products")
+	if info.Config.AckWait != 10*time.Second || info.Config.MaxDeliver != 5 {
+		t.Errorf("consumer got ack wait=%s max deliver=%d", info.Config.AckWait, info.Config.MaxDeliver)
+	}
+
+	// Those it can't aren't ignored.
+	if subscribe(queue.JetStreamConfig{AckPolicy: nats.AckNonePolicy, AckWait: 10 * time.Second, MaxDeliver: 5}) {
+		t.Error("subscription started with a different ack policy")
+	}
+	if info = consumerInfo(t, url, "plm", "plm_products"); info.Config.AckPolicy != nats.AckExplicitPolicy {
+		t.Errorf("consumer ack policy got=%v", info.Config.AckPolicy)
+	}
+}
@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+)
+
+const (
+	DefaultKafkaTopic        = "smfg.catalog.products"
+	DefaultKafkaBatchTimeout = 10 * time.Millisecond
+
+	// Kafka headers are named as the CloudEvents Kafka binding describes.
+	kafkaHeaderPrefix  = "ce_"
+	kafkaContentHeader = "content-type"
+)
+
+// KafkaWriter sends messages to Kafka; *kafka.Writer satisfies it.
+type KafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaConfig says where product events are sent. Writes are batched for up
+// to BatchTimeout, which bounds how long a publish waits.
+type KafkaConfig struct {
+	Brokers      []string
+	BatchTimeout time.Duration
+}
+
+// NewKafkaWriter writes to the topic each message names, partitioned by
+// key, once every in-sync replica has it.
+func NewKafkaWriter(config KafkaConfig) *kafka.Writer {
+	if config.BatchTimeout <= 0 {
+		config.BatchTimeout = DefaultKafkaBatchTimeout
+	}
+	return &kafka.Writer{
+		Addr:         kafka.TCP(config.Brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: config.BatchTimeout,
+	}
+}
+
+// kafkaQueue publishes product events to a Kafka topic. Messages are keyed
+// by SKU, so each product's events land on one partition and are read in
+// the order they were published.
+type kafkaQueue struct {
+	writer     KafkaWriter
+	topic      string
+	source     string
+	serializer Serializer
+}
+
+// NewKafkaQueue publishes product events to topic, with products encoded by
+// serializer.
+func NewKafkaQueue(writer KafkaWriter, topic string, serializer Serializer) *kafkaQueue {
+	return &kafkaQueue{
+		writer:     writer,
+		topic:      topic,
+		source:     DefaultEventSource,
+		serializer: serializer,
+	}
+}
+
+func (k *kafkaQueue) PublishChange(ctx context.Context, change catalog.Change) error {
+	event, err := ProductEvent(k.source, change, k.serializer)
+	if err != nil {
+		return errors.WithMessage(err, "failed to create product event")
+	}
+	return k.publish(ctx, k.topic, event)
+}
+
+// PublishSnapshot sends to the target's topic, or the product topic when it
+// doesn't have one. Kafka has no exchanges or routing keys, so the target's
+// are ignored.
+func (k *kafkaQueue) PublishSnapshot(ctx context.Context, product catalog.Product, target catalog.ReplayTarget) error {
+	event, err := SnapshotEvent(k.source, product, k.serializer)
+	if err != nil {
+		return errors.WithMessage(err, "failed to create snapshot event")
+	}
+	topic := target.Topic
+	if topic == "" {
+		topic = k.topic
+	}
+	return k.publish(ctx, topic, event)
+}
+
+func (k *kafkaQueue) publish(ctx context.Context, topic string, event Event) error {
+	msg, err := KafkaMessage(event)
+	if err != nil {
+		return errors.WithMessage(err, "failed to serialize message for kafka")
+	}
+	msg.Topic = topic
+	if err = k.writer.WriteMessages(ctx, msg); err != nil {
+		return errors.Wrap(err, "failed to send product event to kafka")
+	}
+	return nil
+}
+
+// KafkaMessage turns the event into a message keyed by its subject, in the
+// same mode as Publishing would.
+func KafkaMessage(e Event) (kafka.Message, error) {
+	pub, err := e.Publishing()
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	names := make([]string, 0, len(pub.Headers))
+	for name := range pub.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	headers := []kafka.Header{{Key: kafkaContentHeader, Value: []byte(pub.ContentType)}}
+	for _, name := range names {
+		if s, ok := pub.Headers[name].(string); ok {
+			key := kafkaHeaderPrefix + strings.TrimPrefix(name, headerPrefix)
+			headers = append(headers, kafka.Header{Key: key, Value: []byte(s)})
+		}
+	}
+
+	return kafka.Message{
+		Key:     []byte(e.Subject),
+		Value:   pub.Body,
+		Headers: headers,
+		Time:    e.Time,
+	}, nil
+}
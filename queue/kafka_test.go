@@ -0,0 +1,141 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/queue"
+)
+
+type kafkaWriter struct {
+	msgs []kafka.Message
+	err  error
+}
+
+func (w *kafkaWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func (w *kafkaWriter) Close() error {
+	return nil
+}
+
+func kafkaHeader(m kafka.Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestKafkaQueue(t *testing.T) {
+	ctx := context.Background()
+	product := testProduct()
+
+	for _, encoding := range encodings {
+		t.Run(encoding, func(t *testing.T) {
+			s, err := queue.NewSerializer(encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := &kafkaWriter{}
+			q := queue.NewKafkaQueue(w, "products", s)
+
+			change := catalog.Change{Seq: 7, Sku: product.Sku, Type: catalog.ChangeUpdated, Time: time.Now(), Product: &product}
+			if err = q.PublishChange(ctx, change); err != nil {
+				t.Fatal(err)
+			}
+			if err = q.PublishSnapshot(ctx, product, catalog.ReplayTarget{Topic: "rebuild", Exchange: "ignored", RoutingKey: "ignored"}); err != nil {
+				t.Fatal(err)
+			}
+			if len(w.msgs) != 2 {
+				t.Fatalf("messages got=%d want=2", len(w.msgs))
+			}
+
+			m := w.msgs[0]
+			if m.Topic != "products" || string(m.Key) != product.Sku {
+				t.Errorf("topic got=%s key got=%s", m.Topic, m.Key)
+			}
+			if got := kafkaHeader(m, "ce_id"); got != "7" {
+				t.Errorf("ce_id got=%s want=7", got)
+			}
+			if got := kafkaHeader(m, "ce_type"); got != queue.ProductEventPrefix+"updated" {
+				t.Errorf("ce_type got=%s", got)
+			}
+			wantContent := queue.EventContentType
+			if encoding != queue.EncodingJSON {
+				wantContent = s.ContentType()
+			}
+			if got := kafkaHeader(m, "content-type"); got != wantContent {
+				t.Errorf("content-type got=%s want=%s", got, wantContent)
+			}
+
+			if m = w.msgs[1]; m.Topic != "rebuild" || kafkaHeader(m, "ce_type") != queue.SnapshotType {
+				t.Errorf("snapshot topic got=%s type got=%s", m.Topic, kafkaHeader(m, "ce_type"))
+			}
+		})
+	}
+}
+
+func TestFanout(t *testing.T) {
+	ctx := context.Background()
+	product := testProduct()
+	change := catalog.Change{Seq: 1, Sku: product.Sku, Type: catalog.ChangeCreated, Time: time.Now(), Product: &product}
+
+	var rabbit []int64
+	mockQueue := queue.NewMockQueue()
+	mockQueue.PublishChangeFunc = func(ctx context.Context, change catalog.Change) error {
+		rabbit = append(rabbit, change.Seq)
+		return nil
+	}
+	w := &kafkaWriter{}
+	q := queue.NewFanout(
+		catalog.Destination{Name: "rabbitmq", Queue: mockQueue},
+		catalog.Destination{Name: "kafka", Queue: queue.NewKafkaQueue(w, "products", queue.JSONSerializer{})},
+	)
+
+	if err := q.PublishChange(ctx, change); err != nil {
+		t.Fatal(err)
+	}
+	if len(rabbit) != 1 || len(w.msgs) != 1 {
+		t.Errorf("published got rabbit=%d kafka=%d want 1 each", len(rabbit), len(w.msgs))
+	}
+
+	// One destination failing doesn't stop the other, but fails the publish.
+	w.err = errors.New("kafka unavailable")
+	err := q.PublishChange(ctx, change)
+	if err == nil || !strings.Contains(err.Error(), "kafka unavailable") {
+		t.Errorf("err got=%v", err)
+	}
+	if len(rabbit) != 2 {
+		t.Errorf("rabbit published got=%d want=2", len(rabbit))
+	}
+
+	// Snapshots only go to the destination named.
+	var snapshots int
+	mockQueue.PublishSnapshotFunc = func(ctx context.Context, product catalog.Product, target catalog.ReplayTarget) error {
+		snapshots++
+		return nil
+	}
+	if err = q.PublishSnapshot(ctx, product, catalog.ReplayTarget{Destination: "rabbitmq"}); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots != 1 || len(w.msgs) != 1 {
+		t.Errorf("snapshots got rabbit=%d kafka=%d want 1, 0", snapshots, len(w.msgs)-1)
+	}
+	for _, target := range []catalog.ReplayTarget{{}, {Destination: "nats"}} {
+		if err = q.PublishSnapshot(ctx, product, target); !errors.Is(err, catalog.ErrUnknownDestination) {
+			t.Errorf("target %+v err got=%v want=%v", target, err, catalog.ErrUnknownDestination)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package queue
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+var ErrNoExchange = errors.New("queue: exchange not found")
+
+// MemoryBroker is a Broker held in memory, for tests and running locally
+// without RabbitMQ. It routes as RabbitMQ does for fanout, direct and topic
+// exchanges, including the default exchange that routes to the queue named
+// by the key, and redelivers or dead-letters messages that are nacked.
+// Messages a subscription leaves unsettled when it ends are requeued.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+}
+
+type memExchange struct {
+	kind     string
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue *memQueue
+	key   string
+}
+
+type memQueue struct {
+	broker             *MemoryBroker
+	name               string
+	deadLetterExchange string
+	ready              []amqp.Delivery
+	unacked            map[uint64]memUnacked
+	tag                uint64
+	consumers          uint64
+	notify             chan struct{}
+}
+
+// memUnacked is a delivery waiting to be settled by the consumer it was
+// given to.
+type memUnacked struct {
+	amqp.Delivery
+	consumer uint64
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: make(map[string]*memExchange),
+		queues:    make(map[string]*memQueue),
+	}
+}
+
+// DeclareExchange creates an exchange of kind, one of the amqp.Exchange
+// kinds other than headers, unless it already exists.
+func (b *MemoryBroker) DeclareExchange(name, kind string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.declareExchange(name, kind)
+}
+
+func (b *MemoryBroker) declareExchange(name, kind string) error {
+	switch kind {
+	case amqp.ExchangeFanout, amqp.ExchangeDirect, amqp.ExchangeTopic:
+	default:
+		return errors.Errorf("unsupported exchange kind %q", kind)
+	}
+	if e, ok := b.exchanges[name]; ok {
+		if e.kind != kind {
+			return errors.Errorf("exchange %s is already declared as %s", name, e.kind)
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{kind: kind}
+	return nil
+}
+
+// DeclareQueue creates a queue unless it already exists.
+func (b *MemoryBroker) DeclareQueue(name, deadLetterExchange string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.declareQueue(name, deadLetterExchange)
+}
+
+func (b *MemoryBroker) declareQueue(name, deadLetterExchange string) *memQueue {
+	if q, ok := b.queues[name]; ok {
+		return q
+	}
+	q := &memQueue{
+		broker:             b,
+		name:               name,
+		deadLetterExchange: deadLetterExchange,
+		unacked:            make(map[uint64]memUnacked),
+		notify:             make(chan struct{}, 1),
+	}
+	b.queues[name] = q
+	return q
+}
+
+// Bind routes messages sent to exchange with a matching key to queue.
+func (b *MemoryBroker) Bind(queue, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bind(queue, key, exchange)
+}
+
+func (b *MemoryBroker) bind(queue, key, exchange string) error {
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return errors.Wrap(ErrNoExchange, exchange)
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return errors.Errorf("queue %s not found", queue)
+	}
+	for _, binding := range e.bindings {
+		if binding.queue == q && binding.key == key {
+			return nil
+		}
+	}
+	e.bindings = append(e.bindings, memBinding{queue: q, key: key})
+	return nil
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	queues, err := b.route(exchange, key)
+	if err != nil {
+		countPublish(exchange, err)
+		return err
+	}
+	if len(queues) == 0 {
+		err = errors.Wrapf(ErrReturned, "no queue bound to %s with key %s", exchange, key)
+		countPublish(exchange, err)
+		return err
+	}
+	for _, q := range queues {
+		q.push(delivery(exchange, key, msg))
+	}
+	countPublish(exchange, nil)
+	return nil
+}
+
+func (b *MemoryBroker) route(exchange, key string) ([]*memQueue, error) {
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*memQueue{q}, nil
+		}
+		return nil, nil
+	}
+
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return nil, errors.Wrap(ErrNoExchange, exchange)
+	}
+	var queues []*memQueue
+	seen := make(map[*memQueue]bool)
+	for _, binding := range e.bindings {
+		if seen[binding.queue] || !e.matches(binding.key, key) {
+			continue
+		}
+		seen[binding.queue] = true
+		queues = append(queues, binding.queue)
+	}
+	return queues, nil
+}
+
+func (e *memExchange) matches(pattern, key string) bool {
+	switch e.kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatch(strings.Split(pattern, "."), strings.Split(key, "."))
+	default:
+		return pattern == key
+	}
+}
+
+// topicMatch matches dot separated words, where * stands for exactly one
+// word and # for any number of them.
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+	}
+}
+
+func delivery(exchange, key string, msg amqp.Publishing) amqp.Delivery {
+	return amqp.Delivery{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Exchange:        exchange,
+		RoutingKey:      key,
+		Body:            msg.Body,
+	}
+}
+
+// Subscribe delivers one message at a time, so that a handler is never
+// given another before it returns. It returns straight away with an error
+// when the subscription can't be declared. Once ctx is done, messages the
+// handler hasn't settled go back to the queue to be redelivered, as they
+// would when a RabbitMQ channel closes.
+func (b *MemoryBroker) Subscribe(ctx context.Context, sub Subscription, handler func(d amqp.Delivery)) error {
+	q, err := b.declare(sub)
+	if err != nil {
+		return err
+	}
+	consumer := q.consume()
+
+	if sub.Started != nil {
+		sub.Started()
+	}
+	if sub.Stopped != nil {
+		defer sub.Stopped()
+	}
+	defer q.requeue(consumer)
+
+	for {
+		d, ok := q.next(ctx, consumer, sub.AutoAck)
+		if !ok {
+			return nil
+		}
+		handler(d)
+	}
+}
+
+func (b *MemoryBroker) declare(sub Subscription) (*memQueue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sub.DeadLetterExchange != "" {
+		if err := b.declareExchange(sub.DeadLetterExchange, amqp.ExchangeFanout); err != nil {
+			return nil, err
+		}
+		dead := DeadLetterQueue(sub.Queue)
+		b.declareQueue(dead, "")
+		if err := b.bind(dead, "", sub.DeadLetterExchange); err != nil {
+			return nil, err
+		}
+	}
+	if sub.Exchange != "" && sub.Kind != "" {
+		if err := b.declareExchange(sub.Exchange, sub.Kind); err != nil {
+			return nil, err
+		}
+	}
+	q := b.declareQueue(sub.Queue, sub.DeadLetterExchange)
+	if sub.Exchange != "" {
+		for _, key := range sub.bindingKeys() {
+			if err := b.bind(sub.Queue, key, sub.Exchange); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return q, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	return nil
+}
+
+// Messages returns the messages waiting in queue, and how many have been
+// delivered but not yet settled.
+func (b *MemoryBroker) Messages(queue string) ([]amqp.Delivery, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, 0
+	}
+	ready := make([]amqp.Delivery, len(q.ready))
+	copy(ready, q.ready)
+	return ready, len(q.unacked)
+}
+
+// WaitFor waits until queue has n messages waiting, and reports whether it
+// got there before ctx was done.
+func (b *MemoryBroker) WaitFor(ctx context.Context, queue string, n int) bool {
+	for {
+		if ready, _ := b.Messages(queue); len(ready) >= n {
+			return true
+		}
+		if !sleep(ctx, 5*time.Millisecond) {
+			return false
+		}
+	}
+}
+
+// push must be called with the broker locked.
+func (q *memQueue) push(d amqp.Delivery) {
+	q.ready = append(q.ready, d)
+	q.signal()
+}
+
+func (q *memQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// consume returns a new consumer of the queue.
+func (q *memQueue) consume() uint64 {
+	q.broker.mu.Lock()
+	defer q.broker.mu.Unlock()
+	q.consumers++
+	return q.consumers
+}
+
+// requeue puts the messages consumer hasn't settled back at the front of the
+// queue, in the order they were delivered.
+func (q *memQueue) requeue(consumer uint64) {
+	q.broker.mu.Lock()
+	defer q.broker.mu.Unlock()
+
+	var tags []uint64
+	for tag, u := range q.unacked {
+		if u.consumer == consumer {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	requeued := make([]amqp.Delivery, 0, len(tags)+len(q.ready))
+	for _, tag := range tags {
+		d := q.unacked[tag].Delivery
+		delete(q.unacked, tag)
+		d.Redelivered = true
+		d.Acknowledger = nil
+		requeued = append(requeued, d)
+	}
+	q.ready = append(requeued, q.ready...)
+	q.signal()
+}
+
+func (q *memQueue) next(ctx context.Context, consumer uint64, autoAck bool) (amqp.Delivery, bool) {
+	for {
+		q.broker.mu.Lock()
+		if len(q.ready) > 0 {
+			d := q.ready[0]
+			q.ready = q.ready[1:]
+			q.tag++
+			d.DeliveryTag = q.tag
+			if !autoAck {
+				d.Acknowledger = q
+				q.unacked[d.DeliveryTag] = memUnacked{Delivery: d, consumer: consumer}
+			}
+			if len(q.ready) > 0 {
+				// Let any other consumer of the queue have the next one.
+				q.signal()
+			}
+			q.broker.mu.Unlock()
+			return d, true
+		}
+		q.broker.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return amqp.Delivery{}, false
+		case <-q.notify:
+		}
+	}
+}
+
+func (q *memQueue) Ack(tag uint64, multiple bool) error {
+	return q.settle(tag, multiple, func(amqp.Delivery) {})
+}
+
+func (q *memQueue) Nack(tag uint64, multiple bool, requeue bool) error {
+	return q.settle(tag, multiple, func(d amqp.Delivery) {
+		if requeue {
+			d.Redelivered = true
+			d.Acknowledger = nil
+			q.ready = append([]amqp.Delivery{d}, q.ready...)
+			q.signal()
+			return
+		}
+		q.deadLetter(d)
+	})
+}
+
+func (q *memQueue) Reject(tag uint64, requeue bool) error {
+	return q.Nack(tag, false, requeue)
+}
+
+func (q *memQueue) settle(tag uint64, multiple bool, fn func(amqp.Delivery)) error {
+	q.broker.mu.Lock()
+	defer q.broker.mu.Unlock()
+
+	if _, ok := q.unacked[tag]; !ok {
+		return errors.Errorf("unknown delivery tag %d", tag)
+	}
+	tags := []uint64{tag}
+	if multiple {
+		tags = tags[:0]
+		for t := range q.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+	}
+	for _, t := range tags {
+		d := q.unacked[t].Delivery
+		delete(q.unacked, t)
+		fn(d)
+	}
+	return nil
+}
+
+// deadLetter must be called with the broker locked. Messages are sent on
+// with their original routing key and an x-death header, as RabbitMQ does.
+func (q *memQueue) deadLetter(d amqp.Delivery) {
+	if q.deadLetterExchange == "" {
+		return
+	}
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers["x-death"] = []interface{}{amqp.Table{
+		"queue":        q.name,
+		"reason":       "rejected",
+		"exchange":     d.Exchange,
+		"routing-keys": []interface{}{d.RoutingKey},
+	}}
+	d.Headers = headers
+	d.Acknowledger = nil
+	d.Redelivered = false
+
+	queues, _ := q.broker.route(q.deadLetterExchange, d.RoutingKey)
+	for _, dq := range queues {
+		dead := d
+		dead.Exchange = q.deadLetterExchange
+		dq.push(dead)
+	}
+}
@@ -0,0 +1,260 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sksmith/smfg-catalog/queue"
+	"github.com/streadway/amqp"
+)
+
+func message(body string) amqp.Publishing {
+	return amqp.Publishing{MessageId: body, Body: []byte(body)}
+}
+
+func bodies(ds []amqp.Delivery) []string {
+	var s []string
+	for _, d := range ds {
+		s = append(s, string(d.Body))
+	}
+	return s
+}
+
+// recordingBroker keeps the exchange of every message published through
+// it, routed or not.
+type recordingBroker struct {
+	queue.Broker
+	mu        sync.Mutex
+	exchanges []string
+}
+
+func (r *recordingBroker) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	r.mu.Lock()
+	r.exchanges = append(r.exchanges, exchange)
+	r.mu.Unlock()
+	return r.Broker.Publish(ctx, exchange, key, msg)
+}
+
+func (r *recordingBroker) published(exchange string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, e := range r.exchanges {
+		if e == exchange {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMemoryBrokerRouting(t *testing.T) {
+	ctx := context.Background()
+	b := queue.NewMemoryBroker()
+	rb := &recordingBroker{Broker: b}
+	if err := rb.Publish(ctx, "", "missing", message("before")); !errors.Is(err, queue.ErrReturned) {
+		t.Errorf("unroutable err got=%v want=%v", err, queue.ErrReturned)
+	}
+
+	if err := b.DeclareExchange("fanout", amqp.ExchangeFanout); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeclareExchange("topic", amqp.ExchangeTopic); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeclareExchange("direct", amqp.ExchangeDirect); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"a", "b", "c"} {
+		b.DeclareQueue(q, "")
+	}
+	binds := []struct{ queue, key, exchange string }{
+		{"a", "", "fanout"},
+		{"b", "ignored", "fanout"},
+		{"a", "product.*", "topic"},
+		{"b", "product.#", "topic"},
+		{"c", "#.deleted", "topic"},
+		{"c", "eu", "direct"},
+	}
+	for _, bind := range binds {
+		if err := b.Bind(bind.queue, bind.key, bind.exchange); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		exchange, key string
+		want          []string
+	}{
+		{"fanout", "anything", []string{"a", "b"}},
+		{"topic", "product.created", []string{"a", "b"}},
+		{"topic", "product.eu.deleted", []string{"b", "c"}},
+		{"topic", "product", []string{"b"}},
+		{"topic", "deleted", []string{"c"}},
+		{"direct", "eu", []string{"c"}},
+		{"", "a", []string{"a"}},
+	}
+	for _, test := range tests {
+		name := test.exchange + "/" + test.key
+		body := name
+		if err := rb.Publish(ctx, test.exchange, test.key, message(body)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, q := range []string{"a", "b", "c"} {
+			ready, _ := b.Messages(q)
+			got := false
+			for _, d := range ready {
+				if string(d.Body) == body {
+					got = true
+				}
+			}
+			want := false
+			for _, w := range test.want {
+				if w == q {
+					want = true
+				}
+			}
+			if got != want {
+				t.Errorf("%s: queue %s got=%v want=%v", name, q, got, want)
+			}
+		}
+	}
+
+	if err := rb.Publish(ctx, "direct", "us", message("lost")); !errors.Is(err, queue.ErrReturned) {
+		t.Errorf("unroutable err got=%v want=%v", err, queue.ErrReturned)
+	}
+	if err := rb.Publish(ctx, "missing", "", message("lost")); !errors.Is(err, queue.ErrNoExchange) {
+		t.Errorf("missing exchange err got=%v want=%v", err, queue.ErrNoExchange)
+	}
+	if got := rb.published("direct"); got != 2 {
+		t.Errorf("published to direct got=%d want=2", got)
+	}
+}
+
+func TestMemoryBrokerSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := queue.NewMemoryBroker()
+
+	sub := queue.Subscription{
+		Queue:              "work",
+		Exchange:           "jobs",
+		Kind:               amqp.ExchangeTopic,
+		Keys:               []string{"job.*"},
+		DeadLetterExchange: "jobs.dead",
+	}
+	handled := make(chan string, 10)
+	started := make(chan struct{})
+	sub.Started = func() { close(started) }
+
+	redelivered := false
+	go b.Subscribe(ctx, sub, func(d amqp.Delivery) {
+		switch string(d.Body) {
+		case "ok":
+			d.Ack(false)
+		case "retry":
+			if !d.Redelivered {
+				d.Nack(false, true)
+				return
+			}
+			redelivered = true
+			d.Ack(false)
+		case "poison":
+			d.Nack(false, false)
+		}
+		handled <- string(d.Body)
+	})
+	<-started
+
+	for _, body := range []string{"retry", "poison", "ok"} {
+		if err := b.Publish(ctx, "jobs", "job.run", message(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for len(got) < 3 {
+		select {
+		case body := <-handled:
+			got[body] = true
+		case <-ctx.Done():
+			t.Fatalf("handled got=%v", got)
+		}
+	}
+	if !redelivered {
+		t.Error("retry wasn't redelivered")
+	}
+
+	if !b.WaitFor(ctx, queue.DeadLetterQueue("work"), 1) {
+		t.Fatal("nothing dead-lettered")
+	}
+	dead, _ := b.Messages(queue.DeadLetterQueue("work"))
+	if got := bodies(dead); len(got) != 1 || got[0] != "poison" {
+		t.Errorf("dead-lettered got=%v want=[poison]", got)
+	}
+	if dead[0].RoutingKey != "job.run" || dead[0].Headers["x-death"] == nil {
+		t.Errorf("dead-lettered message got=%+v", dead[0])
+	}
+	if ready, unacked := b.Messages("work"); len(ready) != 0 || unacked != 0 {
+		t.Errorf("work queue got ready=%d unacked=%d want none", len(ready), unacked)
+	}
+}
+
+// Messages a subscription hadn't settled when it ended are delivered again
+// to the next one, in the order they were first delivered.
+func TestMemoryBrokerRequeuesUnacked(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b := queue.NewMemoryBroker()
+	b.DeclareQueue("work", "")
+	for _, body := range []string{"1", "2", "3"} {
+		if err := b.Publish(ctx, "", "work", message(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, stop := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	var unacked []amqp.Delivery
+	sub := queue.Subscription{Queue: "work", Stopped: func() { close(stopped) }}
+	go b.Subscribe(first, sub, func(d amqp.Delivery) {
+		if string(d.Body) == "1" {
+			d.Ack(false)
+		} else {
+			unacked = append(unacked, d)
+		}
+		if len(unacked) == 2 {
+			stop()
+		}
+	})
+	<-stopped
+
+	ready, pending := b.Messages("work")
+	if got := bodies(ready); len(got) != 2 || got[0] != "2" || got[1] != "3" || pending != 0 {
+		t.Fatalf("work queue got ready=%v unacked=%d want [2 3] and none", got, pending)
+	}
+	if !ready[0].Redelivered {
+		t.Error("requeued message isn't marked redelivered")
+	}
+	if err := unacked[0].Ack(false); err == nil {
+		t.Error("ack after the subscription ended got=nil want error")
+	}
+
+	redelivered := make(chan string, 2)
+	sub.Stopped = nil
+	go b.Subscribe(ctx, sub, func(d amqp.Delivery) {
+		d.Ack(false)
+		redelivered <- string(d.Body)
+	})
+	for _, want := range []string{"2", "3"} {
+		select {
+		case got := <-redelivered:
+			if got != want {
+				t.Errorf("redelivered got=%s want=%s", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatal("nothing redelivered")
+		}
+	}
+}
@@ -7,17 +7,25 @@ import (
 )
 
 type MockQueue struct {
-	PublishProductFunc func(ctx context.Context, product catalog.Product) error
+	PublishChangeFunc   func(ctx context.Context, change catalog.Change) error
+	PublishSnapshotFunc func(ctx context.Context, product catalog.Product, target catalog.ReplayTarget) error
 }
 
 func NewMockQueue() *MockQueue {
 	return &MockQueue{
-		PublishProductFunc: func(ctx context.Context, product catalog.Product) error {
+		PublishChangeFunc: func(ctx context.Context, change catalog.Change) error {
+			return nil
+		},
+		PublishSnapshotFunc: func(ctx context.Context, product catalog.Product, target catalog.ReplayTarget) error {
 			return nil
 		},
 	}
 }
 
-func (m *MockQueue) PublishProduct(ctx context.Context, product catalog.Product) error {
-	return m.PublishProductFunc(ctx, product)
+func (m *MockQueue) PublishChange(ctx context.Context, change catalog.Change) error {
+	return m.PublishChangeFunc(ctx, change)
+}
+
+func (m *MockQueue) PublishSnapshot(ctx context.Context, product catalog.Product, target catalog.ReplayTarget) error {
+	return m.PublishSnapshotFunc(ctx, product, target)
 }
@@ -0,0 +1,202 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+	"github.com/sksmith/smfg-catalog/queue"
+)
+
+// changeLog is a change log and publish cursors for the outbox to work from.
+type changeLog struct {
+	mu      sync.Mutex
+	changes []catalog.Change
+	cursors map[string]int64
+}
+
+func (l *changeLog) repo() db.MockRepo {
+	repo := db.NewMockRepo()
+	repo.SaveChangeFunc = func(ctx context.Context, change catalog.Change, tx ...core.Transaction) (catalog.Change, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		change.Seq = int64(len(l.changes) + 1)
+		l.changes = append(l.changes, change)
+		return change, nil
+	}
+	repo.GetChangesFunc = func(ctx context.Context, since int64, limit int, tx ...core.Transaction) ([]catalog.Change, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		var changes []catalog.Change
+		for _, c := range l.changes {
+			if c.Seq > since && len(changes) < limit {
+				changes = append(changes, c)
+			}
+		}
+		return changes, nil
+	}
+	repo.ClaimPublishCursorFunc = func(ctx context.Context, destination, token string, lease time.Duration) (int64, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.cursors[destination], nil
+	}
+	repo.SavePublishCursorFunc = func(ctx context.Context, destination, token string, seq int64) error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.cursors == nil {
+			l.cursors = map[string]int64{}
+		}
+		l.cursors[destination] = seq
+		return nil
+	}
+	return repo
+}
+
+func (l *changeLog) publishedTo(destination string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cursors[destination]
+}
+
+func TestOutboxPublisher(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	outbox := &changeLog{}
+	var mu sync.Mutex
+	var published []int64
+	down := int64(3)
+	q := queue.NewMockQueue()
+	q.PublishChangeFunc = func(ctx context.Context, change catalog.Change) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if change.Seq == down {
+			return errors.New("broker unavailable")
+		}
+		published = append(published, change.Seq)
+		return nil
+	}
+	service := catalog.NewService(outbox.repo(), q, "product.fanout")
+
+	for i := 0; i < 5; i++ {
+		product := testProduct()
+		product.Sku = string(rune('A' + i))
+		if err := service.CreateProduct(ctx, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service.StartPublisher(ctx)
+
+	// The cursor stops short of the change that couldn't be published, so
+	// that it isn't lost.
+	eventually(t, ctx, "publishing up to the failure", func() bool { return outbox.publishedTo("") == 2 })
+	time.Sleep(10 * time.Millisecond)
+	if got := outbox.publishedTo(""); got != 2 {
+		t.Fatalf("cursor got=%d want=2", got)
+	}
+
+	// Once the broker is back, a new change wakes the publisher, which picks
+	// up where it stopped.
+	mu.Lock()
+	down = 0
+	mu.Unlock()
+	if err := service.DeleteProduct(ctx, "A"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, ctx, "publishing the rest", func() bool { return outbox.publishedTo("") == 6 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []int64{1, 2, 3, 4, 5, 6}
+	if len(published) != len(want) {
+		t.Fatalf("published got=%v want=%v", published, want)
+	}
+	for i := range want {
+		if published[i] != want[i] {
+			t.Fatalf("published got=%v want=%v", published, want)
+		}
+	}
+}
+
+// recordingQueue keeps the sequence of each change it publishes, and fails
+// while it's down.
+type recordingQueue struct {
+	mu        sync.Mutex
+	down      bool
+	published []int64
+}
+
+func (r *recordingQueue) queue() catalog.Queue {
+	q := queue.NewMockQueue()
+	q.PublishChangeFunc = func(ctx context.Context, change catalog.Change) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.down {
+			return errors.New("broker unavailable")
+		}
+		r.published = append(r.published, change.Seq)
+		return nil
+	}
+	return q
+}
+
+func (r *recordingQueue) setDown(down bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.down = down
+}
+
+func (r *recordingQueue) sequences() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int64{}, r.published...)
+}
+
+func TestOutboxDestinations(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	outbox := &changeLog{}
+	rabbit, kafka := &recordingQueue{}, &recordingQueue{down: true}
+	q := queue.NewFanout(
+		catalog.Destination{Name: "rabbitmq", Queue: rabbit.queue()},
+		catalog.Destination{Name: "kafka", Queue: kafka.queue()},
+	)
+	service := catalog.NewService(outbox.repo(), q, "product.fanout")
+	service.StartPublisher(ctx)
+
+	for i := 0; i < 3; i++ {
+		product := testProduct()
+		product.Sku = string(rune('A' + i))
+		if err := service.CreateProduct(ctx, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The healthy destination gets each change once, however often the
+	// other is retried.
+	eventually(t, ctx, "publishing to rabbitmq", func() bool { return outbox.publishedTo("rabbitmq") == 3 })
+	if got := outbox.publishedTo("kafka"); got != 0 {
+		t.Errorf("kafka cursor got=%d want=0", got)
+	}
+
+	kafka.setDown(false)
+	if err := service.DeleteProduct(ctx, "A"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, ctx, "publishing to kafka", func() bool { return outbox.publishedTo("kafka") == 4 })
+	eventually(t, ctx, "publishing the delete to rabbitmq", func() bool { return outbox.publishedTo("rabbitmq") == 4 })
+
+	want := []int64{1, 2, 3, 4}
+	for name, r := range map[string]*recordingQueue{"rabbitmq": rabbit, "kafka": kafka} {
+		if got := r.sequences(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s published got=%v want=%v", name, got, want)
+		}
+	}
+}
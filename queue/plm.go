@@ -0,0 +1,193 @@
+package queue
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/streadway/amqp"
+)
+
+const (
+	DefaultPLMMaxAttempts = 5
+	DefaultPLMRetryDelay  = time.Second
+
+	// plmMaxTracked bounds the attempt counts kept for messages being retried.
+	// Messages redelivered to another instance are never settled here, so
+	// the counts least recently added to are forgotten first.
+	plmMaxTracked = 10000
+)
+
+// ProductUpserter saves the products received from PLM, catalog.Service
+// satisfies it.
+type ProductUpserter interface {
+	UpsertProduct(ctx context.Context, product catalog.Product) (bool, error)
+}
+
+// PLMConfig describes where product master data arrives from. When Exchange
+// is set the queue is bound to it with RoutingKey, otherwise PLM is expected
+// to publish to the queue directly. Consumer names the durable consumer on
+// brokers that have them, Queue when it's empty.
+type PLMConfig struct {
+	Queue              string
+	Consumer           string
+	Exchange           string
+	RoutingKey         string
+	DeadLetterExchange string
+	MaxAttempts        int
+	// RetryDelay is how long to wait before requeueing a failed message.
+	RetryDelay time.Duration
+}
+
+// PLMConsumer upserts the products published by the product lifecycle
+// management system. Upserts are idempotent, so redelivered messages are
+// harmless. Messages that can't be read, describe an invalid product or one
+// whose barcodes are taken are dead-lettered straight away, while those
+// failing for other reasons are requeued until they've been tried
+// MaxAttempts times.
+type PLMConsumer struct {
+	broker   Broker
+	config   PLMConfig
+	products ProductUpserter
+
+	mux      sync.Mutex
+	attempts *lru.Cache
+}
+
+func NewPLMConsumer(broker Broker, config PLMConfig, products ProductUpserter) *PLMConsumer {
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = DefaultPLMMaxAttempts
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = DefaultPLMRetryDelay
+	}
+	// New only fails for a size below one.
+	attempts, _ := lru.New(plmMaxTracked)
+	return &PLMConsumer{
+		broker:   broker,
+		config:   config,
+		products: products,
+		attempts: attempts,
+	}
+}
+
+// Start consumes product messages in the background until ctx is done.
+func (p *PLMConsumer) Start(ctx context.Context) {
+	log.Info().
+		Str("queue", p.config.Queue).
+		Str("exchange", p.config.Exchange).
+		Str("dead-letter-exchange", p.config.DeadLetterExchange).
+		Int("max-attempts", p.config.MaxAttempts).
+		Msg("starting plm consumer")
+
+	// The PLM exchange belongs to PLM, so it isn't declared here.
+	sub := Subscription{
+		Queue:              p.config.Queue,
+		Consumer:           p.config.Consumer,
+		Exchange:           p.config.Exchange,
+		Durable:            true,
+		DeadLetterExchange: p.config.DeadLetterExchange,
+	}
+	if p.config.Exchange != "" {
+		sub.Keys = []string{p.config.RoutingKey}
+	}
+	go func() {
+		err := p.broker.Subscribe(ctx, sub, func(d amqp.Delivery) { p.handle(ctx, d) })
+		if err != nil {
+			log.Error().Err(err).Str("queue", p.config.Queue).Msg("unable to consume plm products")
+		}
+	}()
+}
+
+func (p *PLMConsumer) handle(ctx context.Context, d amqp.Delivery) {
+	product := catalog.Product{}
+	if err := json.Unmarshal(d.Body, &product); err != nil {
+		log.Warn().Err(err).Str("messageId", d.MessageId).Msg("dead-lettering unreadable plm message")
+		p.settle(d, false)
+		return
+	}
+
+	changed, err := p.products.UpsertProduct(ctx, product)
+	if err == nil {
+		log.Debug().Str("sku", product.Sku).Bool("changed", changed).Msg("upserted plm product")
+		p.settle(d, true)
+		return
+	}
+
+	// Retrying won't help a product that is invalid, or whose barcodes
+	// belong to another product, until someone fixes it in PLM.
+	if errors.Is(err, catalog.ErrInvalidProduct) || errors.Is(err, catalog.ErrInvalidBarcode) ||
+		errors.Is(err, core.ErrConflict) {
+		log.Warn().Err(err).Str("sku", product.Sku).Msg("dead-lettering invalid plm product")
+		p.settle(d, false)
+		return
+	}
+
+	attempt := p.attempt(d)
+	if attempt >= p.config.MaxAttempts {
+		log.Error().Err(err).Str("sku", product.Sku).Int("attempts", attempt).Msg("dead-lettering plm product")
+		p.settle(d, false)
+		return
+	}
+
+	log.Warn().Err(err).Str("sku", product.Sku).Int("attempt", attempt).Msg("failed to upsert plm product, requeueing")
+	sleep(ctx, p.config.RetryDelay)
+	if err = d.Nack(false, true); err != nil {
+		log.Warn().Err(err).Str("sku", product.Sku).Msg("failed to requeue plm message")
+	}
+}
+
+// settle acks a handled message, or rejects it to the dead-letter exchange,
+// and forgets its attempts.
+func (p *PLMConsumer) settle(d amqp.Delivery, ok bool) {
+	p.mux.Lock()
+	p.attempts.Remove(messageKey(d))
+	p.mux.Unlock()
+
+	var err error
+	if ok {
+		err = d.Ack(false)
+	} else {
+		err = d.Nack(false, false)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("messageId", d.MessageId).Msg("failed to settle plm message")
+	}
+}
+
+// attempt counts a failed delivery and returns how many times the message
+// has been tried. Quorum queues count deliveries themselves, which covers
+// attempts made by other instances.
+func (p *PLMConsumer) attempt(d amqp.Delivery) int {
+	key := messageKey(d)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	n := 1
+	if v, ok := p.attempts.Get(key); ok {
+		n += v.(int)
+	}
+	p.attempts.Add(key, n)
+
+	if count, ok := d.Headers["x-delivery-count"].(int64); ok && int(count)+1 > n {
+		n = int(count) + 1
+	}
+	return n
+}
+
+func messageKey(d amqp.Delivery) string {
+	if d.MessageId != "" {
+		return d.MessageId
+	}
+	sum := sha256.Sum256(d.Body)
+	return hex.EncodeToString(sum[:])
+}
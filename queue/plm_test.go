@@ -0,0 +1,190 @@
+package queue_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sksmith/smfg-catalog/core"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/db"
+	"github.com/sksmith/smfg-catalog/queue"
+	"github.com/streadway/amqp"
+)
+
+type upserter func(ctx context.Context, product catalog.Product) (bool, error)
+
+func (f upserter) UpsertProduct(ctx context.Context, product catalog.Product) (bool, error) {
+	return f(ctx, product)
+}
+
+func TestPLMConsumer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	b := queue.NewMemoryBroker()
+	if err := b.DeclareExchange("plm", amqp.ExchangeTopic); err != nil {
+		t.Fatal(err)
+	}
+
+	var mux sync.Mutex
+	saved := map[string]int{}
+	calls := map[string]int{}
+	products := upserter(func(ctx context.Context, product catalog.Product) (bool, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		calls[product.Sku]++
+		switch {
+		case product.Name == "":
+			return false, catalog.ErrInvalidProduct
+		case product.Sku == "FLAKY" && calls[product.Sku] < 2:
+			return false, errors.New("database unavailable")
+		case product.Sku == "DOWN":
+			return false, errors.New("database unavailable")
+		}
+		saved[product.Sku]++
+		return true, nil
+	})
+
+	config := queue.PLMConfig{
+		Queue:              "catalog.plm",
+		Exchange:           "plm",
+		RoutingKey:         "product.#",
+		DeadLetterExchange: "catalog.plm.dead",
+		MaxAttempts:        3,
+		RetryDelay:         time.Millisecond,
+	}
+	queue.NewPLMConsumer(b, config, products).Start(ctx)
+
+	// The queue is bound once the consumer has started.
+	for b.Publish(ctx, "plm", "product.upsert", message(`{"sku":"OK","name":"Widget"}`)) != nil {
+		if ctx.Err() != nil {
+			t.Fatal("plm queue never bound")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, body := range []string{
+		`{"sku":"FLAKY","name":"Widget"}`,
+		`{"sku":"INVALID"}`,
+		`not json`,
+		`{"sku":"DOWN","name":"Widget"}`,
+	} {
+		if err := b.Publish(ctx, "plm", "product.upsert", message(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dead := queue.DeadLetterQueue(config.Queue)
+	if !b.WaitFor(ctx, dead, 3) {
+		t.Fatal("messages weren't dead-lettered")
+	}
+	got, _ := b.Messages(dead)
+	want := map[string]bool{`{"sku":"INVALID"}`: true, `not json`: true, `{"sku":"DOWN","name":"Widget"}`: true}
+	for _, body := range bodies(got) {
+		if !want[body] {
+			t.Errorf("unexpected dead-lettered message %s", body)
+		}
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if saved["OK"] != 1 || saved["FLAKY"] != 1 {
+		t.Errorf("saved got=%v", saved)
+	}
+	if calls["DOWN"] != config.MaxAttempts {
+		t.Errorf("attempts got=%d want=%d", calls["DOWN"], config.MaxAttempts)
+	}
+	if calls["INVALID"] != 1 {
+		t.Errorf("invalid attempts got=%d want=1", calls["INVALID"])
+	}
+}
+
+func TestPLMConsumerUpsert(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	b := queue.NewMemoryBroker()
+	if err := b.DeclareExchange("plm", amqp.ExchangeTopic); err != nil {
+		t.Fatal(err)
+	}
+
+	var mux sync.Mutex
+	stored := map[string]catalog.Product{}
+	saves := 0
+	mockRepo := db.NewMockRepo()
+	mockRepo.GetProductFunc = func(ctx context.Context, sku string, tx ...core.Transaction) (catalog.Product, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		if p, ok := stored[sku]; ok {
+			return p, nil
+		}
+		return catalog.Product{}, core.ErrNotFound
+	}
+	mockRepo.SaveProductFunc = func(ctx context.Context, product catalog.Product, tx ...core.Transaction) error {
+		mux.Lock()
+		defer mux.Unlock()
+		stored[product.Sku] = product
+		saves++
+		return nil
+	}
+	// The conflicting product's barcode belongs to another product.
+	mockRepo.GetProductByBarcodeFunc = func(ctx context.Context, gtin string, tx ...core.Transaction) (catalog.Product, error) {
+		if gtin == "00000096385074" {
+			return catalog.Product{Sku: "OTHER"}, nil
+		}
+		return catalog.Product{}, core.ErrNotFound
+	}
+	service := catalog.NewService(mockRepo, queue.NewMockQueue(), "product.fanout")
+
+	// A retry would outlast the test, only dead-lettering can settle the
+	// conflict in time.
+	config := queue.PLMConfig{
+		Queue:              "catalog.plm",
+		Exchange:           "plm",
+		RoutingKey:         "product.#",
+		DeadLetterExchange: "catalog.plm.dead",
+		MaxAttempts:        3,
+		RetryDelay:         time.Hour,
+	}
+	queue.NewPLMConsumer(b, config, service).Start(ctx)
+
+	product, err := json.Marshal(testProduct())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflict := `{"sku":"SKU-2","name":"Gadget","barcodes":[{"gtin":"96385074","packagingLevel":"each","quantity":1,"primary":true}]}`
+
+	for b.Publish(ctx, "plm", "product.upsert", message(string(product))) != nil {
+		if ctx.Err() != nil {
+			t.Fatal("plm queue never bound")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// PLM sends the product again, as it does after a redelivery or a resync.
+	for _, body := range []string{string(product), conflict} {
+		if err = b.Publish(ctx, "plm", "product.upsert", message(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dead := queue.DeadLetterQueue(config.Queue)
+	if !b.WaitFor(ctx, dead, 1) {
+		t.Fatal("conflicting product wasn't dead-lettered")
+	}
+	got, _ := b.Messages(dead)
+	if bodies := bodies(got); len(bodies) != 1 || bodies[0] != conflict {
+		t.Errorf("dead-lettered got=%v want the conflicting product", bodies)
+	}
+	if ready, unacked := b.Messages(config.Queue); len(ready) != 0 || unacked != 0 {
+		t.Errorf("plm queue got ready=%d unacked=%d want none", len(ready), unacked)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if saves != 1 {
+		t.Errorf("saves got=%d want=1", saves)
+	}
+}
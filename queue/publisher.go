@@ -0,0 +1,281 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sksmith/bunnyq"
+	"github.com/streadway/amqp"
+)
+
+const (
+	DefaultPublishAttempts = 3
+	DefaultPublishBackoff  = 200 * time.Millisecond
+	DefaultConfirmTimeout  = 5 * time.Second
+)
+
+var (
+	// ErrNacked means the broker refused a message, ErrReturned that no queue
+	// was bound to take it and ErrUnconfirmed that the broker didn't say
+	// either way in time.
+	ErrNacked      = errors.New("queue: message nacked by broker")
+	ErrReturned    = errors.New("queue: message unroutable")
+	ErrUnconfirmed = errors.New("queue: message not confirmed")
+)
+
+var (
+	publishCount *prometheus.CounterVec
+	publishRetry *prometheus.CounterVec
+)
+
+func ConfigureMetrics() {
+	publishCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_publish_count",
+			Help: "Number of publish attempts by outcome",
+		},
+		[]string{"exchange", "result"},
+	)
+	publishRetry = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_publish_retry_count",
+			Help: "Number of publishes retried after a failed attempt",
+		},
+		[]string{"exchange"},
+	)
+	prometheus.MustRegister(publishCount)
+	prometheus.MustRegister(publishRetry)
+}
+
+// PublisherConfig sets how hard a publish is tried. Attempts are spaced by
+// Backoff, doubling each time.
+type PublisherConfig struct {
+	Attempts       int
+	Backoff        time.Duration
+	ConfirmTimeout time.Duration
+}
+
+// Channel is the part of an amqp.Channel a Publisher uses. Closing it also
+// closes the connection it was opened on.
+type Channel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Close() error
+}
+
+// Dialer opens a Channel in confirm mode.
+type Dialer func() (Channel, error)
+
+// Publisher sends messages over a connection of its own, since
+// bunnyq.Publish can't set message headers or properties. It connects on
+// first use, and again on the next publish after the connection drops.
+//
+// The channel is in confirm mode and messages are mandatory, so a publish
+// only succeeds once the broker has routed the message and taken
+// responsibility for it. A failed publish is retried before it's reported;
+// whatever called it is then left to try again later.
+type Publisher struct {
+	dial   Dialer
+	config PublisherConfig
+
+	mux      sync.Mutex
+	ch       Channel
+	closed   chan *amqp.Error
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+func NewPublisher(addr bunnyq.Address, config PublisherConfig) *Publisher {
+	return NewChannelPublisher(func() (Channel, error) { return dialConfirm(addr) }, config)
+}
+
+// NewChannelPublisher publishes over the channels dial opens.
+func NewChannelPublisher(dial Dialer, config PublisherConfig) *Publisher {
+	if config.Attempts < 1 {
+		config.Attempts = DefaultPublishAttempts
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = DefaultPublishBackoff
+	}
+	if config.ConfirmTimeout <= 0 {
+		config.ConfirmTimeout = DefaultConfirmTimeout
+	}
+	return &Publisher{dial: dial, config: config}
+}
+
+// Publish sends msg to exchange with routing key key, and waits for the
+// broker to confirm it.
+func (p *Publisher) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	backoff := p.config.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = p.publish(ctx, exchange, key, msg)
+		countPublish(exchange, err)
+		if err == nil || attempt >= p.config.Attempts || ctx.Err() != nil {
+			return err
+		}
+
+		if publishRetry != nil {
+			publishRetry.WithLabelValues(exchange).Inc()
+		}
+		if !sleep(ctx, backoff) {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (p *Publisher) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := p.connect(); err != nil {
+		return err
+	}
+	if err := p.ch.Publish(exchange, key, true, false, msg); err != nil {
+		p.reset()
+		return errors.WithMessage(err, "failed to publish to channel")
+	}
+
+	// Only one message is ever outstanding. An unroutable message is
+	// returned before it's acked, so by the time the ack arrives any return
+	// is waiting.
+	var returned *amqp.Return
+	timeout := time.NewTimer(p.config.ConfirmTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case r, ok := <-p.returns:
+			if !ok {
+				p.reset()
+				return errors.Wrap(ErrUnconfirmed, "channel closed")
+			}
+			returned = &r
+		case c, ok := <-p.confirms:
+			if !ok {
+				p.reset()
+				return errors.Wrap(ErrUnconfirmed, "channel closed")
+			}
+			if !c.Ack {
+				return errors.WithStack(ErrNacked)
+			}
+			select {
+			case r, ok := <-p.returns:
+				if ok {
+					returned = &r
+				}
+			default:
+			}
+			if returned != nil {
+				return errors.Wrapf(ErrReturned, "%d %s", returned.ReplyCode, returned.ReplyText)
+			}
+			return nil
+		case <-timeout.C:
+			// A late confirm would be taken for the next message's.
+			p.reset()
+			return errors.WithStack(ErrUnconfirmed)
+		case <-ctx.Done():
+			p.reset()
+			return errors.WithStack(ctx.Err())
+		}
+	}
+}
+
+func (p *Publisher) connect() error {
+	if p.ch != nil {
+		select {
+		case <-p.closed:
+			p.reset()
+		default:
+			return nil
+		}
+	}
+
+	ch, err := p.dial()
+	if err != nil {
+		return err
+	}
+
+	p.ch = ch
+	p.closed = ch.NotifyClose(make(chan *amqp.Error, 1))
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	return nil
+}
+
+func (p *Publisher) reset() {
+	if p.ch != nil {
+		_ = p.ch.Close()
+	}
+	p.ch = nil
+	p.closed = nil
+	p.confirms = nil
+	p.returns = nil
+}
+
+func (p *Publisher) Close() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.ch == nil {
+		return nil
+	}
+	err := p.ch.Close()
+	p.ch = nil
+	p.reset()
+	return errors.WithStack(err)
+}
+
+// confirmChannel closes its connection along with it.
+type confirmChannel struct {
+	*amqp.Channel
+	conn *amqp.Connection
+}
+
+func dialConfirm(addr bunnyq.Address) (Channel, error) {
+	conn, err := amqp.Dial(amqpURL(addr))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to connect to rabbitmq")
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithMessage(err, "failed to open channel")
+	}
+	if err = ch.Confirm(false); err != nil {
+		_ = conn.Close()
+		return nil, errors.WithMessage(err, "failed to put channel in confirm mode")
+	}
+	return &confirmChannel{Channel: ch, conn: conn}, nil
+}
+
+func (c *confirmChannel) Close() error {
+	return c.conn.Close()
+}
+
+func countPublish(exchange string, err error) {
+	if publishCount == nil {
+		return
+	}
+	result := "ok"
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNacked):
+		result = "nacked"
+	case errors.Is(err, ErrReturned):
+		result = "returned"
+	case errors.Is(err, ErrUnconfirmed):
+		result = "unconfirmed"
+	default:
+		result = "error"
+	}
+	publishCount.WithLabelValues(exchange, result).Inc()
+}
@@ -0,0 +1,172 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sksmith/smfg-catalog/queue"
+	"github.com/streadway/amqp"
+)
+
+// Outcomes of a publish on a scriptedChannel.
+const (
+	acked    = "ack"
+	nacked   = "nack"
+	returned = "return"
+	silent   = "silent"
+)
+
+// scriptedChannel answers each publish as its script says, the way a broker
+// answers a channel in confirm mode.
+type scriptedChannel struct {
+	script    *[]string
+	published *int
+	closed    *int
+
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+func (c *scriptedChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	*c.published++
+	outcome := (*c.script)[0]
+	*c.script = (*c.script)[1:]
+
+	tag := uint64(*c.published)
+	switch outcome {
+	case acked:
+		c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	case nacked:
+		c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: false}
+	case returned:
+		c.returns <- amqp.Return{ReplyCode: 312, ReplyText: "NO_ROUTE", Exchange: exchange, RoutingKey: key}
+		c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	}
+	return nil
+}
+
+func (c *scriptedChannel) NotifyClose(ch chan *amqp.Error) chan *amqp.Error { return ch }
+
+func (c *scriptedChannel) NotifyPublish(ch chan amqp.Confirmation) chan amqp.Confirmation {
+	c.confirms = ch
+	return ch
+}
+
+func (c *scriptedChannel) NotifyReturn(ch chan amqp.Return) chan amqp.Return {
+	c.returns = ch
+	return ch
+}
+
+func (c *scriptedChannel) Close() error {
+	*c.closed++
+	return nil
+}
+
+var configureMetrics sync.Once
+
+// publishCounts reads the publish metrics, by name and labels.
+func publishCounts(t *testing.T) map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]float64{}
+	for _, f := range families {
+		if !strings.HasPrefix(f.GetName(), "queue_publish_") {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			name := f.GetName()
+			for _, l := range m.GetLabel() {
+				name += " " + l.GetValue()
+			}
+			counts[name] = m.GetCounter().GetValue()
+		}
+	}
+	return counts
+}
+
+func TestPublisher(t *testing.T) {
+	configureMetrics.Do(queue.ConfigureMetrics)
+	before := publishCounts(t)
+
+	tests := []struct {
+		name    string
+		script  []string
+		err     error
+		publish int
+		dials   int
+	}{
+		{name: "acked", script: []string{acked}, publish: 1, dials: 1},
+		{name: "retried", script: []string{nacked, acked}, publish: 2, dials: 1},
+		{name: "nacked", script: []string{nacked, nacked, nacked}, err: queue.ErrNacked, publish: 3, dials: 1},
+		{name: "returned", script: []string{returned, returned, returned}, err: queue.ErrReturned, publish: 3, dials: 1},
+		// A confirm arriving late would be taken for the next message's, so
+		// the channel is dropped after a timeout.
+		{name: "unconfirmed", script: []string{silent, silent, acked}, publish: 3, dials: 3},
+	}
+
+	ctx := context.Background()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script := append([]string{}, test.script...)
+			published, closed, dials := 0, 0, 0
+			p := queue.NewChannelPublisher(func() (queue.Channel, error) {
+				dials++
+				return &scriptedChannel{script: &script, published: &published, closed: &closed}, nil
+			}, queue.PublisherConfig{Attempts: 3, Backoff: time.Millisecond, ConfirmTimeout: 10 * time.Millisecond})
+
+			err := p.Publish(ctx, test.name, "product.created", message("body"))
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Errorf("err got=%v want=%v", err, test.err)
+			}
+			if published != test.publish || dials != test.dials {
+				t.Errorf("published got=%d want=%d, dials got=%d want=%d", published, test.publish, dials, test.dials)
+			}
+			if err = p.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if closed != dials {
+				t.Errorf("closed got=%d want=%d", closed, dials)
+			}
+		})
+	}
+
+	t.Run("dial failure", func(t *testing.T) {
+		p := queue.NewChannelPublisher(func() (queue.Channel, error) {
+			return nil, errors.New("connection refused")
+		}, queue.PublisherConfig{Attempts: 2, Backoff: time.Millisecond})
+		if err := p.Publish(ctx, "down", "", message("body")); err == nil {
+			t.Error("publish succeeded without a channel")
+		}
+	})
+
+	// Each attempt is counted by its outcome, and each retry once.
+	want := map[string]float64{
+		"queue_publish_count acked ok":                1,
+		"queue_publish_count down error":              2,
+		"queue_publish_count nacked nacked":           3,
+		"queue_publish_count retried nacked":          1,
+		"queue_publish_count retried ok":              1,
+		"queue_publish_count returned returned":       3,
+		"queue_publish_count unconfirmed ok":          1,
+		"queue_publish_count unconfirmed unconfirmed": 2,
+		"queue_publish_retry_count acked":             0,
+		"queue_publish_retry_count down":              1,
+		"queue_publish_retry_count nacked":            2,
+		"queue_publish_retry_count retried":           1,
+		"queue_publish_retry_count returned":          2,
+		"queue_publish_retry_count unconfirmed":       2,
+	}
+	after := publishCounts(t)
+	for name, n := range want {
+		if got := after[name] - before[name]; got != n {
+			t.Errorf("%s got=%v want=%v", name, got, n)
+		}
+	}
+}
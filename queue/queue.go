@@ -2,29 +2,59 @@ package queue
 
 import (
 	"context"
-	"encoding/json"
 
 	"github.com/pkg/errors"
-	"github.com/sksmith/bunnyq"
 	"github.com/sksmith/smfg-catalog/core/catalog"
 )
 
 type productQueue struct {
-	queue           *bunnyq.BunnyQ
+	broker          Broker
 	productExchange string
+	source          string
+	serializer      Serializer
 }
 
-func New(bq *bunnyq.BunnyQ, productExchange string) *productQueue {
-	return &productQueue{queue: bq, productExchange: productExchange}
+// New publishes product events to productExchange, with products encoded by
+// serializer.
+func New(broker Broker, productExchange string, serializer Serializer) *productQueue {
+	return &productQueue{
+		broker:          broker,
+		productExchange: productExchange,
+		source:          DefaultEventSource,
+		serializer:      serializer,
+	}
 }
 
-func (p *productQueue) PublishProduct(ctx context.Context, product catalog.Product) error {
-	body, err := json.Marshal(product)
+func (p *productQueue) PublishChange(ctx context.Context, change catalog.Change) error {
+	event, err := ProductEvent(p.source, change, p.serializer)
+	if err != nil {
+		return errors.WithMessage(err, "failed to create product event")
+	}
+	msg, err := event.Publishing()
 	if err != nil {
 		return errors.WithMessage(err, "failed to serialize message for queue")
 	}
-	if err = p.queue.Publish(ctx, p.productExchange, body); err != nil {
-		return errors.WithMessage(err, "failed to send inventory update to queue")
+	if err = p.broker.Publish(ctx, p.productExchange, "", msg); err != nil {
+		return errors.WithMessage(err, "failed to send product event to queue")
+	}
+	return nil
+}
+
+func (p *productQueue) PublishSnapshot(ctx context.Context, product catalog.Product, target catalog.ReplayTarget) error {
+	event, err := SnapshotEvent(p.source, product, p.serializer)
+	if err != nil {
+		return errors.WithMessage(err, "failed to create snapshot event")
+	}
+	msg, err := event.Publishing()
+	if err != nil {
+		return errors.WithMessage(err, "failed to serialize message for queue")
+	}
+	exchange := target.Exchange
+	if exchange == "" {
+		exchange = p.productExchange
+	}
+	if err = p.broker.Publish(ctx, exchange, target.RoutingKey, msg); err != nil {
+		return errors.WithMessage(err, "failed to send snapshot event to queue")
 	}
 	return nil
 }
@@ -0,0 +1,453 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/pkg/errors"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/grpc/catalogpb"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+	EncodingAvro     = "avro"
+
+	ProtobufContentType = "application/protobuf"
+	AvroContentType     = "application/avro"
+)
+
+var ErrUnknownEncoding = errors.New("queue: unknown encoding")
+
+// Serializer encodes the product carried by product events. Every encoding
+// has to let a decoder built before a field was added read products written
+// after: JSON and protobuf skip fields they don't know, and avro messages
+// name the schema they were written with by its fingerprint, which has to
+// be registered with RegisterAvroSchema to be read.
+type Serializer interface {
+	Encoding() string
+	ContentType() string
+	Marshal(product catalog.Product) ([]byte, error)
+	Unmarshal(data []byte) (catalog.Product, error)
+}
+
+var serializers = map[string]Serializer{
+	EncodingJSON:     JSONSerializer{},
+	EncodingProtobuf: ProtobufSerializer{},
+	EncodingAvro:     newAvroSerializer(),
+}
+
+// NewSerializer returns the serializer for an encoding, JSON when it's
+// empty.
+func NewSerializer(encoding string) (Serializer, error) {
+	if encoding == "" {
+		encoding = EncodingJSON
+	}
+	s, ok := serializers[strings.ToLower(encoding)]
+	if !ok {
+		names := make([]string, 0, len(serializers))
+		for name := range serializers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%w %q, expected one of %s", ErrUnknownEncoding, encoding, strings.Join(names, ", "))
+	}
+	return s, nil
+}
+
+// serializerFor returns the serializer producing contentType.
+func serializerFor(contentType string) (Serializer, error) {
+	for _, s := range serializers {
+		if s.ContentType() == contentType {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no serializer for content type %q", ErrUnknownEncoding, contentType)
+}
+
+type JSONSerializer struct{}
+
+func (JSONSerializer) Encoding() string    { return EncodingJSON }
+func (JSONSerializer) ContentType() string { return DataContentType }
+
+func (JSONSerializer) Marshal(product catalog.Product) ([]byte, error) {
+	b, err := json.Marshal(product)
+	return b, errors.WithStack(err)
+}
+
+func (JSONSerializer) Unmarshal(data []byte) (catalog.Product, error) {
+	product := catalog.Product{}
+	err := json.Unmarshal(data, &product)
+	return product, errors.WithStack(err)
+}
+
+// ProtobufSerializer writes the Product message the grpc api serves.
+type ProtobufSerializer struct{}
+
+func (ProtobufSerializer) Encoding() string    { return EncodingProtobuf }
+func (ProtobufSerializer) ContentType() string { return ProtobufContentType }
+
+func (ProtobufSerializer) Marshal(product catalog.Product) ([]byte, error) {
+	b, err := proto.Marshal(catalogpb.FromProduct(product))
+	return b, errors.WithStack(err)
+}
+
+func (ProtobufSerializer) Unmarshal(data []byte) (catalog.Product, error) {
+	pb := &catalogpb.Product{}
+	if err := proto.Unmarshal(data, pb); err != nil {
+		return catalog.Product{}, errors.WithStack(err)
+	}
+	return catalogpb.ToProduct(pb), nil
+}
+
+// ProductAvroSchema is the avro schema of product event data. Fields added
+// to it need a default, so that products written before they were can
+// still be read.
+const ProductAvroSchema = `{
+  "type": "record",
+  "name": "Product",
+  "namespace": "com.smfg.catalog",
+  "fields": [
+    {"name": "sku", "type": "string"},
+    {"name": "name", "type": "string"},
+    {"name": "description", "type": "string", "default": ""},
+    {"name": "dimensions", "default": null, "type": ["null", {
+      "type": "record",
+      "name": "Dimensions",
+      "fields": [
+        {"name": "height", "type": "double"},
+        {"name": "width", "type": "double"},
+        {"name": "depth", "type": "double"},
+        {"name": "unit", "type": "string"}
+      ]
+    }]},
+    {"name": "weight", "default": null, "type": ["null", {
+      "type": "record",
+      "name": "Weight",
+      "fields": [
+        {"name": "net", "type": "double"},
+        {"name": "gross", "type": "double"},
+        {"name": "unit", "type": "string"}
+      ]
+    }]},
+    {"name": "barcodes", "type": {"type": "array", "items": {
+      "type": "record",
+      "name": "Barcode",
+      "fields": [
+        {"name": "gtin", "type": "string"},
+        {"name": "packagingLevel", "type": "string"},
+        {"name": "quantity", "type": "int"},
+        {"name": "primary", "type": "boolean"}
+      ]
+    }}}
+  ]
+}`
+
+const (
+	avroDimensions = "com.smfg.catalog.Dimensions"
+	avroWeight     = "com.smfg.catalog.Weight"
+)
+
+// ErrUnknownSchema is returned for avro data written with a schema that
+// hasn't been registered.
+var ErrUnknownSchema = errors.New("queue: unknown avro schema")
+
+// AvroSerializer writes products with ProductAvroSchema and reads them with
+// whichever registered schema they were written with.
+type AvroSerializer struct {
+	codec *goavro.Codec
+
+	mu      sync.RWMutex
+	writers map[uint64]*goavro.Codec
+}
+
+func newAvroSerializer() *AvroSerializer {
+	codec, err := goavro.NewCodec(ProductAvroSchema)
+	if err != nil {
+		panic(err)
+	}
+	return &AvroSerializer{codec: codec, writers: map[uint64]*goavro.Codec{codec.Rabin: codec}}
+}
+
+// RegisterAvroSchema lets the avro serializer read products written with
+// another version of ProductAvroSchema.
+func RegisterAvroSchema(schema string) error {
+	return serializers[EncodingAvro].(*AvroSerializer).RegisterSchema(schema)
+}
+
+// RegisterSchema lets s read products written with schema, which has to
+// resolve to ProductAvroSchema: every field they share has the same type,
+// and every field only ProductAvroSchema has has a default.
+func (s *AvroSerializer) RegisterSchema(schema string) error {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var reader, writer interface{}
+	if err = json.Unmarshal([]byte(ProductAvroSchema), &reader); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = json.Unmarshal([]byte(schema), &writer); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = resolveAvro(reader, writer, "", ""); err != nil {
+		return errors.Wrap(err, "avro schema does not resolve to the product schema")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writers[codec.Rabin] = codec
+	return nil
+}
+
+func (*AvroSerializer) Encoding() string    { return EncodingAvro }
+func (*AvroSerializer) ContentType() string { return AvroContentType }
+
+func (s *AvroSerializer) Marshal(product catalog.Product) ([]byte, error) {
+	native := map[string]interface{}{
+		"sku":         product.Sku,
+		"name":        product.Name,
+		"description": product.Description,
+		"dimensions":  nil,
+		"weight":      nil,
+	}
+	if d := product.Dimensions; d != nil {
+		native["dimensions"] = goavro.Union(avroDimensions, map[string]interface{}{
+			"height": d.Height, "width": d.Width, "depth": d.Depth, "unit": d.Unit,
+		})
+	}
+	if w := product.Weight; w != nil {
+		native["weight"] = goavro.Union(avroWeight, map[string]interface{}{
+			"net": w.Net, "gross": w.Gross, "unit": w.Unit,
+		})
+	}
+	barcodes := make([]interface{}, 0, len(product.Barcodes))
+	for _, b := range product.Barcodes {
+		barcodes = append(barcodes, map[string]interface{}{
+			"gtin":           b.Gtin,
+			"packagingLevel": string(b.PackagingLevel),
+			"quantity":       int32(b.Quantity),
+			"primary":        b.Primary,
+		})
+	}
+	native["barcodes"] = barcodes
+
+	b, err := s.codec.SingleFromNative(nil, native)
+	return b, errors.WithStack(err)
+}
+
+// Unmarshal reads a product written with a registered schema. Products are
+// single object encoded, so the data starts with the fingerprint of the
+// schema it was written with. The body is decoded with that schema and its
+// fields are then read by name, so fields ProductAvroSchema doesn't know
+// are skipped and those the writer didn't have take their defaults, which
+// are all zero values.
+func (s *AvroSerializer) Unmarshal(data []byte) (catalog.Product, error) {
+	fingerprint, body, err := goavro.FingerprintFromSOE(data)
+	if err != nil {
+		return catalog.Product{}, errors.WithStack(err)
+	}
+	s.mu.RLock()
+	writer, ok := s.writers[fingerprint]
+	s.mu.RUnlock()
+	if !ok {
+		return catalog.Product{}, errors.Wrapf(ErrUnknownSchema, "fingerprint %x", fingerprint)
+	}
+	native, rest, err := writer.NativeFromBinary(body)
+	if err != nil {
+		return catalog.Product{}, errors.WithStack(err)
+	}
+	if len(rest) > 0 {
+		return catalog.Product{}, errors.Errorf("avro product has %d bytes left over", len(rest))
+	}
+	record, ok := native.(map[string]interface{})
+	if !ok {
+		return catalog.Product{}, errors.New("avro product is not a record")
+	}
+
+	product := catalog.Product{
+		Sku:         avroString(record["sku"]),
+		Name:        avroString(record["name"]),
+		Description: avroString(record["description"]),
+	}
+	if d, ok := avroRecord(record["dimensions"], avroDimensions); ok {
+		product.Dimensions = &catalog.Dimensions{
+			Height: avroDouble(d["height"]),
+			Width:  avroDouble(d["width"]),
+			Depth:  avroDouble(d["depth"]),
+			Unit:   avroString(d["unit"]),
+		}
+	}
+	if w, ok := avroRecord(record["weight"], avroWeight); ok {
+		product.Weight = &catalog.Weight{
+			Net:   avroDouble(w["net"]),
+			Gross: avroDouble(w["gross"]),
+			Unit:  avroString(w["unit"]),
+		}
+	}
+	barcodes, _ := record["barcodes"].([]interface{})
+	product.Barcodes = make([]catalog.Barcode, 0, len(barcodes))
+	for _, item := range barcodes {
+		b, _ := item.(map[string]interface{})
+		quantity, _ := b["quantity"].(int32)
+		primary, _ := b["primary"].(bool)
+		product.Barcodes = append(product.Barcodes, catalog.Barcode{
+			Gtin:           avroString(b["gtin"]),
+			PackagingLevel: catalog.PackagingLevel(avroString(b["packagingLevel"])),
+			Quantity:       int(quantity),
+			Primary:        primary,
+		})
+	}
+	return product, nil
+}
+
+func avroString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func avroDouble(v interface{}) float64 {
+	f, _ := v.(float64)
+	return f
+}
+
+// avroRecord unwraps a union holding a record, goavro decodes them as a map
+// keyed by the record's full name.
+func avroRecord(v interface{}, name string) (map[string]interface{}, bool) {
+	union, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	record, ok := union[name].(map[string]interface{})
+	return record, ok
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// resolveAvro checks that data written with the writer schema can be read
+// as the reader schema. Unlike the avro spec it doesn't promote types, a
+// field has to keep its type to be read.
+func resolveAvro(reader, writer interface{}, readerNS, writerNS string) error {
+	reader, writer = avroType(reader), avroType(writer)
+
+	switch r := reader.(type) {
+	case string:
+		if w, ok := writer.(string); ok && avroPrimitives[r] && r == w {
+			return nil
+		}
+		return errors.Errorf("%s is written as %s", avroTypeName(reader), avroTypeName(writer))
+
+	case []interface{}:
+		// Whichever branch a value was written with has to be readable.
+		w, ok := writer.([]interface{})
+		if !ok {
+			w = []interface{}{writer}
+		}
+		for _, wb := range w {
+			resolved := false
+			for _, rb := range r {
+				if resolveAvro(rb, wb, readerNS, writerNS) == nil {
+					resolved = true
+					break
+				}
+			}
+			if !resolved {
+				return errors.Errorf("union %s can't read %s", avroTypeName(reader), avroTypeName(wb))
+			}
+		}
+		return nil
+
+	case map[string]interface{}:
+		w, ok := writer.(map[string]interface{})
+		if !ok || r["type"] != w["type"] {
+			return errors.Errorf("%s is written as %s", avroTypeName(reader), avroTypeName(writer))
+		}
+		switch r["type"] {
+		case "array":
+			return resolveAvro(r["items"], w["items"], readerNS, writerNS)
+		case "record":
+			return resolveAvroRecord(r, w, readerNS, writerNS)
+		}
+	}
+	return errors.Errorf("unsupported avro type %s", avroTypeName(reader))
+}
+
+func resolveAvroRecord(reader, writer map[string]interface{}, readerNS, writerNS string) error {
+	readerName, readerNS := avroFullName(reader, readerNS)
+	writerName, writerNS := avroFullName(writer, writerNS)
+	if readerName != writerName {
+		return errors.Errorf("record %s is written as %s", readerName, writerName)
+	}
+
+	writerFields := map[string]interface{}{}
+	fields, _ := writer["fields"].([]interface{})
+	for _, f := range fields {
+		field, _ := f.(map[string]interface{})
+		writerFields[avroString(field["name"])] = field["type"]
+	}
+	fields, _ = reader["fields"].([]interface{})
+	for _, f := range fields {
+		field, _ := f.(map[string]interface{})
+		name := avroString(field["name"])
+		wt, ok := writerFields[name]
+		if !ok {
+			if _, ok = field["default"]; !ok {
+				return errors.Errorf("%s.%s is missing and has no default", readerName, name)
+			}
+			continue
+		}
+		if err := resolveAvro(field["type"], wt, readerNS, writerNS); err != nil {
+			return errors.Wrapf(err, "%s.%s", readerName, name)
+		}
+	}
+	return nil
+}
+
+// avroType unwraps a primitive written as {"type": "string"}.
+func avroType(t interface{}) interface{} {
+	if m, ok := t.(map[string]interface{}); ok {
+		if name, ok := m["type"].(string); ok && avroPrimitives[name] {
+			return name
+		}
+	}
+	return t
+}
+
+// avroFullName returns the namespaced name of a record, and the namespace
+// the types inside it are in.
+func avroFullName(record map[string]interface{}, namespace string) (string, string) {
+	name := avroString(record["name"])
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name, name[:i]
+	}
+	if ns, ok := record["namespace"].(string); ok {
+		namespace = ns
+	}
+	if namespace == "" {
+		return name, namespace
+	}
+	return namespace + "." + name, namespace
+}
+
+func avroTypeName(t interface{}) string {
+	switch v := t.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		if name, ok := v["name"].(string); ok {
+			return name
+		}
+		return avroString(v["type"])
+	}
+	b, _ := json.Marshal(t)
+	return string(b)
+}
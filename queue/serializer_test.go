@@ -0,0 +1,345 @@
+package queue_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/sksmith/smfg-catalog/core/catalog"
+	"github.com/sksmith/smfg-catalog/queue"
+	"github.com/streadway/amqp"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var encodings = []string{queue.EncodingJSON, queue.EncodingProtobuf, queue.EncodingAvro}
+
+func testProduct() catalog.Product {
+	return catalog.Product{
+		Sku:         "SKU-1",
+		Name:        "Widget",
+		Description: "A widget",
+		Dimensions:  &catalog.Dimensions{Height: 1.5, Width: 2, Depth: 3, Unit: "CMT"},
+		Weight:      &catalog.Weight{Net: 0.5, Gross: 0.75, Unit: "KGM"},
+		Barcodes: []catalog.Barcode{
+			{Gtin: "00012345600012", PackagingLevel: catalog.PackagingEach, Quantity: 1, Primary: true},
+			{Gtin: "10012345600019", PackagingLevel: catalog.PackagingCase, Quantity: 12},
+		},
+	}
+}
+
+func serializer(t *testing.T, encoding string) queue.Serializer {
+	s, err := queue.NewSerializer(encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSerializers(t *testing.T) {
+	products := map[string]catalog.Product{
+		"full":    testProduct(),
+		"minimal": {Sku: "SKU-2", Name: "Bare", Barcodes: []catalog.Barcode{{Gtin: "00012345600012", PackagingLevel: catalog.PackagingEach, Quantity: 1, Primary: true}}},
+	}
+
+	for _, encoding := range encodings {
+		for name, want := range products {
+			t.Run(encoding+" "+name, func(t *testing.T) {
+				s := serializer(t, encoding)
+				data, err := s.Marshal(want)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := s.Unmarshal(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !got.Equal(want) {
+					t.Errorf("product got=%+v want=%+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestNewSerializerUnknown(t *testing.T) {
+	if _, err := queue.NewSerializer("xml"); err == nil {
+		t.Error("expected an error for an unknown encoding")
+	}
+	if s := serializer(t, ""); s.Encoding() != queue.EncodingJSON {
+		t.Errorf("default encoding got=%s want=%s", s.Encoding(), queue.EncodingJSON)
+	}
+}
+
+// Each encoding is written the way a later version with an extra field
+// would write it, and must still be read by today's decoder.
+func TestSerializersSkipNewFields(t *testing.T) {
+	want := testProduct()
+
+	newer := map[string]func(t *testing.T) []byte{
+		queue.EncodingJSON: func(t *testing.T) []byte {
+			data, err := queue.JSONSerializer{}.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := map[string]interface{}{}
+			if err = json.Unmarshal(data, &fields); err != nil {
+				t.Fatal(err)
+			}
+			fields["origin"] = "DE"
+			fields["barcodes"].([]interface{})[0].(map[string]interface{})["label"] = "retail"
+			if data, err = json.Marshal(fields); err != nil {
+				t.Fatal(err)
+			}
+			return data
+		},
+		queue.EncodingProtobuf: func(t *testing.T) []byte {
+			data, err := queue.ProtobufSerializer{}.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = protowire.AppendTag(data, 7, protowire.BytesType)
+			return protowire.AppendString(data, "DE")
+		},
+		queue.EncodingAvro: func(t *testing.T) []byte {
+			schema := avroSchema(t, func(fields []interface{}) []interface{} {
+				return append(fields, map[string]interface{}{"name": "origin", "type": "string", "default": ""})
+			})
+			if err := queue.RegisterAvroSchema(schema); err != nil {
+				t.Fatal(err)
+			}
+			native := avroNative(t, want)
+			native["origin"] = "DE"
+			return avroSingle(t, schema, native)
+		},
+	}
+
+	for _, encoding := range encodings {
+		t.Run(encoding, func(t *testing.T) {
+			got, err := serializer(t, encoding).Unmarshal(newer[encoding](t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("product got=%+v want=%+v", got, want)
+			}
+		})
+	}
+}
+
+// Avro products name the schema they were written with, so that consumers
+// can look it up rather than having to assume it.
+func TestAvroSingleObjectEncoding(t *testing.T) {
+	data, err := serializer(t, queue.EncodingAvro).Marshal(testProduct())
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := goavro.NewCodec(queue.ProductAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, body, err := goavro.FingerprintFromSOE(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != codec.Rabin {
+		t.Errorf("fingerprint got=%x want=%x", fingerprint, codec.Rabin)
+	}
+
+	// Bare binary, without the fingerprint, isn't accepted.
+	if _, err = serializer(t, queue.EncodingAvro).Unmarshal(body); err == nil {
+		t.Error("bare avro binary was decoded")
+	}
+}
+
+// avroSchema returns ProductAvroSchema with its Product fields edited.
+func avroSchema(t *testing.T, edit func(fields []interface{}) []interface{}) string {
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(queue.ProductAvroSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	schema["fields"] = edit(schema["fields"].([]interface{}))
+	b, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// avroNative returns the fields the avro serializer writes for product.
+func avroNative(t *testing.T, product catalog.Product) map[string]interface{} {
+	data, err := serializer(t, queue.EncodingAvro).Marshal(product)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := goavro.NewCodec(queue.ProductAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, _, err := codec.NativeFromSingle(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return native.(map[string]interface{})
+}
+
+func avroSingle(t *testing.T, schema string, native map[string]interface{}) []byte {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := codec.SingleFromNative(nil, native)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func avroField(fields []interface{}, name string) int {
+	for i, f := range fields {
+		if f.(map[string]interface{})["name"] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Products written with another version of the schema are read by field
+// name, not position.
+func TestAvroSchemaResolution(t *testing.T) {
+	product := testProduct()
+
+	// description is dropped, which the reader has a default for, and the
+	// remaining fields are written in reverse with one in the middle it
+	// doesn't know.
+	schema := avroSchema(t, func(fields []interface{}) []interface{} {
+		fields = append(fields[:2], fields[3:]...)
+		reversed := make([]interface{}, 0, len(fields)+1)
+		for i := len(fields) - 1; i >= 0; i-- {
+			reversed = append(reversed, fields[i])
+			if i == 2 {
+				reversed = append(reversed, map[string]interface{}{"name": "origin", "type": "string"})
+			}
+		}
+		return reversed
+	})
+	if err := queue.RegisterAvroSchema(schema); err != nil {
+		t.Fatal(err)
+	}
+	native := avroNative(t, product)
+	delete(native, "description")
+	native["origin"] = "DE"
+
+	got, err := serializer(t, queue.EncodingAvro).Unmarshal(avroSingle(t, schema, native))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := product
+	want.Description = ""
+	if !got.Equal(want) {
+		t.Errorf("product got=%+v want=%+v", got, want)
+	}
+}
+
+func TestAvroSchemaUnresolvable(t *testing.T) {
+	schemas := map[string]func(fields []interface{}) []interface{}{
+		"removed field without default": func(fields []interface{}) []interface{} {
+			i := avroField(fields, "name")
+			return append(fields[:i], fields[i+1:]...)
+		},
+		"retyped field": func(fields []interface{}) []interface{} {
+			fields[avroField(fields, "sku")].(map[string]interface{})["type"] = "long"
+			return fields
+		},
+		"retyped nested field": func(fields []interface{}) []interface{} {
+			barcode := fields[avroField(fields, "barcodes")].(map[string]interface{})["type"].(map[string]interface{})["items"].(map[string]interface{})
+			barcode["fields"].([]interface{})[2].(map[string]interface{})["type"] = "string"
+			return fields
+		},
+		"renamed record": func(fields []interface{}) []interface{} {
+			union := fields[avroField(fields, "weight")].(map[string]interface{})["type"].([]interface{})
+			union[1].(map[string]interface{})["name"] = "Mass"
+			return fields
+		},
+	}
+
+	for name, edit := range schemas {
+		t.Run(name, func(t *testing.T) {
+			if err := queue.RegisterAvroSchema(avroSchema(t, edit)); err == nil {
+				t.Error("schema was registered")
+			}
+		})
+	}
+}
+
+func TestAvroUnknownSchema(t *testing.T) {
+	schema := avroSchema(t, func(fields []interface{}) []interface{} {
+		return append(fields, map[string]interface{}{"name": "unregistered", "type": "string", "default": ""})
+	})
+	native := avroNative(t, testProduct())
+	native["unregistered"] = "x"
+
+	_, err := serializer(t, queue.EncodingAvro).Unmarshal(avroSingle(t, schema, native))
+	if !errors.Is(err, queue.ErrUnknownSchema) {
+		t.Errorf("err got=%v want=%v", err, queue.ErrUnknownSchema)
+	}
+}
+
+func TestProductEvent(t *testing.T) {
+	product := testProduct()
+	changes := []catalog.Change{
+		{Seq: 42, Type: catalog.ChangeUpdated, Sku: product.Sku, Product: &product, Time: time.Now()},
+		{Seq: 43, Type: catalog.ChangeDeleted, Sku: product.Sku, Time: time.Now()},
+	}
+	contentTypes := map[string]string{
+		queue.EncodingJSON:     queue.EventContentType,
+		queue.EncodingProtobuf: queue.ProtobufContentType,
+		queue.EncodingAvro:     queue.AvroContentType,
+	}
+
+	for _, encoding := range encodings {
+		for _, change := range changes {
+			t.Run(encoding+" "+string(change.Type), func(t *testing.T) {
+				event, err := queue.ProductEvent(queue.DefaultEventSource, change, serializer(t, encoding))
+				if err != nil {
+					t.Fatal(err)
+				}
+				msg, err := event.Publishing()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				wantType := queue.ProductEventPrefix + string(change.Type)
+				if msg.Type != wantType || msg.Headers["cloudEvents_type"] != wantType {
+					t.Errorf("type got=%s,%v want=%s", msg.Type, msg.Headers["cloudEvents_type"], wantType)
+				}
+				if change.Product != nil && msg.ContentType != contentTypes[encoding] {
+					t.Errorf("content type got=%s want=%s", msg.ContentType, contentTypes[encoding])
+				}
+
+				got, err := queue.DecodeEvent(amqp.Delivery{ContentType: msg.ContentType, Headers: msg.Headers, Body: msg.Body})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.ID != strconv.FormatInt(change.Seq, 10) || got.Subject != product.Sku || got.Type != wantType {
+					t.Errorf("event got=%+v", got)
+				}
+				p, err := got.Product()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if change.Product == nil {
+					if p != nil {
+						t.Errorf("product got=%+v want=nil", p)
+					}
+					return
+				}
+				if p == nil || !p.Equal(product) {
+					t.Errorf("product got=%+v want=%+v", p, product)
+				}
+			})
+		}
+	}
+}